@@ -0,0 +1,330 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"digger.dev/cloud/models"
+	"digger.dev/cloud/services"
+	dg_configuration "github.com/diggerhq/digger/libs/digger_config"
+	"github.com/diggerhq/digger/libs/orchestrator"
+	dg_github "github.com/diggerhq/digger/libs/orchestrator/github"
+	"github.com/google/go-github/v55/github"
+)
+
+// approvalPolicyFor returns the approval policy of the project, projects the runner hasn't reported yet only
+// have the policy of the org
+func (gc *GithubController) approvalPolicyFor(repo *models.Repo, projectName string) (*services.ApprovalPolicy, error) {
+	project, err := gc.Projects.GetProjectByName(repo.OrganisationID, repo, projectName)
+	if err != nil {
+		return nil, err
+	}
+	if project == nil {
+		project = &models.Project{Name: projectName, OrganisationID: repo.OrganisationID, RepoID: repo.ID}
+	}
+	return services.ApprovalPolicyForProject(gc.Policies, project)
+}
+
+// pullRequestApprovals collects what the policy needs to decide on the pull request
+func (gc *GithubController) pullRequestApprovals(ghService *dg_github.GithubService, repo *models.Repo, prNumber int, author string, headSha string, projectDir string, policy *services.ApprovalPolicy) (services.PullRequestApprovals, error) {
+	approvals := services.PullRequestApprovals{HeadSha: headSha, Author: author}
+	reviews, err := gc.Approvals.GetPullRequestReviews(repo.RepoFullName, prNumber)
+	if err != nil {
+		return approvals, err
+	}
+	approvals.Reviews = reviews
+	approvals.IsTeamMember = func(team string, login string) (bool, error) {
+		membership, response, err := ghService.Client.Teams.GetTeamMembershipBySlug(context.Background(), ghService.Owner, team, login)
+		if response != nil && response.StatusCode == http.StatusNotFound {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		return membership.GetState() == "active", nil
+	}
+	if policy.RequireCodeowners {
+		codeowners, err := loadCodeowners(ghService, headSha)
+		if err != nil {
+			return approvals, err
+		}
+		if codeowners != nil {
+			approvals.Codeowners = codeowners.OwnersOf(projectDir)
+		}
+	}
+	return approvals, nil
+}
+
+// loadCodeowners reads the CODEOWNERS file of the commit, nil if the repository has none
+func loadCodeowners(ghService *dg_github.GithubService, sha string) (*services.Codeowners, error) {
+	for _, path := range services.CodeownersPaths {
+		file, _, response, err := ghService.Client.Repositories.GetContents(context.Background(), ghService.Owner, ghService.RepoName, path, &github.RepositoryContentGetOptions{Ref: sha})
+		if response != nil && response.StatusCode == http.StatusNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading %v: %v", path, err)
+		}
+		content, err := file.GetContent()
+		if err != nil {
+			return nil, fmt.Errorf("error decoding %v: %v", path, err)
+		}
+		return services.ParseCodeowners(content), nil
+	}
+	return nil, nil
+}
+
+// syncPullRequestReviews stores the reviews submitted before the app received review events
+func (gc *GithubController) syncPullRequestReviews(ghService *dg_github.GithubService, repoFullName string, prNumber int) error {
+	opts := &github.ListOptions{PerPage: 100}
+	for {
+		reviews, response, err := ghService.Client.PullRequests.ListReviews(context.Background(), ghService.Owner, ghService.RepoName, prNumber, opts)
+		if err != nil {
+			return fmt.Errorf("error listing reviews: %v", err)
+		}
+		for _, review := range reviews {
+			err = gc.savePullRequestReview(repoFullName, prNumber, review, strings.ToLower(review.GetState()))
+			if err != nil {
+				return err
+			}
+		}
+		if response.NextPage == 0 {
+			return nil
+		}
+		opts.Page = response.NextPage
+	}
+}
+
+// savePullRequestReview stores the review as the latest of its reviewer, comments don't change whether a
+// reviewer approved so they aren't stored
+func (gc *GithubController) savePullRequestReview(repoFullName string, prNumber int, review *github.PullRequestReview, state string) error {
+	if state != models.ReviewStateApproved && state != models.ReviewStateChangesRequested && state != models.ReviewStateDismissed {
+		return nil
+	}
+	return gc.Approvals.SavePullRequestReview(&models.PullRequestReview{
+		RepoFullName:      repoFullName,
+		PullRequestNumber: prNumber,
+		Reviewer:          review.GetUser().GetLogin(),
+		State:             state,
+		CommitSha:         review.GetCommitID(),
+		SubmittedAt:       review.GetSubmittedAt().Time,
+	})
+}
+
+func isApplyJob(job orchestrator.Job) bool {
+	for _, command := range job.Commands {
+		if command == "digger apply" {
+			return true
+		}
+	}
+	return false
+}
+
+// holdUnapprovedApplies holds the apply jobs of projects whose approval policy the pull request doesn't satisfy
+// and tells the commenter why. Jobs are held if the policy can't be evaluated. A closed pull request can't be
+// approved anymore, so its unapproved applies, e.g. the ones started by the merge, are cancelled instead.
+func (gc *GithubController) holdUnapprovedApplies(ghService *dg_github.GithubService, repo *models.Repo, prNumber int, closed bool, author string, headSha string, commenter string,
+	jobs map[string]orchestrator.Job, projects map[string]dg_configuration.Project, diggerJobs map[string]*models.DiggerJob) error {
+	transitions := gc.jobTransitions(repo.OrganisationID, commenter)
+	synced := false
+	held := make([]string, 0)
+	for projectName, job := range jobs {
+		diggerJob, ok := diggerJobs[projectName]
+		if !ok || !isApplyJob(job) {
+			continue
+		}
+		policy, err := gc.approvalPolicyFor(repo, projectName)
+		if err != nil {
+			return err
+		}
+		if policy == nil {
+			continue
+		}
+
+		if !synced {
+			// the reviews received as events are still evaluated if listing fails
+			err = gc.syncPullRequestReviews(ghService, repo.RepoFullName, prNumber)
+			if err != nil {
+				log.Printf("failed to sync reviews of %v#%v: %v", repo.RepoFullName, prNumber, err)
+			}
+			synced = true
+		}
+		approved, reason := gc.evaluateApprovalPolicy(ghService, repo, prNumber, author, headSha, projects[projectName].Dir, policy)
+		if approved {
+			continue
+		}
+		err = transitions.HoldForApproval(&models.ApplyApprovalRequest{
+			DiggerJobId:       diggerJob.DiggerJobId,
+			RepoFullName:      repo.RepoFullName,
+			PullRequestNumber: prNumber,
+			OrganisationID:    repo.OrganisationID,
+			ProjectName:       projectName,
+			ProjectDir:        projects[projectName].Dir,
+			RequestedBy:       commenter,
+			Reason:            reason,
+		})
+		if err != nil {
+			return err
+		}
+		if closed {
+			_, err = transitions.CancelHeld(diggerJob.DiggerJobId)
+			if err != nil {
+				return err
+			}
+		}
+		held = append(held, fmt.Sprintf("- **%v**: %v", projectName, reason))
+	}
+
+	if len(held) == 0 {
+		return nil
+	}
+	comment := fmt.Sprintf("@%v the apply is waiting for approval, it starts once the pull request is approved:\n%v", commenter, strings.Join(held, "\n"))
+	if closed {
+		comment = fmt.Sprintf("@%v the apply isn't approved and the pull request is closed, it is cancelled:\n%v", commenter, strings.Join(held, "\n"))
+	}
+	err := ghService.PublishComment(prNumber, comment)
+	if err != nil {
+		log.Printf("failed to comment on held applies of %v#%v: %v", repo.RepoFullName, prNumber, err)
+	}
+	return nil
+}
+
+func (gc *GithubController) evaluateApprovalPolicy(ghService *dg_github.GithubService, repo *models.Repo, prNumber int, author string, headSha string, projectDir string, policy *services.ApprovalPolicy) (bool, string) {
+	approvals, err := gc.pullRequestApprovals(ghService, repo, prNumber, author, headSha, projectDir, policy)
+	if err == nil {
+		var approved bool
+		var reason string
+		approved, reason, err = policy.Evaluate(approvals)
+		if err == nil {
+			return approved, reason
+		}
+	}
+	log.Printf("failed to evaluate approval policy of %v#%v: %v", repo.RepoFullName, prNumber, err)
+	return false, "the approval policy couldn't be evaluated, " + err.Error()
+}
+
+// handlePullRequestReviewEvent records the review and starts the held applies of the pull request it approves
+func (gc *GithubController) handlePullRequestReviewEvent(payload *github.PullRequestReviewEvent) error {
+	state := strings.ToLower(payload.GetReview().GetState())
+	switch payload.GetAction() {
+	case "submitted":
+	case "dismissed":
+		state = models.ReviewStateDismissed
+	default:
+		return nil
+	}
+	repoFullName := payload.GetRepo().GetFullName()
+	repoOwner := payload.GetRepo().GetOwner().GetLogin()
+	repoName := payload.GetRepo().GetName()
+	pr := payload.GetPullRequest()
+	prNumber := pr.GetNumber()
+
+	repo, err := gc.findGithubRepo(payload.GetInstallation().GetID(), payload.GetRepo().GetID(), repoFullName, repoOwner, repoName)
+	if err != nil {
+		return err
+	}
+	err = gc.savePullRequestReview(repo.RepoFullName, prNumber, payload.GetReview(), state)
+	if err != nil {
+		return fmt.Errorf("error saving review: %v", err)
+	}
+
+	if pr.GetState() != "open" {
+		// held applies of closed pull requests are cancelled when they close
+		return nil
+	}
+	requests, err := gc.Approvals.GetApplyApprovalRequests(repo.RepoFullName, prNumber)
+	if err != nil || len(requests) == 0 {
+		return err
+	}
+	ghService, _, err := getGithubService(gc.Github, gc.GithubClientProvider, payload.GetInstallation().GetID(), repoFullName, repoOwner, repoName)
+	if err != nil {
+		return err
+	}
+
+	jobs := gc.jobTransitions(repo.OrganisationID, payload.GetReview().GetUser().GetLogin())
+	released := make([]string, 0)
+	outdated := make([]string, 0)
+	for _, request := range requests {
+		job, err := gc.Jobs.GetDiggerJob(request.DiggerJobId)
+		if err != nil {
+			return err
+		}
+		if job.CommitSha != pr.GetHead().GetSHA() {
+			// the approval is for a commit the job wouldn't apply
+			cancelled, err := jobs.CancelHeld(request.DiggerJobId)
+			if err != nil {
+				return err
+			}
+			if cancelled {
+				outdated = append(outdated, fmt.Sprintf("- **%v**, requested by @%v", request.ProjectName, request.RequestedBy))
+			}
+			continue
+		}
+
+		policy, err := gc.approvalPolicyFor(repo, request.ProjectName)
+		if err != nil {
+			return err
+		}
+		reason := "the approval policy was removed"
+		if policy != nil {
+			var approved bool
+			approved, reason = gc.evaluateApprovalPolicy(ghService, repo, prNumber, pr.GetUser().GetLogin(), pr.GetHead().GetSHA(), request.ProjectDir, policy)
+			if !approved {
+				continue
+			}
+		}
+		ok, err := jobs.ReleaseApproved(request.DiggerJobId)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			// another review released it
+			continue
+		}
+		// the parents which finished while the job was held couldn't start it, the ones still running start it when they finish
+		parentsSucceeded, err := services.ParentDiggerJobsSucceeded(gc.Jobs, job.DiggerJobId)
+		if err != nil {
+			return err
+		}
+		if parentsSucceeded {
+			err = dispatchDiggerJob(jobs, ghService.Client, repoOwner, repoName, job)
+			if err != nil {
+				return err
+			}
+		}
+		released = append(released, fmt.Sprintf("- **%v**, requested by @%v: %v", request.ProjectName, request.RequestedBy, reason))
+	}
+
+	if len(outdated) > 0 {
+		err = ghService.PublishComment(prNumber, fmt.Sprintf("The pull request changed since these applies were requested, they are cancelled, comment `digger apply` again:\n%v", strings.Join(outdated, "\n")))
+		if err != nil {
+			log.Printf("failed to comment on cancelled applies of %v#%v: %v", repo.RepoFullName, prNumber, err)
+		}
+	}
+	if len(released) > 0 {
+		err = ghService.PublishComment(prNumber, fmt.Sprintf("The held applies are approved and starting:\n%v", strings.Join(released, "\n")))
+		if err != nil {
+			log.Printf("failed to comment on released applies of %v#%v: %v", repo.RepoFullName, prNumber, err)
+		}
+	}
+	return nil
+}
+
+// cancelHeldApplies cancels the held applies of a pull request which has been closed
+func (gc *GithubController) cancelHeldApplies(jobs services.JobTransitions, repoFullName string, prNumber int) error {
+	requests, err := gc.Approvals.GetApplyApprovalRequests(repoFullName, prNumber)
+	if err != nil {
+		return err
+	}
+	for _, request := range requests {
+		_, err = jobs.CancelHeld(request.DiggerJobId)
+		if err != nil {
+			return err
+		}
+		log.Printf("cancelled held apply of %v for %v#%v", request.ProjectName, repoFullName, prNumber)
+	}
+	return nil
+}
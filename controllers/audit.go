@@ -0,0 +1,181 @@
+package controllers
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"digger.dev/cloud/middleware"
+	"digger.dev/cloud/models"
+	"digger.dev/cloud/services"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/exp/maps"
+)
+
+// recordAuditEvent stores the action made by the caller, before and after are snapshots of the changed fields.
+// Failing to record the event doesn't fail the request, the change has already been made.
+func recordAuditEvent(store models.AuditStore, c *gin.Context, orgId uint, action string, targetType string, targetId any, before any, after any) {
+	event := &models.AuditEvent{
+		OrganisationID: orgId,
+		Actor:          c.GetString(middleware.ACTOR_KEY),
+		Action:         action,
+		TargetType:     targetType,
+		TargetId:       fmt.Sprintf("%v", targetId),
+		Before:         auditSnapshot(before),
+		After:          auditSnapshot(after),
+		RequestId:      c.GetString(middleware.REQUEST_ID_KEY),
+		SourceIp:       c.ClientIP(),
+	}
+	if event.Actor == "" {
+		event.Actor = "unknown"
+	}
+	err := store.CreateAuditEvent(event)
+	if err != nil {
+		log.Printf("failed to record audit event %v for %v %v: %v", action, targetType, targetId, err)
+	}
+}
+
+func auditSnapshot(value any) string {
+	if value == nil {
+		return ""
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		log.Printf("failed to serialise audit snapshot: %v", err)
+		return ""
+	}
+	return string(data)
+}
+
+func parseAuditEventFilter(c *gin.Context) (models.AuditEventFilter, error) {
+	filter := models.AuditEventFilter{
+		Actor:      c.Query("actor"),
+		Action:     c.Query("action"),
+		TargetType: c.Query("target_type"),
+		TargetId:   c.Query("target_id"),
+		Limit:      100,
+	}
+	if from := c.Query("from"); from != "" {
+		t, err := parseFilterTime(from, false)
+		if err != nil {
+			return filter, fmt.Errorf("invalid from: %v", err)
+		}
+		filter.From = &t
+	}
+	if to := c.Query("to"); to != "" {
+		t, err := parseFilterTime(to, true)
+		if err != nil {
+			return filter, fmt.Errorf("invalid to: %v", err)
+		}
+		filter.To = &t
+	}
+	if limit := c.Query("limit"); limit != "" {
+		l, err := strconv.Atoi(limit)
+		if err != nil || l < 1 || l > 1000 {
+			return filter, fmt.Errorf("limit has to be between 1 and 1000")
+		}
+		filter.Limit = l
+	}
+	if offset := c.Query("offset"); offset != "" {
+		o, err := strconv.Atoi(offset)
+		if err != nil || o < 0 {
+			return filter, fmt.Errorf("invalid offset")
+		}
+		filter.Offset = o
+	}
+	return filter, nil
+}
+
+// FindAuditEventsForOrg returns audit events as JSON, or as CSV file with format=csv. Exports ignore the page size.
+func (api *ApiController) FindAuditEventsForOrg(c *gin.Context) {
+	org, ok := api.getOrgFromParams(c)
+	if !ok {
+		return
+	}
+	writeAuditEvents(api.Audit, c, org)
+}
+
+// AuditExport is the export of the audit page, it takes the same filters as the page
+func (web *WebController) AuditExport(c *gin.Context) {
+	orgId, _ := c.Get(middleware.ORGANISATION_ID_KEY)
+	org, err := web.Orgs.GetOrganisationById(orgId)
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Unknown error occurred while fetching database")
+		return
+	}
+	writeAuditEvents(web.Audit, c, org)
+}
+
+func writeAuditEvents(store models.AuditStore, c *gin.Context, org *models.Organisation) {
+	filter, err := parseAuditEventFilter(c)
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	format := c.DefaultQuery("format", "json")
+	if format == "csv" {
+		filter.Limit = 0
+		filter.Offset = 0
+	}
+
+	events, total, err := store.GetAuditEvents(org.ID, filter)
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Unknown error occurred while fetching database")
+		return
+	}
+
+	switch format {
+	case "json":
+		response := make([]interface{}, 0)
+		for _, e := range events {
+			response = append(response, e.MapToJsonStruct())
+		}
+		c.JSON(http.StatusOK, gin.H{"events": response, "total": total})
+	case "csv":
+		c.Header("Content-Type", "text/csv")
+		c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=audit-%v-%v.csv", org.Name, time.Now().Format("20060102")))
+		writer := csv.NewWriter(c.Writer)
+		writer.Write([]string{"id", "created_at", "actor", "action", "target_type", "target_id", "before", "after", "request_id", "source_ip"})
+		for _, e := range events {
+			writer.Write([]string{strconv.Itoa(int(e.ID)), e.CreatedAt.UTC().Format(time.RFC3339), e.Actor, e.Action,
+				e.TargetType, e.TargetId, e.Before, e.After, e.RequestId, e.SourceIp})
+		}
+		writer.Flush()
+		if err := writer.Error(); err != nil {
+			log.Printf("failed to write audit csv export: %v", err)
+		}
+	default:
+		c.String(http.StatusBadRequest, "Unsupported format %v", format)
+	}
+}
+
+func (web *WebController) AuditPage(c *gin.Context) {
+	orgId, _ := c.Get(middleware.ORGANISATION_ID_KEY)
+
+	filter, err := parseAuditEventFilter(c)
+	if err != nil {
+		services.AddError(c, err.Error())
+		filter = models.AuditEventFilter{Limit: 100}
+	}
+
+	events, total, err := web.Audit.GetAuditEvents(orgId, filter)
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Unknown error occurred while fetching database")
+		return
+	}
+
+	pageContext := services.GetMessages(c)
+	maps.Copy(pageContext, gin.H{
+		"Events":      events,
+		"Total":       total,
+		"Filter":      filter,
+		"From":        c.Query("from"),
+		"To":          c.Query("to"),
+		"ExportQuery": c.Request.URL.RawQuery,
+	})
+	c.HTML(http.StatusOK, "audit.tmpl", pageContext)
+}
@@ -0,0 +1,34 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"digger.dev/cloud/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuditEventsFilteredByDay(t *testing.T) {
+	r, _, _ := setupApiWithMemoryStore(t)
+
+	w := doRequest(r, "POST", "/repos/infra/report-projects", `{"name": "prod"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = doRequest(r, "PUT", "/repos/infra/projects/prod/plan-policy", `package digger`)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// a date ending the range covers the whole day, as the date inputs of the audit page send it
+	today := time.Now().UTC().Format(time.DateOnly)
+	w = doRequest(r, "GET", "/orgs/memoryOrg/audit-events?action="+models.AuditActionPolicyCreated+"&from="+today+"&to="+today, "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var response struct{ Total int }
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, 1, response.Total)
+
+	yesterday := time.Now().UTC().AddDate(0, 0, -1).Format(time.DateOnly)
+	w = doRequest(r, "GET", "/orgs/memoryOrg/audit-events?action="+models.AuditActionPolicyCreated+"&to="+yesterday, "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, 0, response.Total)
+}
@@ -0,0 +1,338 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"digger.dev/cloud/middleware"
+	"digger.dev/cloud/models"
+	"digger.dev/cloud/services"
+	"digger.dev/cloud/utils"
+	dg_configuration "github.com/diggerhq/digger/libs/digger_config"
+	"github.com/diggerhq/digger/libs/orchestrator"
+	dg_github "github.com/diggerhq/digger/libs/orchestrator/github"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"golang.org/x/exp/maps"
+)
+
+// DriftDetectionActor is who drift check jobs are requested by
+const DriftDetectionActor = "digger-drift-detection"
+
+// GithubDriftDispatcher runs drift checks as plan jobs in the digger workflow of the GitHub repository
+type GithubDriftDispatcher struct {
+	models.Stores
+	GithubClientProvider utils.GithubClientProvider
+}
+
+func (d *GithubDriftDispatcher) githubService(project *models.Project) (*dg_github.GithubService, *string, *models.GithubAppInstallation, error) {
+	repo := project.Repo
+	if repo == nil || repo.VcsProvider != models.VcsProviderGithub || repo.RepoFullName == "" {
+		return nil, nil, nil, fmt.Errorf("drift detection needs the GitHub repository of the project")
+	}
+	installation, err := d.Github.GetGithubAppInstallationByOrgAndRepo(project.OrganisationID, repo.RepoFullName, models.GithubAppInstallActive)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if installation == nil {
+		return nil, nil, nil, fmt.Errorf("the GitHub app isn't installed for %v", repo.RepoFullName)
+	}
+	ghService, token, err := getGithubService(d.Github, d.GithubClientProvider, installation.GithubInstallationId, repo.RepoFullName, repo.RepoOwner, repo.RepoName)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return ghService, token, installation, nil
+}
+
+// CreateDriftJob creates a job which plans the project on the head of the default branch, with the config
+// stored for the repo
+func (d *GithubDriftDispatcher) CreateDriftJob(project *models.Project) (*models.DiggerJob, error) {
+	ghService, token, installation, err := d.githubService(project)
+	if err != nil {
+		return nil, err
+	}
+	repo := project.Repo
+	ctx := context.Background()
+	ghRepo, _, err := ghService.Client.Repositories.Get(ctx, repo.RepoOwner, repo.RepoName)
+	if err != nil {
+		return nil, fmt.Errorf("error getting repository: %v", err)
+	}
+	branch := ghRepo.GetDefaultBranch()
+	head, _, err := ghService.Client.Repositories.GetBranch(ctx, repo.RepoOwner, repo.RepoName, branch, true)
+	if err != nil {
+		return nil, fmt.Errorf("error getting branch %v: %v", branch, err)
+	}
+	commitSha := head.GetCommit().GetSHA()
+
+	configYaml, err := dg_configuration.LoadDiggerConfigYamlFromString(repo.DiggerConfig)
+	if err != nil {
+		return nil, fmt.Errorf("error loading digger config: %v", err)
+	}
+	if configYaml.GenerateProjectsConfig != nil {
+		cloneUrl, err := githubCloneUrl(d.Github, installation.GithubInstallationId, repo.RepoFullName, ghRepo.GetCloneURL())
+		if err != nil {
+			return nil, fmt.Errorf("error getting clone url: %v", err)
+		}
+		err = services.ConfigLoader.GenerateProjects(ghService.Client, repo.RepoOwner, repo.RepoName, commitSha, cloneUrl, branch, *token, configYaml)
+		if err != nil {
+			return nil, fmt.Errorf("error generating projects: %v", err)
+		}
+	}
+	config, _, err := loadDiggerConfig(configYaml)
+	if err != nil {
+		return nil, err
+	}
+
+	configProject := config.GetProject(project.Name)
+	if configProject == nil {
+		return nil, fmt.Errorf("project %v isn't in digger.yml", project.Name)
+	}
+	if !configProject.DriftDetection {
+		return nil, fmt.Errorf("drift detection is disabled for project %v in digger.yml", project.Name)
+	}
+	workflow, ok := config.Workflows[configProject.Workflow]
+	if !ok {
+		return nil, fmt.Errorf("failed to find workflow config '%s' for project '%s'", configProject.Workflow, configProject.Name)
+	}
+	stateEnvVars, commandEnvVars := dg_configuration.CollectTerraformEnvConfig(workflow.EnvVars)
+	stateEnvProvider, commandEnvProvider := orchestrator.GetStateAndCommandProviders(*configProject)
+	job := orchestrator.Job{
+		ProjectName:        configProject.Name,
+		ProjectDir:         configProject.Dir,
+		ProjectWorkspace:   configProject.Workspace,
+		ProjectWorkflow:    configProject.Workflow,
+		Terragrunt:         configProject.Terragrunt,
+		OpenTofu:           configProject.OpenTofu,
+		Commands:           []string{"digger plan"},
+		ApplyStage:         orchestrator.ToConfigStage(workflow.Apply),
+		PlanStage:          orchestrator.ToConfigStage(workflow.Plan),
+		CommandEnvVars:     commandEnvVars,
+		StateEnvVars:       stateEnvVars,
+		EventName:          "drift-detection",
+		Namespace:          repo.RepoFullName,
+		RequestedBy:        DriftDetectionActor,
+		CommandEnvProvider: commandEnvProvider,
+		StateEnvProvider:   stateEnvProvider,
+	}
+	serialized, err := json.Marshal(orchestrator.JobToJson(job))
+	if err != nil {
+		return nil, err
+	}
+
+	batchId, _ := uuid.NewUUID()
+	diggerJob, err := d.Jobs.CreateDiggerJob(batchId, serialized, branch, commitSha)
+	if err != nil {
+		return nil, err
+	}
+	_, err = d.Jobs.CreateDiggerJobLink(diggerJob.DiggerJobId, repo.RepoFullName)
+	if err != nil {
+		return nil, err
+	}
+	return diggerJob, nil
+}
+
+func (d *GithubDriftDispatcher) DispatchDriftJob(project *models.Project, job *models.DiggerJob) error {
+	ghService, _, _, err := d.githubService(project)
+	if err != nil {
+		return err
+	}
+	jobs := services.JobTransitions{Stores: d.Stores, OrgId: project.OrganisationID, Actor: DriftDetectionActor}
+	return dispatchDiggerJob(jobs, ghService.Client, project.Repo.RepoOwner, project.Repo.RepoName, job)
+}
+
+// completeDriftReport records the result of the drift check the run was for, if it was for one
+func (api *ApiController) completeDriftReport(project *models.Project, run *models.ProjectRun) {
+	err := services.CompleteDriftReport(api.Stores, project, run)
+	if err != nil {
+		log.Printf("Error completing drift report of run %v: %v", run.ID, err)
+	}
+}
+
+func (api *ApiController) FindDriftScheduleForProject(c *gin.Context) {
+	project, ok := api.getRepoAndProjectFromParams(c, c.Param("repo"), c.Param("projectName"))
+	if !ok {
+		return
+	}
+	schedule, err := api.Drift.GetDriftSchedule(project.ID)
+	if err != nil {
+		log.Printf("Error fetching drift schedule: %v", err)
+		c.String(http.StatusInternalServerError, "Error fetching drift schedule")
+		return
+	}
+	if schedule == nil {
+		c.String(http.StatusNotFound, "Could not find drift schedule for project: "+project.Name)
+		return
+	}
+	c.JSON(http.StatusOK, schedule.MapToJsonStruct())
+}
+
+type SetDriftScheduleRequest struct {
+	// Cron is a five field cron expression in UTC, e.g. "0 6 * * 1-5"
+	Cron string `json:"cron"`
+	// Enabled defaults to true
+	Enabled *bool `json:"enabled"`
+}
+
+func (api *ApiController) SetDriftScheduleForProject(c *gin.Context) {
+	var request SetDriftScheduleRequest
+	err := c.BindJSON(&request)
+	if err != nil {
+		log.Printf("Error binding JSON: %v", err)
+		return
+	}
+	cron, err := services.ParseCron(request.Cron)
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	project, ok := api.getRepoAndProjectFromParams(c, c.Param("repo"), c.Param("projectName"))
+	if !ok {
+		return
+	}
+	schedule, err := api.Drift.GetDriftSchedule(project.ID)
+	if err != nil {
+		log.Printf("Error fetching drift schedule: %v", err)
+		c.String(http.StatusInternalServerError, "Error fetching drift schedule")
+		return
+	}
+	var before interface{}
+	if schedule == nil {
+		schedule = &models.DriftSchedule{ProjectID: project.ID}
+	} else {
+		before = gin.H{"cron": schedule.Cron, "enabled": schedule.Enabled}
+	}
+	schedule.Cron = request.Cron
+	schedule.Enabled = request.Enabled == nil || *request.Enabled
+	schedule.NextRunAt = cron.Next(time.Now())
+	err = api.Drift.SaveDriftSchedule(schedule)
+	if err != nil {
+		log.Printf("Error saving drift schedule: %v", err)
+		c.String(http.StatusInternalServerError, "Error saving drift schedule")
+		return
+	}
+	recordAuditEvent(api.Audit, c, project.OrganisationID, models.AuditActionDriftScheduleUpdated, "drift_schedule", project.Name,
+		before, gin.H{"cron": schedule.Cron, "enabled": schedule.Enabled})
+	c.JSON(http.StatusOK, schedule.MapToJsonStruct())
+}
+
+// driftHistoryLength is how many drift checks the history of a project shows
+const driftHistoryLength = 50
+
+func (api *ApiController) FindDriftForOrg(c *gin.Context) {
+	org, ok := api.getOrgFromParams(c)
+	if !ok {
+		return
+	}
+	drift, err := api.Drift.GetDriftForOrg(org.ID)
+	if err != nil {
+		log.Printf("Error fetching drift: %v", err)
+		c.String(http.StatusInternalServerError, "Error fetching drift")
+		return
+	}
+	response := make([]interface{}, 0, len(drift))
+	for i := range drift {
+		response = append(response, drift[i].MapToJsonStruct())
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+func (api *ApiController) FindDriftReportsForProject(c *gin.Context) {
+	project, ok := api.getRepoAndProjectFromParams(c, c.Param("repo"), c.Param("projectName"))
+	if !ok {
+		return
+	}
+	reports, err := api.Drift.GetDriftReportsForProject(project.ID, driftHistoryLength)
+	if err != nil {
+		log.Printf("Error fetching drift reports: %v", err)
+		c.String(http.StatusInternalServerError, "Error fetching drift reports")
+		return
+	}
+	response := make([]interface{}, 0, len(reports))
+	for i := range reports {
+		response = append(response, reports[i].MapToJsonStruct())
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// formatDriftDuration says roughly for how long a project has been drifting, e.g. "3 days"
+func formatDriftDuration(d time.Duration) string {
+	unit := func(count int, name string) string {
+		if count == 1 {
+			return "1 " + name
+		}
+		return fmt.Sprintf("%v %vs", count, name)
+	}
+	switch {
+	case d >= 48*time.Hour:
+		return unit(int(d/(24*time.Hour)), "day")
+	case d >= 2*time.Hour:
+		return unit(int(d/time.Hour), "hour")
+	case d >= time.Minute:
+		return unit(int(d/time.Minute), "minute")
+	default:
+		return "less than a minute"
+	}
+}
+
+func (web *WebController) DriftPage(c *gin.Context) {
+	orgId := c.GetUint(middleware.ORGANISATION_ID_KEY)
+	if orgId == 0 {
+		c.String(http.StatusForbidden, "Not allowed to access this resource")
+		return
+	}
+	drift, err := web.Drift.GetDriftForOrg(orgId)
+	if err != nil {
+		log.Printf("Error fetching drift: %v", err)
+		c.String(http.StatusInternalServerError, "Error fetching drift")
+		return
+	}
+
+	now := time.Now()
+	driftingFor := make(map[uint]string)
+	drifting := 0
+	for _, projectDrift := range drift {
+		if projectDrift.DriftingSince != nil {
+			driftingFor[projectDrift.Project.ID] = formatDriftDuration(now.Sub(*projectDrift.DriftingSince))
+			drifting++
+		}
+	}
+	pageContext := services.GetMessages(c)
+	maps.Copy(pageContext, gin.H{
+		"Drift":       drift,
+		"DriftingFor": driftingFor,
+		"Drifting":    drifting,
+	})
+	c.HTML(http.StatusOK, "drift.tmpl", pageContext)
+}
+
+func (web *WebController) ProjectDriftPage(c *gin.Context) {
+	project, ok := web.validateRequestProjectId(c)
+	if !ok {
+		return
+	}
+	schedule, err := web.Drift.GetDriftSchedule(project.ID)
+	if err != nil {
+		log.Printf("Error fetching drift schedule: %v", err)
+		c.String(http.StatusInternalServerError, "Error fetching drift schedule")
+		return
+	}
+	reports, err := web.Drift.GetDriftReportsForProject(project.ID, driftHistoryLength)
+	if err != nil {
+		log.Printf("Error fetching drift reports: %v", err)
+		c.String(http.StatusInternalServerError, "Error fetching drift reports")
+		return
+	}
+
+	pageContext := services.GetMessages(c)
+	maps.Copy(pageContext, gin.H{
+		"Project":  project,
+		"Schedule": schedule,
+		"Reports":  reports,
+	})
+	c.HTML(http.StatusOK, "project_drift.tmpl", pageContext)
+}
@@ -0,0 +1,122 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"digger.dev/cloud/models"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDriftSchedule(t *testing.T) {
+	r, store, org := setupApiWithMemoryStore(t)
+
+	w := doRequest(r, "POST", "/repos/infra/report-projects", `{"name": "prod"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = doRequest(r, "GET", "/repos/infra/projects/prod/drift-schedule", "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = doRequest(r, "PUT", "/repos/infra/projects/prod/drift-schedule", `{"cron": "0 25 * * *"}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = doRequest(r, "PUT", "/repos/infra/projects/prod/drift-schedule", `{"cron": "0 6 * * 1-5"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = doRequest(r, "GET", "/repos/infra/projects/prod/drift-schedule", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var schedule struct {
+		Cron      string
+		Enabled   bool
+		NextRunAt time.Time
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &schedule))
+	assert.Equal(t, "0 6 * * 1-5", schedule.Cron)
+	assert.True(t, schedule.Enabled)
+	assert.Equal(t, 6, schedule.NextRunAt.Hour())
+	assert.True(t, schedule.NextRunAt.After(time.Now()))
+
+	w = doRequest(r, "PUT", "/repos/infra/projects/prod/drift-schedule", `{"cron": "@daily", "enabled": false}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	events, _, err := store.GetAuditEvents(org.ID, models.AuditEventFilter{Action: models.AuditActionDriftScheduleUpdated})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(events))
+	assert.Equal(t, models.AuditActionDriftScheduleUpdated, events[0].Action)
+	assert.Contains(t, events[0].Before, "0 6 * * 1-5")
+
+	// drift policies are evaluated by the runner and stored as they are
+	w = doRequest(r, "PUT", "/repos/infra/projects/prod/drift-policy", `package digger`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	// the scheduler has to be able to evaluate drift alert policies
+	w = doRequest(r, "PUT", "/repos/infra/projects/prod/drift-alert-policy", `package digger`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = doRequest(r, "PUT", "/repos/infra/projects/prod/drift-alert-policy", `{"slack_webhook_url": "http://10.0.0.1/internal"}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = doRequest(r, "PUT", "/repos/infra/projects/prod/drift-alert-policy", `{"ignore_actions": ["update"]}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	// as are approval policies
+	w = doRequest(r, "PUT", "/repos/infra/projects/prod/approval-policy", `{"min_approvals": "two"}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = doRequest(r, "PUT", "/repos/infra/projects/prod/approval-policy", `{"min_approvals": 2, "require_codeowners": true}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestDriftForOrg(t *testing.T) {
+	r, store, org := setupApiWithMemoryStore(t)
+
+	w := doRequest(r, "POST", "/repos/infra/report-projects", `{"name": "prod"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = doRequest(r, "POST", "/repos/infra/report-projects", `{"name": "staging"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = doRequest(r, "PUT", "/repos/infra/projects/staging/drift-schedule", `{"cron": "@daily"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	projects, err := store.GetProjectsForRepoName(org.ID, "infra")
+	assert.NoError(t, err)
+	for _, project := range projects {
+		if project.Name == "prod" {
+			assert.NoError(t, store.SaveDriftReport(&models.DriftReport{ProjectID: project.ID, DiggerJobId: "drift-job", Status: models.DriftReportPending}))
+		}
+	}
+	serializedJob, _ := json.Marshal(map[string]interface{}{"projectName": "prod", "commands": []string{"digger plan"}})
+	assert.NoError(t, store.UpdateDiggerJob(&models.DiggerJob{DiggerJobId: "drift-job", BatchId: uuid.New(), SerializedJob: serializedJob}))
+	plan := `{"format_version": "1.2", "resource_changes": [
+		{"address": "aws_s3_bucket.logs", "mode": "managed", "type": "aws_s3_bucket", "name": "logs", "change": {"actions": ["update"]}},
+		{"address": "data.aws_caller_identity.current", "mode": "data", "type": "aws_caller_identity", "name": "current", "change": {"actions": ["read"]}}
+	]}`
+	w = doRequest(r, "POST", "/repos/infra/projects/prod/runs", `{"status": "succeeded", "command": "digger plan", "jobId": "drift-job", "planJson": `+plan+`}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = doRequest(r, "GET", "/orgs/"+org.Name+"/drift", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var drift []struct {
+		ProjectName     string
+		Drifting        bool
+		DriftingSince   *time.Time
+		Schedule        *struct{ Cron string }
+		LastCheck       *struct{ Status string }
+		ResourceChanges []struct{ Address string }
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &drift))
+	assert.Equal(t, 2, len(drift))
+	assert.Equal(t, "prod", drift[0].ProjectName)
+	assert.True(t, drift[0].Drifting)
+	assert.NotNil(t, drift[0].DriftingSince)
+	assert.Equal(t, models.DriftReportDrifted, drift[0].LastCheck.Status)
+	assert.Equal(t, 1, len(drift[0].ResourceChanges))
+	assert.Equal(t, "aws_s3_bucket.logs", drift[0].ResourceChanges[0].Address)
+	assert.Equal(t, "staging", drift[1].ProjectName)
+	assert.False(t, drift[1].Drifting)
+	assert.Nil(t, drift[1].LastCheck)
+	assert.Equal(t, "@daily", drift[1].Schedule.Cron)
+
+	w = doRequest(r, "GET", "/repos/infra/projects/prod/drift-reports", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var reports []struct {
+		Status      string
+		ChangeCount int
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &reports))
+	assert.Equal(t, 1, len(reports))
+	assert.Equal(t, 1, reports[0].ChangeCount)
+}
@@ -3,39 +3,71 @@ package controllers
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"math/rand"
 	"net/http"
 	"net/url"
 	"os"
-	"path"
 	"reflect"
 	"strconv"
 	"strings"
 
 	"digger.dev/cloud/middleware"
 	"digger.dev/cloud/models"
+	"digger.dev/cloud/services"
 	"digger.dev/cloud/utils"
+	"github.com/dchest/uniuri"
 	dg_configuration "github.com/diggerhq/digger/libs/digger_config"
 	orchestrator "github.com/diggerhq/digger/libs/orchestrator"
 	dg_github "github.com/diggerhq/digger/libs/orchestrator/github"
 	"github.com/dominikbraun/graph"
+	"github.com/gin-contrib/sessions"
 	"github.com/gin-gonic/gin"
 	"github.com/google/go-github/v55/github"
 	"github.com/google/uuid"
 	"golang.org/x/oauth2"
 )
 
-func GithubAppWebHook(c *gin.Context) {
+// GithubController handles the webhooks of the GitHub app and the pages setting it up
+type GithubController struct {
+	models.Stores
+	GithubClientProvider utils.GithubClientProvider
+}
+
+func (gc *GithubController) GithubAppWebHook(c *gin.Context) {
 	c.Header("Content-Type", "application/json")
-	gh := &utils.DiggerGithubRealClientProvider{}
 	log.Printf("GithubAppWebHook")
 
-	payload, err := github.ValidatePayload(c.Request, []byte(os.Getenv("GITHUB_WEBHOOK_SECRET")))
+	githubApp, err := gc.githubAppForWebhook(c)
+	if errors.Is(err, models.ErrGithubAppNotFound) {
+		log.Printf("Rejecting webhook for unknown github app %v", c.GetHeader("X-GitHub-Hook-Installation-Target-ID"))
+		c.String(http.StatusUnauthorized, "Unknown GitHub app")
+		return
+	}
+	if err != nil {
+		log.Printf("Error finding github app for webhook: %v", err)
+		c.String(http.StatusInternalServerError, "Error finding GitHub app")
+		return
+	}
+	creds, err := gc.Github.GetGithubAppCredentials(githubApp)
+	if err != nil {
+		log.Printf("Error reading github app credentials: %v", err)
+		c.String(http.StatusInternalServerError, "Error reading GitHub app credentials")
+		return
+	}
+	// ValidatePayload doesn't check anything if the secret and the signature are both empty
+	if creds.WebhookSecret == "" {
+		log.Printf("Rejecting webhook for github app %v, it has no webhook secret", githubApp.GithubId)
+		c.String(http.StatusUnauthorized, "GitHub app has no webhook secret")
+		return
+	}
+
+	payload, err := github.ValidatePayload(c.Request, []byte(creds.WebhookSecret))
 	if err != nil {
 		log.Printf("Error validating github app webhook's payload: %v", err)
-		c.String(http.StatusBadRequest, "Error validating github app webhook's payload")
+		c.String(http.StatusUnauthorized, "Error validating github app webhook's payload")
 		return
 	}
 
@@ -53,7 +85,7 @@ func GithubAppWebHook(c *gin.Context) {
 	case *github.InstallationEvent:
 		log.Printf("InstallationEvent, action: %v\n", *event.Action)
 		if *event.Action == "created" {
-			err := handleInstallationCreatedEvent(event)
+			err := gc.handleInstallationCreatedEvent(event)
 			if err != nil {
 				c.String(http.StatusInternalServerError, "Failed to handle webhook event.")
 				return
@@ -61,7 +93,7 @@ func GithubAppWebHook(c *gin.Context) {
 		}
 
 		if *event.Action == "deleted" {
-			err := handleInstallationDeletedEvent(event)
+			err := gc.handleInstallationDeletedEvent(event)
 			if err != nil {
 				c.String(http.StatusInternalServerError, "Failed to handle webhook event.")
 				return
@@ -70,13 +102,13 @@ func GithubAppWebHook(c *gin.Context) {
 	case *github.InstallationRepositoriesEvent:
 		log.Printf("InstallationRepositoriesEvent, action: %v\n", *event.Action)
 		if *event.Action == "added" {
-			err := handleInstallationRepositoriesAddedEvent(gh, event)
+			err := gc.handleInstallationRepositoriesAddedEvent(event)
 			if err != nil {
 				c.String(http.StatusInternalServerError, "Failed to handle installation repo added event.")
 			}
 		}
 		if *event.Action == "removed" {
-			err := handleInstallationRepositoriesDeletedEvent(event)
+			err := gc.handleInstallationRepositoriesDeletedEvent(event)
 			if err != nil {
 				c.String(http.StatusInternalServerError, "Failed to handle installation repo deleted event.")
 			}
@@ -87,7 +119,7 @@ func GithubAppWebHook(c *gin.Context) {
 			c.String(http.StatusOK, "OK")
 			return
 		}
-		err := handleIssueCommentEvent(gh, event)
+		err := gc.handleIssueCommentEvent(event)
 		if err != nil {
 			log.Printf("handleIssueCommentEvent error: %v", err)
 			c.String(http.StatusInternalServerError, err.Error())
@@ -95,15 +127,32 @@ func GithubAppWebHook(c *gin.Context) {
 		}
 	case *github.PullRequestEvent:
 		log.Printf("Got pull request event for %d", *event.PullRequest.ID)
-		err := handlePullRequestEvent(gh, event)
+		err := gc.handlePullRequestEvent(event)
 		if err != nil {
 			log.Printf("handlePullRequestEvent error: %v", err)
 			c.String(http.StatusInternalServerError, err.Error())
 			return
 		}
+	case *github.PullRequestReviewEvent:
+		log.Printf("PullRequestReviewEvent, action: %v\n", event.GetAction())
+		err := gc.handlePullRequestReviewEvent(event)
+		if err != nil {
+			log.Printf("handlePullRequestReviewEvent error: %v", err)
+			c.String(http.StatusInternalServerError, err.Error())
+			return
+		}
+	case *github.RepositoryEvent:
+		log.Printf("RepositoryEvent, action: %v\n", event.GetAction())
+		if event.GetAction() == "renamed" || event.GetAction() == "transferred" {
+			err := gc.handleRepositoryRenamedEvent(event)
+			if err != nil {
+				c.String(http.StatusInternalServerError, "Failed to handle repository event.")
+				return
+			}
+		}
 	case *github.PushEvent:
 		log.Printf("Got push event for %d", event.Repo.URL)
-		err := handlePushEvent(gh, event)
+		err := gc.handlePushEvent(event)
 		if err != nil {
 			log.Printf("handlePushEvent error: %v", err)
 			c.String(http.StatusInternalServerError, err.Error())
@@ -116,6 +165,22 @@ func GithubAppWebHook(c *gin.Context) {
 	c.JSON(200, "ok")
 }
 
+const githubSetupStateSessionKey = "github_setup_state"
+const githubSetupUrlSessionKey = "github_setup_url"
+
+// githubAppForWebhook finds the app a webhook has been sent for, GitHub sends its id in a header
+func (gc *GithubController) githubAppForWebhook(c *gin.Context) (*models.GithubApp, error) {
+	appId := c.GetHeader("X-GitHub-Hook-Installation-Target-ID")
+	if appId == "" || c.GetHeader("X-GitHub-Hook-Installation-Target-Type") != "integration" {
+		return gc.Github.GetDefaultGithubApp()
+	}
+	appId64, err := strconv.ParseInt(appId, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid app id %v: %v", appId, err)
+	}
+	return gc.Github.GetGithubApp(appId64)
+}
+
 func GithubAppSetup(c *gin.Context) {
 
 	type githubWebhook struct {
@@ -132,7 +197,7 @@ func GithubAppSetup(c *gin.Context) {
 		RedirectURL           string            `json:"redirect_url"`
 		CallbackUrls          []string          `json:"callback_urls"`
 		RequestOauthOnInstall bool              `json:"request_oauth_on_install"`
-		SetupOnUpdate         bool              `json:"setup_on_update"'`
+		SetupOnUpdate         bool              `json:"setup_on_update"`
 		URL                   string            `json:"url"`
 		Webhook               *githubWebhook    `json:"hook_attributes"`
 	}
@@ -163,6 +228,7 @@ func GithubAppSetup(c *gin.Context) {
 			"pull_request_review",
 			"pull_request",
 			"push",
+			"repository",
 		},
 		Permissions: map[string]string{
 			"actions":          "write",
@@ -178,9 +244,18 @@ func GithubAppSetup(c *gin.Context) {
 		},
 	}
 
+	// the app can be created on a GitHub Enterprise Server instead of github.com, e.g. ?github_url=https://ghes.example.com
+	githubUrl := strings.TrimSuffix(c.Query("github_url"), "/")
+	webUrl, err := (&models.GithubApp{GithubApiUrl: githubUrl}).WebUrl()
+	if err != nil {
+		log.Printf("invalid github_url %v: %v", githubUrl, err)
+		c.String(http.StatusBadRequest, "Invalid github_url")
+		return
+	}
+
 	url := &url.URL{
-		Scheme: "https",
-		Host:   "github.com",
+		Scheme: webUrl.Scheme,
+		Host:   webUrl.Host,
 		Path:   "/settings/apps/new",
 	}
 
@@ -190,6 +265,22 @@ func GithubAppSetup(c *gin.Context) {
 		url.Path = fmt.Sprintf("organizations/%s%s", githubOrg, url.Path)
 	}
 
+	// state is sent back with the code and ties the exchange to this session
+	state := uniuri.NewLen(32)
+	query := url.Query()
+	query.Set("state", state)
+	url.RawQuery = query.Encode()
+
+	session := sessions.Default(c)
+	session.Set(githubSetupStateSessionKey, state)
+	session.Set(githubSetupUrlSessionKey, githubUrl)
+	err = session.Save()
+	if err != nil {
+		log.Printf("failed to save github setup state to session, %v", err)
+		c.String(http.StatusInternalServerError, "Failed to start GitHub app setup")
+		return
+	}
+
 	jsonManifest, err := json.MarshalIndent(manifest, "", " ")
 	if err != nil {
 		c.Error(fmt.Errorf("failed to serialize manifest %s", err))
@@ -202,66 +293,99 @@ func GithubAppSetup(c *gin.Context) {
 // GithubSetupExchangeCode handles the user coming back from creating their app
 // A code query parameter is exchanged for this app's ID, key, and webhook_secret
 // Implements https://developer.github.com/apps/building-github-apps/creating-github-apps-from-a-manifest/#implementing-the-github-app-manifest-flow
-func GithubSetupExchangeCode(c *gin.Context) {
+func (gc *GithubController) GithubSetupExchangeCode(c *gin.Context) {
 	code := c.Query("code")
 	if code == "" {
-		c.Error(fmt.Errorf("Ignoring callback, missing code query parameter"))
+		c.String(http.StatusBadRequest, "Missing code query parameter")
+		return
 	}
 
-	client := github.NewClient(nil)
+	session := sessions.Default(c)
+	state, _ := session.Get(githubSetupStateSessionKey).(string)
+	githubUrl, _ := session.Get(githubSetupUrlSessionKey).(string)
+	session.Delete(githubSetupStateSessionKey)
+	session.Delete(githubSetupUrlSessionKey)
+	err := session.Save()
+	if err != nil {
+		log.Printf("failed to clear github setup state from session, %v", err)
+	}
+	if state == "" || c.Query("state") != state {
+		log.Printf("github setup state mismatch")
+		c.String(http.StatusBadRequest, "Invalid state, start the setup again")
+		return
+	}
+
+	githubApp := &models.GithubApp{GithubApiUrl: githubUrl}
+	client, err := utils.NewGithubClient(githubApp, nil)
+	if err != nil {
+		log.Printf("failed to create github client: %v", err)
+		c.String(http.StatusInternalServerError, "Failed to create GitHub client")
+		return
+	}
 	cfg, _, err := client.Apps.CompleteAppManifest(context.Background(), code)
 	if err != nil {
-		c.Error(fmt.Errorf("Failed to exchange code for github app: %s", err))
+		log.Printf("Failed to exchange code for github app: %v", err)
+		c.String(http.StatusInternalServerError, "Failed to exchange code for GitHub app")
 		return
 	}
-	log.Printf("Found credentials for GitHub app %v with id %d", *cfg.Name, cfg.GetID())
+	log.Printf("Found credentials for GitHub app %v with id %d", cfg.GetName(), cfg.GetID())
 
-	_, err = models.DB.CreateGithubApp(cfg.GetName(), cfg.GetID(), cfg.GetHTMLURL())
+	githubApp.GithubId = cfg.GetID()
+	githubApp.Name = cfg.GetName()
+	githubApp.GithubAppUrl = cfg.GetHTMLURL()
+	_, err = gc.Github.CreateGithubAppWithCredentials(githubApp, models.GithubAppCredentials{
+		ClientId:      cfg.GetClientID(),
+		ClientSecret:  cfg.GetClientSecret(),
+		PrivateKey:    cfg.GetPEM(),
+		WebhookSecret: cfg.GetWebhookSecret(),
+	})
 	if err != nil {
-		c.Error(fmt.Errorf("Failed to create github app record on callback"))
+		log.Printf("Failed to create github app record on callback: %v", err)
+		c.String(http.StatusInternalServerError, "Failed to save GitHub app")
+		return
 	}
+	recordAuditEvent(gc.Audit, c, c.GetUint(middleware.ORGANISATION_ID_KEY), models.AuditActionGithubAppCreated, "github_app", githubApp.GithubId,
+		nil, gin.H{"name": githubApp.Name, "url": githubApp.GithubAppUrl, "apiUrl": githubApp.GithubApiUrl})
 
 	c.HTML(http.StatusOK, "github_setup.tmpl", gin.H{
-		"Target":        "",
-		"Manifest":      "",
-		"ID":            cfg.GetID(),
-		"ClientID":      cfg.GetClientID(),
-		"ClientSecret":  cfg.GetClientSecret(),
-		"Key":           cfg.GetPEM(),
-		"WebhookSecret": cfg.GetWebhookSecret(),
-		"URL":           cfg.GetHTMLURL(),
+		"Target":   "",
+		"Manifest": "",
+		"ID":       cfg.GetID(),
+		"URL":      cfg.GetHTMLURL(),
 	})
+}
 
+// splitRepoFullName returns owner and name of a repository full name like diggerhq/digger
+func splitRepoFullName(repoFullName string) (string, string, error) {
+	parts := strings.SplitN(repoFullName, "/", 2)
+	if len(parts) != 2 {
+		return "", "", fmt.Errorf("repo full name %v is not in the owner/name format", repoFullName)
+	}
+	return parts[0], parts[1], nil
 }
 
-func createOrGetDiggerRepoForGithubRepo(ghRepoFullName string, installationId int64) (*models.Repo, *models.Organisation, error) {
-	link, err := models.DB.GetGithubInstallationLinkForInstallationId(installationId)
+func (gc *GithubController) createOrGetDiggerRepoForGithubRepo(ghRepo *github.Repository, installationId int64) (*models.Repo, *models.Organisation, error) {
+	link, err := gc.Github.GetGithubAppInstallationLink(installationId)
 	if err != nil {
 		log.Printf("Error fetching installation link: %v", err)
 		return nil, nil, err
 	}
+	if link == nil {
+		return nil, nil, fmt.Errorf("GitHub app installation %v is not linked to any organisation", installationId)
+	}
 	orgId := link.OrganisationId
-	org, err := models.DB.GetOrganisationById(orgId)
+	org, err := gc.Orgs.GetOrganisationById(orgId)
 	if err != nil {
 		log.Printf("Error fetching organisation by id: %v, error: %v\n", orgId, err)
 		return nil, nil, err
 	}
 
-	diggerRepoName := strings.ReplaceAll(ghRepoFullName, "/", "-")
-
-	repo, err := models.DB.GetRepo(orgId, diggerRepoName)
-
+	owner, name, err := splitRepoFullName(ghRepo.GetFullName())
 	if err != nil {
-		log.Printf("Error fetching repo: %v", err)
 		return nil, nil, err
 	}
 
-	if repo != nil {
-		log.Printf("Digger repo already exists: %v", repo)
-		return repo, org, nil
-	}
-
-	repo, err = models.DB.CreateRepo(diggerRepoName, org, `
+	repo, err := gc.Github.GetOrCreateGithubRepo(org, installationId, ghRepo.GetID(), owner, name, `
 generate_projects:
  include: "."
 `)
@@ -269,11 +393,36 @@ generate_projects:
 		log.Printf("Error creating digger repo: %v", err)
 		return nil, nil, err
 	}
-	log.Printf("Created digger repo: %v", repo)
+	log.Printf("Digger repo for %v: %v", ghRepo.GetFullName(), repo.Name)
 	return repo, org, nil
 }
 
-func handleInstallationRepositoriesAddedEvent(ghClientProvider utils.GithubClientProvider, payload *github.InstallationRepositoriesEvent) error {
+// handleRepositoryRenamedEvent follows renames and transfers of repositories, digger repos are looked up
+// by the GitHub repository id which doesn't change
+func (gc *GithubController) handleRepositoryRenamedEvent(payload *github.RepositoryEvent) error {
+	installationId := payload.GetInstallation().GetID()
+	link, err := gc.Github.GetGithubAppInstallationLink(installationId)
+	if err != nil {
+		log.Printf("Error getting GetGithubAppInstallationLink: %v", err)
+		return fmt.Errorf("error getting github app link")
+	}
+	if link == nil {
+		log.Printf("GitHub app installation %v is not linked to any organisation", installationId)
+		return nil
+	}
+
+	repo, err := gc.Github.FindGithubRepo(link.OrganisationId, installationId, payload.GetRepo().GetID(), payload.GetRepo().GetOwner().GetLogin(), payload.GetRepo().GetName())
+	if err != nil {
+		log.Printf("Error updating repo %v: %v", payload.GetRepo().GetFullName(), err)
+		return fmt.Errorf("error updating repo")
+	}
+	if repo == nil {
+		log.Printf("No digger repo for GitHub repository %v", payload.GetRepo().GetFullName())
+	}
+	return nil
+}
+
+func (gc *GithubController) handleInstallationRepositoriesAddedEvent(payload *github.InstallationRepositoriesEvent) error {
 	installationId := *payload.Installation.ID
 	login := *payload.Installation.Account.Login
 	accountId := *payload.Installation.Account.ID
@@ -281,19 +430,19 @@ func handleInstallationRepositoriesAddedEvent(ghClientProvider utils.GithubClien
 
 	for _, repo := range payload.RepositoriesAdded {
 		repoFullName := *repo.FullName
-		_, err := models.DB.GithubRepoAdded(installationId, appId, login, accountId, repoFullName)
+		_, err := gc.Github.GithubRepoAdded(installationId, appId, login, accountId, repoFullName)
 		if err != nil {
 			log.Printf("GithubRepoAdded failed, error: %v\n", err)
 			return err
 		}
 
-		//_, org, err := createOrGetDiggerRepoForGithubRepo(repoFullName, installationId)
+		//_, org, err := gc.createOrGetDiggerRepoForGithubRepo(repoFullName, installationId)
 		//if err != nil {
 		//	log.Printf("createOrGetDiggerRepoForGithubRepo failed, error: %v\n", err)
 		//	return err
 		//}
 
-		//client, _, err := ghClientProvider.Get(int64(appId), installationId)
+		//client, _, err := gc.GithubClientProvider.Get(int64(appId), installationId)
 		//if err != nil {
 		//	log.Printf("GetGithubClient failed, error: %v\n", err)
 		//	return err
@@ -308,12 +457,12 @@ func handleInstallationRepositoriesAddedEvent(ghClientProvider utils.GithubClien
 	return nil
 }
 
-func handleInstallationRepositoriesDeletedEvent(payload *github.InstallationRepositoriesEvent) error {
+func (gc *GithubController) handleInstallationRepositoriesDeletedEvent(payload *github.InstallationRepositoriesEvent) error {
 	installationId := *payload.Installation.ID
 	appId := *payload.Installation.AppID
 	for _, repo := range payload.RepositoriesRemoved {
 		repoFullName := *repo.FullName
-		_, err := models.DB.GithubRepoRemoved(installationId, appId, repoFullName)
+		_, err := gc.Github.GithubRepoRemoved(installationId, appId, repoFullName)
 		if err != nil {
 			return err
 		}
@@ -323,7 +472,7 @@ func handleInstallationRepositoriesDeletedEvent(payload *github.InstallationRepo
 	return nil
 }
 
-func handleInstallationCreatedEvent(installation *github.InstallationEvent) error {
+func (gc *GithubController) handleInstallationCreatedEvent(installation *github.InstallationEvent) error {
 	installationId := *installation.Installation.ID
 	login := *installation.Installation.Account.Login
 	accountId := *installation.Installation.Account.ID
@@ -332,11 +481,11 @@ func handleInstallationCreatedEvent(installation *github.InstallationEvent) erro
 	for _, repo := range installation.Repositories {
 		repoFullName := *repo.FullName
 		log.Printf("Adding a new installation %d for repo: %s", installationId, repoFullName)
-		_, err := models.DB.GithubRepoAdded(installationId, appId, login, accountId, repoFullName)
+		_, err := gc.Github.GithubRepoAdded(installationId, appId, login, accountId, repoFullName)
 		if err != nil {
 			return err
 		}
-		_, _, err = createOrGetDiggerRepoForGithubRepo(repoFullName, installationId)
+		_, _, err = gc.createOrGetDiggerRepoForGithubRepo(repo, installationId)
 		if err != nil {
 			return err
 		}
@@ -344,23 +493,25 @@ func handleInstallationCreatedEvent(installation *github.InstallationEvent) erro
 	return nil
 }
 
-func handleInstallationDeletedEvent(installation *github.InstallationEvent) error {
+func (gc *GithubController) handleInstallationDeletedEvent(installation *github.InstallationEvent) error {
 	installationId := *installation.Installation.ID
 	appId := *installation.Installation.AppID
 
-	link, err := models.DB.GetGithubInstallationLinkForInstallationId(installationId)
+	link, err := gc.Github.GetGithubAppInstallationLink(installationId)
 	if err != nil {
 		return err
 	}
-	_, err = models.DB.MakeGithubAppInstallationLinkInactive(link)
-	if err != nil {
-		return err
+	if link != nil {
+		_, err = gc.Github.MakeGithubAppInstallationLinkInactive(link)
+		if err != nil {
+			return err
+		}
 	}
 
 	for _, repo := range installation.Repositories {
 		repoFullName := *repo.FullName
 		log.Printf("Removing an installation %d for repo: %s", installationId, repoFullName)
-		_, err := models.DB.GithubRepoRemoved(installationId, appId, repoFullName)
+		_, err := gc.Github.GithubRepoRemoved(installationId, appId, repoFullName)
 		if err != nil {
 			return err
 		}
@@ -368,53 +519,57 @@ func handleInstallationDeletedEvent(installation *github.InstallationEvent) erro
 	return nil
 }
 
-func handlePushEvent(gh utils.GithubClientProvider, payload *github.PushEvent) error {
+func (gc *GithubController) handlePushEvent(payload *github.PushEvent) error {
 	installationId := *payload.Installation.ID
 	repoName := *payload.Repo.Name
 	repoFullName := *payload.Repo.FullName
 	repoOwner := *payload.Repo.Owner.Login
-	cloneURL := *payload.Repo.CloneURL
 	ref := *payload.Ref
 	defaultBranch := *payload.Repo.DefaultBranch
 
 	if strings.HasSuffix(ref, defaultBranch) {
-		link, err := models.DB.GetGithubAppInstallationLink(installationId)
+		link, err := gc.Github.GetGithubAppInstallationLink(installationId)
 		if err != nil {
 			log.Printf("Error getting GetGithubAppInstallationLink: %v", err)
 			return fmt.Errorf("error getting github app link")
 		}
+		if link == nil {
+			log.Printf("GitHub app installation %v is not linked to any organisation", installationId)
+			return fmt.Errorf("error getting github app link")
+		}
 
 		orgId := link.OrganisationId
-		diggerRepoName := strings.ReplaceAll(repoFullName, "/", "-")
-		repo, err := models.DB.GetRepo(orgId, diggerRepoName)
+		repo, err := gc.Github.FindGithubRepo(orgId, installationId, *payload.Repo.ID, repoOwner, repoName)
 		if err != nil {
 			log.Printf("Error getting Repo: %v", err)
 			return fmt.Errorf("error getting github app link")
 		}
 		if repo == nil {
-			log.Printf("Repo not found: Org: %v | repo: %v", orgId, diggerRepoName)
-			return fmt.Errorf("Repo not found: Org: %v | repo: %v", orgId, diggerRepoName)
+			log.Printf("Repo not found: Org: %v | repo: %v", orgId, repoFullName)
+			return fmt.Errorf("Repo not found: Org: %v | repo: %v", orgId, repoFullName)
 		}
 
-		_, token, err := getGithubService(gh, installationId, repoFullName, repoOwner, repoName)
+		ghService, _, err := getGithubService(gc.Github, gc.GithubClientProvider, installationId, repoFullName, repoOwner, repoName)
 		if err != nil {
 			log.Printf("Error getting github service: %v", err)
 			return fmt.Errorf("error getting github service")
 		}
-		utils.CloneGitRepoAndDoAction(cloneURL, defaultBranch, *token, func(dir string) {
-			dat, err := os.ReadFile(path.Join(dir, "digger.yml"))
-			//TODO: fail here and return failure to main fn (need to refactor CloneGitRepoAndDoAction for that
-			if err != nil {
-				log.Printf("ERROR fetching digger.yml file: %v", err)
-			}
-			models.DB.UpdateRepoDiggerConfig(link.OrganisationId, string(dat), repo)
-		})
+		diggerYml, err := services.ConfigLoader.LoadDiggerYml(ghService.Client, repoOwner, repoName, payload.GetAfter())
+		if err != nil {
+			log.Printf("ERROR fetching digger.yml file: %v", err)
+			return fmt.Errorf("error fetching digger.yml")
+		}
+		_, err = gc.Repos.UpdateRepoDiggerConfig(link.OrganisationId, diggerYml, repo)
+		if err != nil {
+			log.Printf("Error updating digger config: %v", err)
+			return fmt.Errorf("error updating digger config")
+		}
 	}
 
 	return nil
 }
 
-func handlePullRequestEvent(gh utils.GithubClientProvider, payload *github.PullRequestEvent) error {
+func (gc *GithubController) handlePullRequestEvent(payload *github.PullRequestEvent) error {
 	installationId := *payload.Installation.ID
 	repoName := *payload.Repo.Name
 	repoOwner := *payload.Repo.Owner.Login
@@ -422,7 +577,19 @@ func handlePullRequestEvent(gh utils.GithubClientProvider, payload *github.PullR
 	cloneURL := *payload.Repo.CloneURL
 	prNumber := *payload.PullRequest.Number
 
-	ghService, config, projectsGraph, branch, err := getDiggerConfig(gh, installationId, repoFullName, repoOwner, repoName, cloneURL, prNumber)
+	repo, err := gc.findGithubRepo(installationId, *payload.Repo.ID, repoFullName, repoOwner, repoName)
+	if err != nil {
+		return err
+	}
+	if payload.GetAction() == "closed" {
+		err = gc.cancelHeldApplies(gc.jobTransitions(repo.OrganisationID, payload.GetSender().GetLogin()), repo.RepoFullName, prNumber)
+		if err != nil {
+			log.Printf("cancelHeldApplies error: %v", err)
+			return fmt.Errorf("error cancelling held applies")
+		}
+	}
+
+	ghService, config, projectsGraph, prHead, err := gc.getDiggerConfig(installationId, *payload.Repo.ID, repoFullName, repoOwner, repoName, cloneURL, prNumber)
 
 	if err != nil {
 		log.Printf("getDiggerConfig error: %v", err)
@@ -444,7 +611,6 @@ func handlePullRequestEvent(gh utils.GithubClientProvider, payload *github.PullR
 	err = setPRStatusForJobs(ghService, prNumber, jobsForImpactedProjects)
 	if err != nil {
 		log.Printf("error setting status for PR: %v", err)
-		fmt.Errorf("error setting status for PR: %v", err)
 	}
 
 	impactedProjectsMap := make(map[string]dg_configuration.Project)
@@ -457,13 +623,20 @@ func handlePullRequestEvent(gh utils.GithubClientProvider, payload *github.PullR
 		impactedJobsMap[j.ProjectName] = j
 	}
 
-	batchId, _, err := utils.ConvertJobsToDiggerJobs(impactedJobsMap, impactedProjectsMap, projectsGraph, *branch, repoFullName)
+	batchId, diggerJobs, err := utils.ConvertJobsToDiggerJobs(gc.Jobs, impactedJobsMap, impactedProjectsMap, projectsGraph, prHead.GetRef(), prHead.GetSHA(), repoFullName)
 	if err != nil {
 		log.Printf("ConvertJobsToDiggerJobs error: %v", err)
 		return fmt.Errorf("error convertingjobs")
 	}
 
-	err = TriggerDiggerJobs(ghService.Client, repoOwner, repoName, batchId, prNumber, ghService)
+	err = gc.holdUnapprovedApplies(ghService, repo, prNumber, payload.GetAction() == "closed", payload.PullRequest.GetUser().GetLogin(), prHead.GetSHA(), payload.GetSender().GetLogin(),
+		impactedJobsMap, impactedProjectsMap, diggerJobs)
+	if err != nil {
+		log.Printf("holdUnapprovedApplies error: %v", err)
+		return fmt.Errorf("error checking approvals of applies")
+	}
+
+	err = TriggerDiggerJobs(gc.jobTransitions(repo.OrganisationID, payload.GetSender().GetLogin()), ghService.Client, repoOwner, repoName, batchId, prNumber, ghService)
 	if err != nil {
 		log.Printf("TriggerDiggerJobs error: %v", err)
 		return fmt.Errorf("error triggerring GitHub Actions for Digger Jobs")
@@ -472,14 +645,14 @@ func handlePullRequestEvent(gh utils.GithubClientProvider, payload *github.PullR
 	return nil
 }
 
-func getGithubService(gh utils.GithubClientProvider, installationId int64, repoFullName string, repoOwner string, repoName string) (*dg_github.GithubService, *string, error) {
-	installation, err := models.DB.GetGithubAppInstallationByIdAndRepo(installationId, repoFullName)
+func getGithubService(githubStore models.GithubStore, gh utils.GithubClientProvider, installationId int64, repoFullName string, repoOwner string, repoName string) (*dg_github.GithubService, *string, error) {
+	installation, err := githubStore.GetGithubAppInstallationByIdAndRepo(installationId, repoFullName)
 	if err != nil {
 		log.Printf("Error getting installation: %v", err)
 		return nil, nil, fmt.Errorf("Error getting installation: %v", err)
 	}
 
-	_, err = models.DB.GetGithubApp(installation.GithubAppId)
+	_, err = githubStore.GetGithubApp(installation.GithubAppId)
 	if err != nil {
 		log.Printf("Error getting app: %v", err)
 		return nil, nil, fmt.Errorf("Error getting app: %v", err)
@@ -499,35 +672,63 @@ func getGithubService(gh utils.GithubClientProvider, installationId int64, repoF
 
 	return &ghService, token, nil
 }
-func getDiggerConfig(gh utils.GithubClientProvider, installationId int64, repoFullName string, repoOwner string, repoName string, cloneUrl string, prNumber int) (*dg_github.GithubService, *dg_configuration.DiggerConfig, graph.Graph[string, dg_configuration.Project], *string, error) {
-	ghService, token, err := getGithubService(gh, installationId, repoFullName, repoOwner, repoName)
+
+// githubCloneUrl makes sure repos are cloned from the host of the app the installation belongs to
+func githubCloneUrl(githubStore models.GithubStore, installationId int64, repoFullName string, cloneUrl string) (string, error) {
+	installation, err := githubStore.GetGithubAppInstallationByIdAndRepo(installationId, repoFullName)
 	if err != nil {
-		log.Printf("Error getting github service: %v", err)
-		return nil, nil, nil, nil, fmt.Errorf("error getting github service")
+		return "", fmt.Errorf("error getting installation: %v", err)
 	}
-	var prBranch string
-	prBranch, err = ghService.GetBranchName(prNumber)
+	githubApp, err := githubStore.GetGithubApp(installation.GithubAppId)
 	if err != nil {
-		log.Printf("Error getting branch name: %v", err)
-		return nil, nil, nil, nil, fmt.Errorf("error getting branch name")
+		return "", fmt.Errorf("error getting app: %v", err)
 	}
+	return githubApp.CloneUrl(cloneUrl)
+}
 
-	link, err := models.DB.GetGithubAppInstallationLink(installationId)
+// findGithubRepo finds the repo in the org the installation is linked to
+func (gc *GithubController) findGithubRepo(installationId int64, githubRepoId int64, repoFullName string, repoOwner string, repoName string) (*models.Repo, error) {
+	link, err := gc.Github.GetGithubAppInstallationLink(installationId)
 	if err != nil {
 		log.Printf("Error getting GetGithubAppInstallationLink: %v", err)
-		return nil, nil, nil, nil, fmt.Errorf("error getting github app link")
+		return nil, fmt.Errorf("error getting github app link")
 	}
 
 	if link == nil {
 		log.Printf("Failed to find GithubAppInstallationLink for installationId: %v", installationId)
-		return nil, nil, nil, nil, fmt.Errorf("error getting github app installation link")
+		return nil, fmt.Errorf("error getting github app installation link")
 	}
 
-	diggerRepoName := repoOwner + "-" + repoName
-	repo, err := models.DB.GetRepo(link.Organisation.ID, diggerRepoName)
+	repo, err := gc.Github.FindGithubRepo(link.OrganisationId, installationId, githubRepoId, repoOwner, repoName)
 	if err != nil {
 		log.Printf("Error getting repo: %v", err)
-		return nil, nil, nil, nil, fmt.Errorf("error getting repo")
+		return nil, fmt.Errorf("error getting repo")
+	}
+	if repo == nil {
+		log.Printf("Repo not found: Org: %v | repo: %v", link.OrganisationId, repoFullName)
+		return nil, fmt.Errorf("repo not found")
+	}
+	return repo, nil
+}
+
+// getDiggerConfig loads the config at the head of the pull request, which is returned with it
+func (gc *GithubController) getDiggerConfig(installationId int64, githubRepoId int64, repoFullName string, repoOwner string, repoName string, cloneUrl string, prNumber int) (*dg_github.GithubService, *dg_configuration.DiggerConfig, graph.Graph[string, dg_configuration.Project], *github.PullRequestBranch, error) {
+	ghService, token, err := getGithubService(gc.Github, gc.GithubClientProvider, installationId, repoFullName, repoOwner, repoName)
+	if err != nil {
+		log.Printf("Error getting github service: %v", err)
+		return nil, nil, nil, nil, fmt.Errorf("error getting github service")
+	}
+	pr, _, err := ghService.Client.PullRequests.Get(context.Background(), repoOwner, repoName, prNumber)
+	if err != nil {
+		log.Printf("Error getting pull request: %v", err)
+		return nil, nil, nil, nil, fmt.Errorf("error getting branch name")
+	}
+	prBranch := pr.GetHead().GetRef()
+	prSha := pr.GetHead().GetSHA()
+
+	repo, err := gc.findGithubRepo(installationId, githubRepoId, repoFullName, repoOwner, repoName)
+	if err != nil {
+		return nil, nil, nil, nil, err
 	}
 
 	configYaml, err := dg_configuration.LoadDiggerConfigYamlFromString(repo.DiggerConfig)
@@ -539,9 +740,12 @@ func getDiggerConfig(gh utils.GithubClientProvider, installationId int64, repoFu
 	log.Printf("Digger config loadded successfully\n")
 
 	if configYaml.GenerateProjectsConfig != nil {
-		err = utils.CloneGitRepoAndDoAction(cloneUrl, prBranch, *token, func(dir string) {
-			dg_configuration.HandleYamlProjectGeneration(configYaml, dir)
-		})
+		cloneUrl, err = githubCloneUrl(gc.Github, installationId, repoFullName, cloneUrl)
+		if err != nil {
+			log.Printf("Error getting clone url: %v", err)
+			return nil, nil, nil, nil, fmt.Errorf("error getting clone url")
+		}
+		err = services.ConfigLoader.GenerateProjects(ghService.Client, repoOwner, repoName, prSha, cloneUrl, prBranch, *token, configYaml)
 		if err != nil {
 			log.Printf("Error generating projects: %v", err)
 			return nil, nil, nil, nil, fmt.Errorf("error generating projects")
@@ -555,7 +759,7 @@ func getDiggerConfig(gh utils.GithubClientProvider, installationId int64, repoFu
 		return nil, nil, nil, nil, fmt.Errorf("error loading digger config")
 	}
 	log.Printf("Digger config parsed successfully\n")
-	return ghService, config, dependencyGraph, &prBranch, nil
+	return ghService, config, dependencyGraph, pr.GetHead(), nil
 }
 
 func setPRStatusForJobs(prService *dg_github.GithubService, prNumber int, jobs []orchestrator.Job) error {
@@ -576,7 +780,7 @@ func setPRStatusForJobs(prService *dg_github.GithubService, prNumber int, jobs [
 	}
 	return nil
 }
-func handleIssueCommentEvent(gh utils.GithubClientProvider, payload *github.IssueCommentEvent) error {
+func (gc *GithubController) handleIssueCommentEvent(payload *github.IssueCommentEvent) error {
 	installationId := *payload.Installation.ID
 	repoName := *payload.Repo.Name
 	repoOwner := *payload.Repo.Owner.Login
@@ -584,7 +788,7 @@ func handleIssueCommentEvent(gh utils.GithubClientProvider, payload *github.Issu
 	cloneURL := *payload.Repo.CloneURL
 	issueNumber := *payload.Issue.Number
 
-	ghService, config, projectsGraph, branch, err := getDiggerConfig(gh, installationId, repoFullName, repoOwner, repoName, cloneURL, issueNumber)
+	ghService, config, projectsGraph, prHead, err := gc.getDiggerConfig(installationId, *payload.Repo.ID, repoFullName, repoOwner, repoName, cloneURL, issueNumber)
 
 	if err != nil {
 		log.Printf("getDiggerConfig error: %v", err)
@@ -613,7 +817,6 @@ func handleIssueCommentEvent(gh utils.GithubClientProvider, payload *github.Issu
 	err = setPRStatusForJobs(ghService, issueNumber, jobs)
 	if err != nil {
 		log.Printf("error setting status for PR: %v", err)
-		fmt.Errorf("error setting status for PR: %v", err)
 	}
 
 	impactedProjectsMap := make(map[string]dg_configuration.Project)
@@ -626,13 +829,24 @@ func handleIssueCommentEvent(gh utils.GithubClientProvider, payload *github.Issu
 		impactedProjectsJobMap[j.ProjectName] = j
 	}
 
-	batchId, _, err := utils.ConvertJobsToDiggerJobs(impactedProjectsJobMap, impactedProjectsMap, projectsGraph, *branch, repoFullName)
+	batchId, diggerJobs, err := utils.ConvertJobsToDiggerJobs(gc.Jobs, impactedProjectsJobMap, impactedProjectsMap, projectsGraph, prHead.GetRef(), prHead.GetSHA(), repoFullName)
 	if err != nil {
 		log.Printf("ConvertJobsToDiggerJobs error: %v", err)
 		return fmt.Errorf("error convertingjobs")
 	}
 
-	err = TriggerDiggerJobs(ghService.Client, repoOwner, repoName, batchId, issueNumber, ghService)
+	repo, err := gc.findGithubRepo(installationId, *payload.Repo.ID, repoFullName, repoOwner, repoName)
+	if err != nil {
+		return err
+	}
+	err = gc.holdUnapprovedApplies(ghService, repo, issueNumber, payload.GetIssue().GetState() == "closed", payload.Issue.GetUser().GetLogin(), prHead.GetSHA(), payload.GetComment().GetUser().GetLogin(),
+		impactedProjectsJobMap, impactedProjectsMap, diggerJobs)
+	if err != nil {
+		log.Printf("holdUnapprovedApplies error: %v", err)
+		return fmt.Errorf("error checking approvals of applies")
+	}
+
+	err = TriggerDiggerJobs(gc.jobTransitions(repo.OrganisationID, payload.GetComment().GetUser().GetLogin()), ghService.Client, repoOwner, repoName, batchId, issueNumber, ghService)
 	if err != nil {
 		log.Printf("TriggerDiggerJobs error: %v", err)
 		return fmt.Errorf("error triggerring GitHub Actions for Digger Jobs")
@@ -640,8 +854,13 @@ func handleIssueCommentEvent(gh utils.GithubClientProvider, payload *github.Issu
 	return nil
 }
 
-func TriggerDiggerJobs(client *github.Client, repoOwner string, repoName string, batchId *uuid.UUID, prNumber int, prService *dg_github.GithubService) error {
-	diggerJobs, err := models.DB.GetPendingParentDiggerJobs(batchId)
+// jobTransitions changes the jobs of the org on behalf of the GitHub user whose event is handled
+func (gc *GithubController) jobTransitions(orgId uint, login string) services.JobTransitions {
+	return services.JobTransitions{Stores: gc.Stores, OrgId: orgId, Actor: "github:" + login}
+}
+
+func TriggerDiggerJobs(jobs services.JobTransitions, client *github.Client, repoOwner string, repoName string, batchId *uuid.UUID, prNumber int, prService *dg_github.GithubService) error {
+	diggerJobs, err := jobs.Stores.Jobs.GetPendingParentDiggerJobs(batchId)
 
 	if err != nil {
 		log.Printf("failed to get pending digger jobs, %v\n", err)
@@ -654,31 +873,44 @@ func TriggerDiggerJobs(client *github.Client, repoOwner string, repoName string,
 		if job.SerializedJob == nil {
 			return fmt.Errorf("GitHub job can't be nil")
 		}
-		jobString := string(job.SerializedJob)
-		log.Printf("jobString: %v \n", jobString)
+		log.Printf("jobString: %v \n", string(job.SerializedJob))
 
+		err = dispatchDiggerJob(jobs, client, repoOwner, repoName, &job)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dispatchDiggerJob claims the job and starts the digger workflow for it, jobs claimed before are skipped
+func dispatchDiggerJob(jobs services.JobTransitions, client *github.Client, repoOwner string, repoName string, job *models.DiggerJob) error {
+	claimed, err := jobs.Claim(job.DiggerJobId)
+	if err != nil {
+		log.Printf("failed to claim digger job, %v\n", err)
+		return fmt.Errorf("failed to claim digger job, %v\n", err)
+	}
+	if !claimed {
+		log.Printf("digger job %v has already been triggered", job.DiggerJobId)
+		return nil
+	}
+
+	inputs, err := services.JobDispatchInputs(jobs.Stores, jobs.OrgId, job, repoOwner, repoName)
+	if err == nil {
 		// TODO: make workflow file name configurable
 		_, err = client.Actions.CreateWorkflowDispatchEventByFileName(context.Background(), repoOwner, repoName, "digger_workflow.yml", github.CreateWorkflowDispatchEventRequest{
 			Ref:    job.BranchName,
-			Inputs: map[string]interface{}{"job": jobString, "id": job.DiggerJobId},
+			Inputs: inputs,
 		})
+	}
 
-		if err != nil {
-			log.Printf("failed to trigger github workflow, %v\n", err)
-			return fmt.Errorf("failed to trigger github workflow, %v\n", err)
-		} else {
-			if err != nil {
-				log.Printf("failed to set pr status, %v\n", err)
-				return fmt.Errorf("failed to set pr status, %v\n", err)
-			}
-
-			job.Status = models.DiggerJobTriggered
-			err := models.DB.UpdateDiggerJob(&job)
-			if err != nil {
-				log.Printf("failed to trigger github workflow, %v\n", err)
-				return fmt.Errorf("failed to trigger github workflow, %v\n", err)
-			}
+	if err != nil {
+		log.Printf("failed to trigger github workflow, %v\n", err)
+		releaseErr := jobs.Release(job.DiggerJobId)
+		if releaseErr != nil {
+			log.Printf("failed to release digger job %v, %v\n", job.DiggerJobId, releaseErr)
 		}
+		return fmt.Errorf("failed to trigger github workflow, %v\n", err)
 	}
 	return nil
 }
@@ -743,6 +975,21 @@ func CreateDiggerWorkflowWithPullRequest(org *models.Organisation, client *githu
 		diggerHostname := os.Getenv("DIGGER_CLOUD_HOSTNAME")
 		diggerOrg := org.Name
 
+		// with GitHub OIDC auth the runner exchanges its id token instead of using a stored DIGGER_TOKEN secret
+		permissions := ""
+		diggerToken := "\n          digger-token: ${{ secrets.DIGGER_TOKEN }}"
+		if _, ok := os.LookupEnv("GITHUB_OIDC_AUTH"); ok {
+			permissions = `
+    permissions:
+      actions: read
+      contents: write
+      id-token: write
+      issues: write
+      pull-requests: write
+      statuses: write`
+			diggerToken = ""
+		}
+
 		workflowFileContents := fmt.Sprintf(`on:
   workflow_dispatch:
     inputs:
@@ -754,20 +1001,19 @@ func CreateDiggerWorkflowWithPullRequest(org *models.Organisation, client *githu
 jobs:
   build:
     name: %v
-    runs-on: ubuntu-latest
+    runs-on: ubuntu-latest%v
     steps:
       - name: digger run
         uses: diggerhq/digger@develop
         with:
           setup-aws: %v
-          disable-locking: %v
-          digger-token: ${{ secrets.DIGGER_TOKEN }}
+          disable-locking: %v%v
           digger-hostname: '%v'
           digger-organisation: '%v'
         env:
           GITHUB_CONTEXT: ${{ toJson(github) }}
           GITHUB_TOKEN: ${{ secrets.GITHUB_TOKEN }}
-`, jobName, setupAws, disableLocking, diggerHostname, diggerOrg)
+`, jobName, permissions, setupAws, disableLocking, diggerToken, diggerHostname, diggerOrg)
 
 		commitMessage := "Configure Digger workflow"
 		var req github.RepositoryContentFileOptions
@@ -791,12 +1037,28 @@ jobs:
 	return nil
 }
 
-func GithubAppCallbackPage(c *gin.Context) {
+// githubAppForCallback finds the app an installation callback is for. Apps registered by hand can use
+// /github/callback/<app id> as their callback url, install links rendered by Digger pass the app id as state.
+// Callbacks with neither are for the default app.
+func (gc *GithubController) githubAppForCallback(c *gin.Context) (*models.GithubApp, error) {
+	appId := c.Param("appId")
+	if appId == "" {
+		appId = c.Query("state")
+	}
+	if appId == "" {
+		return gc.Github.GetDefaultGithubApp()
+	}
+	appId64, err := strconv.ParseInt(appId, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid app id %v: %v", appId, err)
+	}
+	return gc.Github.GetGithubApp(appId64)
+}
+
+func (gc *GithubController) GithubAppCallbackPage(c *gin.Context) {
 	installationId := c.Request.URL.Query()["installation_id"][0]
 	//setupAction := c.Request.URL.Query()["setup_action"][0]
 	code := c.Request.URL.Query()["code"][0]
-	clientId := os.Getenv("GITHUB_APP_CLIENT_ID")
-	clientSecret := os.Getenv("GITHUB_APP_CLIENT_SECRET")
 
 	orgId, exists := c.Get(middleware.ORGANISATION_ID_KEY)
 	if !exists {
@@ -811,26 +1073,45 @@ func GithubAppCallbackPage(c *gin.Context) {
 		return
 	}
 
-	result, err := validateGithubCallback(clientId, clientSecret, code, installationId64)
+	githubApp, err := gc.githubAppForCallback(c)
+	if errors.Is(err, models.ErrGithubAppNotFound) {
+		c.String(http.StatusNotFound, "Unknown GitHub app")
+		return
+	}
+	if err != nil {
+		log.Printf("Error fetching github app: %v", err)
+		c.String(http.StatusInternalServerError, "Failed to find GitHub app")
+		return
+	}
+	creds, err := gc.Github.GetGithubAppCredentials(githubApp)
+	if err != nil {
+		log.Printf("Error reading github app credentials: %v", err)
+		c.String(http.StatusInternalServerError, "Failed to read GitHub app credentials")
+		return
+	}
+
+	result, err := validateGithubCallback(githubApp, creds.ClientId, creds.ClientSecret, code, installationId64)
 	if !result {
 		log.Printf("Failed to validated installation id, %v\n", err)
 		c.String(http.StatusInternalServerError, "Failed to validate installation_id.")
 		return
 	}
 
-	org, err := models.DB.GetOrganisationById(orgId)
+	org, err := gc.Orgs.GetOrganisationById(orgId)
 	if err != nil {
 		log.Printf("Error fetching organisation: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error fetching organisation"})
 		return
 	}
 
-	_, err = models.DB.CreateGithubInstallationLink(org, installationId64)
+	_, err = gc.Github.CreateGithubInstallationLink(org, installationId64)
 	if err != nil {
 		log.Printf("Error saving CreateGithubInstallationLink to database: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error updating GitHub installation"})
 		return
 	}
+	recordAuditEvent(gc.Audit, c, org.ID, models.AuditActionGithubInstallLinked, "github_installation", installationId64,
+		nil, gin.H{"githubAppId": githubApp.GithubId})
 	//TODO move to config; same for all other os.Getenv() calls in this file
 	callbackSuccessRedirectURL := os.Getenv("CALLBACK_SUCCESS_REDIRECT_URL")
 	if callbackSuccessRedirectURL == "" {
@@ -839,7 +1120,7 @@ func GithubAppCallbackPage(c *gin.Context) {
 	c.Redirect(http.StatusFound, callbackSuccessRedirectURL)
 }
 
-func GithubReposPage(c *gin.Context) {
+func (gc *GithubController) GithubReposPage(c *gin.Context) {
 	orgId, exists := c.Get(middleware.ORGANISATION_ID_KEY)
 	if !exists {
 		log.Printf("Organisation ID not found in context")
@@ -847,53 +1128,77 @@ func GithubReposPage(c *gin.Context) {
 		return
 	}
 
-	link, err := models.DB.GetGithubInstallationLinkForOrg(orgId)
+	links, err := gc.Github.GetGithubInstallationLinksForOrg(orgId)
 	if err != nil {
-		log.Printf("GetGithubInstallationLinkForOrg error: %v\n", err)
-		c.String(http.StatusForbidden, "Failed to find any GitHub installations for this org")
+		log.Printf("GetGithubInstallationLinksForOrg error: %v\n", err)
+		c.String(http.StatusInternalServerError, "Failed to find GitHub installations for this org")
 		return
 	}
 
-	installations, err := models.DB.GetGithubAppInstallations(link.GithubInstallationId)
-	if err != nil {
-		log.Printf("GetGithubAppInstallations error: %v\n", err)
+	if len(links) == 0 {
 		c.String(http.StatusForbidden, "Failed to find any GitHub installations for this org")
 		return
 	}
 
-	if len(installations) == 0 {
-		c.String(http.StatusForbidden, "Failed to find any GitHub installations for this org")
-		return
-	}
+	repos := make([]*github.Repository, 0)
+	seen := make(map[int64]bool)
+	for _, link := range links {
+		installations, err := gc.Github.GetGithubAppInstallations(link.GithubInstallationId)
+		if err != nil {
+			log.Printf("GetGithubAppInstallations error: %v\n", err)
+			c.String(http.StatusInternalServerError, "Failed to find GitHub installations for this org")
+			return
+		}
+		if len(installations) == 0 {
+			// installation with no repositories selected, nothing to list
+			continue
+		}
 
-	gh := &utils.DiggerGithubRealClientProvider{}
-	client, _, err := gh.Get(installations[0].GithubAppId, installations[0].GithubInstallationId)
-	if err != nil {
-		log.Printf("failed to create github client, %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error creating GitHub client"})
-		return
-	}
+		client, _, err := gc.GithubClientProvider.Get(installations[0].GithubAppId, link.GithubInstallationId)
+		if err != nil {
+			log.Printf("failed to create github client, %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error creating GitHub client"})
+			return
+		}
 
-	opts := &github.ListOptions{}
-	repos, _, err := client.Apps.ListRepos(context.Background(), opts)
-	if err != nil {
-		log.Printf("GetGithubAppInstallations error: %v\n", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list GitHub repos."})
-		return
+		opts := &github.ListOptions{PerPage: 100}
+		for {
+			page, resp, err := client.Apps.ListRepos(context.Background(), opts)
+			if err != nil {
+				log.Printf("ListRepos error for installation %v: %v\n", link.GithubInstallationId, err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list GitHub repos."})
+				return
+			}
+			for _, repo := range page.Repositories {
+				if seen[repo.GetID()] {
+					continue
+				}
+				seen[repo.GetID()] = true
+				repos = append(repos, repo)
+			}
+			if resp.NextPage == 0 {
+				break
+			}
+			opts.Page = resp.NextPage
+		}
 	}
-	c.HTML(http.StatusOK, "github_repos.tmpl", gin.H{"Repos": repos.Repositories})
+	c.HTML(http.StatusOK, "github_repos.tmpl", gin.H{"Repos": repos})
 }
 
 // why this validation is needed: https://roadie.io/blog/avoid-leaking-github-org-data/
 // validation based on https://docs.github.com/en/apps/creating-github-apps/authenticating-with-a-github-app/generating-a-user-access-token-for-a-github-app , step 3
-func validateGithubCallback(clientId string, clientSecret string, code string, installationId int64) (bool, error) {
+func validateGithubCallback(githubApp *models.GithubApp, clientId string, clientSecret string, code string, installationId int64) (bool, error) {
 	ctx := context.Background()
 	type OAuthAccessResponse struct {
 		AccessToken string `json:"access_token"`
 	}
 	httpClient := http.Client{}
 
-	reqURL := fmt.Sprintf("https://github.com/login/oauth/access_token?client_id=%s&client_secret=%s&code=%s", clientId, clientSecret, code)
+	accessTokenUrl, err := githubApp.OauthAccessTokenUrl()
+	if err != nil {
+		return false, err
+	}
+	reqURL := fmt.Sprintf("%s?client_id=%s&client_secret=%s&code=%s", accessTokenUrl, clientId, clientSecret, code)
 	req, err := http.NewRequest(http.MethodPost, reqURL, nil)
 	if err != nil {
 		return false, fmt.Errorf("could not create HTTP request: %v\n", err)
@@ -918,7 +1223,10 @@ func validateGithubCallback(clientId string, clientSecret string, code string, i
 		&oauth2.Token{AccessToken: t.AccessToken},
 	)
 	tc := oauth2.NewClient(ctx, ts)
-	client := github.NewClient(tc)
+	client, err := utils.NewGithubClient(githubApp, tc)
+	if err != nil {
+		return false, err
+	}
 
 	installationIdMatch := false
 	// list all installations for the user
@@ -1,20 +1,28 @@
 package controllers
 
 import (
+	"digger.dev/cloud/middleware"
 	"digger.dev/cloud/models"
+	"digger.dev/cloud/services"
 	"digger.dev/cloud/utils"
 	"encoding/json"
 	configuration "github.com/diggerhq/digger/libs/digger_config"
 	orchestrator "github.com/diggerhq/digger/libs/orchestrator"
+	dg_github "github.com/diggerhq/digger/libs/orchestrator/github"
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-contrib/sessions/cookie"
+	"github.com/gin-gonic/gin"
 	"github.com/google/go-github/v55/github"
+	"github.com/google/uuid"
 	"github.com/migueleliasweb/go-github-mock/src/mock"
 	"github.com/stretchr/testify/assert"
-	"gorm.io/driver/sqlite"
-	"gorm.io/gorm"
 	"log"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"strings"
 	"testing"
+	"time"
 )
 
 var issueCommentPayload = `{
@@ -572,31 +580,12 @@ func setupSuite(tb testing.TB) (func(tb testing.TB), *models.Database) {
 	// database file name
 	dbName := "database_test.db"
 
-	// remove old database
-	e := os.Remove(dbName)
-	if e != nil {
-		if !strings.Contains(e.Error(), "no such file or directory") {
-			log.Fatal(e)
-		}
-	}
-
-	// open and create a new database
-	gdb, err := gorm.Open(sqlite.Open(dbName), &gorm.Config{})
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	// migrate tables
-	err = gdb.AutoMigrate(&models.Policy{}, &models.Organisation{}, &models.Repo{}, &models.Project{}, &models.Token{},
-		&models.User{}, &models.ProjectRun{}, &models.GithubAppInstallation{}, &models.GithubApp{}, &models.GithubAppInstallationLink{},
-		&models.GithubDiggerJobLink{}, &models.DiggerJob{}, &models.DiggerJobParentLink{})
+	// create a new database with the migrated schema
+	database, err := models.NewTestDatabase(dbName)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	database := &models.Database{GormDB: gdb}
-	models.DB = database
-
 	// create an org
 	orgTenantId := "11111111-1111-1111-1111-111111111111"
 	externalSource := "test"
@@ -634,6 +623,11 @@ func setupSuite(tb testing.TB) (func(tb testing.TB), *models.Database) {
 	}
 
 	githubAppId := int64(1)
+	_, err = database.CreateGithubApp("digger", githubAppId, "https://github.com/apps/digger")
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	login := "test"
 	accountId := 1
 	repoFullName := "diggerhq/github-job-scheduler"
@@ -658,7 +652,6 @@ func setupSuite(tb testing.TB) (func(tb testing.TB), *models.Database) {
 		log.Fatal(err)
 	}
 
-	models.DB = database
 	// Return a function to teardown the test
 	return func(tb testing.TB) {
 		log.Println("teardown suite")
@@ -675,7 +668,7 @@ func init() {
 }
 func TestGithubHandleIssueCommentEvent(t *testing.T) {
 	t.Skip("!!TODO: Fix this failing test and unskip it")
-	teardownSuite, _ := setupSuite(t)
+	teardownSuite, database := setupSuite(t)
 	defer teardownSuite(t)
 
 	files := make([]github.CommitFile, 2)
@@ -705,16 +698,16 @@ func TestGithubHandleIssueCommentEvent(t *testing.T) {
 	var payload github.IssueCommentEvent
 	err := json.Unmarshal([]byte(issueCommentPayload), &payload)
 	assert.NoError(t, err)
-	err = handleIssueCommentEvent(gh, &payload)
+	gc := &GithubController{Stores: database.Stores(), GithubClientProvider: gh}
+	err = gc.handleIssueCommentEvent(&payload)
 	assert.NoError(t, err)
 
-	jobs, err := models.DB.GetPendingParentDiggerJobs(nil)
+	jobs, err := database.GetPendingParentDiggerJobs(nil)
 	assert.Equal(t, 0, len(jobs))
 }
 
 func TestJobsTreeWithOneJobsAndTwoProjects(t *testing.T) {
-	teardownSuite, _ := setupSuite(t)
-	defer teardownSuite(t)
+	store := models.NewMemoryStore()
 
 	jobs := make(map[string]orchestrator.Job)
 	jobs["dev"] = orchestrator.Job{ProjectName: "dev"}
@@ -730,18 +723,17 @@ func TestJobsTreeWithOneJobsAndTwoProjects(t *testing.T) {
 	graph, err := configuration.CreateProjectDependencyGraph(projects)
 	assert.NoError(t, err)
 
-	_, result, err := utils.ConvertJobsToDiggerJobs(jobs, projectMap, graph, "test", "test")
+	_, result, err := utils.ConvertJobsToDiggerJobs(store, jobs, projectMap, graph, "test", "", "test")
 	assert.NoError(t, err)
 	assert.Equal(t, 1, len(result))
-	parentLinks, err := models.DB.GetDiggerJobParentLinksChildId(&result["dev"].DiggerJobId)
+	parentLinks, err := store.GetDiggerJobParentLinksChildId(&result["dev"].DiggerJobId)
 	assert.NoError(t, err)
 	assert.Empty(t, parentLinks)
 	assert.NotContains(t, result, "prod")
 }
 
 func TestJobsTreeWithTwoDependantJobs(t *testing.T) {
-	teardownSuite, _ := setupSuite(t)
-	defer teardownSuite(t)
+	store := models.NewMemoryStore()
 
 	jobs := make(map[string]orchestrator.Job)
 	jobs["dev"] = orchestrator.Job{ProjectName: "dev"}
@@ -759,22 +751,21 @@ func TestJobsTreeWithTwoDependantJobs(t *testing.T) {
 	projectMap["dev"] = project1
 	projectMap["prod"] = project2
 
-	_, result, err := utils.ConvertJobsToDiggerJobs(jobs, projectMap, graph, "test", "test")
+	_, result, err := utils.ConvertJobsToDiggerJobs(store, jobs, projectMap, graph, "test", "", "test")
 	assert.NoError(t, err)
 	assert.Equal(t, 2, len(result))
 
-	parentLinks, err := models.DB.GetDiggerJobParentLinksChildId(&result["dev"].DiggerJobId)
+	parentLinks, err := store.GetDiggerJobParentLinksChildId(&result["dev"].DiggerJobId)
 	assert.NoError(t, err)
 	assert.Empty(t, parentLinks)
-	parentLinks, err = models.DB.GetDiggerJobParentLinksChildId(&result["prod"].DiggerJobId)
+	parentLinks, err = store.GetDiggerJobParentLinksChildId(&result["prod"].DiggerJobId)
 	assert.NoError(t, err)
 
 	assert.Equal(t, result["dev"].DiggerJobId, parentLinks[0].ParentDiggerJobId)
 }
 
 func TestJobsTreeWithTwoIndependentJobs(t *testing.T) {
-	teardownSuite, _ := setupSuite(t)
-	defer teardownSuite(t)
+	store := models.NewMemoryStore()
 
 	jobs := make(map[string]orchestrator.Job)
 	jobs["dev"] = orchestrator.Job{ProjectName: "dev"}
@@ -792,22 +783,21 @@ func TestJobsTreeWithTwoIndependentJobs(t *testing.T) {
 	projectMap["dev"] = project1
 	projectMap["prod"] = project2
 
-	_, result, err := utils.ConvertJobsToDiggerJobs(jobs, projectMap, graph, "test", "test")
+	_, result, err := utils.ConvertJobsToDiggerJobs(store, jobs, projectMap, graph, "test", "", "test")
 	assert.NoError(t, err)
 	assert.Equal(t, 2, len(result))
-	parentLinks, err := models.DB.GetDiggerJobParentLinksChildId(&result["dev"].DiggerJobId)
+	parentLinks, err := store.GetDiggerJobParentLinksChildId(&result["dev"].DiggerJobId)
 	assert.NoError(t, err)
 	assert.Empty(t, parentLinks)
 	assert.NotNil(t, result["dev"].SerializedJob)
-	parentLinks, err = models.DB.GetDiggerJobParentLinksChildId(&result["prod"].DiggerJobId)
+	parentLinks, err = store.GetDiggerJobParentLinksChildId(&result["prod"].DiggerJobId)
 	assert.NoError(t, err)
 	assert.Empty(t, parentLinks)
 	assert.NotNil(t, result["prod"].SerializedJob)
 }
 
 func TestJobsTreeWithThreeLevels(t *testing.T) {
-	teardownSuite, _ := setupSuite(t)
-	defer teardownSuite(t)
+	store := models.NewMemoryStore()
 
 	jobs := make(map[string]orchestrator.Job)
 	jobs["111"] = orchestrator.Job{ProjectName: "111"}
@@ -837,36 +827,36 @@ func TestJobsTreeWithThreeLevels(t *testing.T) {
 	projectMap["555"] = project5
 	projectMap["666"] = project6
 
-	_, result, err := utils.ConvertJobsToDiggerJobs(jobs, projectMap, graph, "test", "test")
+	_, result, err := utils.ConvertJobsToDiggerJobs(store, jobs, projectMap, graph, "test", "", "test")
 	assert.NoError(t, err)
 	assert.Equal(t, 6, len(result))
-	parentLinks, err := models.DB.GetDiggerJobParentLinksChildId(&result["111"].DiggerJobId)
+	parentLinks, err := store.GetDiggerJobParentLinksChildId(&result["111"].DiggerJobId)
 	assert.NoError(t, err)
 	assert.Empty(t, parentLinks)
 
-	parentLinks, err = models.DB.GetDiggerJobParentLinksChildId(&result["222"].DiggerJobId)
+	parentLinks, err = store.GetDiggerJobParentLinksChildId(&result["222"].DiggerJobId)
 	assert.NoError(t, err)
 	assert.Equal(t, result["111"].DiggerJobId, parentLinks[0].ParentDiggerJobId)
 
-	parentLinks, err = models.DB.GetDiggerJobParentLinksChildId(&result["333"].DiggerJobId)
+	parentLinks, err = store.GetDiggerJobParentLinksChildId(&result["333"].DiggerJobId)
 	assert.NoError(t, err)
 	assert.Equal(t, result["111"].DiggerJobId, parentLinks[0].ParentDiggerJobId)
 
-	parentLinks, err = models.DB.GetDiggerJobParentLinksChildId(&result["444"].DiggerJobId)
+	parentLinks, err = store.GetDiggerJobParentLinksChildId(&result["444"].DiggerJobId)
 	assert.NoError(t, err)
 	assert.Equal(t, result["222"].DiggerJobId, parentLinks[0].ParentDiggerJobId)
 
-	parentLinks, err = models.DB.GetDiggerJobParentLinksChildId(&result["555"].DiggerJobId)
+	parentLinks, err = store.GetDiggerJobParentLinksChildId(&result["555"].DiggerJobId)
 	assert.NoError(t, err)
 	assert.Equal(t, result["222"].DiggerJobId, parentLinks[0].ParentDiggerJobId)
 
-	parentLinks, err = models.DB.GetDiggerJobParentLinksChildId(&result["666"].DiggerJobId)
+	parentLinks, err = store.GetDiggerJobParentLinksChildId(&result["666"].DiggerJobId)
 	assert.NoError(t, err)
 	assert.Equal(t, result["333"].DiggerJobId, parentLinks[0].ParentDiggerJobId)
 }
 
 func TestGithubInstallationRepoAddedEvent(t *testing.T) {
-	teardownSuite, _ := setupSuite(t)
+	teardownSuite, database := setupSuite(t)
 	defer teardownSuite(t)
 
 	githubAppId := int64(360162)
@@ -874,7 +864,7 @@ func TestGithubInstallationRepoAddedEvent(t *testing.T) {
 	accountId := 1
 	installationId := int64(41584295)
 	repoFullName := "diggerhq/test-github-action"
-	_, err := models.DB.CreateGithubAppInstallation(installationId, githubAppId, login, accountId, repoFullName)
+	_, err := database.CreateGithubAppInstallation(installationId, githubAppId, login, accountId, repoFullName)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -906,17 +896,18 @@ func TestGithubInstallationRepoAddedEvent(t *testing.T) {
 	var payload github.InstallationRepositoriesEvent
 	err = json.Unmarshal([]byte(installationRepositoriesAddedPayload), &payload)
 	assert.NoError(t, err)
-	err = handleInstallationRepositoriesAddedEvent(gh, &payload)
+	gc := &GithubController{Stores: database.Stores(), GithubClientProvider: gh}
+	err = gc.handleInstallationRepositoriesAddedEvent(&payload)
 	assert.NoError(t, err)
 
 	orgId := 1
-	appInstall, err := models.DB.GetGithubAppInstallationByOrgAndRepo(orgId, *payload.RepositoriesAdded[0].FullName, models.GithubAppInstallActive)
+	appInstall, err := database.GetGithubAppInstallationByOrgAndRepo(orgId, *payload.RepositoriesAdded[0].FullName, models.GithubAppInstallActive)
 	assert.NoError(t, err)
 	assert.NotNil(t, appInstall)
 }
 
 func TestGithubInstallationRepoDeletedEvent(t *testing.T) {
-	teardownSuite, _ := setupSuite(t)
+	teardownSuite, database := setupSuite(t)
 	defer teardownSuite(t)
 
 	githubAppId := int64(360162)
@@ -924,7 +915,7 @@ func TestGithubInstallationRepoDeletedEvent(t *testing.T) {
 	accountId := 1
 	installationId := int64(41584295)
 	repoFullName := "diggerhq/test-github-action"
-	_, err := models.DB.CreateGithubAppInstallation(installationId, githubAppId, login, accountId, repoFullName)
+	_, err := database.CreateGithubAppInstallation(installationId, githubAppId, login, accountId, repoFullName)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -937,17 +928,18 @@ func TestGithubInstallationRepoDeletedEvent(t *testing.T) {
 	var payload github.InstallationRepositoriesEvent
 	err = json.Unmarshal([]byte(installationRepositoriesDeletedPayload), &payload)
 	assert.NoError(t, err)
-	err = handleInstallationRepositoriesDeletedEvent(&payload)
+	gc := &GithubController{Stores: database.Stores(), GithubClientProvider: gh}
+	err = gc.handleInstallationRepositoriesDeletedEvent(&payload)
 	assert.NoError(t, err)
 
 	orgId := 1
-	appInstall, err := models.DB.GetGithubAppInstallationByOrgAndRepo(orgId, *payload.RepositoriesRemoved[0].FullName, models.GithubAppInstallDeleted)
+	appInstall, err := database.GetGithubAppInstallationByOrgAndRepo(orgId, *payload.RepositoriesRemoved[0].FullName, models.GithubAppInstallDeleted)
 	assert.NoError(t, err)
 	assert.NotNil(t, appInstall)
 }
 
 func TestGithubInstallationRepoAddedDiggerWorkflowDoesntExistEvent(t *testing.T) {
-	teardownSuite, _ := setupSuite(t)
+	teardownSuite, database := setupSuite(t)
 	defer teardownSuite(t)
 
 	githubAppId := int64(360162)
@@ -955,7 +947,7 @@ func TestGithubInstallationRepoAddedDiggerWorkflowDoesntExistEvent(t *testing.T)
 	accountId := 1
 	installationId := int64(41584295)
 	repoFullName := "diggerhq/test-github-action"
-	_, err := models.DB.CreateGithubAppInstallation(installationId, githubAppId, login, accountId, repoFullName)
+	_, err := database.CreateGithubAppInstallation(installationId, githubAppId, login, accountId, repoFullName)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -995,17 +987,18 @@ func TestGithubInstallationRepoAddedDiggerWorkflowDoesntExistEvent(t *testing.T)
 	var payload github.InstallationRepositoriesEvent
 	err = json.Unmarshal([]byte(installationRepositoriesAddedPayload), &payload)
 	assert.NoError(t, err)
-	err = handleInstallationRepositoriesAddedEvent(gh, &payload)
+	gc := &GithubController{Stores: database.Stores(), GithubClientProvider: gh}
+	err = gc.handleInstallationRepositoriesAddedEvent(&payload)
 	assert.NoError(t, err)
 
 	orgId := 1
-	appInstall, err := models.DB.GetGithubAppInstallationByOrgAndRepo(orgId, *payload.RepositoriesAdded[0].FullName, models.GithubAppInstallActive)
+	appInstall, err := database.GetGithubAppInstallationByOrgAndRepo(orgId, *payload.RepositoriesAdded[0].FullName, models.GithubAppInstallActive)
 	assert.NoError(t, err)
 	assert.NotNil(t, appInstall)
 }
 
 func TestGithubInstallationRepoAddedDiggerWorkflowExistEvent(t *testing.T) {
-	teardownSuite, _ := setupSuite(t)
+	teardownSuite, database := setupSuite(t)
 	defer teardownSuite(t)
 
 	githubAppId := int64(360162)
@@ -1013,7 +1006,7 @@ func TestGithubInstallationRepoAddedDiggerWorkflowExistEvent(t *testing.T) {
 	accountId := 1
 	installationId := int64(41584295)
 	repoFullName := "diggerhq/test-github-action"
-	_, err := models.DB.CreateGithubAppInstallation(installationId, githubAppId, login, accountId, repoFullName)
+	_, err := database.CreateGithubAppInstallation(installationId, githubAppId, login, accountId, repoFullName)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -1045,22 +1038,343 @@ func TestGithubInstallationRepoAddedDiggerWorkflowExistEvent(t *testing.T) {
 	var payload github.InstallationRepositoriesEvent
 	err = json.Unmarshal([]byte(installationRepositoriesAddedPayload), &payload)
 	assert.NoError(t, err)
-	err = handleInstallationRepositoriesAddedEvent(gh, &payload)
+	gc := &GithubController{Stores: database.Stores(), GithubClientProvider: gh}
+	err = gc.handleInstallationRepositoriesAddedEvent(&payload)
 	assert.NoError(t, err)
 
 	orgId := 1
-	appInstall, err := models.DB.GetGithubAppInstallationByOrgAndRepo(orgId, *payload.RepositoriesAdded[0].FullName, models.GithubAppInstallActive)
+	appInstall, err := database.GetGithubAppInstallationByOrgAndRepo(orgId, *payload.RepositoriesAdded[0].FullName, models.GithubAppInstallActive)
 	assert.NoError(t, err)
 	assert.NotNil(t, appInstall)
 }
 
 func TestGithubHandleInstallationCreatedEvent(t *testing.T) {
-	teardownSuite, _ := setupSuite(t)
+	teardownSuite, database := setupSuite(t)
 	defer teardownSuite(t)
 
 	var event github.InstallationEvent
 	err := json.Unmarshal([]byte(installationCreatedEvent), &event)
 	assert.NoError(t, err)
-	err = handleInstallationCreatedEvent(&event)
+	gc := &GithubController{Stores: database.Stores()}
+	err = gc.handleInstallationCreatedEvent(&event)
+	assert.NoError(t, err)
+}
+
+func TestPullRequestReviewReleasesHeldApply(t *testing.T) {
+	teardownSuite, database := setupSuite(t)
+	defer teardownSuite(t)
+
+	org, err := database.GetOrganisationByName("testOrg")
+	assert.NoError(t, err)
+	assert.NoError(t, database.SavePolicy(&models.Policy{OrganisationID: org.ID, Type: models.POLICY_TYPE_APPROVAL, Policy: `{"min_approvals": 1, "dismiss_stale_approvals": true}`}))
+
+	var commentPayload github.IssueCommentEvent
+	assert.NoError(t, json.Unmarshal([]byte(issueCommentPayload), &commentPayload))
+	serializedJob, _ := json.Marshal(orchestrator.JobToJson(orchestrator.Job{ProjectName: "prod", Commands: []string{"digger apply"}, PullRequestNumber: github.Int(2)}))
+	job, err := database.CreateDiggerJob(uuid.New(), serializedJob, "main", "head-sha")
+	assert.NoError(t, err)
+	assert.NoError(t, database.HoldDiggerJobForApproval(&models.ApplyApprovalRequest{DiggerJobId: job.DiggerJobId, RepoFullName: "diggerhq/github-job-scheduler",
+		PullRequestNumber: 2, OrganisationID: org.ID, ProjectName: "prod", ProjectDir: "prod", RequestedBy: "alice", Reason: "it needs 1 approvals"}))
+
+	gh := &utils.DiggerGithubClientMockProvider{}
+	gh.MockedHTTPClient = mock.NewMockedHTTPClient(
+		mock.WithRequestMatch(mock.PostReposActionsWorkflowsDispatchesByOwnerByRepoByWorkflowId, nil),
+		mock.WithRequestMatch(mock.PostReposIssuesCommentsByOwnerByRepoByIssueNumber, github.IssueComment{}),
+	)
+	gc := &GithubController{Stores: database.Stores(), GithubClientProvider: gh}
+	headSha := "head-sha"
+	review := func(reviewer string, commitSha string, submittedAt time.Time) *github.PullRequestReviewEvent {
+		return &github.PullRequestReviewEvent{
+			Action: github.String("submitted"),
+			Review: &github.PullRequestReview{State: github.String("APPROVED"), User: &github.User{Login: github.String(reviewer)},
+				CommitID: github.String(commitSha), SubmittedAt: &github.Timestamp{Time: submittedAt}},
+			PullRequest: &github.PullRequest{Number: github.Int(2), State: github.String("open"), User: &github.User{Login: github.String("author")},
+				Head: &github.PullRequestBranch{SHA: github.String(headSha), Ref: github.String("main")}},
+			Repo:         commentPayload.Repo,
+			Installation: commentPayload.Installation,
+		}
+	}
+
+	// approvals of an earlier commit and of the author don't count
+	assert.NoError(t, gc.handlePullRequestReviewEvent(review("bob", "old-sha", time.Now())))
+	assert.NoError(t, gc.handlePullRequestReviewEvent(review("author", "head-sha", time.Now())))
+	job, err = database.GetDiggerJob(job.DiggerJobId)
+	assert.NoError(t, err)
+	assert.Equal(t, models.DiggerJobPendingApproval, job.Status)
+
+	assert.NoError(t, gc.handlePullRequestReviewEvent(review("carol", "head-sha", time.Now())))
+	job, err = database.GetDiggerJob(job.DiggerJobId)
+	assert.NoError(t, err)
+	assert.Equal(t, models.DiggerJobTriggered, job.Status)
+	events, _, err := database.GetAuditEvents(org.ID, models.AuditEventFilter{Action: models.AuditActionJobStatusUpdated, TargetId: job.DiggerJobId})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(events))
+	for _, event := range events {
+		assert.Equal(t, "github:carol", event.Actor)
+	}
+	requests, err := database.GetApplyApprovalRequests("diggerhq/github-job-scheduler", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(requests))
+	reviews, err := database.GetPullRequestReviews("diggerhq/github-job-scheduler", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(reviews))
+
+	hold := func() *models.DiggerJob {
+		job, err := database.CreateDiggerJob(uuid.New(), serializedJob, "main", "head-sha")
+		assert.NoError(t, err)
+		assert.NoError(t, database.HoldDiggerJobForApproval(&models.ApplyApprovalRequest{DiggerJobId: job.DiggerJobId, RepoFullName: "diggerhq/github-job-scheduler",
+			PullRequestNumber: 2, OrganisationID: org.ID, ProjectName: "prod", ProjectDir: "prod", RequestedBy: "alice"}))
+		return job
+	}
+
+	// an approval of a later commit doesn't start the apply of the earlier one
+	job = hold()
+	headSha = "new-sha"
+	assert.NoError(t, gc.handlePullRequestReviewEvent(review("carol", "new-sha", time.Now())))
+	job, err = database.GetDiggerJob(job.DiggerJobId)
+	assert.NoError(t, err)
+	assert.Equal(t, models.DiggerJobFailed, job.Status)
+
+	// closing the pull request cancels its held applies
+	job = hold()
+	assert.NoError(t, gc.cancelHeldApplies(gc.jobTransitions(org.ID, "alice"), "diggerhq/github-job-scheduler", 2))
+	job, err = database.GetDiggerJob(job.DiggerJobId)
+	assert.NoError(t, err)
+	assert.Equal(t, models.DiggerJobFailed, job.Status)
+	events, _, err = database.GetAuditEvents(org.ID, models.AuditEventFilter{Action: models.AuditActionJobStatusUpdated, TargetId: job.DiggerJobId})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(events))
+	assert.Equal(t, "github:alice", events[0].Actor)
+	assert.Equal(t, `{"status":6}`, events[0].Before)
+	assert.Equal(t, `{"status":3}`, events[0].After)
+	requests, err = database.GetApplyApprovalRequests("diggerhq/github-job-scheduler", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(requests))
+}
+
+func TestApprovedApplyStartsAfterItsParentFinishedWhileHeld(t *testing.T) {
+	teardownSuite, database := setupSuite(t)
+	defer teardownSuite(t)
+
+	org, err := database.GetOrganisationByName("testOrg")
+	assert.NoError(t, err)
+	assert.NoError(t, database.SavePolicy(&models.Policy{OrganisationID: org.ID, Type: models.POLICY_TYPE_APPROVAL, Policy: `{"min_approvals": 1}`}))
+
+	var commentPayload github.IssueCommentEvent
+	assert.NoError(t, json.Unmarshal([]byte(issueCommentPayload), &commentPayload))
+	batchId := uuid.New()
+	parentJob, err := database.CreateDiggerJob(batchId, []byte("{}"), "main", "head-sha")
+	assert.NoError(t, err)
+	serializedJob, _ := json.Marshal(orchestrator.JobToJson(orchestrator.Job{ProjectName: "app", Commands: []string{"digger apply"}, PullRequestNumber: github.Int(2)}))
+	job, err := database.CreateDiggerJob(batchId, serializedJob, "main", "head-sha")
+	assert.NoError(t, err)
+	assert.NoError(t, database.CreateDiggerJobParentLink(parentJob.DiggerJobId, job.DiggerJobId))
+	assert.NoError(t, database.HoldDiggerJobForApproval(&models.ApplyApprovalRequest{DiggerJobId: job.DiggerJobId, RepoFullName: "diggerhq/github-job-scheduler",
+		PullRequestNumber: 2, OrganisationID: org.ID, ProjectName: "app", ProjectDir: "app", RequestedBy: "alice"}))
+
+	gh := &utils.DiggerGithubClientMockProvider{}
+	gh.MockedHTTPClient = mock.NewMockedHTTPClient(
+		mock.WithRequestMatch(mock.PostReposActionsWorkflowsDispatchesByOwnerByRepoByWorkflowId, nil),
+		mock.WithRequestMatch(mock.PostReposIssuesCommentsByOwnerByRepoByIssueNumber, github.IssueComment{}),
+	)
+	gc := &GithubController{Stores: database.Stores(), GithubClientProvider: gh}
+	client, _, err := gh.Get(0, 0)
+	assert.NoError(t, err)
+
+	// the parent finishes while the apply is held, it can't start it yet
+	parentJob.Status = models.DiggerJobSucceeded
+	assert.NoError(t, database.UpdateDiggerJob(parentJob))
+	assert.NoError(t, services.DiggerJobCompleted(gc.jobTransitions(org.ID, "runner"), client, parentJob, "diggerhq", "github-job-scheduler", "digger_workflow.yml"))
+	job, err = database.GetDiggerJob(job.DiggerJobId)
+	assert.NoError(t, err)
+	assert.Equal(t, models.DiggerJobPendingApproval, job.Status)
+
+	assert.NoError(t, gc.handlePullRequestReviewEvent(&github.PullRequestReviewEvent{
+		Action: github.String("submitted"),
+		Review: &github.PullRequestReview{State: github.String("APPROVED"), User: &github.User{Login: github.String("carol")},
+			CommitID: github.String("head-sha"), SubmittedAt: &github.Timestamp{Time: time.Now()}},
+		PullRequest: &github.PullRequest{Number: github.Int(2), State: github.String("open"), User: &github.User{Login: github.String("author")},
+			Head: &github.PullRequestBranch{SHA: github.String("head-sha"), Ref: github.String("main")}},
+		Repo:         commentPayload.Repo,
+		Installation: commentPayload.Installation,
+	}))
+	job, err = database.GetDiggerJob(job.DiggerJobId)
+	assert.NoError(t, err)
+	assert.Equal(t, models.DiggerJobTriggered, job.Status)
+}
+
+func TestUnapprovedApplyOfClosedPullRequestIsCancelled(t *testing.T) {
+	store := models.NewMemoryStore()
+	org, err := store.CreateOrganisation("memoryOrg", "test", "memoryOrg")
+	assert.NoError(t, err)
+	assert.NoError(t, store.SavePolicy(&models.Policy{OrganisationID: org.ID, Type: models.POLICY_TYPE_APPROVAL, Policy: `{"min_approvals": 1}`}))
+	repo, err := store.CreateRepo("diggerhq-demo", org, "")
+	assert.NoError(t, err)
+	repo.RepoFullName = "diggerhq/demo"
+
+	job, err := store.CreateDiggerJob(uuid.New(), []byte("{}"), "main", "head-sha")
+	assert.NoError(t, err)
+	jobs := map[string]orchestrator.Job{"prod": {ProjectName: "prod", Commands: []string{"digger apply"}}}
+	projects := map[string]configuration.Project{"prod": {Name: "prod", Dir: "prod"}}
+
+	ghService := &dg_github.GithubService{Owner: "diggerhq", RepoName: "demo", Client: github.NewClient(mock.NewMockedHTTPClient(
+		mock.WithRequestMatch(mock.GetReposPullsReviewsByOwnerByRepoByPullNumber, []github.PullRequestReview{}),
+		mock.WithRequestMatch(mock.PostReposIssuesCommentsByOwnerByRepoByIssueNumber, github.IssueComment{}),
+	))}
+	gc := &GithubController{Stores: store.Stores()}
+	// the merge can't be approved anymore, the apply isn't left waiting
+	err = gc.holdUnapprovedApplies(ghService, repo, 2, true, "author", "head-sha", "alice", jobs, projects, map[string]*models.DiggerJob{"prod": job})
+	assert.NoError(t, err)
+
+	job, err = store.GetDiggerJob(job.DiggerJobId)
+	assert.NoError(t, err)
+	assert.Equal(t, models.DiggerJobFailed, job.Status)
+	requests, err := store.GetApplyApprovalRequests("diggerhq/demo", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(requests))
+	pending, err := store.GetPendingParentDiggerJobs(&job.BatchId)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(pending))
+}
+
+func TestGithubAppWebHookRejectsUnsignedRequestForUnknownApp(t *testing.T) {
+	teardownSuite, database := setupSuite(t)
+	defer teardownSuite(t)
+	t.Setenv("GITHUB_APP_ID", "")
+	t.Setenv("GITHUB_WEBHOOK_SECRET", "")
+
+	gc := &GithubController{Stores: database.Stores(), GithubClientProvider: &utils.DiggerGithubClientMockProvider{}}
+	r := gin.New()
+	r.POST("/github-app-webhook", gc.GithubAppWebHook)
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/github-app-webhook", strings.NewReader(issueCommentPayload))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-GitHub-Event", "issue_comment")
+	req.Header.Set("X-GitHub-Hook-Installation-Target-Type", "integration")
+	req.Header.Set("X-GitHub-Hook-Installation-Target-ID", "999")
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	// apps configured by environment variables can't skip the signature check either
+	t.Setenv("GITHUB_APP_ID", "999")
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodPost, "/github-app-webhook", strings.NewReader(issueCommentPayload))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-GitHub-Event", "issue_comment")
+	req.Header.Set("X-GitHub-Hook-Installation-Target-Type", "integration")
+	req.Header.Set("X-GitHub-Hook-Installation-Target-ID", "999")
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestGithubAppCallbackIsValidatedWithTheAppOfTheInstallation(t *testing.T) {
+	t.Setenv("GITHUB_APP_ID", "")
+	store := models.NewMemoryStore()
+	org, err := store.CreateOrganisation("memoryOrg", "test", "memoryOrg")
+	assert.NoError(t, err)
+
+	// a GHES instance issuing user tokens only for the client credentials of its own app
+	ghes := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/login/oauth/access_token":
+			if r.URL.Query().Get("client_id") != "ghes-client" || r.URL.Query().Get("client_secret") != "ghes-secret" {
+				w.WriteHeader(http.StatusUnauthorized)
+				w.Write([]byte(`{"error": "incorrect_client_credentials"}`))
+				return
+			}
+			w.Write([]byte(`{"access_token": "user-token"}`))
+		case "/api/v3/user/installations":
+			w.Write([]byte(`{"total_count": 1, "installations": [{"id": 77}]}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ghes.Close()
+
+	_, err = store.CreateGithubAppWithCredentials(&models.GithubApp{Name: "ghes", GithubId: 20, GithubApiUrl: ghes.URL + "/api/v3"},
+		models.GithubAppCredentials{ClientId: "ghes-client", ClientSecret: "ghes-secret"})
+	assert.NoError(t, err)
+	// the default app is the latest one, on github.com
+	_, err = store.CreateGithubAppWithCredentials(&models.GithubApp{Name: "github", GithubId: 10},
+		models.GithubAppCredentials{ClientId: "github-client", ClientSecret: "github-secret"})
+	assert.NoError(t, err)
+
+	gc := &GithubController{Stores: store.Stores()}
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(func(c *gin.Context) {
+		c.Set(middleware.ORGANISATION_ID_KEY, org.ID)
+	})
+	r.GET("/github/callback", gc.GithubAppCallbackPage)
+	r.GET("/github/callback/:appId", gc.GithubAppCallbackPage)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/github/callback?installation_id=77&code=abc&state=99", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	for _, callback := range []string{"/github/callback?installation_id=77&code=abc&state=20", "/github/callback/20?installation_id=77&code=abc"} {
+		w = httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, callback, nil))
+		assert.Equal(t, http.StatusFound, w.Code, callback)
+	}
+	link, err := store.GetGithubAppInstallationLink(77)
+	assert.NoError(t, err)
+	assert.Equal(t, org.ID, link.OrganisationId)
+	events, _, err := store.GetAuditEvents(org.ID, models.AuditEventFilter{Action: models.AuditActionGithubInstallLinked})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(events))
+	assert.Equal(t, "77", events[0].TargetId)
+	assert.JSONEq(t, `{"githubAppId": 20}`, events[0].After)
+}
+
+func TestGithubAppSetupIsAudited(t *testing.T) {
+	store := models.NewMemoryStore()
+	org, err := store.CreateOrganisation("memoryOrg", "test", "memoryOrg")
+	assert.NoError(t, err)
+
+	ghes := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/api/v3/app-manifests/abc/conversions" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(`{"id": 30, "name": "digger", "html_url": "https://ghes.example.com/apps/digger",
+			"client_id": "client", "client_secret": "secret", "pem": "private key", "webhook_secret": "webhook"}`))
+	}))
+	defer ghes.Close()
+
+	gc := &GithubController{Stores: store.Stores()}
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.LoadHTMLFiles("../templates/github_setup.tmpl")
+	r.Use(sessions.Sessions("digger-session", cookie.NewStore([]byte("secret"))))
+	r.Use(func(c *gin.Context) {
+		c.Set(middleware.ORGANISATION_ID_KEY, org.ID)
+		c.Set(middleware.ACTOR_KEY, "user:1")
+	})
+	// what GithubAppSetup leaves in the session before sending the user to GitHub
+	r.GET("/github/setup", func(c *gin.Context) {
+		session := sessions.Default(c)
+		session.Set(githubSetupStateSessionKey, "state")
+		session.Set(githubSetupUrlSessionKey, ghes.URL)
+		assert.NoError(t, session.Save())
+	})
+	r.GET("/github/exchange-code", gc.GithubSetupExchangeCode)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/github/setup", nil))
+	req := httptest.NewRequest(http.MethodGet, "/github/exchange-code?code=abc&state=state", nil)
+	req.Header.Set("Cookie", w.Header().Get("Set-Cookie"))
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	events, _, err := store.GetAuditEvents(org.ID, models.AuditEventFilter{Action: models.AuditActionGithubAppCreated})
 	assert.NoError(t, err)
+	assert.Equal(t, 1, len(events))
+	assert.Equal(t, "user:1", events[0].Actor)
+	assert.Equal(t, "30", events[0].TargetId)
+	// credentials are never part of the audit log
+	assert.NotContains(t, events[0].After, "secret")
+	assert.NotContains(t, events[0].After, "private key")
 }
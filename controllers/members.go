@@ -0,0 +1,283 @@
+package controllers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"digger.dev/cloud/models"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+func (api *ApiController) getMemberFromParam(c *gin.Context, org *models.Organisation) (*models.OrgMembership, bool) {
+	userId, err := strconv.ParseUint(c.Param("userId"), 10, 32)
+	if err != nil {
+		c.String(http.StatusBadRequest, "Invalid user id")
+		return nil, false
+	}
+	membership, err := api.Members.GetOrgMembership(org.ID, uint(userId))
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Unknown error occurred while fetching database")
+		return nil, false
+	}
+	if membership == nil {
+		c.String(http.StatusNotFound, "Could not find member")
+		return nil, false
+	}
+	return membership, true
+}
+
+// isLastOrgAdmin protects organisation from losing all its admins
+func (api *ApiController) isLastOrgAdmin(org *models.Organisation, membership *models.OrgMembership) (bool, error) {
+	if membership.Role != models.RoleOrgAdmin {
+		return false, nil
+	}
+	memberships, err := api.Members.GetOrgMemberships(org.ID)
+	if err != nil {
+		return false, err
+	}
+	for _, m := range memberships {
+		if m.ID != membership.ID && m.Role == models.RoleOrgAdmin && m.Status == models.MembershipActive {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func (api *ApiController) ListOrgMembers(c *gin.Context) {
+	org, ok := api.getOrgFromParams(c)
+	if !ok {
+		return
+	}
+
+	memberships, err := api.Members.GetOrgMemberships(org.ID)
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Unknown error occurred while fetching database")
+		return
+	}
+
+	response := make([]interface{}, 0)
+	for _, m := range memberships {
+		response = append(response, m.MapToJsonStruct())
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+type InviteMemberRequest struct {
+	Email string `json:"email" binding:"required,email"`
+	Role  string `json:"role" binding:"required"`
+}
+
+// InviteOrgMember adds the user with the email as invited member, membership becomes active on the first login
+func (api *ApiController) InviteOrgMember(c *gin.Context) {
+	org, ok := api.getOrgFromParams(c)
+	if !ok {
+		return
+	}
+
+	var request InviteMemberRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.String(http.StatusBadRequest, "Error binding JSON: %v", err)
+		return
+	}
+	if !models.IsValidRole(request.Role) {
+		c.String(http.StatusBadRequest, "Invalid role %v", request.Role)
+		return
+	}
+
+	user, err := api.Members.GetUserByEmail(request.Email)
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Unknown error occurred while fetching database")
+		return
+	}
+	if user == nil {
+		user, err = api.Members.CreateUser(request.Email, request.Email, "")
+		if err != nil {
+			c.String(http.StatusInternalServerError, "Failed to create user")
+			return
+		}
+	}
+
+	existing, err := api.Members.GetOrgMembership(org.ID, user.ID)
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Unknown error occurred while fetching database")
+		return
+	}
+	if existing != nil {
+		c.String(http.StatusConflict, "User is already a member of the organisation")
+		return
+	}
+
+	membership, err := api.Members.UpsertOrgMembership(org.ID, user, models.Role(request.Role), models.MembershipInvited)
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Failed to invite member")
+		return
+	}
+	recordAuditEvent(api.Audit, c, org.ID, models.AuditActionMemberInvited, "user", user.ID, nil, gin.H{"email": user.Email, "role": membership.Role})
+	c.JSON(http.StatusOK, membership.MapToJsonStruct())
+}
+
+type UpdateMemberRequest struct {
+	Role string `json:"role" binding:"required"`
+}
+
+func (api *ApiController) UpdateOrgMember(c *gin.Context) {
+	org, ok := api.getOrgFromParams(c)
+	if !ok {
+		return
+	}
+	membership, ok := api.getMemberFromParam(c, org)
+	if !ok {
+		return
+	}
+
+	var request UpdateMemberRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.String(http.StatusBadRequest, "Error binding JSON: %v", err)
+		return
+	}
+	if !models.IsValidRole(request.Role) {
+		c.String(http.StatusBadRequest, "Invalid role %v", request.Role)
+		return
+	}
+
+	if models.Role(request.Role) != models.RoleOrgAdmin {
+		lastAdmin, err := api.isLastOrgAdmin(org, membership)
+		if err != nil {
+			c.String(http.StatusInternalServerError, "Unknown error occurred while fetching database")
+			return
+		}
+		if lastAdmin {
+			c.String(http.StatusConflict, "Organisation must have at least one org-admin")
+			return
+		}
+	}
+
+	oldRole := membership.Role
+	membership, err := api.Members.UpsertOrgMembership(org.ID, membership.User, models.Role(request.Role), membership.Status)
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Failed to update member")
+		return
+	}
+	recordAuditEvent(api.Audit, c, org.ID, models.AuditActionMemberUpdated, "user", membership.UserID, gin.H{"role": oldRole}, gin.H{"role": membership.Role})
+	c.JSON(http.StatusOK, membership.MapToJsonStruct())
+}
+
+func (api *ApiController) RemoveOrgMember(c *gin.Context) {
+	org, ok := api.getOrgFromParams(c)
+	if !ok {
+		return
+	}
+	membership, ok := api.getMemberFromParam(c, org)
+	if !ok {
+		return
+	}
+
+	lastAdmin, err := api.isLastOrgAdmin(org, membership)
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Unknown error occurred while fetching database")
+		return
+	}
+	if lastAdmin {
+		c.String(http.StatusConflict, "Organisation must have at least one org-admin")
+		return
+	}
+
+	err = api.Members.RemoveOrgMembership(org.ID, membership.UserID)
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Failed to remove member")
+		return
+	}
+	recordAuditEvent(api.Audit, c, org.ID, models.AuditActionMemberRemoved, "user", membership.UserID, gin.H{"role": membership.Role}, nil)
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+type CreateRoleGrantRequest struct {
+	Repo    string `json:"repo" binding:"required"`
+	Project string `json:"project"`
+	Role    string `json:"role" binding:"required"`
+}
+
+// CreateRoleGrantForMember gives the member a role on a repo, or on a single project of the repo if project is set
+func (api *ApiController) CreateRoleGrantForMember(c *gin.Context) {
+	org, ok := api.getOrgFromParams(c)
+	if !ok {
+		return
+	}
+	membership, ok := api.getMemberFromParam(c, org)
+	if !ok {
+		return
+	}
+
+	var request CreateRoleGrantRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.String(http.StatusBadRequest, "Error binding JSON: %v", err)
+		return
+	}
+	if !models.IsValidRole(request.Role) || models.Role(request.Role) == models.RoleOrgAdmin {
+		c.String(http.StatusBadRequest, "Invalid role %v", request.Role)
+		return
+	}
+
+	repo, err := api.Repos.GetRepo(org.ID, request.Repo)
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Unknown error occurred while fetching database")
+		return
+	}
+	if repo == nil {
+		c.String(http.StatusNotFound, "Could not find repo %v", request.Repo)
+		return
+	}
+
+	var projectId *uint
+	if request.Project != "" {
+		project, err := api.Projects.GetProjectByName(org.ID, repo, request.Project)
+		if err != nil {
+			c.String(http.StatusInternalServerError, "Unknown error occurred while fetching database")
+			return
+		}
+		if project == nil {
+			c.String(http.StatusNotFound, "Could not find project %v", request.Project)
+			return
+		}
+		projectId = &project.ID
+	}
+
+	grant, err := api.Members.CreateRoleGrant(org.ID, membership.UserID, &repo.ID, projectId, models.Role(request.Role))
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Failed to create role grant")
+		return
+	}
+	recordAuditEvent(api.Audit, c, org.ID, models.AuditActionRoleGrantCreated, "role_grant", grant.ID, nil, grant.MapToJsonStruct())
+	c.JSON(http.StatusOK, grant.MapToJsonStruct())
+}
+
+func (api *ApiController) DeleteRoleGrant(c *gin.Context) {
+	org, ok := api.getOrgFromParams(c)
+	if !ok {
+		return
+	}
+	membership, ok := api.getMemberFromParam(c, org)
+	if !ok {
+		return
+	}
+
+	grantId, err := strconv.ParseUint(c.Param("grantId"), 10, 32)
+	if err != nil {
+		c.String(http.StatusBadRequest, "Invalid grant id")
+		return
+	}
+
+	err = api.Members.DeleteRoleGrant(org.ID, membership.UserID, uint(grantId))
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.String(http.StatusNotFound, "Could not find role grant")
+		} else {
+			c.String(http.StatusInternalServerError, "Failed to delete role grant")
+		}
+		return
+	}
+	recordAuditEvent(api.Audit, c, org.ID, models.AuditActionRoleGrantDeleted, "role_grant", grantId, gin.H{"userId": membership.UserID}, nil)
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
@@ -0,0 +1,170 @@
+package controllers
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"digger.dev/cloud/middleware"
+	"digger.dev/cloud/services"
+	"github.com/dchest/uniuri"
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/oauth2"
+)
+
+const oidcStateSessionKey = "oidc_state"
+const oidcNonceSessionKey = "oidc_nonce"
+const oidcVerifierSessionKey = "oidc_verifier"
+const oidcNextSessionKey = "oidc_next"
+
+// OidcLogin starts authorization code flow with PKCE, state, nonce and code verifier are kept in the session until callback
+func (web *WebController) OidcLogin(c *gin.Context) {
+	provider, err := services.GetOidcProvider(web.Secrets)
+	if err != nil {
+		c.String(http.StatusInternalServerError, "OIDC provider is not configured")
+		return
+	}
+
+	state := uniuri.NewLen(32)
+	nonce := uniuri.NewLen(32)
+	verifier := oauth2.GenerateVerifier()
+
+	next := localRedirectPath(c.Query("next"))
+
+	session := sessions.Default(c)
+	session.Set(oidcStateSessionKey, state)
+	session.Set(oidcNonceSessionKey, nonce)
+	session.Set(oidcVerifierSessionKey, verifier)
+	session.Set(oidcNextSessionKey, next)
+	err = session.Save()
+	if err != nil {
+		log.Printf("failed to save oidc login state to session, %v", err)
+		c.String(http.StatusInternalServerError, "Failed to start login")
+		return
+	}
+
+	authUrl := provider.OAuth2Config().AuthCodeURL(state, oauth2.S256ChallengeOption(verifier), oauth2.SetAuthURLParam("nonce", nonce))
+	c.Redirect(http.StatusFound, authUrl)
+}
+
+// localRedirectPath returns next if it is a path on this host, "/" otherwise. Only local redirects are allowed
+// after login, browsers treat backslashes like slashes so /\evil.com would leave the site.
+func localRedirectPath(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.Contains(next, "\\") {
+		return "/"
+	}
+	u, err := url.Parse(next)
+	if err != nil || u.Scheme != "" || u.Host != "" || strings.HasPrefix(u.Path, "//") {
+		return "/"
+	}
+	return next
+}
+
+// OidcCallback exchanges the code for tokens, verifies id token and maps its claims to organisation and access level
+func (web *WebController) OidcCallback(c *gin.Context) {
+	provider, err := services.GetOidcProvider(web.Secrets)
+	if err != nil {
+		c.String(http.StatusInternalServerError, "OIDC provider is not configured")
+		return
+	}
+
+	if errorCode := c.Query("error"); errorCode != "" {
+		log.Printf("OIDC provider returned error: %v, %v", errorCode, c.Query("error_description"))
+		c.String(http.StatusForbidden, "Login failed")
+		return
+	}
+
+	session := sessions.Default(c)
+	state, _ := session.Get(oidcStateSessionKey).(string)
+	nonce, _ := session.Get(oidcNonceSessionKey).(string)
+	verifier, _ := session.Get(oidcVerifierSessionKey).(string)
+	next, _ := session.Get(oidcNextSessionKey).(string)
+	session.Delete(oidcStateSessionKey)
+	session.Delete(oidcNonceSessionKey)
+	session.Delete(oidcVerifierSessionKey)
+	session.Delete(oidcNextSessionKey)
+
+	if state == "" || c.Query("state") != state {
+		log.Printf("OIDC callback state doesn't match the session")
+		c.String(http.StatusForbidden, "Invalid login state")
+		return
+	}
+
+	token, err := provider.OAuth2Config().Exchange(c.Request.Context(), c.Query("code"), oauth2.VerifierOption(verifier))
+	if err != nil {
+		log.Printf("Failed to exchange OIDC code: %v", err)
+		c.String(http.StatusForbidden, "Login failed")
+		return
+	}
+
+	idToken, ok := token.Extra("id_token").(string)
+	if !ok || idToken == "" {
+		log.Printf("OIDC token response doesn't contain id_token")
+		c.String(http.StatusForbidden, "Login failed")
+		return
+	}
+
+	claims, err := provider.Verifier.Verify(idToken)
+	if err != nil {
+		log.Printf("Failed to verify id token: %v", err)
+		c.String(http.StatusForbidden, "Login failed")
+		return
+	}
+	if claims["nonce"] != nonce {
+		log.Printf("id token nonce doesn't match the session")
+		c.String(http.StatusForbidden, "Login failed")
+		return
+	}
+
+	org, err := provider.GetOrganisation(web.Orgs, claims)
+	if err != nil {
+		log.Printf("Failed to map id token to organisation: %v", err)
+		c.String(http.StatusForbidden, "User doesn't belong to any organisation")
+		return
+	}
+
+	user, membership, err := provider.GetMember(web.Members, org, claims)
+	if err != nil {
+		log.Printf("Failed to resolve member of org %v: %v", org.ID, err)
+		c.String(http.StatusInternalServerError, "Login failed")
+		return
+	}
+
+	expiresAt := time.Now().Add(12 * time.Hour).Unix()
+	if exp, ok := claims["exp"].(float64); ok && int64(exp) < expiresAt {
+		expiresAt = int64(exp)
+	}
+
+	session.Set(middleware.OIDC_SESSION_ORGANISATION_ID_KEY, org.ID)
+	session.Set(middleware.OIDC_SESSION_USER_ID_KEY, user.ID)
+	session.Set(middleware.OIDC_SESSION_SUBJECT_KEY, user.ExternalId)
+	session.Set(middleware.OIDC_SESSION_EXPIRES_AT_KEY, expiresAt)
+	err = session.Save()
+	if err != nil {
+		log.Printf("failed to save oidc login to session, %v", err)
+		c.String(http.StatusInternalServerError, "Login failed")
+		return
+	}
+
+	log.Printf("user %v logged in with OIDC to org id %v as %v\n", user.ID, org.ID, membership.Role)
+	if next == "" {
+		next = "/"
+	}
+	c.Redirect(http.StatusFound, next)
+}
+
+func OidcLogout(c *gin.Context) {
+	session := sessions.Default(c)
+	session.Delete(middleware.OIDC_SESSION_ORGANISATION_ID_KEY)
+	session.Delete(middleware.OIDC_SESSION_USER_ID_KEY)
+	session.Delete(middleware.OIDC_SESSION_SUBJECT_KEY)
+	session.Delete(middleware.OIDC_SESSION_EXPIRES_AT_KEY)
+	err := session.Save()
+	if err != nil {
+		log.Printf("failed to clear oidc session, %v", err)
+	}
+	c.Redirect(http.StatusFound, "/")
+}
@@ -0,0 +1,179 @@
+package controllers
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"digger.dev/cloud/middleware"
+	"digger.dev/cloud/models"
+	"digger.dev/cloud/services"
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-contrib/sessions/cookie"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeOidcProvider implements discovery, jwks and token endpoints of an OIDC provider
+type fakeOidcProvider struct {
+	server        *httptest.Server
+	key           *rsa.PrivateKey
+	codeChallenge string
+	nonce         string
+	roles         []string
+}
+
+func startFakeOidcProvider(t *testing.T) *fakeOidcProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	provider := &fakeOidcProvider{key: key}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 provider.server.URL,
+			"authorization_endpoint": provider.server.URL + "/authorize",
+			"token_endpoint":         provider.server.URL + "/token",
+			"jwks_uri":               provider.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kid": "oidc-kid",
+				"kty": "RSA",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		verifierHash := sha256.Sum256([]byte(r.Form.Get("code_verifier")))
+		if r.Form.Get("code") != "test-code" || base64.RawURLEncoding.EncodeToString(verifierHash[:]) != provider.codeChallenge {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+			"iss":   provider.server.URL,
+			"aud":   "digger",
+			"sub":   "user-1",
+			"nonce": provider.nonce,
+			"org":   "11111111-1111-1111-1111-111111111111",
+			"roles": provider.roles,
+			"exp":   time.Now().Add(time.Hour).Unix(),
+		})
+		token.Header["kid"] = "oidc-kid"
+		idToken, _ := token.SignedString(key)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": "access",
+			"token_type":   "Bearer",
+			"id_token":     idToken,
+		})
+	})
+	provider.server = httptest.NewServer(mux)
+	return provider
+}
+
+func TestOidcLoginFlowSetsOrganisationAndRole(t *testing.T) {
+	teardownSuite, database := setupSuite(t)
+	defer teardownSuite(t)
+
+	provider := startFakeOidcProvider(t)
+	defer provider.server.Close()
+	provider.roles = []string{"developers", "digger-admins"}
+
+	t.Setenv("OIDC_ISSUER_URL", provider.server.URL)
+	t.Setenv("OIDC_CLIENT_ID", "digger")
+	t.Setenv("OIDC_REDIRECT_URL", "http://localhost/oidc/callback")
+	t.Setenv("OIDC_ADMIN_ROLES", "digger-admins")
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(sessions.Sessions("digger-session", cookie.NewStore([]byte("secret"))))
+	web := &WebController{Stores: database.Stores()}
+	r.GET("/oidc/login", web.OidcLogin)
+	r.GET("/oidc/callback", web.OidcCallback)
+	r.GET("/projects/", middleware.OidcWebAuth(database.Stores()), func(c *gin.Context) {
+		c.String(http.StatusOK, "%v %v", c.GetUint(middleware.ORGANISATION_ID_KEY), c.GetString(middleware.ROLE_KEY))
+	})
+
+	// not logged in users are sent to login page
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/projects/", nil))
+	assert.Equal(t, http.StatusFound, w.Code)
+	assert.Equal(t, "/oidc/login?next=%2Fprojects%2F", w.Header().Get("Location"))
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/oidc/login?next=/projects/", nil))
+	assert.Equal(t, http.StatusFound, w.Code)
+	authUrl, err := url.Parse(w.Header().Get("Location"))
+	assert.NoError(t, err)
+	assert.Equal(t, "S256", authUrl.Query().Get("code_challenge_method"))
+	provider.codeChallenge = authUrl.Query().Get("code_challenge")
+	provider.nonce = authUrl.Query().Get("nonce")
+	sessionCookie := w.Header().Get("Set-Cookie")
+
+	// callback with a wrong state is rejected
+	req := httptest.NewRequest(http.MethodGet, "/oidc/callback?code=test-code&state=wrong", nil)
+	req.Header.Set("Cookie", sessionCookie)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	req = httptest.NewRequest(http.MethodGet, "/oidc/callback?code=test-code&state="+authUrl.Query().Get("state"), nil)
+	req.Header.Set("Cookie", sessionCookie)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusFound, w.Code)
+	assert.Equal(t, "/projects/", w.Header().Get("Location"))
+
+	req = httptest.NewRequest(http.MethodGet, "/projects/", nil)
+	req.Header.Set("Cookie", w.Header().Get("Set-Cookie"))
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "1 org-admin", w.Body.String())
+}
+
+func TestOidcMemberIsLinkedByVerifiedEmailOnly(t *testing.T) {
+	teardownSuite, database := setupSuite(t)
+	defer teardownSuite(t)
+
+	org, err := database.GetOrganisationById(1)
+	assert.NoError(t, err)
+	invited, err := database.CreateUser("alice@example.com", "alice@example.com", "")
+	assert.NoError(t, err)
+	provider := &services.OidcProvider{DefaultRole: models.RoleViewer}
+
+	_, _, err = provider.GetMember(database, org, jwt.MapClaims{"sub": "impostor", "email": "alice@example.com"})
+	assert.Error(t, err)
+
+	user, _, err := provider.GetMember(database, org, jwt.MapClaims{"sub": "alice", "email": "alice@example.com", "email_verified": true})
+	assert.NoError(t, err)
+	assert.Equal(t, invited.ID, user.ID)
+
+	// once linked the user isn't taken over by another identity with the same email
+	_, _, err = provider.GetMember(database, org, jwt.MapClaims{"sub": "other", "email": "alice@example.com", "email_verified": true})
+	assert.Error(t, err)
+}
+
+func TestOidcLoginRedirectsOnlyToLocalPaths(t *testing.T) {
+	assert.Equal(t, "/projects/?page=2", localRedirectPath("/projects/?page=2"))
+	assert.Equal(t, "/", localRedirectPath(""))
+	assert.Equal(t, "/", localRedirectPath("https://evil.com/"))
+	assert.Equal(t, "/", localRedirectPath("//evil.com"))
+	assert.Equal(t, "/", localRedirectPath(`/\evil.com`))
+	assert.Equal(t, "/", localRedirectPath(`/\/evil.com`))
+	assert.Equal(t, "/", localRedirectPath("/\t/evil.com"))
+}
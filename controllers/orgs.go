@@ -1,13 +1,11 @@
 package controllers
 
 import (
-	"digger.dev/cloud/models"
-	"fmt"
+	"digger.dev/cloud/services"
 	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt"
 	"log"
 	"net/http"
-	"os"
 	"strings"
 )
 
@@ -16,7 +14,7 @@ type TenantCreatedEvent struct {
 	Name     string `json:"name,omitempty"`
 }
 
-func CreateFronteggOrgFromWebhook(c *gin.Context) {
+func (api *ApiController) CreateFronteggOrgFromWebhook(c *gin.Context) {
 	var json TenantCreatedEvent
 
 	if err := c.ShouldBindJSON(&json); err != nil {
@@ -25,7 +23,7 @@ func CreateFronteggOrgFromWebhook(c *gin.Context) {
 	}
 	source := c.GetHeader("x-tenant-source")
 
-	_, err := models.DB.CreateOrganisation(json.Name, source, json.TenantId)
+	_, err := api.Orgs.CreateOrganisation(json.Name, source, json.TenantId)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create organisation"})
 		return
@@ -33,7 +31,7 @@ func CreateFronteggOrgFromWebhook(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"success": true})
 }
 
-func AssociateTenantIdToDiggerOrg(c *gin.Context) {
+func (api *ApiController) AssociateTenantIdToDiggerOrg(c *gin.Context) {
 	authHeader := c.Request.Header.Get("Authorization")
 	if authHeader == "" {
 		c.String(http.StatusForbidden, "No Authorization header provided")
@@ -47,90 +45,70 @@ func AssociateTenantIdToDiggerOrg(c *gin.Context) {
 		return
 	}
 
-	jwtPublicKey := os.Getenv("JWT_PUBLIC_KEY")
-	if jwtPublicKey == "" {
-		log.Printf("No JWT_PUBLIC_KEY environment variable provided")
-		c.String(http.StatusInternalServerError, "Error occurred while reading public key")
-		c.Abort()
-		return
-	}
-	publicKeyData := []byte(jwtPublicKey)
-
-	publicKey, err := jwt.ParseRSAPublicKeyFromPEM(publicKeyData)
+	verifier, err := services.GetJwtVerifier()
 	if err != nil {
-		log.Printf("Error while parsing public key: %v", err.Error())
-		c.String(http.StatusInternalServerError, "Error occurred while parsing public key")
+		log.Printf("JWT verifier isn't configured: %v", err)
+		c.String(http.StatusInternalServerError, "Error occurred while reading public key")
 		c.Abort()
 		return
 	}
 
 	// validate token
-	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
-		return publicKey, nil
-	})
+	claims, err := verifier.Verify(tokenString)
 	if err != nil {
-		log.Printf("can't parse a token, %v\n", err)
+		if ve, ok := err.(*jwt.ValidationError); ok {
+			if ve.Errors&jwt.ValidationErrorMalformed != 0 {
+				log.Println("That's not even a token")
+			} else if ve.Errors&(jwt.ValidationErrorExpired|jwt.ValidationErrorNotValidYet) != 0 {
+				log.Println("Token is either expired or not active yet")
+			} else {
+				log.Println("Couldn't handle this token:", err)
+			}
+		} else {
+			log.Printf("can't parse a token, %v\n", err)
+		}
 		c.AbortWithStatus(http.StatusForbidden)
 		return
 	}
 
-	if token.Valid {
-
-		if claims, ok := token.Claims.(jwt.MapClaims); ok {
-			if claims.Valid() != nil {
-				log.Printf("Token's claim is invalid")
-				log.Printf("token is invalid")
-				c.AbortWithStatus(http.StatusForbidden)
-			}
-
-			name := claims["name"]
-			tenantId := claims["tenantId"]
-
-			if name == nil {
-				log.Printf("claim's name is nil")
-				log.Printf("token is invalid (name absent from claim)")
-				c.AbortWithStatus(http.StatusForbidden)
-			}
+	name := claims["name"]
+	tenantId := claims["tenantId"]
 
-			if tenantId == nil {
-				log.Printf("claim's tenantId is nil")
-				log.Printf("token is invalid (tenantId absent from claim)")
-				c.AbortWithStatus(http.StatusForbidden)
-			}
+	if name == nil {
+		log.Printf("claim's name is nil")
+		log.Printf("token is invalid (name absent from claim)")
+		c.AbortWithStatus(http.StatusForbidden)
+		return
+	}
 
-			tenantIdStr := tenantId.(string)
-			nameStr := name.(string)
-			log.Printf("name: %s", name)
-			log.Printf("tenantId: %s", tenantId)
+	if tenantId == nil {
+		log.Printf("claim's tenantId is nil")
+		log.Printf("token is invalid (tenantId absent from claim)")
+		c.AbortWithStatus(http.StatusForbidden)
+		return
+	}
 
-			org, err := models.DB.GetOrganisation(tenantId)
+	tenantIdStr := tenantId.(string)
+	nameStr := name.(string)
+	log.Printf("name: %s", name)
+	log.Printf("tenantId: %s", tenantId)
 
-			if err != nil {
-				log.Printf("Failed to get organisation by tenantId: %v", err)
-				c.AbortWithStatus(http.StatusInternalServerError)
-			}
+	org, err := api.Orgs.GetOrganisation(tenantId)
 
-			if org == nil {
-				models.DB.CreateOrganisation(nameStr, "", tenantIdStr)
-			}
+	if err != nil {
+		log.Printf("Failed to get organisation by tenantId: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
 
-			c.AbortWithStatus(http.StatusOK)
-		} else if ve, ok := err.(*jwt.ValidationError); ok {
-			if ve.Errors&jwt.ValidationErrorMalformed != 0 {
-				log.Println("That's not even a token")
-			} else if ve.Errors&(jwt.ValidationErrorExpired|jwt.ValidationErrorNotValidYet) != 0 {
-				log.Println("Token is either expired or not active yet")
-			} else {
-				log.Println("Couldn't handle this token:", err)
-			}
-			c.AbortWithStatus(http.StatusForbidden)
-		} else {
-			log.Println("Couldn't handle this token:", err)
-			c.AbortWithStatus(http.StatusForbidden)
+	if org == nil {
+		_, err = api.Orgs.CreateOrganisation(nameStr, "", tenantIdStr)
+		if err != nil {
+			log.Printf("Failed to create organisation for tenantId %v: %v", tenantIdStr, err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
 		}
 	}
-	c.AbortWithStatus(http.StatusForbidden)
+
+	c.AbortWithStatus(http.StatusOK)
 }
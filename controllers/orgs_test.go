@@ -0,0 +1,34 @@
+package controllers
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCreateOrgFromWebhook(t *testing.T) {
+	r, store, _ := setupApiWithMemoryStore(t)
+
+	w := doRequest(r, "POST", "/create-org-from-frontegg", `{"tenantId": "tenant-2", "name": "webhookOrg"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	org, err := store.GetOrganisation("tenant-2")
+	assert.NoError(t, err)
+	assert.Equal(t, "webhookOrg", org.Name)
+
+	w = doRequest(r, "POST", "/create-org-from-frontegg", `{"tenantId": "tenant-3", "name": "webhookOrg"}`)
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+}
+
+func TestOrgRoutesRejectOtherOrgs(t *testing.T) {
+	r, store, _ := setupApiWithMemoryStore(t)
+	_, err := store.CreateOrganisation("otherOrg", "test", "otherOrg")
+	assert.NoError(t, err)
+
+	w := doRequest(r, "GET", "/orgs/otherOrg/audit-events", "")
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	w = doRequest(r, "GET", "/orgs/unknownOrg/audit-events", "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = doRequest(r, "GET", "/orgs/memoryOrg/audit-events", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+}
@@ -0,0 +1,243 @@
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"digger.dev/cloud/middleware"
+	"digger.dev/cloud/models"
+	"digger.dev/cloud/services"
+	"github.com/diggerhq/digger/libs/orchestrator"
+	"github.com/gin-gonic/gin"
+)
+
+const maxPlanArtifactBytes = 512 * 1024 * 1024
+
+// jobForProject returns the job with jobId and its parsed definition if the job runs for the project
+func (api *ApiController) jobForProject(c *gin.Context, project *models.Project, jobId string) (*models.DiggerJob, *orchestrator.JobJson, bool) {
+	job, err := api.Jobs.GetDiggerJob(jobId)
+	if err != nil {
+		log.Printf("Error fetching job: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error fetching job"})
+		return nil, nil, false
+	}
+	// unknown jobs come back empty
+	if job == nil || job.DiggerJobId == "" {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Job not found"})
+		return nil, nil, false
+	}
+
+	var jobJson orchestrator.JobJson
+	err = json.Unmarshal(job.SerializedJob, &jobJson)
+	if err != nil {
+		log.Printf("Error parsing job %v: %v", job.DiggerJobId, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error parsing job"})
+		return nil, nil, false
+	}
+	if jobJson.ProjectName != project.Name || !jobAllowedForCaller(c, &jobJson) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Job not found"})
+		return nil, nil, false
+	}
+	return job, &jobJson, true
+}
+
+// jobAllowedForCaller tells whether the caller may act on the job, tokens of GitHub Actions jobs only on jobs of
+// the repository they run for
+func jobAllowedForCaller(c *gin.Context, jobJson *orchestrator.JobJson) bool {
+	repository := c.GetString(middleware.JOB_REPOSITORY_KEY)
+	return repository == "" || strings.EqualFold(jobJson.Namespace, repository)
+}
+
+// jobPullRequestNumber returns the pull request the job runs for, 0 if it doesn't run for a pull request
+func jobPullRequestNumber(jobJson *orchestrator.JobJson) int {
+	if jobJson.PullRequestNumber == nil {
+		return 0
+	}
+	return *jobJson.PullRequestNumber
+}
+
+// UploadPlanArtifact stores the plan file of a plan job, the body is the binary plan and commit_sha the commit it was planned for
+func (api *ApiController) UploadPlanArtifact(c *gin.Context) {
+	commitSha := c.Query("commit_sha")
+	if commitSha == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "commit_sha is required"})
+		return
+	}
+
+	project, ok := api.getRepoAndProjectFromParams(c, c.Param("repo"), c.Param("projectName"))
+	if !ok {
+		return
+	}
+	job, jobJson, ok := api.jobForProject(c, project, c.Param("jobId"))
+	if !ok {
+		return
+	}
+	// the plan has to be for the commit the job was created for, otherwise a stale plan could pass for the current head
+	if commitSha != job.CommitSha {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "commit_sha doesn't match the commit of the job"})
+		return
+	}
+	prNumber := jobPullRequestNumber(jobJson)
+
+	key := fmt.Sprintf("plans/%v/%v/%v", project.ID, job.DiggerJobId, commitSha)
+	hash := sha256.New()
+	body := io.TeeReader(http.MaxBytesReader(c.Writer, c.Request.Body, maxPlanArtifactBytes), hash)
+	size, err := api.Blobs.Put(key, body)
+	if err != nil {
+		var maxBytesError *http.MaxBytesError
+		if errors.As(err, &maxBytesError) {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Plan is too large"})
+			return
+		}
+		log.Printf("Error storing plan artifact: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error storing plan"})
+		return
+	}
+
+	artifact := models.PlanArtifact{
+		ProjectID:         project.ID,
+		PullRequestNumber: prNumber,
+		DiggerJobId:       job.DiggerJobId,
+		CommitSha:         commitSha,
+		BlobKey:           key,
+		Size:              size,
+		Sha256:            hex.EncodeToString(hash.Sum(nil)),
+	}
+	err = api.Plans.CreatePlanArtifact(&artifact)
+	if err != nil {
+		log.Printf("Error saving plan artifact: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error storing plan"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"jobId": artifact.DiggerJobId, "commitSha": artifact.CommitSha, "size": artifact.Size, "sha256": artifact.Sha256})
+}
+
+// DownloadPlanArtifact returns the plan an apply job has to apply, the latest one uploaded for the project and
+// pull request of the job. It refuses with 409 if the pull request head moved since the plan, head_sha is the
+// commit the apply job checked out. head_sha is required unless the head of the pull request can be fetched from
+// GitHub, the plan isn't handed out without checking its commit.
+func (api *ApiController) DownloadPlanArtifact(c *gin.Context) {
+	project, ok := api.getRepoAndProjectFromParams(c, c.Param("repo"), c.Param("projectName"))
+	if !ok {
+		return
+	}
+	_, jobJson, ok := api.jobForProject(c, project, c.Param("jobId"))
+	if !ok {
+		return
+	}
+	prNumber := jobPullRequestNumber(jobJson)
+
+	artifact, err := api.Plans.GetLatestPlanArtifact(project.ID, prNumber)
+	if err != nil {
+		log.Printf("Error fetching plan artifact: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error fetching plan"})
+		return
+	}
+	if artifact == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No plan was uploaded for this project"})
+		return
+	}
+
+	headSha := c.Query("head_sha")
+	if headSha != "" && headSha != artifact.CommitSha {
+		c.JSON(http.StatusConflict, gin.H{"error": "The plan was made for another commit, plan again", "planCommitSha": artifact.CommitSha, "headSha": headSha})
+		return
+	}
+	prHeadChecked := false
+	if prNumber != 0 {
+		repo, err := api.Repos.GetRepo(c.GetUint(middleware.ORGANISATION_ID_KEY), c.Param("repo"))
+		if err != nil {
+			log.Printf("Error fetching repo: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error fetching repo"})
+			return
+		}
+		if repo != nil && repo.VcsProvider == models.VcsProviderGithub && repo.RepoFullName != "" {
+			prHeadSha, err := api.pullRequestHeadSha(repo.OrganisationID, repo.RepoFullName, prNumber)
+			if err != nil {
+				log.Printf("Error fetching head of pull request %v of %v: %v", prNumber, repo.RepoFullName, err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Error checking the pull request head"})
+				return
+			}
+			if prHeadSha != artifact.CommitSha {
+				c.JSON(http.StatusConflict, gin.H{"error": "The pull request head moved since the plan, plan again", "planCommitSha": artifact.CommitSha, "headSha": prHeadSha})
+				return
+			}
+			prHeadChecked = true
+		}
+	}
+	// the plan is only handed out if it's known to be of the commit to apply
+	if headSha == "" && !prHeadChecked {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "head_sha is required, the pull request head of the job can't be checked"})
+		return
+	}
+
+	content, err := api.Blobs.Get(artifact.BlobKey)
+	if err != nil {
+		log.Printf("Error reading plan artifact %v: %v", artifact.BlobKey, err)
+		if errors.Is(err, services.ErrBlobNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Plan is no longer stored"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error reading plan"})
+		return
+	}
+	defer content.Close()
+
+	c.DataFromReader(http.StatusOK, artifact.Size, "application/octet-stream", content, map[string]string{
+		"X-Digger-Plan-Job-Id":     artifact.DiggerJobId,
+		"X-Digger-Plan-Commit-Sha": artifact.CommitSha,
+		"X-Digger-Plan-Sha256":     artifact.Sha256,
+	})
+}
+
+// githubWebUrl returns the GitHub host of the repo, which differs from github.com for GitHub Enterprise Server apps
+func (api *ApiController) githubWebUrl(orgId uint, repo *models.Repo) (string, error) {
+	if repo == nil || repo.VcsProvider != models.VcsProviderGithub || repo.RepoFullName == "" {
+		return "https://github.com", nil
+	}
+	installation, err := api.Github.GetGithubAppInstallationByOrgAndRepo(orgId, repo.RepoFullName, models.GithubAppInstallActive)
+	if err != nil {
+		return "", err
+	}
+	if installation == nil {
+		return "https://github.com", nil
+	}
+	app, err := api.Github.GetGithubApp(installation.GithubAppId)
+	if err != nil {
+		return "", err
+	}
+	web, err := app.WebUrl()
+	if err != nil {
+		return "", err
+	}
+	return web.String(), nil
+}
+
+func (api *ApiController) pullRequestHeadSha(orgId uint, repoFullName string, prNumber int) (string, error) {
+	installation, err := api.Github.GetGithubAppInstallationByOrgAndRepo(orgId, repoFullName, models.GithubAppInstallActive)
+	if err != nil {
+		return "", err
+	}
+	if installation == nil {
+		return "", fmt.Errorf("no installation found for repo %v", repoFullName)
+	}
+	client, _, err := api.githubClientProvider().Get(installation.GithubAppId, installation.GithubInstallationId)
+	if err != nil {
+		return "", err
+	}
+	repoOwner, repoName, _ := strings.Cut(repoFullName, "/")
+	pr, _, err := client.PullRequests.Get(context.Background(), repoOwner, repoName, prNumber)
+	if err != nil {
+		return "", err
+	}
+	return pr.GetHead().GetSHA(), nil
+}
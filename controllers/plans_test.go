@@ -0,0 +1,71 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"digger.dev/cloud/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPlanArtifacts(t *testing.T) {
+	r, store, _ := setupApiWithMemoryStore(t)
+
+	w := doRequest(r, "POST", "/repos/infra/report-projects", `{"name": "prod"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	jobs := []struct{ jobId, command, commitSha string }{
+		{"plan-job", "digger plan", "abc"},
+		{"newer-plan-job", "digger plan", "def"},
+		{"apply-job", "digger apply", "def"},
+	}
+	for _, job := range jobs {
+		serializedJob, _ := json.Marshal(map[string]interface{}{"projectName": "prod", "commands": []string{job.command}, "pullRequestNumber": 7})
+		assert.NoError(t, store.UpdateDiggerJob(&models.DiggerJob{DiggerJobId: job.jobId, CommitSha: job.commitSha, SerializedJob: serializedJob}))
+	}
+	for jobId, command := range map[string]string{"branch-plan-job": "digger plan", "branch-apply-job": "digger apply"} {
+		serializedJob, _ := json.Marshal(map[string]interface{}{"projectName": "prod", "commands": []string{command}})
+		assert.NoError(t, store.UpdateDiggerJob(&models.DiggerJob{DiggerJobId: jobId, CommitSha: "abc", SerializedJob: serializedJob}))
+	}
+
+	w = doRequest(r, "GET", "/repos/infra/projects/prod/jobs/apply-job/plan-artifact", "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = doRequest(r, "PUT", "/repos/infra/projects/prod/jobs/plan-job/plan-artifact", "binary plan")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = doRequest(r, "PUT", "/repos/infra/projects/prod/jobs/unknown-job/plan-artifact?commit_sha=abc", "binary plan")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	// a plan can't be tagged with another commit than the one of its job
+	w = doRequest(r, "PUT", "/repos/infra/projects/prod/jobs/plan-job/plan-artifact?commit_sha=def", "binary plan")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = doRequest(r, "PUT", "/repos/infra/projects/prod/jobs/plan-job/plan-artifact?commit_sha=abc", "binary plan")
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = doRequest(r, "GET", "/repos/infra/projects/prod/jobs/apply-job/plan-artifact?head_sha=abc", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "binary plan", w.Body.String())
+	assert.Equal(t, "plan-job", w.Header().Get("X-Digger-Plan-Job-Id"))
+
+	// the head of the pull request of a repo not on GitHub can't be checked
+	w = doRequest(r, "GET", "/repos/infra/projects/prod/jobs/apply-job/plan-artifact", "")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	// neither can the head of jobs without pull request
+	w = doRequest(r, "PUT", "/repos/infra/projects/prod/jobs/branch-plan-job/plan-artifact?commit_sha=abc", "branch plan")
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = doRequest(r, "GET", "/repos/infra/projects/prod/jobs/branch-apply-job/plan-artifact", "")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = doRequest(r, "GET", "/repos/infra/projects/prod/jobs/branch-apply-job/plan-artifact?head_sha=abc", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "branch plan", w.Body.String())
+
+	// a new commit was pushed after the plan
+	w = doRequest(r, "GET", "/repos/infra/projects/prod/jobs/apply-job/plan-artifact?head_sha=def", "")
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	w = doRequest(r, "PUT", "/repos/infra/projects/prod/jobs/newer-plan-job/plan-artifact?commit_sha=def", "newer plan")
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = doRequest(r, "GET", "/repos/infra/projects/prod/jobs/apply-job/plan-artifact?head_sha=def", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "newer plan", w.Body.String())
+}
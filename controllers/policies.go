@@ -3,13 +3,12 @@ package controllers
 import (
 	"digger.dev/cloud/middleware"
 	"digger.dev/cloud/models"
-	"errors"
+	"digger.dev/cloud/services"
 	"fmt"
 	dg_configuration "github.com/diggerhq/digger/libs/digger_config"
 	"github.com/dominikbraun/graph"
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
-	"gorm.io/gorm"
 	"io"
 	"log"
 	"net/http"
@@ -19,20 +18,28 @@ type CreatePolicyInput struct {
 	Policy string
 }
 
-func FindAccessPolicy(c *gin.Context) {
-	findPolicy(c, models.POLICY_TYPE_ACCESS)
+func (api *ApiController) FindAccessPolicy(c *gin.Context) {
+	api.findPolicy(c, models.POLICY_TYPE_ACCESS)
 }
 
-func FindPlanPolicy(c *gin.Context) {
-	findPolicy(c, models.POLICY_TYPE_PLAN)
+func (api *ApiController) FindPlanPolicy(c *gin.Context) {
+	api.findPolicy(c, models.POLICY_TYPE_PLAN)
 }
 
-func FindDriftPolicy(c *gin.Context) {
-	findPolicy(c, models.POLICY_TYPE_DRIFT)
+func (api *ApiController) FindDriftPolicy(c *gin.Context) {
+	api.findPolicy(c, models.POLICY_TYPE_DRIFT)
 }
 
-func findPolicy(c *gin.Context, policyType string) {
-	repo := c.Param("repo")
+func (api *ApiController) FindDriftAlertPolicy(c *gin.Context) {
+	api.findPolicy(c, models.POLICY_TYPE_DRIFT_ALERT)
+}
+
+func (api *ApiController) FindApprovalPolicy(c *gin.Context) {
+	api.findPolicy(c, models.POLICY_TYPE_APPROVAL)
+}
+
+func (api *ApiController) findPolicy(c *gin.Context, policyType string) {
+	repoName := c.Param("repo")
 	projectName := c.Param("projectName")
 	orgId, exists := c.Get(middleware.ORGANISATION_ID_KEY)
 
@@ -42,91 +49,122 @@ func findPolicy(c *gin.Context, policyType string) {
 		return
 	}
 
-	var policy models.Policy
-	query := JoinedOrganisationRepoProjectQuery()
-
-	if repo != "" && projectName != "" {
-		err := query.
-			Where("repos.name = ? AND projects.name = ? AND policies.organisation_id = ? AND policies.type = ?", repo, projectName, orgId, policyType).
-			First(&policy).Error
-		if err != nil {
-			if errors.Is(err, gorm.ErrRecordNotFound) {
-				c.String(http.StatusNotFound, fmt.Sprintf("Could not find policy for repo %v and project name %v", repo, projectName))
-			} else {
-				c.String(http.StatusInternalServerError, "Unknown error occurred while fetching database")
-			}
-			return
-		}
-	} else {
+	if repoName == "" || projectName == "" {
 		c.String(http.StatusBadRequest, "Should pass repo and project name")
 		return
 	}
 
+	notFound := fmt.Sprintf("Could not find policy for repo %v and project name %v", repoName, projectName)
+	repo, err := api.Repos.GetRepo(orgId, repoName)
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Unknown error occurred while fetching database")
+		return
+	}
+	if repo == nil {
+		c.String(http.StatusNotFound, notFound)
+		return
+	}
+
+	project, err := api.Projects.GetProjectByName(orgId, repo, projectName)
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Unknown error occurred while fetching database")
+		return
+	}
+	if project == nil {
+		c.String(http.StatusNotFound, notFound)
+		return
+	}
+
+	policy, err := api.Policies.GetProjectPolicy(orgId, repo.ID, project.ID, policyType)
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Unknown error occurred while fetching database")
+		return
+	}
+	if policy == nil {
+		c.String(http.StatusNotFound, notFound)
+		return
+	}
+
 	c.Header("Content-Type", "text/plain; charset=utf-8")
 	c.String(http.StatusOK, policy.Policy)
 }
 
-func FindAccessPolicyForOrg(c *gin.Context) {
-	findPolicyForOrg(c, models.POLICY_TYPE_ACCESS)
+func (api *ApiController) FindAccessPolicyForOrg(c *gin.Context) {
+	api.findPolicyForOrg(c, models.POLICY_TYPE_ACCESS)
 }
 
-func FindPlanPolicyForOrg(c *gin.Context) {
-	findPolicyForOrg(c, models.POLICY_TYPE_PLAN)
+func (api *ApiController) FindPlanPolicyForOrg(c *gin.Context) {
+	api.findPolicyForOrg(c, models.POLICY_TYPE_PLAN)
 }
 
-func FindDriftPolicyForOrg(c *gin.Context) {
-	findPolicyForOrg(c, models.POLICY_TYPE_DRIFT)
+func (api *ApiController) FindDriftPolicyForOrg(c *gin.Context) {
+	api.findPolicyForOrg(c, models.POLICY_TYPE_DRIFT)
 }
 
-func findPolicyForOrg(c *gin.Context, policyType string) {
+func (api *ApiController) FindDriftAlertPolicyForOrg(c *gin.Context) {
+	api.findPolicyForOrg(c, models.POLICY_TYPE_DRIFT_ALERT)
+}
+
+func (api *ApiController) FindApprovalPolicyForOrg(c *gin.Context) {
+	api.findPolicyForOrg(c, models.POLICY_TYPE_APPROVAL)
+}
+
+func (api *ApiController) findPolicyForOrg(c *gin.Context, policyType string) {
 	organisation := c.Param("organisation")
-	var policy models.Policy
-	query := JoinedOrganisationRepoProjectQuery()
 
-	err := query.
-		Where("organisations.name = ? AND (repos.id IS NULL AND projects.id IS NULL) AND policies.type = ? ", organisation, policyType).
-		First(&policy).Error
+	org, err := api.Orgs.GetOrganisationByName(organisation)
 	if err != nil {
-		if errors.Is(err, gorm.ErrRecordNotFound) {
-			c.String(http.StatusNotFound, "Could not find policy for organisation: "+organisation)
-		} else {
-			c.String(http.StatusInternalServerError, "Unknown error occurred while fetching database")
-		}
+		c.String(http.StatusInternalServerError, "Unknown error occurred while fetching database")
+		return
+	}
+	if org == nil {
+		c.String(http.StatusNotFound, "Could not find policy for organisation: "+organisation)
 		return
 	}
 
 	loggedInOrganisation := c.GetUint(middleware.ORGANISATION_ID_KEY)
 
-	if policy.OrganisationID != loggedInOrganisation {
-		log.Printf("Organisation ID %v does not match logged in organisation ID %v", policy.OrganisationID, loggedInOrganisation)
+	if org.ID != loggedInOrganisation {
+		log.Printf("Organisation ID %v does not match logged in organisation ID %v", org.ID, loggedInOrganisation)
 		c.String(http.StatusForbidden, "Not allowed to access this resource")
 		return
 	}
 
+	policy, err := api.Policies.GetOrgPolicy(org.ID, policyType)
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Unknown error occurred while fetching database")
+		return
+	}
+	if policy == nil {
+		c.String(http.StatusNotFound, "Could not find policy for organisation: "+organisation)
+		return
+	}
+
 	c.Header("Content-Type", "text/plain; charset=utf-8")
 	c.String(http.StatusOK, policy.Policy)
 }
 
-func JoinedOrganisationRepoProjectQuery() *gorm.DB {
-	return models.DB.GormDB.Preload("Organisation").Preload("Repo").Preload("Project").
-		Joins("LEFT JOIN repos ON policies.repo_id = repos.id").
-		Joins("LEFT JOIN projects ON policies.project_id = projects.id").
-		Joins("LEFT JOIN organisations ON policies.organisation_id = organisations.id")
+func (api *ApiController) UpsertAccessPolicyForOrg(c *gin.Context) {
+	api.upsertPolicyForOrg(c, models.POLICY_TYPE_ACCESS)
 }
 
-func UpsertAccessPolicyForOrg(c *gin.Context) {
-	upsertPolicyForOrg(c, models.POLICY_TYPE_ACCESS)
+func (api *ApiController) UpsertPlanPolicyForOrg(c *gin.Context) {
+	api.upsertPolicyForOrg(c, models.POLICY_TYPE_PLAN)
 }
 
-func UpsertPlanPolicyForOrg(c *gin.Context) {
-	upsertPolicyForOrg(c, models.POLICY_TYPE_PLAN)
+func (api *ApiController) UpsertDriftPolicyForOrg(c *gin.Context) {
+	api.upsertPolicyForOrg(c, models.POLICY_TYPE_DRIFT)
 }
 
-func UpsertDriftPolicyForOrg(c *gin.Context) {
-	upsertPolicyForOrg(c, models.POLICY_TYPE_DRIFT)
+func (api *ApiController) UpsertDriftAlertPolicyForOrg(c *gin.Context) {
+	api.upsertPolicyForOrg(c, models.POLICY_TYPE_DRIFT_ALERT)
 }
 
-func upsertPolicyForOrg(c *gin.Context, policyType string) {
+func (api *ApiController) UpsertApprovalPolicyForOrg(c *gin.Context) {
+	api.upsertPolicyForOrg(c, models.POLICY_TYPE_APPROVAL)
+}
+
+func (api *ApiController) upsertPolicyForOrg(c *gin.Context, policyType string) {
 	// Validate input
 	policyData, err := io.ReadAll(c.Request.Body)
 	if err != nil {
@@ -134,11 +172,17 @@ func upsertPolicyForOrg(c *gin.Context, policyType string) {
 		c.String(http.StatusInternalServerError, "Error reading request body")
 		return
 	}
+	if !validatePolicy(c, policyType, string(policyData)) {
+		return
+	}
 	organisation := c.Param("organisation")
 
-	org := models.Organisation{}
-	orgResult := models.DB.GormDB.Where("name = ?", organisation).Take(&org)
-	if orgResult.RowsAffected == 0 {
+	org, err := api.Orgs.GetOrganisationByName(organisation)
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Unknown error occurred while fetching database")
+		return
+	}
+	if org == nil {
 		c.String(http.StatusNotFound, "Could not find organisation: "+organisation)
 		return
 	}
@@ -151,47 +195,64 @@ func upsertPolicyForOrg(c *gin.Context, policyType string) {
 		return
 	}
 
-	policy := models.Policy{}
-
-	policyResult := models.DB.GormDB.Where("organisation_id = ? AND (repo_id IS NULL AND project_id IS NULL) AND type = ?", org.ID, policyType).Take(&policy)
+	policy, err := api.Policies.GetOrgPolicy(org.ID, policyType)
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Unknown error occurred while fetching database")
+		return
+	}
 
-	if policyResult.RowsAffected == 0 {
-		err := models.DB.GormDB.Create(&models.Policy{
+	if policy == nil {
+		policy = &models.Policy{
 			OrganisationID: org.ID,
 			Type:           policyType,
 			Policy:         string(policyData),
-		}).Error
+		}
+		err := api.Policies.SavePolicy(policy)
 
 		if err != nil {
 			log.Printf("Error creating policy: %v", err)
 			c.String(http.StatusInternalServerError, "Error creating policy")
 			return
 		}
+		recordAuditEvent(api.Audit, c, org.ID, models.AuditActionPolicyCreated, "policy", policy.ID,
+			nil, gin.H{"type": policyType, "policy": policy.Policy})
 	} else {
-		err := policyResult.Update("policy", string(policyData)).Error
+		oldPolicyText := policy.Policy
+		policy.Policy = string(policyData)
+		err := api.Policies.SavePolicy(policy)
 		if err != nil {
 			log.Printf("Error updating policy: %v", err)
 			c.String(http.StatusInternalServerError, "Error updating policy")
 			return
 		}
+		recordAuditEvent(api.Audit, c, org.ID, models.AuditActionPolicyUpdated, "policy", policy.ID,
+			gin.H{"type": policyType, "policy": oldPolicyText}, gin.H{"type": policyType, "policy": string(policyData)})
 	}
 
 	c.JSON(http.StatusOK, gin.H{"success": true})
 }
 
-func UpsertAccessPolicyForRepoAndProject(c *gin.Context) {
-	upsertPolicyForRepoAndProject(c, models.POLICY_TYPE_ACCESS)
+func (api *ApiController) UpsertAccessPolicyForRepoAndProject(c *gin.Context) {
+	api.upsertPolicyForRepoAndProject(c, models.POLICY_TYPE_ACCESS)
 }
 
-func UpsertPlanPolicyForRepoAndProject(c *gin.Context) {
-	upsertPolicyForRepoAndProject(c, models.POLICY_TYPE_PLAN)
+func (api *ApiController) UpsertPlanPolicyForRepoAndProject(c *gin.Context) {
+	api.upsertPolicyForRepoAndProject(c, models.POLICY_TYPE_PLAN)
 }
 
-func UpsertDriftPolicyForRepoAndProject(c *gin.Context) {
-	upsertPolicyForRepoAndProject(c, models.POLICY_TYPE_DRIFT)
+func (api *ApiController) UpsertDriftPolicyForRepoAndProject(c *gin.Context) {
+	api.upsertPolicyForRepoAndProject(c, models.POLICY_TYPE_DRIFT)
 }
 
-func upsertPolicyForRepoAndProject(c *gin.Context, policyType string) {
+func (api *ApiController) UpsertDriftAlertPolicyForRepoAndProject(c *gin.Context) {
+	api.upsertPolicyForRepoAndProject(c, models.POLICY_TYPE_DRIFT_ALERT)
+}
+
+func (api *ApiController) UpsertApprovalPolicyForRepoAndProject(c *gin.Context) {
+	api.upsertPolicyForRepoAndProject(c, models.POLICY_TYPE_APPROVAL)
+}
+
+func (api *ApiController) upsertPolicyForRepoAndProject(c *gin.Context, policyType string) {
 	orgID, exists := c.Get(middleware.ORGANISATION_ID_KEY)
 
 	if !exists {
@@ -199,7 +260,12 @@ func upsertPolicyForRepoAndProject(c *gin.Context, policyType string) {
 		return
 	}
 
-	orgID = orgID.(uint)
+	org, err := api.Orgs.GetOrganisationById(orgID)
+	if err != nil {
+		log.Printf("Error fetching organisation: %v", err)
+		c.String(http.StatusInternalServerError, "Error fetching organisation")
+		return
+	}
 
 	// Validate input
 	policyData, err := io.ReadAll(c.Request.Body)
@@ -208,32 +274,33 @@ func upsertPolicyForRepoAndProject(c *gin.Context, policyType string) {
 		c.String(http.StatusInternalServerError, "Error reading request body")
 		return
 	}
-	repo := c.Param("repo")
+	if !validatePolicy(c, policyType, string(policyData)) {
+		return
+	}
+	repoName := c.Param("repo")
 	projectName := c.Param("projectName")
-	repoModel := models.Repo{}
-	repoResult := models.DB.GormDB.Where("name = ?", repo).Take(&repoModel)
-	if repoResult.RowsAffected == 0 {
-		repoModel = models.Repo{
-			OrganisationID: orgID.(uint),
-			Name:           repo,
-		}
-		result := models.DB.GormDB.Create(&repoModel)
-		if result.Error != nil {
-			log.Printf("Error creating repo: %v", err)
-			c.String(http.StatusInternalServerError, "Error creating missing repo")
-			return
-		}
+
+	// missing repos and projects are created
+	repo, err := api.Repos.CreateRepo(repoName, org, "")
+	if err != nil {
+		log.Printf("Error creating repo: %v", err)
+		c.String(http.StatusInternalServerError, "Error creating missing repo")
+		return
 	}
 
-	projectModel := models.Project{}
-	projectResult := models.DB.GormDB.Where("name = ?", projectName).Take(&projectModel)
-	if projectResult.RowsAffected == 0 {
-		projectModel = models.Project{
-			OrganisationID: orgID.(uint),
-			RepoID:         repoModel.ID,
+	project, err := api.Projects.GetProjectByName(org.ID, repo, projectName)
+	if err != nil {
+		log.Printf("Error fetching project: %v", err)
+		c.String(http.StatusInternalServerError, "Error fetching project")
+		return
+	}
+	if project == nil {
+		project = &models.Project{
+			OrganisationID: org.ID,
+			RepoID:         repo.ID,
 			Name:           projectName,
 		}
-		err := models.DB.GormDB.Create(&projectModel).Error
+		err := api.Projects.SaveProject(project)
 		if err != nil {
 			log.Printf("Error creating project: %v", err)
 			c.String(http.StatusInternalServerError, "Error creating missing project")
@@ -241,36 +308,45 @@ func upsertPolicyForRepoAndProject(c *gin.Context, policyType string) {
 		}
 	}
 
-	var policy models.Policy
-
-	policyResult := models.DB.GormDB.Where("organisation_id = ? AND repo_id = ? AND project_id = ? AND type = ?", orgID, repoModel.ID, projectModel.ID, policyType).Take(&policy)
+	policy, err := api.Policies.GetProjectPolicy(org.ID, repo.ID, project.ID, policyType)
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Unknown error occurred while fetching database")
+		return
+	}
 
-	if policyResult.RowsAffected == 0 {
-		err := models.DB.GormDB.Create(&models.Policy{
-			OrganisationID: orgID.(uint),
-			RepoID:         &repoModel.ID,
-			ProjectID:      &projectModel.ID,
+	if policy == nil {
+		policy = &models.Policy{
+			OrganisationID: org.ID,
+			RepoID:         &repo.ID,
+			ProjectID:      &project.ID,
 			Type:           policyType,
 			Policy:         string(policyData),
-		}).Error
+		}
+		err := api.Policies.SavePolicy(policy)
 		if err != nil {
 			log.Printf("Error creating policy: %v", err)
 			c.String(http.StatusInternalServerError, "Error creating policy")
 			return
 		}
+		recordAuditEvent(api.Audit, c, org.ID, models.AuditActionPolicyCreated, "policy", policy.ID,
+			nil, gin.H{"type": policyType, "policy": policy.Policy, "repo": repoName, "project": projectName})
 	} else {
-		err := policyResult.Update("policy", string(policyData)).Error
+		oldPolicyText := policy.Policy
+		policy.Policy = string(policyData)
+		err := api.Policies.SavePolicy(policy)
 		if err != nil {
 			log.Printf("Error updating policy: %v", err)
 			c.String(http.StatusInternalServerError, "Error updating policy")
 			return
 		}
+		recordAuditEvent(api.Audit, c, org.ID, models.AuditActionPolicyUpdated, "policy", policy.ID,
+			gin.H{"type": policyType, "policy": oldPolicyText}, gin.H{"type": policyType, "policy": string(policyData)})
 	}
 
 	c.JSON(http.StatusOK, gin.H{"success": true})
 }
 
-func IssueAccessTokenForOrg(c *gin.Context) {
+func (api *ApiController) IssueAccessTokenForOrg(c *gin.Context) {
 	organisation_ID, exists := c.Get(middleware.ORGANISATION_ID_KEY)
 
 	if !exists {
@@ -278,9 +354,8 @@ func IssueAccessTokenForOrg(c *gin.Context) {
 		return
 	}
 
-	org := models.Organisation{}
-	orgResult := models.DB.GormDB.Where("id = ?", organisation_ID).Take(&org)
-	if orgResult.RowsAffected == 0 {
+	org, err := api.Orgs.GetOrganisationById(organisation_ID)
+	if err != nil {
 		log.Printf("Could not find organisation: %v", organisation_ID)
 		c.String(http.StatusInternalServerError, "Unexpected error")
 		return
@@ -289,21 +364,35 @@ func IssueAccessTokenForOrg(c *gin.Context) {
 	// prefixing token to make easier to retire this type of tokens later
 	token := "t:" + uuid.New().String()
 
-	err := models.DB.GormDB.Create(&models.Token{
-		Value:          token,
-		OrganisationID: org.ID,
-		Type:           models.AccessPolicyType,
-	}).Error
+	tokenModel, err := api.Orgs.CreateToken(org.ID, token, models.AccessPolicyType)
 
 	if err != nil {
 		log.Printf("Error creating token: %v", err)
 		c.String(http.StatusInternalServerError, "Unexpected error")
 		return
 	}
+	// token value is never recorded
+	recordAuditEvent(api.Audit, c, org.ID, models.AuditActionTokenIssued, "token", tokenModel.ID, nil, gin.H{"type": tokenModel.Type})
 
 	c.JSON(http.StatusOK, gin.H{"token": token})
 }
 
+// validatePolicy refuses drift alert and approval policies the backend can't evaluate, other policies are evaluated by the runner
+func validatePolicy(c *gin.Context, policyType string, policy string) bool {
+	var err error
+	switch policyType {
+	case models.POLICY_TYPE_DRIFT_ALERT:
+		_, err = services.ParseDriftAlertPolicy(policy)
+	case models.POLICY_TYPE_APPROVAL:
+		_, err = services.ParseApprovalPolicy(policy)
+	}
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return false
+	}
+	return true
+}
+
 func loadDiggerConfig(configYaml *dg_configuration.DiggerConfigYaml) (*dg_configuration.DiggerConfig, graph.Graph[string, dg_configuration.Project], error) {
 
 	err := dg_configuration.ValidateDiggerConfigYaml(configYaml, "loaded config")
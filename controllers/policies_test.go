@@ -0,0 +1,31 @@
+package controllers
+
+import (
+	"net/http"
+	"testing"
+
+	"digger.dev/cloud/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUpsertPolicy(t *testing.T) {
+	r, store, org := setupApiWithMemoryStore(t)
+
+	w := doRequest(r, "GET", "/repos/infra/projects/prod/plan-policy", "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = doRequest(r, "PUT", "/repos/infra/projects/prod/plan-policy", "package digger\n")
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = doRequest(r, "PUT", "/repos/infra/projects/prod/plan-policy", "package digger\ndeny[]")
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = doRequest(r, "GET", "/repos/infra/projects/prod/plan-policy", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "package digger\ndeny[]", w.Body.String())
+
+	events, total, err := store.GetAuditEvents(org.ID, models.AuditEventFilter{})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), total)
+	assert.Equal(t, models.AuditActionPolicyUpdated, events[0].Action)
+	assert.Equal(t, models.AuditActionPolicyCreated, events[1].Action)
+}
@@ -5,16 +5,33 @@ import (
 	"digger.dev/cloud/models"
 	"digger.dev/cloud/services"
 	"digger.dev/cloud/utils"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"github.com/gin-gonic/gin"
-	"gorm.io/gorm"
 	"log"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 )
 
-func FindProjectsForRepo(c *gin.Context) {
+// ApiController serves the API used by the digger cli and actions, data is read and written through its stores
+type ApiController struct {
+	models.Stores
+	Blobs services.BlobStore
+	// GithubClientProvider defaults to the GitHub App clients
+	GithubClientProvider utils.GithubClientProvider
+}
+
+func (api *ApiController) githubClientProvider() utils.GithubClientProvider {
+	if api.GithubClientProvider != nil {
+		return api.GithubClientProvider
+	}
+	return &utils.DiggerGithubRealClientProvider{Github: api.Github}
+}
+
+func (api *ApiController) FindProjectsForRepo(c *gin.Context) {
 	repo := c.Param("repo")
 	orgId, exists := c.Get(middleware.ORGANISATION_ID_KEY)
 
@@ -23,12 +40,7 @@ func FindProjectsForRepo(c *gin.Context) {
 		return
 	}
 
-	var projects []models.Project
-
-	err := models.DB.GormDB.Preload("Organisation").Preload("Repo").
-		Joins("LEFT JOIN repos ON projects.repo_id = repos.id").
-		Joins("LEFT JOIN organisations ON projects.organisation_id = organisations.id").
-		Where("repos.name = ? AND projects.organisation_id = ?", repo, orgId).Find(&projects).Error
+	projects, err := api.Projects.GetProjectsForRepoName(orgId, repo)
 	if err != nil {
 		c.String(http.StatusInternalServerError, "Unknown error occurred while fetching database")
 		return
@@ -41,48 +53,17 @@ func FindProjectsForRepo(c *gin.Context) {
 		response = append(response, jsonStruct)
 	}
 
-	if err != nil {
-		c.String(http.StatusInternalServerError, "Unknown error occurred while marshalling response")
-		return
-	}
-
 	c.JSON(http.StatusOK, response)
 
 }
 
-func FindProjectsForOrg(c *gin.Context) {
-	requestedOrganisation := c.Param("organisation")
-	loggedInOrganisation, exists := c.Get(middleware.ORGANISATION_ID_KEY)
-
-	if !exists {
-		c.String(http.StatusForbidden, "Not allowed to access this resource")
-		return
-	}
-
-	var org models.Organisation
-	err := models.DB.GormDB.Where("name = ?", requestedOrganisation).First(&org).Error
-	if err != nil {
-		if errors.Is(err, gorm.ErrRecordNotFound) {
-			c.String(http.StatusNotFound, "Could not find organisation: "+requestedOrganisation)
-		} else {
-			c.String(http.StatusInternalServerError, "Unknown error occurred while fetching database")
-		}
+func (api *ApiController) FindProjectsForOrg(c *gin.Context) {
+	org, ok := api.getOrgFromParams(c)
+	if !ok {
 		return
 	}
 
-	if org.ID != loggedInOrganisation {
-		log.Printf("Organisation ID %v does not match logged in organisation ID %v", org.ID, loggedInOrganisation)
-		c.String(http.StatusForbidden, "Not allowed to access this resource")
-		return
-	}
-
-	var projects []models.Project
-
-	err = models.DB.GormDB.Preload("Organisation").Preload("Repo").
-		Joins("LEFT JOIN repos ON projects.repo_id = repos.id").
-		Joins("LEFT JOIN organisations ON projects.organisation_id = organisations.id").
-		Where("projects.organisation_id = ?", org.ID).Find(&projects).Error
-
+	projects, err := api.Projects.GetProjectsForOrg(org.ID)
 	if err != nil {
 		c.String(http.StatusInternalServerError, "Unknown error occurred while fetching database")
 		return
@@ -95,11 +76,6 @@ func FindProjectsForOrg(c *gin.Context) {
 		response = append(response, marshalled)
 	}
 
-	if err != nil {
-		c.String(http.StatusInternalServerError, "Unknown error occurred while marshalling response")
-		return
-	}
-
 	c.JSON(http.StatusOK, response)
 }
 
@@ -108,7 +84,7 @@ type CreateProjectRequest struct {
 	ConfigurationYaml string `json:"configurationYaml"`
 }
 
-func ReportProjectsForRepo(c *gin.Context) {
+func (api *ApiController) ReportProjectsForRepo(c *gin.Context) {
 	var request CreateProjectRequest
 	err := c.BindJSON(&request)
 	if err != nil {
@@ -124,112 +100,130 @@ func ReportProjectsForRepo(c *gin.Context) {
 		return
 	}
 
-	org, err := models.DB.GetOrganisationById(orgId)
+	org, err := api.Orgs.GetOrganisationById(orgId)
 	if err != nil {
 		log.Printf("Error fetching organisation: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error fetching organisation"})
 		return
 	}
 
-	var repo models.Repo
-
-	err = models.DB.GormDB.Where("name = ? AND organisation_id = ?", repoName, orgId).First(&repo).Error
-
+	// CreateRepo returns the repo if it exists already
+	repo, err := api.Repos.CreateRepo(repoName, org, "")
 	if err != nil {
-
-		if errors.Is(err, gorm.ErrRecordNotFound) {
-			repo := models.Repo{
-				Name:           repoName,
-				OrganisationID: org.ID,
-				Organisation:   org,
-			}
-
-			err = models.DB.GormDB.Create(&repo).Error
-
-			if err != nil {
-				log.Printf("Error creating repo: %v", err)
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "Error creating repo"})
-				return
-			}
-		} else {
-			log.Printf("Error fetching repo: %v", err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error fetching repo"})
-			return
-		}
+		log.Printf("Error creating repo: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error creating repo"})
+		return
 	}
 
-	var project models.Project
-
-	err = models.DB.GormDB.Where("name = ? AND organisation_id = ? AND repo_id = ?", request.Name, org.ID, repo.ID).First(&project).Error
-
+	project, err := api.Projects.GetProjectByName(org.ID, repo, request.Name)
 	if err != nil {
-		if errors.Is(err, gorm.ErrRecordNotFound) {
-			project := models.Project{
-				Name:              request.Name,
-				ConfigurationYaml: request.ConfigurationYaml,
-				RepoID:            repo.ID,
-				OrganisationID:    org.ID,
-				Repo:              &repo,
-				Organisation:      org,
-			}
+		log.Printf("Error fetching project: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error fetching project"})
+		return
+	}
 
-			err = models.DB.GormDB.Create(&project).Error
+	if project == nil {
+		project = &models.Project{
+			Name:              request.Name,
+			ConfigurationYaml: request.ConfigurationYaml,
+			RepoID:            repo.ID,
+			OrganisationID:    org.ID,
+			Repo:              repo,
+			Organisation:      org,
+		}
 
-			if err != nil {
-				log.Printf("Error creating project: %v", err)
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "Error creating project"})
-				return
-			}
-			c.JSON(http.StatusOK, project.MapToJsonStruct())
-		} else {
-			log.Printf("Error fetching project: %v", err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error fetching project"})
+		err = api.Projects.SaveProject(project)
+
+		if err != nil {
+			log.Printf("Error creating project: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error creating project"})
 			return
 		}
+		c.JSON(http.StatusOK, project.MapToJsonStruct())
 	}
 }
 
-func RunHistoryForProject(c *gin.Context) {
-	repoName := c.Param("repo")
-	projectName := c.Param("project")
+// getRepoAndProjectFromParams looks up the repo and project of the request in the logged in org
+func (api *ApiController) getRepoAndProjectFromParams(c *gin.Context, repoName string, projectName string) (*models.Project, bool) {
 	orgId, exists := c.Get(middleware.ORGANISATION_ID_KEY)
 
 	if !exists {
 		c.String(http.StatusForbidden, "Not allowed to access this resource")
-		return
+		return nil, false
 	}
 
-	org, err := models.DB.GetOrganisationById(orgId)
+	org, err := api.Orgs.GetOrganisationById(orgId)
 	if err != nil {
 		log.Printf("Error fetching organisation: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error fetching organisation"})
-		return
+		return nil, false
 	}
 
-	var repo models.Repo
-
-	err = models.DB.GormDB.Where("name = ? AND organisation_id = ?", repoName, orgId).First(&repo).Error
-
-	if err != nil {
+	repo, err := api.Repos.GetRepo(org.ID, repoName)
+	if err != nil || repo == nil {
 		log.Printf("Error fetching repo: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error fetching repo"})
-		return
+		return nil, false
 	}
 
-	var project models.Project
+	project, err := api.Projects.GetProjectByName(org.ID, repo, projectName)
+	if err != nil || project == nil {
+		log.Printf("Error fetching project: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error fetching project"})
+		return nil, false
+	}
+	return project, true
+}
 
-	err = models.DB.GormDB.Where("name = ? AND repo_id = ? AND organisation_id", projectName, repo.ID, org.ID).First(&project).Error
+// getOrgFromParams returns the organisation named in the organisation param if it is the one the caller belongs to
+func (api *ApiController) getOrgFromParams(c *gin.Context) (*models.Organisation, bool) {
+	requestedOrganisation := c.Param("organisation")
+	loggedInOrganisation, exists := c.Get(middleware.ORGANISATION_ID_KEY)
 
+	if !exists {
+		c.String(http.StatusForbidden, "Not allowed to access this resource")
+		return nil, false
+	}
+
+	org, err := api.Orgs.GetOrganisationByName(requestedOrganisation)
 	if err != nil {
-		log.Printf("Error fetching project: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error fetching project"})
-		return
+		c.String(http.StatusInternalServerError, "Unknown error occurred while fetching database")
+		return nil, false
+	}
+	if org == nil {
+		c.String(http.StatusNotFound, "Could not find organisation: "+requestedOrganisation)
+		return nil, false
+	}
+
+	if org.ID != loggedInOrganisation {
+		log.Printf("Organisation ID %v does not match logged in organisation ID %v", org.ID, loggedInOrganisation)
+		c.String(http.StatusForbidden, "Not allowed to access this resource")
+		return nil, false
 	}
+	return org, true
+}
 
-	var runHistory []models.ProjectRun
+// RunHistoryForProject returns a page of the runs of the project, filtered and sorted like described in
+// runFilterFromQuery. The total number of matching runs is in the X-Total-Count header and the cursor of the
+// next page in X-Next-Cursor.
+func (api *ApiController) RunHistoryForProject(c *gin.Context) {
+	project, ok := api.getRepoAndProjectFromParams(c, c.Param("repo"), c.Param("projectName"))
+	if !ok {
+		return
+	}
 
-	err = models.DB.GormDB.Where("project_id = ?", project.ID).Find(&runHistory).Error
+	filter, err := runFilterFromQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	filter.ProjectID = project.ID
 
+	page, err := api.Runs.FindProjectRuns(filter)
+	if errors.Is(err, models.ErrInvalidRunCursor) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 	if err != nil {
 		log.Printf("Error fetching run history: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error fetching run history"})
@@ -238,19 +232,178 @@ func RunHistoryForProject(c *gin.Context) {
 
 	response := make([]interface{}, 0)
 
-	for _, r := range runHistory {
+	for _, r := range page.Runs {
 		response = append(response, r.MapToJsonStruct())
 	}
 
+	c.Header("X-Total-Count", strconv.FormatInt(page.Total, 10))
+	if page.NextCursor != "" {
+		c.Header("X-Next-Cursor", page.NextCursor)
+	}
 	c.JSON(http.StatusOK, response)
 }
 
+// runFilterFromQuery reads the run filter from the query parameters status, command, pr, repo, project, job,
+// batch, commit (a prefix of the sha), actor, from and to (dates or RFC 3339 times the runs started in),
+// sort (created_at, started_at or ended_at), order (asc or desc), cursor and limit
+func runFilterFromQuery(c *gin.Context) (models.RunFilter, error) {
+	filter := models.RunFilter{
+		Status:      c.Query("status"),
+		Command:     c.Query("command"),
+		RepoName:    c.Query("repo"),
+		ProjectName: c.Query("project"),
+		DiggerJobId: c.Query("job"),
+		BatchId:     c.Query("batch"),
+		CommitSha:   c.Query("commit"),
+		Actor:       c.Query("actor"),
+		Cursor:      c.Query("cursor"),
+	}
+	var err error
+	if pr := c.Query("pr"); pr != "" {
+		filter.PullRequestNumber, err = strconv.Atoi(pr)
+		if err != nil {
+			return filter, fmt.Errorf("invalid pr %v", pr)
+		}
+	}
+	if limit := c.Query("limit"); limit != "" {
+		filter.Limit, err = strconv.Atoi(limit)
+		if err != nil {
+			return filter, fmt.Errorf("invalid limit %v", limit)
+		}
+	}
+	if from := c.Query("from"); from != "" {
+		filter.StartedAfter, err = parseFilterTime(from, false)
+		if err != nil {
+			return filter, fmt.Errorf("invalid from %v", from)
+		}
+	}
+	if to := c.Query("to"); to != "" {
+		// a date includes the whole day
+		filter.StartedBefore, err = parseFilterTime(to, true)
+		if err != nil {
+			return filter, fmt.Errorf("invalid to %v", to)
+		}
+	}
+
+	switch sortBy := c.Query("sort"); sortBy {
+	case "", models.RunSortCreatedAt, models.RunSortStartedAt, models.RunSortEndedAt:
+		filter.SortBy = sortBy
+	default:
+		return filter, fmt.Errorf("invalid sort %v, expected created_at, started_at or ended_at", sortBy)
+	}
+	switch order := c.Query("order"); order {
+	case "", "desc":
+	case "asc":
+		filter.Ascending = true
+	default:
+		return filter, fmt.Errorf("invalid order %v, expected asc or desc", order)
+	}
+	return filter, nil
+}
+
+// parseFilterTime accepts RFC3339 timestamps and plain dates as sent by html date inputs. A plain date ending a
+// range covers the whole day, the range ends at midnight after it.
+func parseFilterTime(value string, endOfDay bool) (time.Time, error) {
+	date, err := time.Parse(time.DateOnly, value)
+	if err == nil {
+		if endOfDay {
+			return date.AddDate(0, 0, 1), nil
+		}
+		return date, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+func (api *ApiController) RunDetailsForProject(c *gin.Context) {
+	project, ok := api.getRepoAndProjectFromParams(c, c.Param("repo"), c.Param("projectName"))
+	if !ok {
+		return
+	}
+
+	run, ok := api.getRunFromParams(c, project)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, run.MapToJsonStruct())
+}
+
+type UpdateProjectRunStatusRequest struct {
+	Status  string    `json:"status"`
+	EndedAt time.Time `json:"endedAt"`
+}
+
+// UpdateRunStatusForProject sets the final status of a run reported with the running status, which ends live log tails
+func (api *ApiController) UpdateRunStatusForProject(c *gin.Context) {
+	var request UpdateProjectRunStatusRequest
+	err := c.BindJSON(&request)
+	if err != nil {
+		log.Printf("Error binding JSON: %v", err)
+		return
+	}
+	if request.Status == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "status is required"})
+		return
+	}
+
+	project, ok := api.getRepoAndProjectFromParams(c, c.Param("repo"), c.Param("projectName"))
+	if !ok {
+		return
+	}
+	run, ok := api.getRunFromParams(c, project)
+	if !ok {
+		return
+	}
+
+	endedAt := run.EndedAt
+	if !request.EndedAt.IsZero() {
+		endedAt = request.EndedAt.UnixMilli()
+	}
+	err = api.Runs.UpdateProjectRunStatus(run.ID, request.Status, endedAt)
+	if err != nil {
+		log.Printf("Error updating run: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error updating run"})
+		return
+	}
+	run.Status = request.Status
+	run.EndedAt = endedAt
+	// the log is complete now
+	if !run.IsRunning() {
+		api.indexRunForSearch(run)
+		api.completeDriftReport(project, run)
+	}
+	c.JSON(http.StatusOK, run.MapToJsonStruct())
+}
+
+// getRunFromParams returns the run with the id in the runId param if it belongs to the project
+func (api *ApiController) getRunFromParams(c *gin.Context, project *models.Project) (*models.ProjectRun, bool) {
+	runId, err := strconv.ParseUint(c.Param("runId"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid run id"})
+		return nil, false
+	}
+
+	run, err := api.Runs.GetProjectRun(uint(runId))
+	if err != nil {
+		log.Printf("Error fetching run: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error fetching run"})
+		return nil, false
+	}
+	if run == nil || run.ProjectID != project.ID {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Run not found"})
+		return nil, false
+	}
+	return run, true
+}
+
 type SetJobStatusRequest struct {
 	Status    string    `json:"status"`
 	Timestamp time.Time `json:"timestamp"`
+	// WorkflowRunId is the id of the GitHub Actions run the job runs in, GITHUB_RUN_ID
+	WorkflowRunId int64 `json:"workflowRunId"`
 }
 
-func SetJobStatusForProject(c *gin.Context) {
+func (api *ApiController) SetJobStatusForProject(c *gin.Context) {
 	jobId := c.Param("jobId")
 
 	orgId, exists := c.Get(middleware.ORGANISATION_ID_KEY)
@@ -260,6 +413,17 @@ func SetJobStatusForProject(c *gin.Context) {
 		return
 	}
 
+	if c.GetString(middleware.JOB_REPOSITORY_KEY) != "" {
+		project, ok := api.getRepoAndProjectFromParams(c, c.Param("repo"), c.Param("projectName"))
+		if !ok {
+			return
+		}
+		_, _, ok = api.jobForProject(c, project, jobId)
+		if !ok {
+			return
+		}
+	}
+
 	var request SetJobStatusRequest
 
 	err := c.BindJSON(&request)
@@ -270,7 +434,7 @@ func SetJobStatusForProject(c *gin.Context) {
 		return
 	}
 
-	job, err := models.DB.GetDiggerJob(jobId)
+	job, err := api.Jobs.GetDiggerJob(jobId)
 
 	if err != nil {
 		log.Printf("Error fetching job: %v", err)
@@ -278,39 +442,39 @@ func SetJobStatusForProject(c *gin.Context) {
 		return
 	}
 
+	oldStatus := job.Status
 	switch request.Status {
 	case "started":
 		job.Status = models.DiggerJobStarted
 	case "succeeded":
 		job.Status = models.DiggerJobSucceeded
+		organisationId := c.GetUint(middleware.ORGANISATION_ID_KEY)
+		jobs := services.JobTransitions{Stores: api.Stores, OrgId: organisationId, Actor: c.GetString(middleware.ACTOR_KEY)}
 		go func() {
 			defer func() {
 				if r := recover(); r != nil {
 					log.Printf("Recovered from panic while executing goroutine dispatching digger jobs: %v ", r)
 				}
 			}()
-			ghClientProvider := &utils.DiggerGithubRealClientProvider{}
-			installationLink, err := models.DB.GetGithubInstallationLinkForOrg(orgId)
+			jobLink, err := api.Jobs.GetDiggerJobLink(jobId)
+
 			if err != nil {
-				log.Printf("Error fetching installation link: %v", err)
+				log.Printf("Error fetching job link: %v", err)
 				return
 			}
-
-			installations, err := models.DB.GetGithubAppInstallations(installationLink.GithubInstallationId)
-			if err != nil {
-				log.Printf("Error fetching installation: %v", err)
+			if jobLink == nil {
+				log.Printf("No job link found for job %v", jobId)
 				return
 			}
 
-			if len(installations) == 0 {
-				log.Printf("No installations found for installation id %v", installationLink.GithubInstallationId)
+			installation, err := api.Github.GetGithubAppInstallationByOrgAndRepo(orgId, jobLink.RepoFullName, models.GithubAppInstallActive)
+			if err != nil {
+				log.Printf("Error fetching installation: %v", err)
 				return
 			}
 
-			jobLink, err := models.DB.GetDiggerJobLink(jobId)
-
-			if err != nil {
-				log.Printf("Error fetching job link: %v", err)
+			if installation == nil {
+				log.Printf("No installation found for repo %v", jobLink.RepoFullName)
 				return
 			}
 
@@ -322,8 +486,12 @@ func SetJobStatusForProject(c *gin.Context) {
 			}
 
 			repoFullNameSplit := strings.Split(jobLink.RepoFullName, "/")
-			client, _, err := ghClientProvider.Get(installations[0].GithubAppId, installationLink.GithubInstallationId)
-			err = services.DiggerJobCompleted(client, job, repoFullNameSplit[0], repoFullNameSplit[1], workflowFileName)
+			client, _, err := api.githubClientProvider().Get(installation.GithubAppId, installation.GithubInstallationId)
+			if err != nil {
+				log.Printf("Error creating github client: %v", err)
+				return
+			}
+			err = services.DiggerJobCompleted(jobs, client, job, repoFullNameSplit[0], repoFullNameSplit[1], workflowFileName)
 			if err != nil {
 				log.Printf("Error triggering job: %v", err)
 				return
@@ -339,12 +507,23 @@ func SetJobStatusForProject(c *gin.Context) {
 	}
 	job.StatusUpdatedAt = request.Timestamp
 
-	err = models.DB.GormDB.Save(&job).Error
+	if request.WorkflowRunId != 0 {
+		err = api.Jobs.SetDiggerJobLinkWorkflowRun(jobId, request.WorkflowRunId)
+		if err != nil {
+			log.Printf("Error saving workflow run of job: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error saving job"})
+			return
+		}
+	}
+
+	err = api.Jobs.UpdateDiggerJob(job)
 	if err != nil {
 		log.Printf("Error saving update job: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error saving job"})
 		return
 	}
+	recordAuditEvent(api.Audit, c, c.GetUint(middleware.ORGANISATION_ID_KEY), models.AuditActionJobStatusUpdated, "job", job.DiggerJobId,
+		gin.H{"status": oldStatus}, gin.H{"status": job.Status})
 }
 
 type CreateProjectRunRequest struct {
@@ -353,72 +532,123 @@ type CreateProjectRunRequest struct {
 	Status    string    `json:"status"`
 	Command   string    `json:"command"`
 	Output    string    `json:"output"`
+	// JobId links the run to the digger job it ran for, the pull request, commit, actor and workflow run are taken from the job
+	JobId string `json:"jobId"`
+	// PullRequestNumber is the pull request the run belongs to, 0 for runs of pushes to the default branch
+	PullRequestNumber int `json:"pullRequestNumber"`
+	// PlanJson is the output of `terraform show -json` for the plan of the run
+	PlanJson json.RawMessage `json:"planJson"`
 }
 
-func CreateRunForProject(c *gin.Context) {
-	repoName := c.Param("repo")
-	projectName := c.Param("projectName")
-	orgId, exists := c.Get(middleware.ORGANISATION_ID_KEY)
-
-	if !exists {
-		c.String(http.StatusForbidden, "Not allowed to access this resource")
-		return
-	}
-
-	org, err := models.DB.GetOrganisationById(orgId)
-	if err != nil {
-		log.Printf("Error fetching organisation: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error fetching organisation"})
+func (api *ApiController) CreateRunForProject(c *gin.Context) {
+	project, ok := api.getRepoAndProjectFromParams(c, c.Param("repo"), c.Param("projectName"))
+	if !ok {
 		return
 	}
 
-	var repo models.Repo
+	var request CreateProjectRunRequest
 
-	err = models.DB.GormDB.Where("name = ? AND organisation_id = ?", repoName, orgId).First(&repo).Error
+	err := c.BindJSON(&request)
 
 	if err != nil {
-		log.Printf("Error fetching repo: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error fetching repo"})
+		log.Printf("Error binding JSON: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error binding JSON"})
 		return
 	}
 
-	var project models.Project
+	run := models.ProjectRun{
+		PullRequestNumber: request.PullRequestNumber,
+		StartedAt:         request.StartedAt.UnixMilli(),
+		EndedAt:           request.EndedAt.UnixMilli(),
+		Status:            request.Status,
+		Command:           request.Command,
+		ProjectID:         project.ID,
+		Project:           project,
+	}
+
+	if request.JobId != "" {
+		ok = api.linkRunToJob(c, project, &run, request.JobId)
+		if !ok {
+			return
+		}
+	}
+
+	if len(request.PlanJson) > 0 && string(request.PlanJson) != "null" {
+		changes, err := services.ParseTerraformPlanJson(request.PlanJson)
+		if err != nil {
+			log.Printf("Error parsing plan: %v", err)
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid planJson: %v", err)})
+			return
+		}
+		run.SetResourceChanges(changes)
+	}
 
-	err = models.DB.GormDB.Where("name = ? AND repo_id = ? AND organisation_id = ?", projectName, repo.ID, org.ID).First(&project).Error
+	err = api.Runs.CreateProjectRun(&run)
 
 	if err != nil {
-		log.Printf("Error fetching project: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error fetching project"})
+		log.Printf("Error creating run: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error creating run"})
 		return
 	}
 
-	var request CreateProjectRunRequest
+	// output sent with the run becomes the start of its log, longer logs are appended through the logs endpoint
+	if request.Output != "" {
+		run.LogSize, err = services.AppendRunLog(api.RunLogs, api.Blobs, run.ID, 0, strings.NewReader(request.Output))
+		if err != nil {
+			log.Printf("Error storing run output: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error storing run output"})
+			return
+		}
+	}
 
-	err = c.BindJSON(&request)
+	api.indexRunForSearch(&run)
+	api.completeDriftReport(project, &run)
+	c.JSON(http.StatusOK, run.MapToJsonStruct())
+}
 
+// indexRunForSearch keeps the search up to date, a failure only makes the run harder to find so it doesn't fail the request
+func (api *ApiController) indexRunForSearch(run *models.ProjectRun) {
+	err := services.IndexRunForSearch(api.Search, api.RunLogs, api.Blobs, run)
 	if err != nil {
-		log.Printf("Error binding JSON: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error binding JSON"})
-		return
+		log.Printf("Error indexing run %v for search: %v", run.ID, err)
 	}
+}
 
-	run := models.ProjectRun{
-		StartedAt: request.StartedAt.UnixMilli(),
-		EndedAt:   request.EndedAt.UnixMilli(),
-		Status:    request.Status,
-		Command:   request.Command,
-		Output:    request.Output,
-		ProjectID: project.ID,
-		Project:   &project,
+// linkRunToJob sets the job of the run and what it was triggered by: the batch, pull request and commit the job
+// was created for, the user who requested it and the workflow run it ran in
+func (api *ApiController) linkRunToJob(c *gin.Context, project *models.Project, run *models.ProjectRun, jobId string) bool {
+	job, jobJson, ok := api.jobForProject(c, project, jobId)
+	if !ok {
+		return false
+	}
+	run.DiggerJobId = job.DiggerJobId
+	run.BatchId = job.BatchId.String()
+	run.CommitSha = job.CommitSha
+	run.Actor = jobJson.RequestedBy
+	if prNumber := jobPullRequestNumber(jobJson); prNumber != 0 {
+		run.PullRequestNumber = prNumber
 	}
 
-	err = models.DB.GormDB.Create(&run).Error
-
+	link, err := api.Jobs.GetDiggerJobLink(job.DiggerJobId)
 	if err != nil {
-		log.Printf("Error creating run: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error creating run"})
-		return
+		log.Printf("Error fetching job link: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error fetching job"})
+		return false
 	}
-
-	c.JSON(http.StatusOK, run.MapToJsonStruct())
+	if link != nil && link.GithubWorkflowRunId != 0 {
+		repo, err := api.Repos.GetRepo(c.GetUint(middleware.ORGANISATION_ID_KEY), c.Param("repo"))
+		if err != nil {
+			log.Printf("Error fetching repo: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error fetching repo"})
+			return false
+		}
+		webUrl, err := api.githubWebUrl(c.GetUint(middleware.ORGANISATION_ID_KEY), repo)
+		if err != nil {
+			// the run is still worth keeping without the link to its workflow
+			log.Printf("Error finding the GitHub host of %v: %v", link.RepoFullName, err)
+		} else {
+			run.WorkflowRunUrl = fmt.Sprintf("%v/%v/actions/runs/%v", webUrl, link.RepoFullName, link.GithubWorkflowRunId)
+		}
+	}
+	return true
 }
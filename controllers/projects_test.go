@@ -0,0 +1,229 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"digger.dev/cloud/middleware"
+	"digger.dev/cloud/models"
+	"digger.dev/cloud/services"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func setupApiWithMemoryStore(t *testing.T) (*gin.Engine, *models.MemoryStore, *models.Organisation) {
+	store := models.NewMemoryStore()
+	org, err := store.CreateOrganisation("memoryOrg", "test", "memoryOrg")
+	assert.NoError(t, err)
+
+	blobs, err := services.NewFilesystemBlobStore(t.TempDir())
+	assert.NoError(t, err)
+	api := ApiController{Stores: store.Stores(), Blobs: blobs}
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(func(c *gin.Context) {
+		c.Set(middleware.ORGANISATION_ID_KEY, org.ID)
+		c.Set(middleware.ACTOR_KEY, "test")
+	})
+	r.POST("/repos/:repo/report-projects", api.ReportProjectsForRepo)
+	r.GET("/repos/:repo/projects", api.FindProjectsForRepo)
+	r.POST("/repos/:repo/projects/:projectName/runs", api.CreateRunForProject)
+	r.GET("/repos/:repo/projects/:projectName/runs", api.RunHistoryForProject)
+	r.GET("/repos/:repo/projects/:projectName/runs/:runId", api.RunDetailsForProject)
+	r.GET("/repos/:repo/projects/:projectName/runs/:runId/logs", api.GetRunLog)
+	r.POST("/repos/:repo/projects/:projectName/runs/:runId/logs", api.AppendRunLog)
+	r.POST("/repos/:repo/projects/:projectName/runs/:runId/status", api.UpdateRunStatusForProject)
+	r.PUT("/repos/:repo/projects/:projectName/plan-policy", api.UpsertPlanPolicyForRepoAndProject)
+	r.GET("/repos/:repo/projects/:projectName/plan-policy", api.FindPlanPolicy)
+	r.GET("/repos/:repo/projects/:projectName/variables", api.FindVariablesForProject)
+	r.PUT("/repos/:repo/projects/:projectName/variables/:name", api.SetVariableForProject)
+	r.DELETE("/repos/:repo/projects/:projectName/variables/:name", api.DeleteVariableForProject)
+	r.POST("/repos/:repo/projects/:projectName/jobs/:jobId/set-status", api.SetJobStatusForProject)
+	r.PUT("/repos/:repo/projects/:projectName/jobs/:jobId/plan-artifact", api.UploadPlanArtifact)
+	r.GET("/repos/:repo/projects/:projectName/jobs/:jobId/plan-artifact", api.DownloadPlanArtifact)
+	r.GET("/orgs/:organisation/runs/search", api.SearchRunsForOrg)
+	r.GET("/orgs/:organisation/audit-events", api.FindAuditEventsForOrg)
+	r.GET("/repos/:repo/projects/:projectName/drift-schedule", api.FindDriftScheduleForProject)
+	r.PUT("/repos/:repo/projects/:projectName/drift-schedule", api.SetDriftScheduleForProject)
+	r.PUT("/repos/:repo/projects/:projectName/drift-policy", api.UpsertDriftPolicyForRepoAndProject)
+	r.GET("/repos/:repo/projects/:projectName/drift-reports", api.FindDriftReportsForProject)
+	r.GET("/orgs/:organisation/drift", api.FindDriftForOrg)
+	r.PUT("/repos/:repo/projects/:projectName/drift-alert-policy", api.UpsertDriftAlertPolicyForRepoAndProject)
+	r.PUT("/repos/:repo/projects/:projectName/approval-policy", api.UpsertApprovalPolicyForRepoAndProject)
+	r.POST("/create-org-from-frontegg", api.CreateFronteggOrgFromWebhook)
+	return r, store, org
+}
+
+func doRequest(r *gin.Engine, method string, path string, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(method, path, strings.NewReader(body))
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestReportProjectsAndRuns(t *testing.T) {
+	r, _, _ := setupApiWithMemoryStore(t)
+
+	w := doRequest(r, "POST", "/repos/infra/report-projects", `{"name": "prod"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = doRequest(r, "GET", "/repos/infra/projects", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var projects []map[string]interface{}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &projects))
+	assert.Equal(t, 1, len(projects))
+	assert.Equal(t, "prod", projects[0]["name"])
+	assert.Equal(t, "infra", projects[0]["repoName"])
+	assert.Equal(t, "memoryOrg", projects[0]["organisationName"])
+
+	w = doRequest(r, "POST", "/repos/infra/projects/prod/runs", `{"status": "succeeded", "command": "digger plan"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = doRequest(r, "GET", "/repos/infra/projects/prod/runs", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var runs []map[string]interface{}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &runs))
+	assert.Equal(t, 1, len(runs))
+
+	w = doRequest(r, "POST", "/repos/infra/projects/prod/runs", `{"status": "failed", "command": "digger apply", "pullRequestNumber": 12}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = doRequest(r, "POST", "/repos/infra/projects/prod/runs", `{"status": "succeeded", "command": "digger apply", "pullRequestNumber": 12}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = doRequest(r, "GET", "/repos/infra/projects/prod/runs?pr=12&limit=1", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "2", w.Header().Get("X-Total-Count"))
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &runs))
+	assert.Equal(t, 1, len(runs))
+	assert.Equal(t, "succeeded", runs[0]["Status"])
+	assert.Equal(t, 12.0, runs[0]["PullRequestNumber"])
+	w = doRequest(r, "GET", "/repos/infra/projects/prod/runs?pr=12&limit=1&cursor="+w.Header().Get("X-Next-Cursor"), "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "", w.Header().Get("X-Next-Cursor"))
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &runs))
+	assert.Equal(t, "failed", runs[0]["Status"])
+
+	w = doRequest(r, "GET", "/repos/infra/projects/prod/runs?status=succeeded&order=asc", "")
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &runs))
+	assert.Equal(t, 2, len(runs))
+	assert.Equal(t, "digger plan", runs[0]["Command"])
+
+	w = doRequest(r, "GET", "/repos/infra/projects/prod/runs?sort=status", "")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = doRequest(r, "GET", "/repos/infra/projects/prod/runs?cursor=broken", "")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = doRequest(r, "GET", "/repos/unknown/projects/prod/runs", "")
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+}
+
+func TestRunWithStructuredPlan(t *testing.T) {
+	r, _, _ := setupApiWithMemoryStore(t)
+
+	w := doRequest(r, "POST", "/repos/infra/report-projects", `{"name": "prod"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = doRequest(r, "POST", "/repos/infra/projects/prod/runs", `{"status": "succeeded", "command": "digger plan", "planJson": {"resource_changes": []}}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	plan := `{
+		"format_version": "1.2",
+		"resource_changes": [
+			{"address": "aws_s3_bucket.logs", "mode": "managed", "type": "aws_s3_bucket", "name": "logs", "change": {"actions": ["create"]}},
+			{"address": "aws_instance.web", "mode": "managed", "type": "aws_instance", "name": "web", "change": {"actions": ["delete", "create"]}},
+			{"address": "module.vpc.aws_vpc.main", "module_address": "module.vpc", "mode": "managed", "type": "aws_vpc", "name": "main", "change": {"actions": ["update"]}},
+			{"address": "aws_iam_role.ci", "mode": "managed", "type": "aws_iam_role", "name": "ci", "change": {"actions": ["no-op"]}}
+		]
+	}`
+	w = doRequest(r, "POST", "/repos/infra/projects/prod/runs", `{"status": "succeeded", "command": "digger plan", "planJson": `+plan+`}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var run map[string]interface{}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &run))
+	assert.Equal(t, map[string]interface{}{"Create": 1.0, "Update": 1.0, "Delete": 0.0, "Replace": 1.0}, run["PlanSummary"])
+
+	w = doRequest(r, "GET", "/repos/infra/projects/prod/runs/"+strconv.Itoa(int(run["Id"].(float64))), "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var details struct {
+		ResourceChanges []struct {
+			Address       string
+			ModuleAddress string
+			Action        string
+			Actions       []string
+		}
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &details))
+	assert.Equal(t, 3, len(details.ResourceChanges))
+	assert.Equal(t, "aws_instance.web", details.ResourceChanges[1].Address)
+	assert.Equal(t, models.ResourceActionReplace, details.ResourceChanges[1].Action)
+	assert.Equal(t, []string{"delete", "create"}, details.ResourceChanges[1].Actions)
+	assert.Equal(t, "module.vpc", details.ResourceChanges[2].ModuleAddress)
+
+	w = doRequest(r, "GET", "/repos/infra/projects/prod/runs/12345", "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestRunLinkedToJob(t *testing.T) {
+	r, store, _ := setupApiWithMemoryStore(t)
+
+	w := doRequest(r, "POST", "/repos/infra/report-projects", `{"name": "prod"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	batchId := uuid.New()
+	serializedJob, _ := json.Marshal(map[string]interface{}{"projectName": "prod", "commands": []string{"digger plan"}, "pullRequestNumber": 7, "requestedBy": "alice"})
+	assert.NoError(t, store.UpdateDiggerJob(&models.DiggerJob{DiggerJobId: "plan-job", BatchId: batchId, CommitSha: "0123456789abcdef", SerializedJob: serializedJob}))
+	_, err := store.CreateDiggerJobLink("plan-job", "acme/infra")
+	assert.NoError(t, err)
+
+	w = doRequest(r, "POST", "/repos/infra/projects/prod/jobs/plan-job/set-status", `{"status": "started", "workflowRunId": 4242}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = doRequest(r, "POST", "/repos/infra/projects/prod/runs", `{"status": "succeeded", "command": "digger plan", "jobId": "plan-job"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var run map[string]interface{}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &run))
+	assert.Equal(t, "plan-job", run["DiggerJobId"])
+	assert.Equal(t, batchId.String(), run["BatchId"])
+	assert.Equal(t, "0123456789abcdef", run["CommitSha"])
+	assert.Equal(t, "alice", run["Actor"])
+	assert.Equal(t, 7.0, run["PullRequestNumber"])
+	assert.Equal(t, "https://github.com/acme/infra/actions/runs/4242", run["WorkflowRunUrl"])
+
+	w = doRequest(r, "POST", "/repos/infra/projects/prod/runs", `{"status": "succeeded", "command": "digger plan"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = doRequest(r, "POST", "/repos/infra/projects/prod/runs", `{"status": "succeeded", "command": "digger plan", "jobId": "unknown-job"}`)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	for _, query := range []string{"commit=0123456", "actor=alice", "batch=" + batchId.String(), "job=plan-job"} {
+		w = doRequest(r, "GET", "/repos/infra/projects/prod/runs?"+query, "")
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "1", w.Header().Get("X-Total-Count"), query)
+	}
+}
+
+func TestJobTokenOnlyUpdatesJobsOfItsRepository(t *testing.T) {
+	r, store, org := setupApiWithMemoryStore(t)
+
+	w := doRequest(r, "POST", "/repos/acme-infra/report-projects", `{"name": "prod"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	for jobId, namespace := range map[string]string{"own-job": "acme/infra", "other-job": "acme/other"} {
+		serializedJob, _ := json.Marshal(map[string]interface{}{"projectName": "prod", "namespace": namespace, "commands": []string{"digger plan"}})
+		assert.NoError(t, store.UpdateDiggerJob(&models.DiggerJob{DiggerJobId: jobId, SerializedJob: serializedJob}))
+	}
+
+	api := ApiController{Stores: store.Stores()}
+	jobRouter := gin.New()
+	jobRouter.Use(func(c *gin.Context) {
+		c.Set(middleware.ORGANISATION_ID_KEY, org.ID)
+		c.Set(middleware.JOB_REPOSITORY_KEY, "acme/infra")
+	})
+	jobRouter.POST("/repos/:repo/projects/:projectName/jobs/:jobId/set-status", api.SetJobStatusForProject)
+
+	w = doRequest(jobRouter, "POST", "/repos/acme-infra/projects/prod/jobs/other-job/set-status", `{"status": "failed"}`)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = doRequest(jobRouter, "POST", "/repos/acme-infra/projects/prod/jobs/own-job/set-status", `{"status": "failed"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+}
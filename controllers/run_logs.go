@@ -0,0 +1,131 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+
+	"digger.dev/cloud/models"
+	"digger.dev/cloud/services"
+	"github.com/gin-gonic/gin"
+)
+
+// only single ranges are supported, which is what log viewers and resumed downloads use
+var byteRangeRegex = regexp.MustCompile(`^bytes=(\d*)-(\d*)$`)
+
+// AppendRunLog appends the body to the log of the run, offset has to be the size of the log uploaded so far.
+// On a mismatch, e.g. a retried chunk, it responds with 409 and the current size to continue from.
+func (api *ApiController) AppendRunLog(c *gin.Context) {
+	offset, err := strconv.ParseInt(c.Query("offset"), 10, 64)
+	if err != nil || offset < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "offset is required"})
+		return
+	}
+
+	project, ok := api.getRepoAndProjectFromParams(c, c.Param("repo"), c.Param("projectName"))
+	if !ok {
+		return
+	}
+	run, ok := api.getRunFromParams(c, project)
+	if !ok {
+		return
+	}
+
+	body := http.MaxBytesReader(c.Writer, c.Request.Body, services.MaxRunLogChunkBytes)
+	size, err := services.AppendRunLog(api.RunLogs, api.Blobs, run.ID, offset, body)
+	if err != nil {
+		var maxBytesError *http.MaxBytesError
+		switch {
+		case errors.Is(err, models.ErrRunLogOffsetMismatch):
+			c.JSON(http.StatusConflict, gin.H{"error": "offset doesn't match the size of the log", "size": size})
+		case errors.As(err, &maxBytesError):
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("Chunks can't be larger than %v bytes", services.MaxRunLogChunkBytes)})
+		default:
+			log.Printf("Error appending run log: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error appending run log"})
+		}
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"size": size})
+}
+
+// GetRunLog returns the log of the run, a Range header returns a part of it
+func (api *ApiController) GetRunLog(c *gin.Context) {
+	project, ok := api.getRepoAndProjectFromParams(c, c.Param("repo"), c.Param("projectName"))
+	if !ok {
+		return
+	}
+	run, ok := api.getRunFromParams(c, project)
+	if !ok {
+		return
+	}
+	if run.LogExpired {
+		c.JSON(http.StatusGone, gin.H{"error": "The log of this run expired"})
+		return
+	}
+
+	size := run.LogSize
+	if size == 0 {
+		size = int64(len(run.Output))
+	}
+	status := http.StatusOK
+	start, end := int64(0), size-1
+	headers := map[string]string{"Accept-Ranges": "bytes"}
+
+	if rangeHeader := c.GetHeader("Range"); rangeHeader != "" {
+		var satisfiable bool
+		start, end, satisfiable = parseByteRange(rangeHeader, size)
+		if !satisfiable {
+			c.Header("Content-Range", fmt.Sprintf("bytes */%v", size))
+			c.Status(http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		status = http.StatusPartialContent
+		headers["Content-Range"] = fmt.Sprintf("bytes %v-%v/%v", start, end, size)
+	}
+
+	length := end - start + 1
+	content, err := services.OpenRunLog(api.RunLogs, api.Blobs, run, start, length)
+	if err != nil {
+		log.Printf("Error reading run log: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error reading run log"})
+		return
+	}
+	defer content.Close()
+	c.DataFromReader(status, length, "text/plain; charset=utf-8", io.LimitReader(content, length), headers)
+}
+
+// parseByteRange returns the first and last byte of a single range of a log with size bytes
+func parseByteRange(header string, size int64) (int64, int64, bool) {
+	match := byteRangeRegex.FindStringSubmatch(header)
+	if match == nil || (match[1] == "" && match[2] == "") {
+		return 0, 0, false
+	}
+	if match[1] == "" {
+		// the last n bytes
+		suffix, _ := strconv.ParseInt(match[2], 10, 64)
+		if suffix == 0 || size == 0 {
+			return 0, 0, false
+		}
+		if suffix > size {
+			suffix = size
+		}
+		return size - suffix, size - 1, true
+	}
+	start, _ := strconv.ParseInt(match[1], 10, 64)
+	end := size - 1
+	if match[2] != "" {
+		end, _ = strconv.ParseInt(match[2], 10, 64)
+		if end > size-1 {
+			end = size - 1
+		}
+	}
+	if start >= size || start > end {
+		return 0, 0, false
+	}
+	return start, end, true
+}
@@ -0,0 +1,63 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunLogs(t *testing.T) {
+	r, _, _ := setupApiWithMemoryStore(t)
+
+	w := doRequest(r, "POST", "/repos/infra/report-projects", `{"name": "prod"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = doRequest(r, "POST", "/repos/infra/projects/prod/runs", `{"status": "running", "command": "digger plan", "output": "Initializing...\n"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var run map[string]interface{}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &run))
+	assert.Equal(t, "", run["Output"])
+	assert.Equal(t, 16.0, run["LogSize"])
+	logsPath := "/repos/infra/projects/prod/runs/" + strconv.Itoa(int(run["Id"].(float64))) + "/logs"
+
+	w = doRequest(r, "POST", logsPath+"?offset=0", "Initializing...\n")
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.JSONEq(t, `{"error": "offset doesn't match the size of the log", "size": 16}`, w.Body.String())
+	w = doRequest(r, "POST", logsPath+"?offset=16", "Plan: 1 to add\n")
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = doRequest(r, "GET", logsPath, "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "Initializing...\nPlan: 1 to add\n", w.Body.String())
+
+	req, _ := http.NewRequest("GET", logsPath, nil)
+	req.Header.Set("Range", "bytes=16-19")
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusPartialContent, w.Code)
+	assert.Equal(t, "bytes 16-19/31", w.Header().Get("Content-Range"))
+	assert.Equal(t, "Plan", w.Body.String())
+
+	req.Header.Set("Range", "bytes=-7")
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusPartialContent, w.Code)
+	assert.Equal(t, "to add\n", w.Body.String())
+
+	req.Header.Set("Range", "bytes=40-")
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusRequestedRangeNotSatisfiable, w.Code)
+
+	statusPath := strings.TrimSuffix(logsPath, "/logs") + "/status"
+	w = doRequest(r, "POST", statusPath, `{}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = doRequest(r, "POST", statusPath, `{"status": "success", "endedAt": "2024-01-02T03:04:05Z"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &run))
+	assert.Equal(t, "success", run["Status"])
+}
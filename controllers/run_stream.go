@@ -0,0 +1,157 @@
+package controllers
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"digger.dev/cloud/models"
+	"digger.dev/cloud/services"
+	"github.com/gin-contrib/sse"
+	"github.com/gin-gonic/gin"
+	"github.com/robert-nix/ansihtml"
+)
+
+// how often a tail checks for new log chunks, runs are read from the database so every replica can serve tails
+const runLogPollInterval = time.Second
+
+// the largest part of the log sent in one event
+const maxRunLogEventBytes = 256 * 1024
+
+var sgrRegex = regexp.MustCompile("\x1b\\[[0-9;]*m")
+
+// terraformOutputHtml converts terraform output with ANSI colors to the HTML shown on the run page
+func terraformOutputHtml(output []byte) string {
+	html := string(ansihtml.ConvertToHTMLWithClasses(output, "terraform-output-", true))
+	html = strings.Replace(html, "  ", "&nbsp;&nbsp;", -1)
+	html = strings.Replace(html, "\n", "<br>\n", -1)
+	return html
+}
+
+// ansiStreamConverter converts a log to HTML as it arrives. Only complete lines are converted, so escape
+// sequences and characters are never split, and the color of the previous part carries over to the next.
+type ansiStreamConverter struct {
+	pending []byte
+	sgr     []byte
+}
+
+// Write returns the HTML of the lines completed by data
+func (a *ansiStreamConverter) Write(data []byte) string {
+	a.pending = append(a.pending, data...)
+	end := bytes.LastIndexByte(a.pending, '\n')
+	if end == -1 {
+		return ""
+	}
+	lines := a.pending[:end+1]
+	a.pending = append([]byte{}, a.pending[end+1:]...)
+	return a.convert(lines)
+}
+
+// Flush converts the last line, which doesn't end with a newline
+func (a *ansiStreamConverter) Flush() string {
+	if len(a.pending) == 0 {
+		return ""
+	}
+	lines := a.pending
+	a.pending = nil
+	return a.convert(lines)
+}
+
+func (a *ansiStreamConverter) convert(lines []byte) string {
+	html := terraformOutputHtml(append(append([]byte{}, a.sgr...), lines...))
+	sequences := sgrRegex.FindAll(lines, -1)
+	if len(sequences) > 0 {
+		last := sequences[len(sequences)-1]
+		if string(last) == "\x1b[0m" || string(last) == "\x1b[m" {
+			a.sgr = nil
+		} else {
+			a.sgr = last
+		}
+	}
+	return html
+}
+
+// RunLogStream tails the log of a run as Server-Sent Events: "log" events carry HTML of new lines and "end"
+// is sent once the run finished and everything was sent. Event ids are log offsets, so reconnecting clients
+// continue where they left off.
+func (web *WebController) RunLogStream(c *gin.Context) {
+	runId64, err := strconv.ParseUint(c.Param("runid"), 10, 32)
+	if err != nil {
+		c.String(http.StatusBadRequest, "Failed to parse project run id")
+		return
+	}
+	run, ok := web.runOfOrg(c, uint(runId64))
+	if !ok {
+		return
+	}
+	web.streamRunLog(c, run, runLogPollInterval)
+}
+
+func (web *WebController) streamRunLog(c *gin.Context, run *models.ProjectRun, pollInterval time.Duration) {
+	var offset int64
+	if lastEventId := c.GetHeader("Last-Event-ID"); lastEventId != "" {
+		offset, _ = strconv.ParseInt(lastEventId, 10, 64)
+	}
+	converter := &ansiStreamConverter{}
+
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	c.Stream(func(w io.Writer) bool {
+		if run.LogExpired {
+			c.SSEvent("end", gin.H{"html": "The log of this run expired."})
+			return false
+		}
+
+		if run.LogSize > offset+int64(len(converter.pending)) {
+			read := offset + int64(len(converter.pending))
+			data, err := readRunLogPart(web.RunLogs, web.Blobs, run, read, maxRunLogEventBytes)
+			if err != nil {
+				log.Printf("Error reading log of run %v: %v", run.ID, err)
+				return false
+			}
+			html := converter.Write(data)
+			if html != "" {
+				offset = read + int64(len(data)) - int64(len(converter.pending))
+				c.Render(-1, sse.Event{Event: "log", Id: strconv.FormatInt(offset, 10), Data: gin.H{"html": html}})
+			}
+			// more might be waiting, read it before sleeping
+			if read+int64(len(data)) < run.LogSize {
+				return true
+			}
+		}
+
+		if !run.IsRunning() {
+			c.SSEvent("end", gin.H{"html": converter.Flush()})
+			return false
+		}
+
+		select {
+		case <-c.Request.Context().Done():
+			return false
+		case <-ticker.C:
+		}
+		updated, err := web.Runs.GetProjectRun(run.ID)
+		if err != nil || updated == nil {
+			log.Printf("Error fetching run %v: %v", run.ID, err)
+			return false
+		}
+		run = updated
+		return true
+	})
+}
+
+func readRunLogPart(store models.RunLogStore, blobs services.BlobStore, run *models.ProjectRun, offset int64, length int64) ([]byte, error) {
+	content, err := services.OpenRunLog(store, blobs, run, offset, length)
+	if err != nil {
+		return nil, err
+	}
+	defer content.Close()
+	return io.ReadAll(content)
+}
@@ -0,0 +1,103 @@
+package controllers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"digger.dev/cloud/models"
+	"digger.dev/cloud/services"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+// gin streams need a writer that notifies about closed connections
+type closeNotifyingRecorder struct {
+	*httptest.ResponseRecorder
+}
+
+func (r closeNotifyingRecorder) CloseNotify() <-chan bool {
+	return make(chan bool)
+}
+
+func TestAnsiStreamConverterCarriesColorsAcrossParts(t *testing.T) {
+	converter := &ansiStreamConverter{}
+
+	assert.Equal(t, "", converter.Write([]byte("\x1b[32mInitial")))
+	first := converter.Write([]byte("izing...\nPlan"))
+	assert.Contains(t, first, "Initializing...")
+	assert.Contains(t, first, "terraform-output-fg-green")
+
+	second := converter.Write([]byte(": 1 to add\x1b[0m\nNo changes\n"))
+	assert.Contains(t, second, "terraform-output-fg-green")
+	assert.Contains(t, second, "Plan: 1 to add")
+
+	third := converter.Write([]byte("Done\n"))
+	assert.NotContains(t, third, "terraform-output-fg-green")
+	assert.Equal(t, "", converter.Flush())
+}
+
+func TestStreamRunLogFollowsRunningRun(t *testing.T) {
+	store := models.NewMemoryStore()
+	blobs, err := services.NewFilesystemBlobStore(t.TempDir())
+	assert.NoError(t, err)
+	run := models.ProjectRun{Status: models.RunStatusRunning, Command: "digger plan"}
+	assert.NoError(t, store.CreateProjectRun(&run))
+	_, err = services.AppendRunLog(store, blobs, run.ID, 0, strings.NewReader("Initializing...\n"))
+	assert.NoError(t, err)
+
+	web := WebController{Stores: store.Stores(), Blobs: blobs}
+	gin.SetMode(gin.TestMode)
+	w := closeNotifyingRecorder{httptest.NewRecorder()}
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodGet, "/runs/1/logs/stream", nil)
+
+	// the stream starts with the run as it was before the rest of the log arrived
+	streaming, _ := store.GetProjectRun(run.ID)
+	done := make(chan struct{})
+	go func() {
+		web.streamRunLog(c, streaming, 10*time.Millisecond)
+		close(done)
+	}()
+
+	_, err = services.AppendRunLog(store, blobs, run.ID, 16, strings.NewReader("Plan: 1 to add\nno newline"))
+	assert.NoError(t, err)
+	assert.NoError(t, store.UpdateProjectRunStatus(run.ID, "success", time.Now().UnixMilli()))
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream didn't end after the run finished")
+	}
+	body := w.Body.String()
+	assert.Contains(t, body, "Initializing...")
+	assert.Contains(t, body, "Plan: 1 to add")
+	assert.Contains(t, body, "event:end\ndata:{\"html\":\"no newline\"}")
+}
+
+func TestStreamRunLogResumesFromLastEventId(t *testing.T) {
+	store := models.NewMemoryStore()
+	blobs, err := services.NewFilesystemBlobStore(t.TempDir())
+	assert.NoError(t, err)
+	run := models.ProjectRun{Status: "success", Command: "digger plan"}
+	assert.NoError(t, store.CreateProjectRun(&run))
+	_, err = services.AppendRunLog(store, blobs, run.ID, 0, strings.NewReader("Initializing...\nPlan: 1 to add\n"))
+	assert.NoError(t, err)
+	streaming, _ := store.GetProjectRun(run.ID)
+
+	web := WebController{Stores: store.Stores(), Blobs: blobs}
+	gin.SetMode(gin.TestMode)
+	w := closeNotifyingRecorder{httptest.NewRecorder()}
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodGet, "/runs/1/logs/stream", nil)
+	c.Request.Header.Set("Last-Event-ID", "16")
+	web.streamRunLog(c, streaming, time.Millisecond)
+
+	body := w.Body.String()
+	assert.NotContains(t, body, "Initializing...")
+	assert.Contains(t, body, "id:31\nevent:log\n")
+	assert.Contains(t, body, "Plan: 1 to add")
+	assert.Contains(t, body, "event:end")
+}
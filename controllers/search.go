@@ -0,0 +1,102 @@
+package controllers
+
+import (
+	"html/template"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"digger.dev/cloud/middleware"
+	"digger.dev/cloud/models"
+	"digger.dev/cloud/services"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/exp/maps"
+)
+
+const defaultRunSearchLimit = 50
+
+// highlightSnippet escapes a search snippet and marks its matches with <mark>
+func highlightSnippet(snippet string) template.HTML {
+	escaped := template.HTMLEscapeString(snippet)
+	escaped = strings.ReplaceAll(escaped, models.SearchMatchStart, "<mark>")
+	escaped = strings.ReplaceAll(escaped, models.SearchMatchEnd, "</mark>")
+	return template.HTML(escaped)
+}
+
+// searchRunsFromQuery runs the search in the q query parameter, limit caps the number of results
+func searchRunsFromQuery(c *gin.Context, search models.RunSearchStore, orgId uint) ([]models.RunSearchResult, bool) {
+	limit := defaultRunSearchLimit
+	if value := c.Query("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid limit " + value})
+			return nil, false
+		}
+		limit = min(parsed, models.MaxRunPageSize)
+	}
+	query := strings.TrimSpace(c.Query("q"))
+	if query == "" {
+		return []models.RunSearchResult{}, true
+	}
+
+	results, err := search.SearchRuns(orgId, query, limit)
+	if err != nil {
+		log.Printf("Error searching runs: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error searching runs"})
+		return nil, false
+	}
+	return results, true
+}
+
+// SearchRunsForOrg searches the logs and planned resource changes of the runs of the org, snippets are HTML with
+// the matches in <mark> elements
+func (api *ApiController) SearchRunsForOrg(c *gin.Context) {
+	org, ok := api.getOrgFromParams(c)
+	if !ok {
+		return
+	}
+	results, ok := searchRunsFromQuery(c, api.Search, org.ID)
+	if !ok {
+		return
+	}
+
+	response := make([]interface{}, 0)
+	for _, result := range results {
+		addresses := make([]string, 0)
+		for _, change := range result.ResourceChanges {
+			addresses = append(addresses, change.Address)
+		}
+		response = append(response, gin.H{
+			"run":               result.Run.MapToJsonStruct(),
+			"snippet":           highlightSnippet(result.Snippet),
+			"matchingAddresses": addresses,
+		})
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+func (web *WebController) RunSearchPage(c *gin.Context) {
+	orgId := c.GetUint(middleware.ORGANISATION_ID_KEY)
+	if orgId == 0 {
+		c.String(http.StatusForbidden, "Not allowed to access this resource")
+		return
+	}
+	results, ok := searchRunsFromQuery(c, web.Search, orgId)
+	if !ok {
+		return
+	}
+
+	snippets := make(map[uint]template.HTML)
+	for _, result := range results {
+		snippets[result.Run.ID] = highlightSnippet(result.Snippet)
+	}
+
+	pageContext := services.GetMessages(c)
+	maps.Copy(pageContext, gin.H{
+		"Query":    c.Query("q"),
+		"Results":  results,
+		"Snippets": snippets,
+	})
+	c.HTML(http.StatusOK, "run_search.tmpl", pageContext)
+}
@@ -0,0 +1,54 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSearchRuns(t *testing.T) {
+	r, _, org := setupApiWithMemoryStore(t)
+
+	w := doRequest(r, "POST", "/repos/infra/report-projects", `{"name": "prod"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	plan := `{"format_version": "1.2", "resource_changes": [
+		{"address": "aws_iam_role.deployer", "mode": "managed", "type": "aws_iam_role", "name": "deployer", "change": {"actions": ["create"]}}
+	]}`
+	w = doRequest(r, "POST", "/repos/infra/projects/prod/runs", `{"status": "succeeded", "command": "digger plan", "output": "\u001b[32mPlan:\u001b[0m 1 to add <b>", "planJson": `+plan+`}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = doRequest(r, "POST", "/repos/infra/projects/prod/runs", `{"status": "failed", "command": "digger apply", "output": "Error: creating bucket"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = doRequest(r, "GET", "/orgs/"+org.Name+"/runs/search?q=deployer", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var results []struct {
+		Run               map[string]interface{}
+		Snippet           string
+		MatchingAddresses []string
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &results))
+	assert.Equal(t, 1, len(results))
+	assert.Equal(t, "digger plan", results[0].Run["Command"])
+	assert.Equal(t, []string{"aws_iam_role.deployer"}, results[0].MatchingAddresses)
+	assert.Equal(t, "", results[0].Snippet)
+
+	w = doRequest(r, "GET", "/orgs/"+org.Name+"/runs/search?q=add", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &results))
+	assert.Equal(t, 1, len(results))
+	assert.Equal(t, "Plan: 1 to <mark>add</mark> &lt;b&gt;", results[0].Snippet)
+
+	w = doRequest(r, "GET", "/orgs/"+org.Name+"/runs/search?q=error+bucket", "")
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &results))
+	assert.Equal(t, 1, len(results))
+	assert.Equal(t, "digger apply", results[0].Run["Command"])
+
+	w = doRequest(r, "GET", "/orgs/"+org.Name+"/runs/search?q=error+deployer", "")
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &results))
+	assert.Equal(t, 0, len(results))
+
+	w = doRequest(r, "GET", "/orgs/otherOrg/runs/search?q=deployer", "")
+	assert.NotEqual(t, http.StatusOK, w.Code)
+}
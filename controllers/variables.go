@@ -0,0 +1,84 @@
+package controllers
+
+import (
+	"log"
+	"net/http"
+	"regexp"
+
+	"digger.dev/cloud/models"
+	"github.com/gin-gonic/gin"
+)
+
+// variable names end up as environment variables of the job
+var variableNameRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// FindVariablesForProject lists the names of the project variables, values are write-only
+func (api *ApiController) FindVariablesForProject(c *gin.Context) {
+	project, ok := api.getRepoAndProjectFromParams(c, c.Param("repo"), c.Param("projectName"))
+	if !ok {
+		return
+	}
+
+	names, err := api.Variables.GetProjectVariableNames(project.ID)
+	if err != nil {
+		log.Printf("Error fetching project variables: %v", err)
+		c.String(http.StatusInternalServerError, "Error fetching project variables")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"names": names})
+}
+
+type SetProjectVariableRequest struct {
+	Value string `json:"value"`
+}
+
+func (api *ApiController) SetVariableForProject(c *gin.Context) {
+	name := c.Param("name")
+	if !variableNameRegex.MatchString(name) {
+		c.String(http.StatusBadRequest, "Variable names can only contain letters, digits and underscores")
+		return
+	}
+
+	var request SetProjectVariableRequest
+	err := c.BindJSON(&request)
+	if err != nil {
+		log.Printf("Error binding JSON: %v", err)
+		return
+	}
+
+	project, ok := api.getRepoAndProjectFromParams(c, c.Param("repo"), c.Param("projectName"))
+	if !ok {
+		return
+	}
+
+	err = api.Variables.SetProjectVariable(project.ID, name, request.Value)
+	if err != nil {
+		log.Printf("Error saving project variable: %v", err)
+		c.String(http.StatusInternalServerError, "Error saving project variable")
+		return
+	}
+	// values are never recorded
+	recordAuditEvent(api.Audit, c, project.OrganisationID, models.AuditActionVariableUpdated, "project_variable", project.Name+"/"+name, nil, nil)
+	c.JSON(http.StatusOK, gin.H{"name": name})
+}
+
+func (api *ApiController) DeleteVariableForProject(c *gin.Context) {
+	name := c.Param("name")
+	project, ok := api.getRepoAndProjectFromParams(c, c.Param("repo"), c.Param("projectName"))
+	if !ok {
+		return
+	}
+
+	deleted, err := api.Variables.DeleteProjectVariable(project.ID, name)
+	if err != nil {
+		log.Printf("Error deleting project variable: %v", err)
+		c.String(http.StatusInternalServerError, "Error deleting project variable")
+		return
+	}
+	if !deleted {
+		c.String(http.StatusNotFound, "Variable not found")
+		return
+	}
+	recordAuditEvent(api.Audit, c, project.OrganisationID, models.AuditActionVariableDeleted, "project_variable", project.Name+"/"+name, nil, nil)
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,41 @@
+package controllers
+
+import (
+	"net/http"
+	"testing"
+
+	"digger.dev/cloud/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProjectVariables(t *testing.T) {
+	r, store, org := setupApiWithMemoryStore(t)
+
+	w := doRequest(r, "POST", "/repos/infra/report-projects", `{"name": "prod"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = doRequest(r, "PUT", "/repos/infra/projects/prod/variables/not-valid", `{"value": "x"}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = doRequest(r, "PUT", "/repos/infra/projects/prod/variables/TF_VAR_region", `{"value": "eu-west-1"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = doRequest(r, "GET", "/repos/infra/projects/prod/variables", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"names": ["TF_VAR_region"]}`, w.Body.String())
+
+	repo, _ := store.GetRepo(org.ID, "infra")
+	project, _ := store.GetProjectByName(org.ID, repo, "prod")
+	variables, err := store.GetProjectVariables(project.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, "eu-west-1", variables["TF_VAR_region"])
+
+	events, _, err := store.GetAuditEvents(org.ID, models.AuditEventFilter{Action: models.AuditActionVariableUpdated})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(events))
+	assert.NotContains(t, events[0].After, "eu-west-1")
+
+	w = doRequest(r, "DELETE", "/repos/infra/projects/prod/variables/TF_VAR_region", "")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	w = doRequest(r, "DELETE", "/repos/infra/projects/prod/variables/TF_VAR_region", "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
@@ -4,8 +4,10 @@ import (
 	"errors"
 	"fmt"
 	"html/template"
+	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
@@ -15,7 +17,6 @@ import (
 	"digger.dev/cloud/models"
 	"digger.dev/cloud/services"
 	"github.com/gin-gonic/gin"
-	"github.com/robert-nix/ansihtml"
 	"github.com/stripe/stripe-go/v76"
 	"github.com/stripe/stripe-go/v76/checkout/session"
 	"golang.org/x/exp/maps"
@@ -23,6 +24,32 @@ import (
 
 type WebController struct {
 	Config *config.Config
+	models.Stores
+	Blobs services.BlobStore
+}
+
+// loggedInOrganisationId returns the org of the session, requests without one are answered with 403
+func loggedInOrganisationId(c *gin.Context) (uint, bool) {
+	orgId := c.GetUint(middleware.ORGANISATION_ID_KEY)
+	if orgId == 0 {
+		c.String(http.StatusForbidden, "Not allowed to access this resource")
+		return 0, false
+	}
+	return orgId, true
+}
+
+func (web *WebController) projectsOfOrg(c *gin.Context) ([]models.Project, bool) {
+	orgId, ok := loggedInOrganisationId(c)
+	if !ok {
+		return nil, false
+	}
+	projects, err := web.Projects.GetProjectsForOrg(orgId)
+	if err != nil {
+		log.Printf("Error fetching projects of org %v: %v", orgId, err)
+		c.String(http.StatusInternalServerError, "Unknown error occurred while fetching database")
+		return nil, false
+	}
+	return projects, true
 }
 
 func (web *WebController) validateRequestProjectId(c *gin.Context) (*models.Project, bool) {
@@ -31,24 +58,68 @@ func (web *WebController) validateRequestProjectId(c *gin.Context) (*models.Proj
 		c.String(http.StatusInternalServerError, "Failed to parse project id")
 		return nil, false
 	}
-	projectId := uint(projectId64)
-	projects, done := models.DB.GetProjectsFromContext(c, middleware.ORGANISATION_ID_KEY)
-	if !done {
+	orgId, ok := loggedInOrganisationId(c)
+	if !ok {
+		return nil, false
+	}
+	project, err := web.Projects.GetProjectById(orgId, uint(projectId64))
+	if err != nil {
+		log.Printf("Error fetching project %v: %v", projectId64, err)
+		c.String(http.StatusInternalServerError, "Unknown error occurred while fetching database")
+		return nil, false
+	}
+	if project == nil {
+		c.String(http.StatusForbidden, "Not allowed to access this resource")
 		return nil, false
 	}
+	return project, true
+}
 
-	for _, p := range projects {
-		if projectId == p.ID {
-			return &p, true
-		}
+// runOfOrg returns the run if it is a run of the org of the session
+func (web *WebController) runOfOrg(c *gin.Context, runId uint) (*models.ProjectRun, bool) {
+	orgId, ok := loggedInOrganisationId(c)
+	if !ok {
+		return nil, false
+	}
+	run, err := web.Runs.GetProjectRun(runId)
+	if err != nil {
+		log.Printf("Error fetching run %v: %v", runId, err)
+		c.String(http.StatusInternalServerError, "Unknown error occurred while fetching database")
+		return nil, false
 	}
+	if run == nil || run.Project == nil || run.Project.OrganisationID != orgId {
+		c.String(http.StatusNotFound, "Could not find run")
+		return nil, false
+	}
+	return run, true
+}
 
-	c.String(http.StatusForbidden, "Not allowed to access this resource")
-	return nil, false
+// policyOfOrg returns the policy if it is a policy of a project of the org of the session
+func (web *WebController) policyOfOrg(c *gin.Context) (*models.Policy, bool) {
+	policyId64, err := strconv.ParseUint(c.Param("policyid"), 10, 32)
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Failed to parse policy id")
+		return nil, false
+	}
+	orgId, ok := loggedInOrganisationId(c)
+	if !ok {
+		return nil, false
+	}
+	policy, err := web.Policies.GetPolicyById(orgId, uint(policyId64))
+	if err != nil {
+		log.Printf("Error fetching policy %v: %v", policyId64, err)
+		c.String(http.StatusInternalServerError, "Unknown error occurred while fetching database")
+		return nil, false
+	}
+	if policy == nil {
+		c.String(http.StatusNotFound, "Could not find policy")
+		return nil, false
+	}
+	return policy, true
 }
 
 func (web *WebController) ProjectsPage(c *gin.Context) {
-	projects, done := models.DB.GetProjectsFromContext(c, middleware.ORGANISATION_ID_KEY)
+	projects, done := web.projectsOfOrg(c)
 	if !done {
 		return
 	}
@@ -61,13 +132,22 @@ func (web *WebController) ProjectsPage(c *gin.Context) {
 }
 
 func (web *WebController) ReposPage(c *gin.Context) {
-	repos, done := models.DB.GetReposFromContext(c, middleware.ORGANISATION_ID_KEY)
-	if !done {
+	orgId, ok := loggedInOrganisationId(c)
+	if !ok {
+		return
+	}
+	repos, err := web.Repos.GetReposForOrg(orgId)
+	if err != nil {
+		log.Printf("Error fetching repos of org %v: %v", orgId, err)
+		c.String(http.StatusInternalServerError, "Unknown error occurred while fetching database")
 		return
 	}
 
-	githubAppId := os.Getenv("GITHUB_APP_ID")
-	githubApp, err := models.DB.GetGithubApp(githubAppId)
+	githubApp, err := web.Github.GetDefaultGithubApp()
+	if errors.Is(err, models.ErrGithubAppNotFound) {
+		// repos can be listed before the app is set up
+		githubApp, err = &models.GithubApp{}, nil
+	}
 	if err != nil {
 		c.String(http.StatusInternalServerError, "Failed to find GitHub app")
 		return
@@ -83,21 +163,84 @@ func (web *WebController) ReposPage(c *gin.Context) {
 }
 
 func (web *WebController) RunsPage(c *gin.Context) {
-	runs, done := models.DB.GetProjectRunsFromContext(c, middleware.ORGANISATION_ID_KEY)
-	if !done {
+	filter, err := runFilterFromQuery(c)
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	filter.OrganisationID = c.GetUint(middleware.ORGANISATION_ID_KEY)
+	if filter.OrganisationID == 0 {
+		c.String(http.StatusForbidden, "Not allowed to access this resource")
 		return
 	}
 
+	page, err := web.Runs.FindProjectRuns(filter)
+	if errors.Is(err, models.ErrInvalidRunCursor) {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		log.Printf("Error fetching runs: %v", err)
+		c.String(http.StatusInternalServerError, "Error fetching runs")
+		return
+	}
+
+	// the filters are kept when following the links to the next page and to the sorted pages
+	query := c.Request.URL.Query()
+	query.Del("cursor")
+	nextPageUrl := ""
+	if page.NextCursor != "" {
+		next := url.Values{}
+		for key, values := range query {
+			next[key] = values
+		}
+		next.Set("cursor", page.NextCursor)
+		nextPageUrl = "/runs/?" + next.Encode()
+	}
+
 	pageContext := services.GetMessages(c)
 	maps.Copy(pageContext, gin.H{
-		"Runs": runs,
+		"Runs":         page.Runs,
+		"Total":        page.Total,
+		"Filter":       filter,
+		"FirstPageUrl": "/runs/?" + query.Encode(),
+		"NextPageUrl":  nextPageUrl,
+		"SortUrls":     runSortUrls(query),
 	})
 	c.HTML(http.StatusOK, "runs.tmpl", pageContext)
 }
 
+// runSortUrls links the sortable columns of the runs table, the sorted column links to the opposite order
+func runSortUrls(query url.Values) map[string]string {
+	urls := map[string]string{}
+	currentSort := query.Get("sort")
+	if currentSort == "" {
+		currentSort = models.RunSortCreatedAt
+	}
+	for _, sortBy := range []string{models.RunSortCreatedAt, models.RunSortStartedAt, models.RunSortEndedAt} {
+		sorted := url.Values{}
+		for key, values := range query {
+			sorted[key] = values
+		}
+		sorted.Set("sort", sortBy)
+		sorted.Set("order", "desc")
+		if sortBy == currentSort && query.Get("order") != "asc" {
+			sorted.Set("order", "asc")
+		}
+		urls[sortBy] = "/runs/?" + sorted.Encode()
+	}
+	return urls
+}
+
 func (web *WebController) PoliciesPage(c *gin.Context) {
-	policies, done := models.DB.GetPoliciesFromContext(c, middleware.ORGANISATION_ID_KEY)
-	if !done {
+	orgId, ok := loggedInOrganisationId(c)
+	if !ok {
+		return
+	}
+	policies, err := web.Policies.GetPoliciesForOrg(orgId)
+	if err != nil {
+		log.Printf("Error fetching policies of org %v: %v", orgId, err)
+		c.String(http.StatusInternalServerError, "Unknown error occurred while fetching database")
 		return
 	}
 
@@ -111,7 +254,7 @@ func (web *WebController) PoliciesPage(c *gin.Context) {
 func (web *WebController) AddPolicyPage(c *gin.Context) {
 	if c.Request.Method == "GET" {
 		message := ""
-		projects, done := models.DB.GetProjectsFromContext(c, middleware.ORGANISATION_ID_KEY)
+		projects, done := web.projectsOfOrg(c)
 		if !done {
 			return
 		}
@@ -142,9 +285,12 @@ func (web *WebController) AddPolicyPage(c *gin.Context) {
 			c.String(http.StatusInternalServerError, "Failed to parse policy id")
 			return
 		}
-		projectId := uint(projectId64)
-		project, ok := models.DB.GetProjectByProjectId(c, projectId, middleware.ORGANISATION_ID_KEY)
+		orgId, ok := loggedInOrganisationId(c)
 		if !ok {
+			return
+		}
+		project, err := web.Projects.GetProjectById(orgId, uint(projectId64))
+		if err != nil || project == nil {
 			log.Printf("Failed to fetch specified project by id: %v, %v\n", projectIdStr, err)
 			message := "Failed to create a policy"
 			services.AddError(c, message)
@@ -156,7 +302,7 @@ func (web *WebController) AddPolicyPage(c *gin.Context) {
 
 		policy := models.Policy{Project: project, Policy: policyText, Type: policyType, Organisation: project.Organisation, Repo: project.Repo}
 
-		err = models.DB.GormDB.Create(&policy).Error
+		err = web.Policies.SavePolicy(&policy)
 		if err != nil {
 			log.Printf("Failed to create a new policy, %v\n", err)
 			message := "Failed to create a policy"
@@ -164,19 +310,15 @@ func (web *WebController) AddPolicyPage(c *gin.Context) {
 			pageContext := services.GetMessages(c)
 			c.HTML(http.StatusOK, "policy_add.tmpl", pageContext)
 		}
+		recordAuditEvent(web.Audit, c, project.OrganisationID, models.AuditActionPolicyCreated, "policy", policy.ID,
+			nil, gin.H{"type": policy.Type, "policy": policy.Policy, "projectId": project.ID})
 
 		c.Redirect(http.StatusFound, "/policies")
 	}
 }
 
 func (web *WebController) PolicyDetailsPage(c *gin.Context) {
-	policyId64, err := strconv.ParseUint(c.Param("policyid"), 10, 32)
-	if err != nil {
-		c.String(http.StatusInternalServerError, "Failed to parse policy id")
-		return
-	}
-	policyId := uint(policyId64)
-	policy, ok := models.DB.GetPolicyByPolicyId(c, policyId, middleware.ORGANISATION_ID_KEY)
+	policy, ok := web.policyOfOrg(c)
 	if !ok {
 		return
 	}
@@ -197,23 +339,57 @@ func (web *WebController) ProjectDetailsPage(c *gin.Context) {
 	c.HTML(http.StatusOK, "project_details.tmpl", pageContext)
 }
 
+// the run page shows the start of long logs only
+const maxRunLogPageBytes = 4 * 1024 * 1024
+
 func (web *WebController) RunDetailsPage(c *gin.Context) {
 	runId64, err := strconv.ParseUint(c.Param("runid"), 10, 32)
 	if err != nil {
 		c.String(http.StatusInternalServerError, "Failed to parse project run id")
 		return
 	}
-	runId := uint(runId64)
-	run, ok := models.DB.GetProjectByRunId(c, runId, middleware.ORGANISATION_ID_KEY)
+	run, ok := web.runOfOrg(c, uint(runId64))
 	if !ok {
 		return
 	}
 
+	// the page tails the log of running jobs
+	if run.IsRunning() && !run.LogExpired {
+		pageContext := services.GetMessages(c)
+		maps.Copy(pageContext, gin.H{
+			"Run":     run,
+			"LiveLog": true,
+		})
+		c.HTML(http.StatusOK, "run_details.tmpl", pageContext)
+		return
+	}
+
+	output := ""
+	if run.LogExpired {
+		output = "The log of this run expired."
+	} else {
+		content, err := services.OpenRunLog(web.RunLogs, web.Blobs, run, 0, maxRunLogPageBytes)
+		if err != nil {
+			log.Printf("Error opening run log: %v", err)
+			c.String(http.StatusInternalServerError, "Failed to read the run log")
+			return
+		}
+		defer content.Close()
+		logBytes, err := io.ReadAll(content)
+		if err != nil {
+			log.Printf("Error reading run log: %v", err)
+			c.String(http.StatusInternalServerError, "Failed to read the run log")
+			return
+		}
+		output = string(logBytes)
+		if run.LogSize > maxRunLogPageBytes {
+			output += fmt.Sprintf("\n... %v more bytes, download the full log through the API", run.LogSize-maxRunLogPageBytes)
+		}
+	}
+
 	stateSyncOutput := ""
 	terraformPlanOutput := ""
-	runOutput := string(ansihtml.ConvertToHTMLWithClasses([]byte(run.Output), "terraform-output-", true))
-	runOutput = strings.Replace(runOutput, "  ", "&nbsp;&nbsp;", -1)
-	runOutput = strings.Replace(runOutput, "\n", "<br>\n", -1)
+	runOutput := terraformOutputHtml([]byte(output))
 
 	planIndex := strings.Index(runOutput, "Terraform used the selected providers to generate the following execution")
 	if planIndex != -1 {
@@ -245,9 +421,17 @@ func (web *WebController) ProjectDetailsUpdatePage(c *gin.Context) {
 
 	projectName := c.PostForm("project_name")
 	if projectName != project.Name {
+		oldName := project.Name
 		project.Name = projectName
-		models.DB.GormDB.Save(project)
+		err := web.Projects.SaveProject(project)
+		if err != nil {
+			log.Printf("Failed to update project, %v\n", err)
+			c.String(http.StatusInternalServerError, "Failed to update project")
+			return
+		}
 		log.Printf("project name has been updated to %s\n", projectName)
+		recordAuditEvent(web.Audit, c, project.OrganisationID, models.AuditActionProjectUpdated, "project", project.ID,
+			gin.H{"name": oldName}, gin.H{"name": projectName})
 		services.AddMessage(c, "Project has been updated successfully")
 	}
 
@@ -259,13 +443,7 @@ func (web *WebController) ProjectDetailsUpdatePage(c *gin.Context) {
 }
 
 func (web *WebController) PolicyDetailsUpdatePage(c *gin.Context) {
-	policyId64, err := strconv.ParseUint(c.Param("policyid"), 10, 32)
-	if err != nil {
-		c.String(http.StatusInternalServerError, "Failed to parse policy id")
-		return
-	}
-	policyId := uint(policyId64)
-	policy, ok := models.DB.GetPolicyByPolicyId(c, policyId, middleware.ORGANISATION_ID_KEY)
+	policy, ok := web.policyOfOrg(c)
 	if !ok {
 		return
 	}
@@ -276,9 +454,17 @@ func (web *WebController) PolicyDetailsUpdatePage(c *gin.Context) {
 	if policyText == "" {
 		services.AddWarning(c, "Policy can't be empty.")
 	} else if policyText != policy.Policy {
+		oldPolicyText := policy.Policy
 		policy.Policy = policyText
-		models.DB.GormDB.Save(policy)
+		err := web.Policies.SavePolicy(policy)
+		if err != nil {
+			log.Printf("Failed to update policy, %v\n", err)
+			c.String(http.StatusInternalServerError, "Failed to update policy")
+			return
+		}
 		log.Printf("Policy has been updated. policy id: %v\n", policy.ID)
+		recordAuditEvent(web.Audit, c, policy.OrganisationID, models.AuditActionPolicyUpdated, "policy", policy.ID,
+			gin.H{"policy": oldPolicyText}, gin.H{"policy": policyText})
 		services.AddMessage(c, "Policy has been updated successfully")
 		c.Redirect(http.StatusFound, "/policies")
 		return
@@ -320,8 +506,8 @@ func (web *WebController) UpdateRepoPage(c *gin.Context) {
 		return
 	}
 
-	repo, err := models.DB.GetRepoById(orgId, repoId)
-	if err != nil {
+	repo, err := web.Repos.GetRepoById(orgId, repoId)
+	if err != nil || repo == nil {
 		c.String(http.StatusForbidden, "Failed to find repo")
 		return
 	}
@@ -346,7 +532,8 @@ func (web *WebController) UpdateRepoPage(c *gin.Context) {
 			return
 		}
 
-		messages, err := models.DB.UpdateRepoDiggerConfig(orgId, diggerConfigYaml, repo)
+		oldDiggerConfig := repo.DiggerConfig
+		messages, err := web.Repos.UpdateRepoDiggerConfig(orgId, diggerConfigYaml, repo)
 		if err != nil {
 			if strings.HasPrefix(err.Error(), "validation error, ") {
 				services.AddError(c, errors.Unwrap(err).Error())
@@ -368,6 +555,8 @@ func (web *WebController) UpdateRepoPage(c *gin.Context) {
 			c.HTML(http.StatusOK, "repo_add.tmpl", pageContext)
 			return
 		}
+		recordAuditEvent(web.Audit, c, repo.OrganisationID, models.AuditActionRepoConfigUpdated, "repo", repo.ID,
+			gin.H{"diggerConfig": oldDiggerConfig}, gin.H{"diggerConfig": diggerConfigYaml})
 		for _, m := range messages {
 			services.AddMessage(c, m)
 		}
@@ -376,7 +565,13 @@ func (web *WebController) UpdateRepoPage(c *gin.Context) {
 }
 
 func (web *WebController) Checkout(c *gin.Context) {
-	stripe.Key = os.Getenv("STRIPE_KEY")
+	stripeKey, err := web.Secrets.GetSecretOrEnv("stripe_key", "STRIPE_KEY")
+	if err != nil {
+		log.Printf("failed to read stripe key: %v", err)
+		c.String(http.StatusInternalServerError, "Failed to read Stripe key")
+		return
+	}
+	stripe.Key = stripeKey
 
 	params := &stripe.CheckoutSessionParams{
 		LineItems: []*stripe.CheckoutSessionLineItemParams{
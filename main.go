@@ -11,6 +11,8 @@ import (
 	"digger.dev/cloud/controllers"
 	"digger.dev/cloud/middleware"
 	"digger.dev/cloud/models"
+	"digger.dev/cloud/services"
+	"digger.dev/cloud/utils"
 	"github.com/alextanhongpin/go-gin-starter/config"
 	"github.com/getsentry/sentry-go"
 	sentrygin "github.com/getsentry/sentry-go/gin"
@@ -25,9 +27,25 @@ var Version = "dev"
 func main() {
 
 	initLogging()
+
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		err := runMigrateCommand(os.Args[2:])
+		if err != nil {
+			log.Fatalf("migrate failed: %v", err)
+		}
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "secrets" {
+		err := runSecretsCommand(os.Args[2:])
+		if err != nil {
+			log.Fatalf("secrets failed: %v", err)
+		}
+		return
+	}
+
 	cfg := config.New()
 	cfg.AutomaticEnv()
-	web := controllers.WebController{Config: cfg}
 
 	if err := sentry.Init(sentry.ClientOptions{
 		Dsn:           os.Getenv("SENTRY_DSN"),
@@ -42,17 +60,37 @@ func main() {
 		log.Printf("Sentry initialization failed: %v\n", err)
 	}
 
-	//database migrations
+	// refuses to start on pending migrations, see models.ConnectDatabase
 	models.ConnectDatabase()
 
+	stores := models.DB.Stores()
+	blobs, err := services.LoadBlobStore()
+	if err != nil {
+		log.Fatalf("failed to set up the blob store: %v", err)
+	}
+	services.StartRunLogRetention(stores.RunLogs, blobs)
+	services.StartDriftScheduler(stores, &controllers.GithubDriftDispatcher{Stores: stores, GithubClientProvider: &utils.DiggerGithubRealClientProvider{Github: stores.Github}})
+	web := controllers.WebController{Config: cfg, Stores: stores, Blobs: blobs}
+	apiController := controllers.ApiController{Stores: stores, Blobs: blobs}
+	githubController := controllers.GithubController{Stores: stores, GithubClientProvider: &utils.DiggerGithubRealClientProvider{Github: stores.Github}}
+
 	r := gin.Default()
-	// TODO: check "secret"
-	store := gormsessions.NewStore(models.DB.GormDB, true, []byte("secret"))
+	// SESSION_SECRET has to be set in deployments which keep logins in the session (OIDC_AUTH)
+	sessionSecret := os.Getenv("SESSION_SECRET")
+	if sessionSecret == "" {
+		if _, ok := os.LookupEnv("OIDC_AUTH"); ok {
+			log.Fatalf("SESSION_SECRET has to be set when OIDC_AUTH is enabled, logins are kept in sessions signed with it")
+		}
+		sessionSecret = "secret"
+	}
+	store := gormsessions.NewStore(models.DB.GormDB, true, []byte(sessionSecret))
 
 	r.Use(sessions.Sessions("digger-session", store))
 
 	r.Use(sentrygin.New(sentrygin.Options{Repanic: true}))
 
+	r.Use(middleware.RequestId())
+
 	r.Static("/static", "./templates/static")
 
 	r.GET("/health", func(c *gin.Context) {
@@ -73,92 +111,147 @@ func main() {
 	r.LoadHTMLGlob("templates/*.tmpl")
 	r.GET("/", web.RedirectToProjectsPage)
 
-	r.POST("/github-app-webhook", controllers.GithubAppWebHook)
+	r.POST("/github-app-webhook", githubController.GithubAppWebHook)
 
 	tenantActionsGroup := r.Group("/tenants")
 	tenantActionsGroup.Use(middleware.CORSMiddleware())
-	tenantActionsGroup.Any("/associateTenantIdToDiggerOrg", controllers.AssociateTenantIdToDiggerOrg)
+	tenantActionsGroup.Any("/associateTenantIdToDiggerOrg", apiController.AssociateTenantIdToDiggerOrg)
+
+	oidcGroup := r.Group("/oidc")
+	oidcGroup.GET("/login", web.OidcLogin)
+	oidcGroup.GET("/callback", web.OidcCallback)
+	oidcGroup.GET("/logout", controllers.OidcLogout)
 
 	githubGroup := r.Group("/github")
-	githubGroup.Use(middleware.GetWebMiddleware())
-	githubGroup.GET("/callback", controllers.GithubAppCallbackPage)
-	githubGroup.GET("/repos", controllers.GithubReposPage)
+	githubGroup.Use(middleware.GetWebMiddleware(stores), middleware.RequirePermission(stores, models.PermissionManageOrg))
+	githubGroup.GET("/callback", githubController.GithubAppCallbackPage)
+	githubGroup.GET("/callback/:appId", githubController.GithubAppCallbackPage)
+	githubGroup.GET("/repos", githubController.GithubReposPage)
 	githubGroup.GET("/setup", controllers.GithubAppSetup)
-	githubGroup.GET("/exchange-code", controllers.GithubSetupExchangeCode)
+	githubGroup.GET("/exchange-code", githubController.GithubSetupExchangeCode)
 
 	projectsGroup := r.Group("/projects")
-	projectsGroup.Use(middleware.GetWebMiddleware())
+	projectsGroup.Use(middleware.GetWebMiddleware(stores), middleware.RequirePermission(stores, models.PermissionRead))
 	projectsGroup.GET("/", web.ProjectsPage)
 	projectsGroup.GET("/:projectid/details", web.ProjectDetailsPage)
-	projectsGroup.POST("/:projectid/details", web.ProjectDetailsUpdatePage)
+	projectsGroup.GET("/:projectid/drift", web.ProjectDriftPage)
+	projectsGroup.POST("/:projectid/details", middleware.RequirePermission(stores, models.PermissionManageOrg), web.ProjectDetailsUpdatePage)
 
 	runsGroup := r.Group("/runs")
-	runsGroup.Use(middleware.GetWebMiddleware())
+	runsGroup.Use(middleware.GetWebMiddleware(stores), middleware.RequirePermission(stores, models.PermissionRead))
 	runsGroup.GET("/", web.RunsPage)
+	runsGroup.GET("/search", web.RunSearchPage)
 	runsGroup.GET("/:runid/details", web.RunDetailsPage)
+	runsGroup.GET("/:runid/logs/stream", web.RunLogStream)
+
+	driftGroup := r.Group("/drift")
+	driftGroup.Use(middleware.GetWebMiddleware(stores), middleware.RequirePermission(stores, models.PermissionRead))
+	driftGroup.GET("/", web.DriftPage)
 
 	reposGroup := r.Group("/repos")
-	reposGroup.Use(middleware.GetWebMiddleware())
+	reposGroup.Use(middleware.GetWebMiddleware(stores), middleware.RequirePermission(stores, models.PermissionRead))
 	reposGroup.GET("/", web.ReposPage)
 
 	repoGroup := r.Group("/repo")
-	repoGroup.Use(middleware.GetWebMiddleware())
+	repoGroup.Use(middleware.GetWebMiddleware(stores), middleware.RequirePermission(stores, models.PermissionRead))
 	repoGroup.GET("/", web.ReposPage)
 	repoGroup.GET("/:repoid/", web.UpdateRepoPage)
-	repoGroup.POST("/:repoid/", web.UpdateRepoPage)
+	repoGroup.POST("/:repoid/", middleware.RequirePermission(stores, models.PermissionManageOrg), web.UpdateRepoPage)
 
 	policiesGroup := r.Group("/policies")
-	policiesGroup.Use(middleware.GetWebMiddleware())
+	policiesGroup.Use(middleware.GetWebMiddleware(stores), middleware.RequirePermission(stores, models.PermissionRead))
 	policiesGroup.GET("/", web.PoliciesPage)
-	policiesGroup.GET("/add", web.AddPolicyPage)
-	policiesGroup.POST("/add", web.AddPolicyPage)
+	policiesGroup.GET("/add", middleware.RequirePermission(stores, models.PermissionManagePolicies), web.AddPolicyPage)
+	policiesGroup.POST("/add", middleware.RequirePermission(stores, models.PermissionManagePolicies), web.AddPolicyPage)
 	policiesGroup.GET("/:policyid/details", web.PolicyDetailsPage)
-	policiesGroup.POST("/:policyid/details", web.PolicyDetailsUpdatePage)
+	policiesGroup.POST("/:policyid/details", middleware.RequirePermission(stores, models.PermissionManagePolicies), web.PolicyDetailsUpdatePage)
+
+	auditGroup := r.Group("/audit")
+	auditGroup.Use(middleware.GetWebMiddleware(stores), middleware.RequirePermission(stores, models.PermissionManageOrg))
+	auditGroup.GET("/", web.AuditPage)
+	auditGroup.GET("/export", web.AuditExport)
 
 	checkoutGroup := r.Group("/")
-	checkoutGroup.Use(middleware.GetApiMiddleware())
+	checkoutGroup.Use(middleware.GetApiMiddleware(stores), middleware.RequirePermission(stores, models.PermissionManageOrg))
 	checkoutGroup.GET("/checkout", web.Checkout)
 
-	authorized := r.Group("/")
-	authorized.Use(middleware.GetApiMiddleware(), middleware.AccessLevel(models.AccessPolicyType, models.AdminPolicyType))
+	api := r.Group("/")
+	api.Use(middleware.GetApiMiddleware(stores))
 
-	admin := r.Group("/")
-	admin.Use(middleware.GetApiMiddleware(), middleware.AccessLevel(models.AdminPolicyType))
+	read := middleware.RequirePermission(stores, models.PermissionRead)
+	runJobs := middleware.RequirePermission(stores, models.PermissionRunJobs)
+	managePolicies := middleware.RequirePermission(stores, models.PermissionManagePolicies)
+	manageOrg := middleware.RequirePermission(stores, models.PermissionManageOrg)
 
 	fronteggWebhookProcessor := r.Group("/")
-	fronteggWebhookProcessor.Use(middleware.SecretCodeAuth())
+	fronteggWebhookProcessor.Use(middleware.SecretCodeAuth(stores.Secrets))
+
+	api.GET("/repos/:repo/projects/:projectName/access-policy", read, apiController.FindAccessPolicy)
+	api.GET("/orgs/:organisation/access-policy", read, apiController.FindAccessPolicyForOrg)
+
+	api.GET("/repos/:repo/projects/:projectName/plan-policy", read, apiController.FindPlanPolicy)
+	api.GET("/orgs/:organisation/plan-policy", read, apiController.FindPlanPolicyForOrg)
+
+	api.GET("/repos/:repo/projects/:projectName/drift-policy", read, apiController.FindDriftPolicy)
+	api.GET("/orgs/:organisation/drift-policy", read, apiController.FindDriftPolicyForOrg)
+
+	api.GET("/repos/:repo/projects/:projectName/drift-alert-policy", read, apiController.FindDriftAlertPolicy)
+	api.GET("/orgs/:organisation/drift-alert-policy", read, apiController.FindDriftAlertPolicyForOrg)
+
+	api.GET("/repos/:repo/projects/:projectName/approval-policy", read, apiController.FindApprovalPolicy)
+	api.GET("/orgs/:organisation/approval-policy", read, apiController.FindApprovalPolicyForOrg)
+
+	api.GET("/repos/:repo/projects/:projectName/runs", read, apiController.RunHistoryForProject)
+	api.POST("/repos/:repo/projects/:projectName/runs", runJobs, apiController.CreateRunForProject)
+	api.GET("/repos/:repo/projects/:projectName/runs/:runId", read, apiController.RunDetailsForProject)
+	api.POST("/repos/:repo/projects/:projectName/runs/:runId/status", runJobs, apiController.UpdateRunStatusForProject)
+	api.GET("/repos/:repo/projects/:projectName/runs/:runId/logs", read, apiController.GetRunLog)
+	api.POST("/repos/:repo/projects/:projectName/runs/:runId/logs", runJobs, apiController.AppendRunLog)
 
-	authorized.GET("/repos/:repo/projects/:projectName/access-policy", controllers.FindAccessPolicy)
-	authorized.GET("/orgs/:organisation/access-policy", controllers.FindAccessPolicyForOrg)
+	api.POST("/repos/:repo/projects/:projectName/jobs/:jobId/set-status", runJobs, apiController.SetJobStatusForProject)
+	api.PUT("/repos/:repo/projects/:projectName/jobs/:jobId/plan-artifact", runJobs, apiController.UploadPlanArtifact)
+	api.GET("/repos/:repo/projects/:projectName/jobs/:jobId/plan-artifact", runJobs, apiController.DownloadPlanArtifact)
 
-	authorized.GET("/repos/:repo/projects/:projectName/plan-policy", controllers.FindPlanPolicy)
-	authorized.GET("/orgs/:organisation/plan-policy", controllers.FindPlanPolicyForOrg)
+	api.GET("/repos/:repo/projects/:projectName/variables", read, apiController.FindVariablesForProject)
+	api.PUT("/repos/:repo/projects/:projectName/variables/:name", manageOrg, apiController.SetVariableForProject)
+	api.DELETE("/repos/:repo/projects/:projectName/variables/:name", manageOrg, apiController.DeleteVariableForProject)
 
-	authorized.GET("/repos/:repo/projects/:projectName/drift-policy", controllers.FindDriftPolicy)
-	authorized.GET("/orgs/:organisation/drift-policy", controllers.FindDriftPolicyForOrg)
+	api.GET("/repos/:repo/projects", read, apiController.FindProjectsForRepo)
+	api.POST("/repos/:repo/report-projects", runJobs, apiController.ReportProjectsForRepo)
 
-	authorized.GET("/repos/:repo/projects/:projectName/runs", controllers.RunHistoryForProject)
-	authorized.POST("/repos/:repo/projects/:projectName/runs", controllers.CreateRunForProject)
+	api.GET("/orgs/:organisation/projects", read, apiController.FindProjectsForOrg)
+	api.GET("/orgs/:organisation/runs/search", read, apiController.SearchRunsForOrg)
 
-	authorized.POST("/repos/:repo/projects/:projectName/jobs/:jobId/set-status", controllers.SetJobStatusForProject)
+	api.PUT("/repos/:repo/projects/:projectName/access-policy", managePolicies, apiController.UpsertAccessPolicyForRepoAndProject)
+	api.PUT("/orgs/:organisation/access-policy", managePolicies, apiController.UpsertAccessPolicyForOrg)
 
-	authorized.GET("/repos/:repo/projects", controllers.FindProjectsForRepo)
-	authorized.POST("/repos/:repo/report-projects", controllers.ReportProjectsForRepo)
+	api.PUT("/repos/:repo/projects/:projectName/plan-policy", managePolicies, apiController.UpsertPlanPolicyForRepoAndProject)
+	api.PUT("/orgs/:organisation/plan-policy", managePolicies, apiController.UpsertPlanPolicyForOrg)
 
-	authorized.GET("/orgs/:organisation/projects", controllers.FindProjectsForOrg)
+	api.PUT("/repos/:repo/projects/:projectName/drift-policy", managePolicies, apiController.UpsertDriftPolicyForRepoAndProject)
+	api.GET("/repos/:repo/projects/:projectName/drift-schedule", read, apiController.FindDriftScheduleForProject)
+	api.GET("/repos/:repo/projects/:projectName/drift-reports", read, apiController.FindDriftReportsForProject)
+	api.GET("/orgs/:organisation/drift", read, apiController.FindDriftForOrg)
+	api.PUT("/repos/:repo/projects/:projectName/drift-schedule", managePolicies, apiController.SetDriftScheduleForProject)
+	api.PUT("/orgs/:organisation/drift-policy", managePolicies, apiController.UpsertDriftPolicyForOrg)
+	api.PUT("/repos/:repo/projects/:projectName/drift-alert-policy", managePolicies, apiController.UpsertDriftAlertPolicyForRepoAndProject)
+	api.PUT("/orgs/:organisation/drift-alert-policy", managePolicies, apiController.UpsertDriftAlertPolicyForOrg)
 
-	admin.PUT("/repos/:repo/projects/:projectName/access-policy", controllers.UpsertAccessPolicyForRepoAndProject)
-	admin.PUT("/orgs/:organisation/access-policy", controllers.UpsertAccessPolicyForOrg)
+	api.PUT("/repos/:repo/projects/:projectName/approval-policy", managePolicies, apiController.UpsertApprovalPolicyForRepoAndProject)
+	api.PUT("/orgs/:organisation/approval-policy", managePolicies, apiController.UpsertApprovalPolicyForOrg)
 
-	admin.PUT("/repos/:repo/projects/:projectName/plan-policy", controllers.UpsertPlanPolicyForRepoAndProject)
-	admin.PUT("/orgs/:organisation/plan-policy", controllers.UpsertPlanPolicyForOrg)
+	api.POST("/tokens/issue-access-token", manageOrg, apiController.IssueAccessTokenForOrg)
 
-	admin.PUT("/repos/:repo/projects/:projectName/drift-policy", controllers.UpsertDriftPolicyForRepoAndProject)
-	admin.PUT("/orgs/:organisation/drift-policy", controllers.UpsertDriftPolicyForOrg)
+	api.GET("/orgs/:organisation/audit-events", manageOrg, apiController.FindAuditEventsForOrg)
 
-	admin.POST("/tokens/issue-access-token", controllers.IssueAccessTokenForOrg)
+	api.GET("/orgs/:organisation/members", read, apiController.ListOrgMembers)
+	api.POST("/orgs/:organisation/members", manageOrg, apiController.InviteOrgMember)
+	api.PUT("/orgs/:organisation/members/:userId", manageOrg, apiController.UpdateOrgMember)
+	api.DELETE("/orgs/:organisation/members/:userId", manageOrg, apiController.RemoveOrgMember)
+	api.POST("/orgs/:organisation/members/:userId/grants", manageOrg, apiController.CreateRoleGrantForMember)
+	api.DELETE("/orgs/:organisation/members/:userId/grants/:grantId", manageOrg, apiController.DeleteRoleGrant)
 
-	fronteggWebhookProcessor.POST("/create-org-from-frontegg", controllers.CreateFronteggOrgFromWebhook)
+	fronteggWebhookProcessor.POST("/create-org-from-frontegg", apiController.CreateFronteggOrgFromWebhook)
 
 	r.Run(fmt.Sprintf(":%d", cfg.GetInt("port")))
 }
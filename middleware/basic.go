@@ -10,7 +10,7 @@ import (
 	"strings"
 )
 
-func HttpBasicWebAuth() gin.HandlerFunc {
+func HttpBasicWebAuth(stores models.Stores) gin.HandlerFunc {
 
 	return func(c *gin.Context) {
 		log.Printf("Restricting access")
@@ -22,20 +22,23 @@ func HttpBasicWebAuth() gin.HandlerFunc {
 		gin.BasicAuth(gin.Accounts{
 			username: password,
 		})(c)
-		setDefaultOrganisationId(c)
+		setDefaultOrganisationId(c, stores)
 		c.Next()
 	}
 }
 
-func setDefaultOrganisationId(c *gin.Context) {
-	orgNumberOne, err := models.DB.GetOrganisation(models.DEFAULT_ORG_NAME)
+func setDefaultOrganisationId(c *gin.Context, stores models.Stores) {
+	orgNumberOne, err := stores.Orgs.GetOrganisation(models.DEFAULT_ORG_NAME)
 	if err != nil {
 		c.Error(fmt.Errorf("Error fetching default organisation please check your configuration"))
 	}
 	c.Set(ORGANISATION_ID_KEY, orgNumberOne.ID)
+	// basic auth has a single shared account which manages the whole installation
+	c.Set(ROLE_KEY, string(models.RoleOrgAdmin))
+	c.Set(ACTOR_KEY, "basic-auth")
 }
 
-func HttpBasicApiAuth() gin.HandlerFunc {
+func HttpBasicApiAuth(stores models.Stores) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		authHeader := c.Request.Header.Get("Authorization")
 		if authHeader == "" {
@@ -51,7 +54,7 @@ func HttpBasicApiAuth() gin.HandlerFunc {
 		}
 
 		if token == os.Getenv("BEARER_AUTH_TOKEN") {
-			setDefaultOrganisationId(c)
+			setDefaultOrganisationId(c, stores)
 			c.Next()
 		}
 		return
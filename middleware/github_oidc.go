@@ -0,0 +1,160 @@
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"digger.dev/cloud/models"
+	"digger.dev/cloud/services"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt"
+)
+
+const GITHUB_ACTIONS_OIDC_ISSUER = "https://token.actions.githubusercontent.com"
+
+// GithubOidcKeySet holds GitHub's signing keys for Actions OIDC tokens, tests replace it with a local stand-in
+var GithubOidcKeySet = services.NewJwksKeySet(GITHUB_ACTIONS_OIDC_ISSUER + "/.well-known/jwks")
+
+// githubOidcAudience is the audience runners have to request their tokens for, the Digger hostname unless
+// GITHUB_OIDC_AUDIENCE overrides it. Tokens for any other audience, like the default one of GitHub, are rejected.
+func githubOidcAudience() string {
+	if audience := os.Getenv("GITHUB_OIDC_AUDIENCE"); audience != "" {
+		return audience
+	}
+	return os.Getenv("DIGGER_CLOUD_HOSTNAME")
+}
+
+// JobRepositoryAllowed tells whether the caller may access the route. Tokens of GitHub Actions jobs are limited to
+// the routes of the repo the job runs for, org-wide routes and routes of other repos are off limits.
+func JobRepositoryAllowed(c *gin.Context) bool {
+	if c.GetString(JOB_REPOSITORY_KEY) == "" {
+		return true
+	}
+	repoName := c.Param("repo")
+	return repoName != "" && repoName == c.GetString(JOB_REPO_NAME_KEY)
+}
+
+// isGithubActionsOidcToken checks the issuer of the token without verifying it, so we know which verification to apply
+func isGithubActionsOidcToken(tokenString string) bool {
+	token, _, err := new(jwt.Parser).ParseUnverified(tokenString, jwt.MapClaims{})
+	if err != nil {
+		return false
+	}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return false
+	}
+	return claims.VerifyIssuer(GITHUB_ACTIONS_OIDC_ISSUER, true)
+}
+
+// SetGithubOidcContextParameters verifies GitHub Actions OIDC token and grants access scoped to the repository
+// the job is running for. Organisation is resolved through the GitHub app installation of that repository.
+func SetGithubOidcContextParameters(c *gin.Context, stores models.Stores, keySet services.KeySource, tokenString string) error {
+	audience := githubOidcAudience()
+	if audience == "" {
+		log.Printf("GitHub OIDC tokens can't be verified, neither GITHUB_OIDC_AUDIENCE nor DIGGER_CLOUD_HOSTNAME is set")
+		return fmt.Errorf("token is invalid")
+	}
+	verifier := services.JwtVerifier{
+		KeySource: keySet,
+		Issuers:   []string{GITHUB_ACTIONS_OIDC_ISSUER},
+		Audiences: []string{audience},
+	}
+
+	claims, err := verifier.Verify(tokenString)
+	if err != nil {
+		log.Printf("Error while verifying GitHub OIDC token: %v", err)
+		return fmt.Errorf("token is invalid")
+	}
+
+	repository, _ := claims["repository"].(string)
+	repositoryOwner, _ := claims["repository_owner"].(string)
+	if repository == "" || repositoryOwner == "" {
+		log.Printf("GitHub OIDC token doesn't have repository claims")
+		return fmt.Errorf("token is invalid")
+	}
+	if !strings.HasPrefix(repository, repositoryOwner+"/") {
+		log.Printf("repository %v doesn't belong to repository owner %v", repository, repositoryOwner)
+		return fmt.Errorf("token is invalid")
+	}
+
+	repositoryId, err := strconv.ParseInt(fmt.Sprintf("%v", claims["repository_id"]), 10, 64)
+	if err != nil {
+		log.Printf("GitHub OIDC token for %v doesn't have a valid repository_id claim", repository)
+		return fmt.Errorf("token is invalid")
+	}
+
+	link, repo, err := githubOidcRepo(stores.Github, repository, repositoryOwner, repositoryId)
+	if err != nil {
+		return err
+	}
+	if repo == nil {
+		log.Printf("No repo with GitHub id %v found for %v", repositoryId, repository)
+		return fmt.Errorf("token is invalid")
+	}
+
+	// the job is allowed to act only on the repo it has been dispatched for
+	diggerRepoName := repo.Name
+	if repoParam := c.Param("repo"); repoParam != "" && repoParam != diggerRepoName {
+		log.Printf("GitHub OIDC token for %v can't be used for repo %v", repository, repoParam)
+		return fmt.Errorf("token is not allowed to access repo %v", repoParam)
+	}
+
+	c.Set(ORGANISATION_ID_KEY, link.OrganisationId)
+	c.Set(ROLE_KEY, string(models.RoleOperator))
+	c.Set(JOB_REPOSITORY_KEY, repository)
+	c.Set(JOB_REPO_NAME_KEY, diggerRepoName)
+	c.Set(ACTOR_KEY, "github-actions:"+repository)
+	log.Printf("GitHub OIDC token accepted for repo %v, org id %v\n", repository, link.OrganisationId)
+	return nil
+}
+
+// githubOidcRepo finds the repo a GitHub Actions job runs for. The token is issued by github.com, so only installations
+// of github.com apps are considered, and the repo has to exist with the GitHub id of the token in the linked organisation.
+func githubOidcRepo(github models.GithubStore, repository string, repositoryOwner string, repositoryId int64) (*models.GithubAppInstallationLink, *models.Repo, error) {
+	installations, err := github.GetGithubAppInstallationsForRepo(repository)
+	if err != nil {
+		log.Printf("Error while fetching GitHub app installations for repo %v: %v", repository, err)
+		return nil, nil, err
+	}
+	for _, installation := range installations {
+		if !strings.EqualFold(installation.Login, repositoryOwner) {
+			continue
+		}
+		app, err := github.GetGithubApp(installation.GithubAppId)
+		if errors.Is(err, models.ErrGithubAppNotFound) {
+			continue
+		}
+		if err != nil {
+			log.Printf("Error while fetching GitHub app %v: %v", installation.GithubAppId, err)
+			return nil, nil, err
+		}
+		if app.IsEnterprise() {
+			continue
+		}
+
+		link, err := github.GetGithubAppInstallationLink(installation.GithubInstallationId)
+		if err != nil {
+			log.Printf("Error while fetching GitHub app installation link: %v", err)
+			return nil, nil, err
+		}
+		if link == nil {
+			log.Printf("GitHub app installation %v is not linked to any organisation", installation.GithubInstallationId)
+			continue
+		}
+
+		repo, err := github.GetRepoByGithubId(link.OrganisationId, repositoryId)
+		if err != nil {
+			log.Printf("Error while fetching repo for GitHub repository %v: %v", repositoryId, err)
+			return nil, nil, err
+		}
+		if repo != nil {
+			return link, repo, nil
+		}
+	}
+	return nil, nil, nil
+}
@@ -0,0 +1,270 @@
+package middleware
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"digger.dev/cloud/models"
+	"digger.dev/cloud/services"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt"
+	"github.com/stretchr/testify/assert"
+)
+
+func setupSuite(tb testing.TB) (func(tb testing.TB), *models.Database, *models.Organisation) {
+	log.Println("setup suite")
+
+	// database file name
+	dbName := "database_middleware_test.db"
+
+	// create a new database with the migrated schema
+	database, err := models.NewTestDatabase(dbName)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	org, err := database.CreateOrganisation("testOrg", "test", "11111111-1111-1111-1111-111111111111")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Return a function to teardown the test
+	return func(tb testing.TB) {
+		log.Println("teardown suite")
+		err = os.Remove(dbName)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}, database, org
+}
+
+func init() {
+	log.SetOutput(os.Stdout)
+	log.SetFlags(log.Ldate | log.Ltime | log.Lshortfile)
+	gin.SetMode(gin.TestMode)
+}
+
+// startJwksServer serves public part of the key the same way GitHub does it for Actions OIDC tokens
+func startJwksServer(key *rsa.PrivateKey, kid string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kid": kid,
+				"kty": "RSA",
+				"use": "sig",
+				"alg": "RS256",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	}))
+}
+
+const testDiggerHostname = "https://digger.example.com"
+
+const testGithubRepoId = int64(647152016)
+
+func signGithubOidcToken(t *testing.T, key *rsa.PrivateKey, kid string, repository string, owner string) string {
+	return signGithubOidcTokenFor(t, key, kid, repository, owner, testDiggerHostname)
+}
+
+func signGithubOidcTokenFor(t *testing.T, key *rsa.PrivateKey, kid string, repository string, owner string, audience string) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss":              GITHUB_ACTIONS_OIDC_ISSUER,
+		"aud":              audience,
+		"sub":              "repo:" + repository + ":ref:refs/heads/main",
+		"repository":       repository,
+		"repository_owner": owner,
+		"repository_id":    fmt.Sprint(testGithubRepoId),
+		"iat":              time.Now().Unix(),
+		"exp":              time.Now().Add(5 * time.Minute).Unix(),
+	})
+	token.Header["kid"] = kid
+	signed, err := token.SignedString(key)
+	assert.NoError(t, err)
+	return signed
+}
+
+// installGithubOidcRepo installs the app with the given GHES api url on diggerhq/github-job-scheduler and links it to the org
+func installGithubOidcRepo(t *testing.T, database *models.Database, org *models.Organisation, githubApiUrl string) {
+	installationId := int64(41584295)
+	app := &models.GithubApp{Name: "digger", GithubId: 1, GithubApiUrl: githubApiUrl}
+	err := database.GormDB.Save(app).Error
+	assert.NoError(t, err)
+	_, err = database.CreateGithubAppInstallation(installationId, app.GithubId, "diggerhq", 1, "diggerhq/github-job-scheduler")
+	assert.NoError(t, err)
+	_, err = database.CreateGithubInstallationLink(org, installationId)
+	assert.NoError(t, err)
+	_, err = database.GetOrCreateGithubRepo(org, installationId, testGithubRepoId, "diggerhq", "github-job-scheduler", "")
+	assert.NoError(t, err)
+}
+
+func setupOidcRouter(stores models.Stores) *gin.Engine {
+	r := gin.New()
+	r.Use(BearerTokenAuth(stores, services.Auth{}))
+	r.GET("/repos/:repo/projects", RequirePermission(stores, models.PermissionRead), func(c *gin.Context) {
+		c.String(http.StatusOK, "%v %v", c.GetUint(ORGANISATION_ID_KEY), c.GetString(ROLE_KEY))
+	})
+	r.GET("/orgs/:organisation/projects", RequirePermission(stores, models.PermissionRead), func(c *gin.Context) {
+		c.String(http.StatusOK, "%v", c.GetUint(ORGANISATION_ID_KEY))
+	})
+	return r
+}
+
+func TestGithubOidcTokenIsMappedToOrganisation(t *testing.T) {
+	teardownSuite, database, org := setupSuite(t)
+	defer teardownSuite(t)
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	server := startJwksServer(key, "test-kid")
+	defer server.Close()
+	GithubOidcKeySet = services.NewJwksKeySet(server.URL)
+	t.Setenv("DIGGER_CLOUD_HOSTNAME", testDiggerHostname)
+
+	installGithubOidcRepo(t, database, org, "")
+
+	r := setupOidcRouter(database.Stores())
+	token := signGithubOidcToken(t, key, "test-kid", "diggerhq/github-job-scheduler", "diggerhq")
+
+	req := httptest.NewRequest(http.MethodGet, "/repos/diggerhq-github-job-scheduler/projects", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "1 operator", w.Body.String())
+
+	// the same token can't be used for another repo of the organisation
+	req = httptest.NewRequest(http.MethodGet, "/repos/diggerhq-another-repo/projects", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	// nor for routes of the whole organisation
+	req = httptest.NewRequest(http.MethodGet, "/orgs/testOrg/projects", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	// tokens requested for the default audience of GitHub aren't meant for Digger
+	token = signGithubOidcTokenFor(t, key, "test-kid", "diggerhq/github-job-scheduler", "diggerhq", "https://github.com/diggerhq")
+	req = httptest.NewRequest(http.MethodGet, "/repos/diggerhq-github-job-scheduler/projects", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
+
+func TestGithubOidcTokenWithoutInstallationIsRejected(t *testing.T) {
+	teardownSuite, database, _ := setupSuite(t)
+	defer teardownSuite(t)
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	server := startJwksServer(key, "test-kid")
+	defer server.Close()
+	GithubOidcKeySet = services.NewJwksKeySet(server.URL)
+	t.Setenv("DIGGER_CLOUD_HOSTNAME", testDiggerHostname)
+
+	r := setupOidcRouter(database.Stores())
+	token := signGithubOidcToken(t, key, "test-kid", "someone/unknown", "someone")
+
+	req := httptest.NewRequest(http.MethodGet, "/repos/someone-unknown/projects", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
+
+func TestGithubOidcTokenSignedByUnknownKeyIsRejected(t *testing.T) {
+	teardownSuite, database, org := setupSuite(t)
+	defer teardownSuite(t)
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	server := startJwksServer(key, "test-kid")
+	defer server.Close()
+	GithubOidcKeySet = services.NewJwksKeySet(server.URL)
+	t.Setenv("DIGGER_CLOUD_HOSTNAME", testDiggerHostname)
+
+	installGithubOidcRepo(t, database, org, "")
+
+	r := setupOidcRouter(database.Stores())
+	token := signGithubOidcToken(t, otherKey, "test-kid", "diggerhq/github-job-scheduler", "diggerhq")
+
+	req := httptest.NewRequest(http.MethodGet, "/repos/diggerhq-github-job-scheduler/projects", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
+
+func TestGithubOidcTokenForUnknownRepositoryIdIsRejected(t *testing.T) {
+	teardownSuite, database, org := setupSuite(t)
+	defer teardownSuite(t)
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	server := startJwksServer(key, "test-kid")
+	defer server.Close()
+	GithubOidcKeySet = services.NewJwksKeySet(server.URL)
+	t.Setenv("DIGGER_CLOUD_HOSTNAME", testDiggerHostname)
+
+	// the installation covers the name, but the org has no repo with the GitHub id of the token
+	installationId := int64(41584295)
+	_, err = database.CreateGithubApp("digger", 1, "")
+	assert.NoError(t, err)
+	_, err = database.CreateGithubAppInstallation(installationId, 1, "diggerhq", 1, "diggerhq/github-job-scheduler")
+	assert.NoError(t, err)
+	_, err = database.CreateGithubInstallationLink(org, installationId)
+	assert.NoError(t, err)
+	_, err = database.GetOrCreateGithubRepo(org, installationId, testGithubRepoId+1, "diggerhq", "github-job-scheduler", "")
+	assert.NoError(t, err)
+
+	r := setupOidcRouter(database.Stores())
+	token := signGithubOidcToken(t, key, "test-kid", "diggerhq/github-job-scheduler", "diggerhq")
+
+	req := httptest.NewRequest(http.MethodGet, "/repos/diggerhq-github-job-scheduler/projects", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
+
+func TestGithubOidcTokenForEnterpriseInstallationIsRejected(t *testing.T) {
+	teardownSuite, database, org := setupSuite(t)
+	defer teardownSuite(t)
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	server := startJwksServer(key, "test-kid")
+	defer server.Close()
+	GithubOidcKeySet = services.NewJwksKeySet(server.URL)
+	t.Setenv("DIGGER_CLOUD_HOSTNAME", testDiggerHostname)
+
+	// tokens of github.com workflows can't act on a GHES repository of the same name
+	installGithubOidcRepo(t, database, org, "https://ghes.example.com/api/v3")
+
+	r := setupOidcRouter(database.Stores())
+	token := signGithubOidcToken(t, key, "test-kid", "diggerhq/github-job-scheduler", "diggerhq")
+
+	req := httptest.NewRequest(http.MethodGet, "/repos/diggerhq-github-job-scheduler/projects", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
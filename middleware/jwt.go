@@ -8,12 +8,11 @@ import (
 	"github.com/golang-jwt/jwt"
 	"log"
 	"net/http"
-	"os"
 	"strings"
 )
 
-func SetContextParameters(c *gin.Context, auth services.Auth, token *jwt.Token) error {
-	if claims, ok := token.Claims.(jwt.MapClaims); ok {
+func SetContextParameters(c *gin.Context, stores models.Stores, auth services.Auth, claims jwt.MapClaims) error {
+	if claims != nil {
 		if claims.Valid() != nil {
 			log.Printf("Token's claim is invalid")
 			return fmt.Errorf("token is invalid")
@@ -27,7 +26,7 @@ func SetContextParameters(c *gin.Context, auth services.Auth, token *jwt.Token)
 		tenantId = tenantId.(string)
 		log.Printf("tenantId: %s", tenantId)
 
-		org, err := models.DB.GetOrganisation(tenantId)
+		org, err := stores.Orgs.GetOrganisation(tenantId)
 		if err != nil {
 			log.Printf("Error while fetching organisation: %v", err)
 			return err
@@ -37,10 +36,24 @@ func SetContextParameters(c *gin.Context, auth services.Auth, token *jwt.Token)
 		}
 
 		c.Set(ORGANISATION_ID_KEY, org.ID)
+		c.Set(ACTOR_KEY, fmt.Sprintf("user:%v", claims["sub"]))
 
 		log.Printf("set org id %v\n", org.ID)
 
-		tokenType := claims["type"].(string)
+		// tokens without a type are user tokens
+		tokenType, _ := claims["type"].(string)
+
+		// role grants apply to users logged in with JWT too, the subject is matched to the users digger knows
+		if subject, ok := claims["sub"].(string); ok && subject != "" && tokenType != "tenantAccessToken" {
+			user, err := stores.Members.GetUserByExternalId(subject)
+			if err != nil {
+				log.Printf("Error while fetching user %v: %v", subject, err)
+				return err
+			}
+			if user != nil {
+				c.Set(USER_ID_KEY, user.ID)
+			}
+		}
 
 		permissions := make([]string, 0)
 		if tokenType == "tenantAccessToken" {
@@ -62,13 +75,13 @@ func SetContextParameters(c *gin.Context, auth services.Auth, token *jwt.Token)
 		}
 		for _, permission := range permissions {
 			if permission == "digger.all.*" {
-				c.Set(ACCESS_LEVEL_KEY, models.AdminPolicyType)
+				c.Set(ROLE_KEY, string(models.RoleOrgAdmin))
 				return nil
 			}
 		}
 		for _, permission := range permissions {
 			if permission == "digger.all.read.*" {
-				c.Set(ACCESS_LEVEL_KEY, models.AccessPolicyType)
+				c.Set(ROLE_KEY, string(models.RoleOperator))
 				return nil
 			}
 		}
@@ -79,7 +92,7 @@ func SetContextParameters(c *gin.Context, auth services.Auth, token *jwt.Token)
 	return nil
 }
 
-func WebAuth(auth services.Auth) gin.HandlerFunc {
+func WebAuth(stores models.Stores, auth services.Auth) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		var tokenString string
 		tokenString, err := c.Cookie("token")
@@ -95,64 +108,46 @@ func WebAuth(auth services.Auth) gin.HandlerFunc {
 			return
 		}
 
-		jwtPublicKey := os.Getenv("JWT_PUBLIC_KEY")
-		if jwtPublicKey == "" {
-			log.Printf("No JWT_PUBLIC_KEY environment variable provided")
-			c.String(http.StatusInternalServerError, "Error occurred while reading public key")
-			c.Abort()
-			return
-		}
-		publicKeyData := []byte(jwtPublicKey)
-
-		publicKey, err := jwt.ParseRSAPublicKeyFromPEM(publicKeyData)
+		verifier, err := services.GetJwtVerifier()
 		if err != nil {
-			log.Printf("Error while parsing public key: %v", err.Error())
-			c.String(http.StatusInternalServerError, "Error occurred while parsing public key")
+			log.Printf("JWT verifier isn't configured: %v", err)
+			c.String(http.StatusInternalServerError, "Error occurred while reading public key")
 			c.Abort()
 			return
 		}
 
 		// validate token
-		token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-			if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
-				return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-			}
-			return publicKey, nil
-		})
+		claims, err := verifier.Verify(tokenString)
 		if err != nil {
-			log.Printf("can't parse a token, %v\n", err)
+			if ve, ok := err.(*jwt.ValidationError); ok {
+				if ve.Errors&jwt.ValidationErrorMalformed != 0 {
+					log.Println("That's not even a token")
+				} else if ve.Errors&(jwt.ValidationErrorExpired|jwt.ValidationErrorNotValidYet) != 0 {
+					log.Println("Token is either expired or not active yet")
+				} else {
+					log.Println("Couldn't handle this token:", err)
+				}
+			} else {
+				log.Println("Couldn't handle this token:", err)
+			}
 			c.AbortWithStatus(http.StatusForbidden)
 			return
 		}
 
-		if token.Valid {
-			err = SetContextParameters(c, auth, token)
-			if err != nil {
-				log.Printf("Error while setting context parameters: %v", err)
-				c.String(http.StatusForbidden, "Failed to parse token")
-				c.Abort()
-				return
-			}
-
-			c.Next()
+		err = SetContextParameters(c, stores, auth, claims)
+		if err != nil {
+			log.Printf("Error while setting context parameters: %v", err)
+			c.String(http.StatusForbidden, "Failed to parse token")
+			c.Abort()
 			return
-		} else if ve, ok := err.(*jwt.ValidationError); ok {
-			if ve.Errors&jwt.ValidationErrorMalformed != 0 {
-				log.Println("That's not even a token")
-			} else if ve.Errors&(jwt.ValidationErrorExpired|jwt.ValidationErrorNotValidYet) != 0 {
-				log.Println("Token is either expired or not active yet")
-			} else {
-				log.Println("Couldn't handle this token:", err)
-			}
-		} else {
-			log.Println("Couldn't handle this token:", err)
 		}
 
-		c.AbortWithStatus(http.StatusForbidden)
+		c.Next()
 	}
 }
 
-func SecretCodeAuth() gin.HandlerFunc {
+// SecretCodeAuth checks the x-webhook-secret header is signed with the webhook_secret secret, or WEBHOOK_SECRET if it isn't stored
+func SecretCodeAuth(secrets models.SecretStore) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		secret := c.Request.Header.Get("x-webhook-secret")
 		if secret == "" {
@@ -161,11 +156,18 @@ func SecretCodeAuth() gin.HandlerFunc {
 			c.Abort()
 			return
 		}
-		_, err := jwt.Parse(secret, func(token *jwt.Token) (interface{}, error) {
+		webhookSecret, err := secrets.GetSecretOrEnv("webhook_secret", "WEBHOOK_SECRET")
+		if err != nil {
+			log.Printf("Error reading webhook secret: %v", err)
+			c.String(http.StatusInternalServerError, "Error reading webhook secret")
+			c.Abort()
+			return
+		}
+		_, err = jwt.Parse(secret, func(token *jwt.Token) (interface{}, error) {
 			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
 				return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
 			}
-			return []byte(os.Getenv("WEBHOOK_SECRET")), nil
+			return []byte(webhookSecret), nil
 		})
 
 		if err != nil {
@@ -178,7 +180,7 @@ func SecretCodeAuth() gin.HandlerFunc {
 	}
 }
 
-func BearerTokenAuth(auth services.Auth) gin.HandlerFunc {
+func BearerTokenAuth(stores models.Stores, auth services.Auth) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		authHeader := c.Request.Header.Get("Authorization")
 		if authHeader == "" {
@@ -194,63 +196,48 @@ func BearerTokenAuth(auth services.Auth) gin.HandlerFunc {
 		}
 
 		if strings.HasPrefix(token, "t:") {
-			var dbToken models.Token
-
-			token, err := models.DB.GetToken(token)
-			if token == nil {
-				c.String(http.StatusForbidden, "Invalid bearer token")
-				c.Abort()
-				return
-			}
-
+			dbToken, err := stores.Orgs.GetToken(token)
 			if err != nil {
 				log.Printf("Error while fetching token from database: %v", err)
 				c.String(http.StatusInternalServerError, "Error occurred while fetching database")
 				c.Abort()
 				return
 			}
-			c.Set(ORGANISATION_ID_KEY, dbToken.OrganisationID)
-			c.Set(ACCESS_LEVEL_KEY, dbToken.Type)
-		} else {
-			jwtPublicKey := os.Getenv("JWT_PUBLIC_KEY")
-			if jwtPublicKey == "" {
-				log.Printf("No JWT_PUBLIC_KEY environment variable provided")
-				c.String(http.StatusInternalServerError, "Error occurred while reading public key")
+
+			if dbToken == nil {
+				c.String(http.StatusForbidden, "Invalid bearer token")
 				c.Abort()
 				return
 			}
-			publicKeyData := []byte(jwtPublicKey)
-
-			publicKey, err := jwt.ParseRSAPublicKeyFromPEM(publicKeyData)
+			c.Set(ORGANISATION_ID_KEY, dbToken.OrganisationID)
+			c.Set(ROLE_KEY, string(models.TokenRole(dbToken.Type)))
+			c.Set(ACTOR_KEY, fmt.Sprintf("token:%v", dbToken.ID))
+		} else if isGithubActionsOidcToken(token) {
+			err := SetGithubOidcContextParameters(c, stores, GithubOidcKeySet, token)
 			if err != nil {
-				log.Printf("Error while parsing public key: %v", err.Error())
-				c.String(http.StatusInternalServerError, "Error occurred while parsing public key")
+				log.Printf("Error while verifying GitHub OIDC token: %v", err)
+				c.String(http.StatusForbidden, "Authorization header is invalid")
 				c.Abort()
 				return
 			}
-
-			token, err := jwt.Parse(token, func(token *jwt.Token) (interface{}, error) {
-				if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
-					return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-				}
-				return publicKey, nil
-			})
-
+		} else {
+			verifier, err := services.GetJwtVerifier()
 			if err != nil {
-				log.Printf("Error while parsing token: %v", err.Error())
-				c.String(http.StatusForbidden, "Authorization header is invalid")
+				log.Printf("JWT verifier isn't configured: %v", err)
+				c.String(http.StatusInternalServerError, "Error occurred while reading public key")
 				c.Abort()
 				return
 			}
 
-			if !token.Valid {
-				log.Printf("Token is invalid")
+			claims, err := verifier.Verify(token)
+			if err != nil {
+				log.Printf("Error while parsing token: %v", err.Error())
 				c.String(http.StatusForbidden, "Authorization header is invalid")
 				c.Abort()
 				return
 			}
 
-			err = SetContextParameters(c, auth, token)
+			err = SetContextParameters(c, stores, auth, claims)
 			if err != nil {
 				log.Printf("Error while setting context parameters: %v", err)
 				c.String(http.StatusForbidden, "Failed to parse token")
@@ -263,20 +250,6 @@ func BearerTokenAuth(auth services.Auth) gin.HandlerFunc {
 	}
 }
 
-func AccessLevel(allowedAccessLevels ...string) gin.HandlerFunc {
-	return func(c *gin.Context) {
-		accessLevel := c.GetString(ACCESS_LEVEL_KEY)
-		for _, allowedAccessLevel := range allowedAccessLevels {
-			if accessLevel == allowedAccessLevel {
-				c.Next()
-				return
-			}
-		}
-		c.String(http.StatusForbidden, "Not allowed to access this resource with this access level")
-		c.Abort()
-	}
-}
-
 func CORSMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
@@ -294,4 +267,9 @@ func CORSMiddleware() gin.HandlerFunc {
 }
 
 const ORGANISATION_ID_KEY = "organisation_ID"
-const ACCESS_LEVEL_KEY = "access_level"
+const ROLE_KEY = "role"
+const USER_ID_KEY = "user_id"
+const ACTOR_KEY = "actor"
+const REQUEST_ID_KEY = "request_id"
+const JOB_REPOSITORY_KEY = "job_repository"
+const JOB_REPO_NAME_KEY = "job_repo_name"
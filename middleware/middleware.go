@@ -1,6 +1,7 @@
 package middleware
 
 import (
+	"digger.dev/cloud/models"
 	"digger.dev/cloud/services"
 	"github.com/gin-gonic/gin"
 	"log"
@@ -8,7 +9,8 @@ import (
 	"os"
 )
 
-func GetWebMiddleware() gin.HandlerFunc {
+// GetWebMiddleware returns the authentication of web routes configured with JWT_AUTH, OIDC_AUTH, HTTP_BASIC_AUTH or NOOP_AUTH
+func GetWebMiddleware(stores models.Stores) gin.HandlerFunc {
 	if _, ok := os.LookupEnv("JWT_AUTH"); ok {
 		log.Printf("Using JWT middleware for web routes")
 		auth := services.Auth{
@@ -17,20 +19,24 @@ func GetWebMiddleware() gin.HandlerFunc {
 			Secret:     os.Getenv("AUTH_SECRET"),
 			ClientId:   os.Getenv("FRONTEGG_CLIENT_ID"),
 		}
-		return WebAuth(auth)
+		return WebAuth(stores, auth)
+	} else if _, ok := os.LookupEnv("OIDC_AUTH"); ok {
+		log.Printf("Using OIDC session middleware for web routes")
+		return OidcWebAuth(stores)
 	} else if _, ok := os.LookupEnv("HTTP_BASIC_AUTH"); ok {
 		log.Printf("Using http basic auth middleware for web routes")
-		return HttpBasicWebAuth()
+		return HttpBasicWebAuth(stores)
 	} else if _, ok := os.LookupEnv("NOOP_AUTH"); ok {
 		log.Printf("Using noop auth for web routes")
 		return NoopWebAuth()
 	} else {
-		log.Fatalf("Please specify one of JWT_AUTH or HTTP_BASIC_AUTH")
+		log.Fatalf("Please specify one of JWT_AUTH, OIDC_AUTH or HTTP_BASIC_AUTH")
 		return nil
 	}
 }
 
-func GetApiMiddleware() gin.HandlerFunc {
+// GetApiMiddleware returns the authentication of API routes, the same variables as for web routes choose it
+func GetApiMiddleware(stores models.Stores) gin.HandlerFunc {
 	if _, ok := os.LookupEnv("JWT_AUTH"); ok {
 		log.Printf("Using JWT middleware for API routes")
 		auth := services.Auth{
@@ -39,14 +45,18 @@ func GetApiMiddleware() gin.HandlerFunc {
 			Secret:     os.Getenv("AUTH_SECRET"),
 			ClientId:   os.Getenv("FRONTEGG_CLIENT_ID"),
 		}
-		return BearerTokenAuth(auth)
+		return BearerTokenAuth(stores, auth)
+	} else if _, ok := os.LookupEnv("OIDC_AUTH"); ok {
+		// with OIDC login API is used with digger issued tokens or GitHub Actions OIDC tokens
+		log.Printf("Using bearer token middleware for API routes")
+		return BearerTokenAuth(stores, services.Auth{})
 	} else if _, ok := os.LookupEnv("HTTP_BASIC_AUTH"); ok {
 		log.Printf("Using http basic auth middleware for API routes")
-		return HttpBasicApiAuth()
+		return HttpBasicApiAuth(stores)
 	} else if _, ok := os.LookupEnv("NOOP_AUTH"); ok {
 		return NoopApiAuth()
 	} else {
-		log.Fatalf("Please specify one of JWT_AUTH or HTTP_BASIC_AUTH")
+		log.Fatalf("Please specify one of JWT_AUTH, OIDC_AUTH or HTTP_BASIC_AUTH")
 		return nil
 	}
 }
@@ -0,0 +1,70 @@
+package middleware
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"digger.dev/cloud/models"
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+)
+
+// session keys set by the OIDC callback once the id token is verified
+const OIDC_SESSION_ORGANISATION_ID_KEY = "oidc_organisation_id"
+const OIDC_SESSION_USER_ID_KEY = "oidc_user_id"
+const OIDC_SESSION_SUBJECT_KEY = "oidc_subject"
+const OIDC_SESSION_EXPIRES_AT_KEY = "oidc_expires_at"
+
+// OidcWebAuth reads the user logged in with OIDC from the session, users without valid session are sent to the login page.
+// Membership of the user is loaded on every request, so removing members and changing their roles takes effect at once.
+func OidcWebAuth(stores models.Stores) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		session := sessions.Default(c)
+		orgId, ok := session.Get(OIDC_SESSION_ORGANISATION_ID_KEY).(uint)
+		userId, _ := session.Get(OIDC_SESSION_USER_ID_KEY).(uint)
+		subject, _ := session.Get(OIDC_SESSION_SUBJECT_KEY).(string)
+		expiresAt, _ := session.Get(OIDC_SESSION_EXPIRES_AT_KEY).(int64)
+		if !ok || time.Now().Unix() > expiresAt {
+			log.Printf("no valid oidc session, redirecting to login")
+			redirectToOidcLogin(c)
+			return
+		}
+
+		membership, err := stores.Members.GetOrgMembership(orgId, userId)
+		if err != nil {
+			log.Printf("Error while fetching membership of user %v in org %v: %v", userId, orgId, err)
+			c.String(http.StatusInternalServerError, "Error while checking the session")
+			c.Abort()
+			return
+		}
+		if membership == nil || membership.Status != models.MembershipActive || membership.User.ExternalId != subject {
+			log.Printf("user %v is no longer an active member of org %v, redirecting to login", userId, orgId)
+			session.Clear()
+			err = session.Save()
+			if err != nil {
+				log.Printf("Error while clearing session: %v", err)
+			}
+			redirectToOidcLogin(c)
+			return
+		}
+
+		c.Set(ORGANISATION_ID_KEY, orgId)
+		c.Set(ROLE_KEY, string(membership.Role))
+		c.Set(USER_ID_KEY, userId)
+		c.Set(ACTOR_KEY, fmt.Sprintf("user:%v", userId))
+		c.Next()
+	}
+}
+
+func redirectToOidcLogin(c *gin.Context) {
+	if c.Request.Method != http.MethodGet {
+		c.String(http.StatusForbidden, "Session expired, please log in again")
+		c.Abort()
+		return
+	}
+	c.Redirect(http.StatusFound, "/oidc/login?next="+url.QueryEscape(c.Request.URL.RequestURI()))
+	c.Abort()
+}
@@ -0,0 +1,126 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"digger.dev/cloud/models"
+	"digger.dev/cloud/services"
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-contrib/sessions/cookie"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOidcWebAuthLoadsMembershipOnEveryRequest(t *testing.T) {
+	teardownSuite, database, org := setupSuite(t)
+	defer teardownSuite(t)
+
+	user, err := database.CreateUser("dev@digger.dev", "dev@digger.dev", "dev")
+	assert.NoError(t, err)
+	_, err = database.UpsertOrgMembership(org.ID, user, models.RoleViewer, models.MembershipActive)
+	assert.NoError(t, err)
+
+	r := gin.New()
+	r.Use(sessions.Sessions("digger-session", cookie.NewStore([]byte("secret"))))
+	r.GET("/login", func(c *gin.Context) {
+		session := sessions.Default(c)
+		session.Set(OIDC_SESSION_ORGANISATION_ID_KEY, org.ID)
+		session.Set(OIDC_SESSION_USER_ID_KEY, user.ID)
+		session.Set(OIDC_SESSION_SUBJECT_KEY, "dev")
+		session.Set(OIDC_SESSION_EXPIRES_AT_KEY, time.Now().Add(time.Hour).Unix())
+		assert.NoError(t, session.Save())
+	})
+	r.GET("/projects/", OidcWebAuth(database.Stores()), func(c *gin.Context) {
+		c.String(http.StatusOK, c.GetString(ROLE_KEY))
+	})
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/login", nil))
+	sessionCookie := w.Header().Get("Set-Cookie")
+	getProjects := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/projects/", nil)
+		req.Header.Set("Cookie", sessionCookie)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	w = getProjects()
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "viewer", w.Body.String())
+
+	_, err = database.UpsertOrgMembership(org.ID, user, models.RoleOrgAdmin, models.MembershipActive)
+	assert.NoError(t, err)
+	w = getProjects()
+	assert.Equal(t, "org-admin", w.Body.String())
+
+	assert.NoError(t, database.RemoveOrgMembership(org.ID, user.ID))
+	w = getProjects()
+	assert.Equal(t, http.StatusFound, w.Code)
+}
+
+func TestJwtUserIdIsSetForKnownUsers(t *testing.T) {
+	teardownSuite, database, org := setupSuite(t)
+	defer teardownSuite(t)
+
+	user, err := database.CreateUser("dev@digger.dev", "dev@digger.dev", "frontegg-user")
+	assert.NoError(t, err)
+
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	err = SetContextParameters(c, database.Stores(), services.Auth{}, jwt.MapClaims{
+		"tenantId":    org.ExternalId,
+		"sub":         "frontegg-user",
+		"type":        "userToken",
+		"permissions": []interface{}{"digger.all.read.*"},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, user.ID, c.GetUint(USER_ID_KEY))
+	assert.Equal(t, string(models.RoleOperator), c.GetString(ROLE_KEY))
+}
+
+func TestJwtWithoutTypeIsUserToken(t *testing.T) {
+	teardownSuite, database, org := setupSuite(t)
+	defer teardownSuite(t)
+
+	user, err := database.CreateUser("dev@digger.dev", "dev@digger.dev", "frontegg-user")
+	assert.NoError(t, err)
+
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	err = SetContextParameters(c, database.Stores(), services.Auth{}, jwt.MapClaims{
+		"tenantId":    org.ExternalId,
+		"sub":         "frontegg-user",
+		"permissions": []interface{}{"digger.all.*"},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, user.ID, c.GetUint(USER_ID_KEY))
+	assert.Equal(t, string(models.RoleOrgAdmin), c.GetString(ROLE_KEY))
+}
+
+func TestWebhookSecretIsReadFromSecrets(t *testing.T) {
+	t.Setenv("WEBHOOK_SECRET", "env-secret")
+	store := models.NewMemoryStore()
+	r := gin.New()
+	r.POST("/create-org-from-frontegg", SecretCodeAuth(store.Stores().Secrets), func(c *gin.Context) {
+		c.String(http.StatusOK, "ok")
+	})
+	post := func(key string) int {
+		signed, err := jwt.New(jwt.SigningMethodHS256).SignedString([]byte(key))
+		assert.NoError(t, err)
+		req := httptest.NewRequest(http.MethodPost, "/create-org-from-frontegg", nil)
+		req.Header.Set("x-webhook-secret", signed)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusOK, post("env-secret"))
+
+	// the stored secret takes precedence over the environment variable
+	assert.NoError(t, store.SetSecret("webhook_secret", "stored-secret"))
+	assert.Equal(t, http.StatusOK, post("stored-secret"))
+	assert.Equal(t, http.StatusForbidden, post("env-secret"))
+}
@@ -0,0 +1,100 @@
+package middleware
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+
+	"digger.dev/cloud/models"
+	"github.com/gin-gonic/gin"
+)
+
+// RequirePermission lets the request through only if the role of the caller (possibly raised by a repo or project
+// grant for the resource in the route) has the permission, and the route is of the repo of the job for job tokens
+func RequirePermission(stores models.Stores, permission models.Permission) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !JobRepositoryAllowed(c) {
+			c.String(http.StatusForbidden, "Not allowed to access this resource from this repository")
+			c.Abort()
+			return
+		}
+		if !HasPermission(c, stores, permission) {
+			c.String(http.StatusForbidden, "Not allowed to access this resource with this role")
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+func HasPermission(c *gin.Context, stores models.Stores, permission models.Permission) bool {
+	role := models.Role(c.GetString(ROLE_KEY))
+	if role.HasPermission(permission) {
+		return true
+	}
+	return EffectiveRole(c, stores).HasPermission(permission)
+}
+
+// EffectiveRole returns organisation role of the caller combined with role grants for repo and project of the route
+func EffectiveRole(c *gin.Context, stores models.Stores) models.Role {
+	role := models.Role(c.GetString(ROLE_KEY))
+	userId := c.GetUint(USER_ID_KEY)
+	orgId := c.GetUint(ORGANISATION_ID_KEY)
+	if userId == 0 || orgId == 0 {
+		return role
+	}
+
+	grants, err := stores.Members.GetRoleGrants(orgId, userId)
+	if err != nil || len(grants) == 0 {
+		return role
+	}
+
+	repoId, projectId := routeRepoAndProject(c, stores, orgId)
+	for _, grant := range grants {
+		if (grant.ProjectID != nil && projectId != 0 && *grant.ProjectID == projectId) ||
+			(grant.ProjectID == nil && grant.RepoID != nil && repoId != 0 && *grant.RepoID == repoId) {
+			role = models.HighestRole(role, grant.Role)
+		}
+	}
+	return role
+}
+
+// routeRepoAndProject resolves repo and project the request is about from route parameters, 0 if route has none
+func routeRepoAndProject(c *gin.Context, stores models.Stores, orgId uint) (uint, uint) {
+	var repoId, projectId uint
+
+	if repoName := c.Param("repo"); repoName != "" {
+		repo, err := stores.Repos.GetRepo(orgId, repoName)
+		if err != nil {
+			log.Printf("Error while fetching repo %v: %v", repoName, err)
+		} else if repo != nil {
+			repoId = repo.ID
+			if projectName := c.Param("projectName"); projectName != "" {
+				project, err := stores.Projects.GetProjectByName(orgId, repo, projectName)
+				if err == nil && project != nil {
+					projectId = project.ID
+				}
+			}
+		}
+	}
+
+	if repoIdParam := c.Param("repoid"); repoIdParam != "" {
+		id, err := strconv.ParseUint(repoIdParam, 10, 32)
+		if err == nil {
+			repoId = uint(id)
+		}
+	}
+
+	if projectIdParam := c.Param("projectid"); projectIdParam != "" {
+		id, err := strconv.ParseUint(projectIdParam, 10, 32)
+		if err == nil {
+			project, err := stores.Projects.GetProjectById(orgId, uint(id))
+			if err == nil && project != nil {
+				projectId = project.ID
+				repoId = project.RepoID
+			}
+		}
+	}
+
+	return repoId, projectId
+}
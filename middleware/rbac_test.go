@@ -0,0 +1,71 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"digger.dev/cloud/models"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRoleGrantsRaisePermissionsOnlyForGrantedRepo(t *testing.T) {
+	teardownSuite, database, org := setupSuite(t)
+	defer teardownSuite(t)
+
+	testRoleGrantsRaisePermissionsOnlyForGrantedRepo(t, database.Stores(), org)
+}
+
+func TestMemoryStoreRoleGrantsRaisePermissionsOnlyForGrantedRepo(t *testing.T) {
+	store := models.NewMemoryStore()
+	org, err := store.CreateOrganisation("testOrg", "test", "11111111-1111-1111-1111-111111111111")
+	assert.NoError(t, err)
+
+	testRoleGrantsRaisePermissionsOnlyForGrantedRepo(t, store.Stores(), org)
+}
+
+func testRoleGrantsRaisePermissionsOnlyForGrantedRepo(t *testing.T, stores models.Stores, org *models.Organisation) {
+	repo, err := stores.Repos.CreateRepo("diggerhq-infra", org, "")
+	assert.NoError(t, err)
+	_, err = stores.Repos.CreateRepo("diggerhq-other", org, "")
+	assert.NoError(t, err)
+
+	user, err := stores.Members.CreateUser("dev@digger.dev", "dev@digger.dev", "dev")
+	assert.NoError(t, err)
+	_, err = stores.Members.UpsertOrgMembership(org.ID, user, models.RoleViewer, models.MembershipActive)
+	assert.NoError(t, err)
+	_, err = stores.Members.CreateRoleGrant(org.ID, user.ID, &repo.ID, nil, models.RoleOperator)
+	assert.NoError(t, err)
+
+	r := gin.New()
+	r.Use(func(c *gin.Context) {
+		c.Set(ORGANISATION_ID_KEY, org.ID)
+		c.Set(USER_ID_KEY, user.ID)
+		c.Set(ROLE_KEY, string(models.RoleViewer))
+	})
+	r.GET("/repos/:repo/projects", RequirePermission(stores, models.PermissionRead), func(c *gin.Context) {
+		c.String(http.StatusOK, "ok")
+	})
+	r.POST("/repos/:repo/report-projects", RequirePermission(stores, models.PermissionRunJobs), func(c *gin.Context) {
+		c.String(http.StatusOK, "ok")
+	})
+	r.PUT("/orgs/:organisation/access-policy", RequirePermission(stores, models.PermissionManagePolicies), func(c *gin.Context) {
+		c.String(http.StatusOK, "ok")
+	})
+
+	for _, tc := range []struct {
+		method string
+		path   string
+		code   int
+	}{
+		{http.MethodGet, "/repos/diggerhq-other/projects", http.StatusOK},
+		{http.MethodPost, "/repos/diggerhq-infra/report-projects", http.StatusOK},
+		{http.MethodPost, "/repos/diggerhq-other/report-projects", http.StatusForbidden},
+		{http.MethodPut, "/orgs/testOrg/access-policy", http.StatusForbidden},
+	} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(tc.method, tc.path, nil))
+		assert.Equal(t, tc.code, w.Code, "%v %v", tc.method, tc.path)
+	}
+}
@@ -0,0 +1,22 @@
+package middleware
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const REQUEST_ID_HEADER = "X-Request-Id"
+
+// RequestId keeps request id passed by the load balancer or generates a new one, it is returned in response headers
+// and recorded in audit events
+func RequestId() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		requestId := c.GetHeader(REQUEST_ID_HEADER)
+		if requestId == "" || len(requestId) > 128 {
+			requestId = uuid.New().String()
+		}
+		c.Set(REQUEST_ID_KEY, requestId)
+		c.Header(REQUEST_ID_HEADER, requestId)
+		c.Next()
+	}
+}
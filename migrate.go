@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+
+	"digger.dev/cloud/models"
+)
+
+// runMigrateCommand handles `migrate up`, `migrate down [steps]` and `migrate status`
+func runMigrateCommand(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: migrate up | down [steps] | status")
+	}
+
+	database, err := models.OpenDatabase()
+	if err != nil {
+		return fmt.Errorf("failed to connect to database: %v", err)
+	}
+
+	switch args[0] {
+	case "up":
+		applied, err := models.MigrateUp(database)
+		for _, m := range applied {
+			log.Printf("applied %v %v", m.Version, m.Name)
+		}
+		if err != nil {
+			return err
+		}
+		if len(applied) == 0 {
+			log.Printf("database is up to date")
+		}
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			steps, err = strconv.Atoi(args[1])
+			if err != nil || steps < 1 {
+				return fmt.Errorf("invalid number of steps: %v", args[1])
+			}
+		}
+		reverted, err := models.MigrateDown(database, steps)
+		for _, m := range reverted {
+			log.Printf("reverted %v %v", m.Version, m.Name)
+		}
+		if err != nil {
+			return err
+		}
+	case "status":
+		statuses, err := models.GetMigrationsStatus(database)
+		if err != nil {
+			return err
+		}
+		for _, s := range statuses {
+			appliedAt := "pending"
+			if s.AppliedAt != nil {
+				appliedAt = s.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			fmt.Printf("%4d  %-40s %v\n", s.Migration.Version, s.Migration.Name, appliedAt)
+		}
+	default:
+		return fmt.Errorf("unknown migrate command %v, expected up, down or status", args[0])
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	ReviewStateApproved         = "approved"
+	ReviewStateChangesRequested = "changes_requested"
+	ReviewStateCommented        = "commented"
+	ReviewStateDismissed        = "dismissed"
+)
+
+// PullRequestReview is the latest review a reviewer submitted on a pull request, like on GitHub a later review
+// replaces the earlier ones of the same reviewer
+type PullRequestReview struct {
+	gorm.Model
+	RepoFullName      string `gorm:"uniqueIndex:idx_pull_request_review"`
+	PullRequestNumber int    `gorm:"uniqueIndex:idx_pull_request_review"`
+	Reviewer          string `gorm:"uniqueIndex:idx_pull_request_review"`
+	State             string
+	// CommitSha is the head of the pull request the review was submitted for
+	CommitSha   string
+	SubmittedAt time.Time
+}
+
+// ApplyApprovalRequest is an apply job held in DiggerJobPendingApproval, it is removed once the job is released
+type ApplyApprovalRequest struct {
+	gorm.Model
+	DiggerJobId       string `gorm:"size:50;uniqueIndex"`
+	RepoFullName      string `gorm:"index:idx_apply_approval_pull_request"`
+	PullRequestNumber int    `gorm:"index:idx_apply_approval_pull_request"`
+	OrganisationID    uint
+	ProjectName       string
+	ProjectDir        string
+	RequestedBy       string
+	// Reason is why the apply was held
+	Reason string
+}
@@ -0,0 +1,89 @@
+package models
+
+import (
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// AuditEvent records a single mutating action. Events are append-only, updates and deletes are refused.
+type AuditEvent struct {
+	ID             uint      `gorm:"primarykey"`
+	CreatedAt      time.Time `gorm:"index"`
+	OrganisationID uint      `gorm:"index"`
+	// Actor identifies who made the change, e.g. user:12, token:3, github-actions:diggerhq/infra
+	Actor      string `gorm:"index"`
+	Action     string `gorm:"index"`
+	TargetType string
+	TargetId   string
+	// Before and After are JSON snapshots of the changed fields
+	Before    string
+	After     string
+	RequestId string
+	SourceIp  string
+}
+
+const (
+	AuditActionPolicyCreated        = "policy.created"
+	AuditActionPolicyUpdated        = "policy.updated"
+	AuditActionProjectUpdated       = "project.updated"
+	AuditActionRepoConfigUpdated    = "repo.config_updated"
+	AuditActionTokenIssued          = "token.issued"
+	AuditActionJobStatusUpdated     = "job.status_updated"
+	AuditActionMemberInvited        = "member.invited"
+	AuditActionMemberUpdated        = "member.updated"
+	AuditActionMemberRemoved        = "member.removed"
+	AuditActionRoleGrantCreated     = "role_grant.created"
+	AuditActionRoleGrantDeleted     = "role_grant.deleted"
+	AuditActionVariableUpdated      = "project_variable.updated"
+	AuditActionVariableDeleted      = "project_variable.deleted"
+	AuditActionDriftScheduleUpdated = "drift_schedule.updated"
+	AuditActionGithubAppCreated     = "github_app.created"
+	AuditActionGithubInstallLinked  = "github_installation.linked"
+)
+
+func (e *AuditEvent) BeforeUpdate(tx *gorm.DB) error {
+	return fmt.Errorf("audit events can't be updated")
+}
+
+func (e *AuditEvent) BeforeDelete(tx *gorm.DB) error {
+	return fmt.Errorf("audit events can't be deleted")
+}
+
+func (e *AuditEvent) MapToJsonStruct() interface{} {
+	return struct {
+		Id         uint      `json:"id"`
+		CreatedAt  time.Time `json:"createdAt"`
+		Actor      string    `json:"actor"`
+		Action     string    `json:"action"`
+		TargetType string    `json:"targetType"`
+		TargetId   string    `json:"targetId"`
+		Before     string    `json:"before"`
+		After      string    `json:"after"`
+		RequestId  string    `json:"requestId"`
+		SourceIp   string    `json:"sourceIp"`
+	}{
+		Id:         e.ID,
+		CreatedAt:  e.CreatedAt,
+		Actor:      e.Actor,
+		Action:     e.Action,
+		TargetType: e.TargetType,
+		TargetId:   e.TargetId,
+		Before:     e.Before,
+		After:      e.After,
+		RequestId:  e.RequestId,
+		SourceIp:   e.SourceIp,
+	}
+}
+
+type AuditEventFilter struct {
+	Actor      string
+	Action     string
+	TargetType string
+	TargetId   string
+	From       *time.Time
+	To         *time.Time
+	Limit      int
+	Offset     int
+}
@@ -0,0 +1,178 @@
+package models
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// DriftSchedule runs drift detection for a project, Cron is a five field cron expression evaluated in UTC
+type DriftSchedule struct {
+	gorm.Model
+	ProjectID uint `gorm:"uniqueIndex"`
+	Project   *Project
+	Cron      string
+	Enabled   bool
+	// NextRunAt is when the scheduler checks the project next, it is advanced before the check is dispatched
+	NextRunAt time.Time `gorm:"index"`
+	LastRunAt *time.Time
+}
+
+const (
+	DriftReportPending = "pending"
+	DriftReportNoDrift = "no_drift"
+	DriftReportDrifted = "drifted"
+	DriftReportFailed  = "failed"
+)
+
+// DriftReport is the result of one drift check, a plan of the default branch. It is pending until the runner
+// reports the run of its job.
+type DriftReport struct {
+	gorm.Model
+	ProjectID   uint `gorm:"index"`
+	Project     *Project
+	DiggerJobId string `gorm:"size:50;index"`
+	CommitSha   string
+	// ProjectRunID is the run the runner reported for the job, its resource changes are the drift
+	ProjectRunID *uint
+	Status       string
+	ChangeCount  int
+	// Alert is set when the drift policy doesn't accept the drift, Reason explains the decision or the failure
+	Alert       bool
+	Reason      string
+	CompletedAt *time.Time
+}
+
+// SchedulerLease makes one replica the leader of a background job, the holder has to renew it before ExpiresAt
+type SchedulerLease struct {
+	Name      string `gorm:"primaryKey"`
+	Holder    string
+	ExpiresAt time.Time
+}
+
+func (s *DriftSchedule) MapToJsonStruct() interface{} {
+	return struct {
+		Cron      string     `json:"cron"`
+		Enabled   bool       `json:"enabled"`
+		NextRunAt time.Time  `json:"nextRunAt"`
+		LastRunAt *time.Time `json:"lastRunAt"`
+	}{
+		Cron:      s.Cron,
+		Enabled:   s.Enabled,
+		NextRunAt: s.NextRunAt,
+		LastRunAt: s.LastRunAt,
+	}
+}
+
+// ProjectDrift is the drift state of a project, how its last check went and since when it has been drifting
+type ProjectDrift struct {
+	Project  Project
+	Schedule *DriftSchedule
+	// LastReport is the last completed check, nil if no check completed yet
+	LastReport *DriftReport
+	// DriftingSince is when the first of the drifted checks since the last check without drift ran,
+	// nil if the project isn't drifting. Failed checks don't end drift.
+	DriftingSince *time.Time
+	// ResourceChanges are the changes the last check found, without data source reads
+	ResourceChanges []ProjectRunResourceChange
+}
+
+// driftedChanges drops data source reads, they happen on every plan
+func driftedChanges(changes []ProjectRunResourceChange) []ProjectRunResourceChange {
+	drifted := make([]ProjectRunResourceChange, 0, len(changes))
+	for _, change := range changes {
+		if change.Action != ResourceActionRead {
+			drifted = append(drifted, change)
+		}
+	}
+	return drifted
+}
+
+// sortProjectDrift puts drifting projects first, the ones drifting the longest at the top, then orders by name
+func sortProjectDrift(drift []ProjectDrift) {
+	sort.SliceStable(drift, func(i, j int) bool {
+		a, b := drift[i], drift[j]
+		if (a.DriftingSince == nil) != (b.DriftingSince == nil) {
+			return a.DriftingSince != nil
+		}
+		if a.DriftingSince != nil && !a.DriftingSince.Equal(*b.DriftingSince) {
+			return a.DriftingSince.Before(*b.DriftingSince)
+		}
+		if a.Project.Repo != nil && b.Project.Repo != nil && a.Project.Repo.Name != b.Project.Repo.Name {
+			return a.Project.Repo.Name < b.Project.Repo.Name
+		}
+		return a.Project.Name < b.Project.Name
+	})
+}
+
+func (r *DriftReport) MapToJsonStruct() interface{} {
+	return struct {
+		Id           uint       `json:"id"`
+		CreatedAt    time.Time  `json:"createdAt"`
+		CompletedAt  *time.Time `json:"completedAt"`
+		Status       string     `json:"status"`
+		ChangeCount  int        `json:"changeCount"`
+		Alert        bool       `json:"alert"`
+		Reason       string     `json:"reason"`
+		CommitSha    string     `json:"commitSha"`
+		DiggerJobId  string     `json:"diggerJobId"`
+		ProjectRunId *uint      `json:"projectRunId"`
+	}{
+		Id:           r.ID,
+		CreatedAt:    r.CreatedAt,
+		CompletedAt:  r.CompletedAt,
+		Status:       r.Status,
+		ChangeCount:  r.ChangeCount,
+		Alert:        r.Alert,
+		Reason:       r.Reason,
+		CommitSha:    r.CommitSha,
+		DiggerJobId:  r.DiggerJobId,
+		ProjectRunId: r.ProjectRunID,
+	}
+}
+
+func (d *ProjectDrift) MapToJsonStruct() interface{} {
+	var schedule, lastCheck interface{}
+	if d.Schedule != nil {
+		schedule = d.Schedule.MapToJsonStruct()
+	}
+	if d.LastReport != nil {
+		lastCheck = d.LastReport.MapToJsonStruct()
+	}
+	changes := make([]resourceChangeJson, 0, len(d.ResourceChanges))
+	for _, change := range d.ResourceChanges {
+		changes = append(changes, resourceChangeJson{
+			Address:       change.Address,
+			ModuleAddress: change.ModuleAddress,
+			Type:          change.Type,
+			Name:          change.Name,
+			Action:        change.Action,
+			Actions:       strings.Split(change.Actions, ","),
+		})
+	}
+	repoName := ""
+	if d.Project.Repo != nil {
+		repoName = d.Project.Repo.Name
+	}
+	return struct {
+		ProjectId       uint                 `json:"projectId"`
+		ProjectName     string               `json:"projectName"`
+		RepoName        string               `json:"repoName"`
+		Drifting        bool                 `json:"drifting"`
+		DriftingSince   *time.Time           `json:"driftingSince"`
+		Schedule        interface{}          `json:"schedule"`
+		LastCheck       interface{}          `json:"lastCheck"`
+		ResourceChanges []resourceChangeJson `json:"resourceChanges"`
+	}{
+		ProjectId:       d.Project.ID,
+		ProjectName:     d.Project.Name,
+		RepoName:        repoName,
+		Drifting:        d.DriftingSince != nil,
+		DriftingSince:   d.DriftingSince,
+		Schedule:        schedule,
+		LastCheck:       lastCheck,
+		ResourceChanges: changes,
+	}
+}
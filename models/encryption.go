@@ -0,0 +1,190 @@
+package models
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// EncryptedValue is a value sealed with envelope encryption: the value is encrypted with its own data key,
+// and the data key is encrypted with the master key identified by KeyId
+type EncryptedValue struct {
+	KeyId            string
+	EncryptedDataKey string
+	Ciphertext       string
+}
+
+// Keyring holds the master keys, new values are sealed with the current one. Previous keys are only kept to
+// open values until they have been rotated.
+type Keyring struct {
+	currentKeyId string
+	keys         map[string][]byte
+}
+
+// LoadKeyring reads the master key from DIGGER_ENCRYPTION_KEY or the file in DIGGER_ENCRYPTION_KEY_FILE, both
+// base64 encoded 32 byte keys. DIGGER_ENCRYPTION_PREVIOUS_KEYS is a comma separated list of keys being rotated out.
+func LoadKeyring() (*Keyring, error) {
+	encoded := os.Getenv("DIGGER_ENCRYPTION_KEY")
+	if keyFile := os.Getenv("DIGGER_ENCRYPTION_KEY_FILE"); encoded == "" && keyFile != "" {
+		content, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read DIGGER_ENCRYPTION_KEY_FILE: %v", err)
+		}
+		encoded = strings.TrimSpace(string(content))
+	}
+	if encoded == "" {
+		return nil, fmt.Errorf("DIGGER_ENCRYPTION_KEY or DIGGER_ENCRYPTION_KEY_FILE has to be set")
+	}
+
+	keyring := &Keyring{keys: make(map[string][]byte)}
+	currentKeyId, err := keyring.add(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("invalid encryption key: %v", err)
+	}
+	keyring.currentKeyId = currentKeyId
+
+	for _, previous := range strings.Split(os.Getenv("DIGGER_ENCRYPTION_PREVIOUS_KEYS"), ",") {
+		previous = strings.TrimSpace(previous)
+		if previous == "" {
+			continue
+		}
+		_, err := keyring.add(previous)
+		if err != nil {
+			return nil, fmt.Errorf("invalid previous encryption key: %v", err)
+		}
+	}
+	return keyring, nil
+}
+
+func (k *Keyring) add(encoded string) (string, error) {
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", fmt.Errorf("key is not valid base64: %v", err)
+	}
+	if len(key) != 32 {
+		return "", fmt.Errorf("key must be 32 bytes, got %v", len(key))
+	}
+	// the id is derived from the key so it doesn't have to be configured separately
+	sum := sha256.Sum256(key)
+	keyId := hex.EncodeToString(sum[:8])
+	k.keys[keyId] = key
+	return keyId, nil
+}
+
+func (k *Keyring) CurrentKeyId() string {
+	return k.currentKeyId
+}
+
+// Seal encrypts plaintext with a new data key wrapped by the current master key
+func (k *Keyring) Seal(plaintext string) (EncryptedValue, error) {
+	dataKey := make([]byte, 32)
+	_, err := io.ReadFull(rand.Reader, dataKey)
+	if err != nil {
+		return EncryptedValue{}, fmt.Errorf("failed to generate data key: %v", err)
+	}
+	ciphertext, err := aesGcmSeal(dataKey, []byte(plaintext))
+	if err != nil {
+		return EncryptedValue{}, err
+	}
+	encryptedDataKey, err := aesGcmSeal(k.keys[k.currentKeyId], dataKey)
+	if err != nil {
+		return EncryptedValue{}, err
+	}
+	return EncryptedValue{
+		KeyId:            k.currentKeyId,
+		EncryptedDataKey: base64.StdEncoding.EncodeToString(encryptedDataKey),
+		Ciphertext:       base64.StdEncoding.EncodeToString(ciphertext),
+	}, nil
+}
+
+func (k *Keyring) Open(value EncryptedValue) (string, error) {
+	dataKey, err := k.dataKey(value)
+	if err != nil {
+		return "", err
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(value.Ciphertext)
+	if err != nil {
+		return "", fmt.Errorf("ciphertext is not valid base64: %v", err)
+	}
+	plaintext, err := aesGcmOpen(dataKey, ciphertext)
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+// Rewrap wraps the data key of value with the current master key, the ciphertext stays the same.
+// It returns false if the value uses the current key already.
+func (k *Keyring) Rewrap(value EncryptedValue) (EncryptedValue, bool, error) {
+	if value.KeyId == k.currentKeyId {
+		return value, false, nil
+	}
+	dataKey, err := k.dataKey(value)
+	if err != nil {
+		return value, false, err
+	}
+	encryptedDataKey, err := aesGcmSeal(k.keys[k.currentKeyId], dataKey)
+	if err != nil {
+		return value, false, err
+	}
+	value.KeyId = k.currentKeyId
+	value.EncryptedDataKey = base64.StdEncoding.EncodeToString(encryptedDataKey)
+	return value, true, nil
+}
+
+func (k *Keyring) dataKey(value EncryptedValue) ([]byte, error) {
+	masterKey, ok := k.keys[value.KeyId]
+	if !ok {
+		return nil, fmt.Errorf("encryption key %v is not configured", value.KeyId)
+	}
+	encryptedDataKey, err := base64.StdEncoding.DecodeString(value.EncryptedDataKey)
+	if err != nil {
+		return nil, fmt.Errorf("data key is not valid base64: %v", err)
+	}
+	return aesGcmOpen(masterKey, encryptedDataKey)
+}
+
+// aesGcmSeal returns the nonce followed by the ciphertext
+func aesGcmSeal(key []byte, plaintext []byte) ([]byte, error) {
+	gcm, err := newGcm(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %v", err)
+	}
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func aesGcmOpen(key []byte, sealed []byte) ([]byte, error) {
+	gcm, err := newGcm(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, fmt.Errorf("encrypted value is too short")
+	}
+	nonce, ciphertext := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt value: %v", err)
+	}
+	return plaintext, nil
+}
+
+func newGcm(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
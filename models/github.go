@@ -1,12 +1,102 @@
 package models
 
-import "gorm.io/gorm"
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"gorm.io/gorm"
+)
 
 type GithubApp struct {
 	gorm.Model
 	GithubId     int64
 	Name         string
 	GithubAppUrl string
+	// endpoints of a GitHub Enterprise Server instance, all empty for github.com
+	GithubApiUrl    string
+	GithubUploadUrl string
+	GithubOauthUrl  string
+	// ClientId of apps created through the manifest flow, their secrets are kept in the secrets table
+	ClientId string
+}
+
+type GithubAppCredentials struct {
+	ClientId      string
+	ClientSecret  string
+	PrivateKey    string
+	WebhookSecret string
+}
+
+// IsEnterprise is true if the app is registered on a GitHub Enterprise Server instead of github.com
+func (app *GithubApp) IsEnterprise() bool {
+	return app != nil && app.GithubApiUrl != ""
+}
+
+// ApiBaseUrl returns the REST API root without a trailing slash, for example https://ghes.example.com/api/v3
+func (app *GithubApp) ApiBaseUrl() string {
+	if !app.IsEnterprise() {
+		return "https://api.github.com"
+	}
+	base := strings.TrimSuffix(app.GithubApiUrl, "/")
+	if !strings.HasSuffix(base, "/api/v3") {
+		base = base + "/api/v3"
+	}
+	return base
+}
+
+// UploadBaseUrl returns the uploads API root without a trailing slash
+func (app *GithubApp) UploadBaseUrl() string {
+	if !app.IsEnterprise() {
+		return "https://uploads.github.com"
+	}
+	if app.GithubUploadUrl != "" {
+		return strings.TrimSuffix(app.GithubUploadUrl, "/")
+	}
+	return strings.TrimSuffix(app.ApiBaseUrl(), "/api/v3") + "/api/uploads"
+}
+
+// WebUrl returns scheme and host serving the UI, OAuth and git endpoints, for example https://ghes.example.com
+func (app *GithubApp) WebUrl() (*url.URL, error) {
+	if !app.IsEnterprise() {
+		return &url.URL{Scheme: "https", Host: "github.com"}, nil
+	}
+	u, err := url.Parse(app.GithubApiUrl)
+	if err != nil {
+		return nil, fmt.Errorf("invalid GitHub API url %v: %v", app.GithubApiUrl, err)
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("invalid GitHub API url %v: scheme and host are required", app.GithubApiUrl)
+	}
+	return &url.URL{Scheme: u.Scheme, Host: u.Host}, nil
+}
+
+// OauthAccessTokenUrl returns the endpoint exchanging OAuth codes for user access tokens
+func (app *GithubApp) OauthAccessTokenUrl() (string, error) {
+	if app.IsEnterprise() && app.GithubOauthUrl != "" {
+		return strings.TrimSuffix(app.GithubOauthUrl, "/") + "/access_token", nil
+	}
+	web, err := app.WebUrl()
+	if err != nil {
+		return "", err
+	}
+	return web.String() + "/login/oauth/access_token", nil
+}
+
+// CloneUrl points the clone url of a repository at the host of the app, so the installation token
+// is never sent anywhere else
+func (app *GithubApp) CloneUrl(cloneUrl string) (string, error) {
+	web, err := app.WebUrl()
+	if err != nil {
+		return "", err
+	}
+	u, err := url.Parse(cloneUrl)
+	if err != nil {
+		return "", fmt.Errorf("invalid clone url %v: %v", cloneUrl, err)
+	}
+	u.Scheme = web.Scheme
+	u.Host = web.Host
+	return u.String(), nil
 }
 
 type GithubAppInstallStatus int
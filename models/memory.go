@@ -0,0 +1,1640 @@
+package models
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dchest/uniuri"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// MemoryStore implements the stores without a database, records are copied in and out so callers
+// can't change stored data without saving it, like with GORM
+type MemoryStore struct {
+	mu            sync.Mutex
+	nextId        uint
+	organisations map[uint]Organisation
+	repos         map[uint]Repo
+	projects      map[uint]Project
+	policies      map[uint]Policy
+	tokens        map[uint]Token
+	jobs          map[string]DiggerJob
+	jobLinks      map[string]GithubDiggerJobLink
+	parentLinks   []DiggerJobParentLink
+	searchDocs    map[uint]RunSearchDocument
+	runs          map[uint]ProjectRun
+	auditEvents   []AuditEvent
+	// variables are kept in plain text by project id and name
+	variables map[uint]map[string]string
+	plans     []PlanArtifact
+	logChunks map[uint][]RunLogChunk
+	// drift schedules are kept by project id
+	driftSchedules map[uint]DriftSchedule
+	driftReports   map[uint]DriftReport
+	leases         map[string]SchedulerLease
+	// reviews are kept by repo, pull request and reviewer, approval requests by job id
+	reviews          map[string]PullRequestReview
+	approvalRequests map[string]ApplyApprovalRequest
+	githubApps       map[uint]GithubApp
+	installations    map[uint]GithubAppInstallation
+	installLinks     map[uint]GithubAppInstallationLink
+	users            map[uint]User
+	memberships      map[uint]OrgMembership
+	roleGrants       map[uint]RoleGrant
+	// secrets are kept in plain text by name
+	secrets map[string]string
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		organisations:    make(map[uint]Organisation),
+		repos:            make(map[uint]Repo),
+		projects:         make(map[uint]Project),
+		policies:         make(map[uint]Policy),
+		tokens:           make(map[uint]Token),
+		jobs:             make(map[string]DiggerJob),
+		jobLinks:         make(map[string]GithubDiggerJobLink),
+		searchDocs:       make(map[uint]RunSearchDocument),
+		runs:             make(map[uint]ProjectRun),
+		variables:        make(map[uint]map[string]string),
+		logChunks:        make(map[uint][]RunLogChunk),
+		driftSchedules:   make(map[uint]DriftSchedule),
+		driftReports:     make(map[uint]DriftReport),
+		leases:           make(map[string]SchedulerLease),
+		reviews:          make(map[string]PullRequestReview),
+		approvalRequests: make(map[string]ApplyApprovalRequest),
+		githubApps:       make(map[uint]GithubApp),
+		installations:    make(map[uint]GithubAppInstallation),
+		installLinks:     make(map[uint]GithubAppInstallationLink),
+		users:            make(map[uint]User),
+		memberships:      make(map[uint]OrgMembership),
+		roleGrants:       make(map[uint]RoleGrant),
+		secrets:          make(map[string]string),
+	}
+}
+
+func (m *MemoryStore) Stores() Stores {
+	return Stores{Orgs: m, Repos: m, Projects: m, Policies: m, Jobs: m, Runs: m, Audit: m, Variables: m, Plans: m, RunLogs: m, Search: m, Drift: m, Leases: m, Approvals: m,
+		Github: m, Members: m, Secrets: m}
+}
+
+// id returns the next id and sets the timestamps of a new record, callers hold the lock
+func (m *MemoryStore) id() (uint, time.Time) {
+	m.nextId++
+	return m.nextId, time.Now()
+}
+
+// memoryId converts the ids passed around as any, e.g. taken from the gin context
+func memoryId(id any) uint {
+	switch v := id.(type) {
+	case uint:
+		return v
+	case int:
+		return uint(v)
+	case int64:
+		return uint(v)
+	case uint64:
+		return uint(v)
+	case float64:
+		return uint(v)
+	case string:
+		parsed, _ := strconv.ParseUint(v, 10, 64)
+		return uint(parsed)
+	case *uint:
+		if v != nil {
+			return *v
+		}
+	}
+	return 0
+}
+
+func (m *MemoryStore) GetOrganisationById(orgId any) (*Organisation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	org, ok := m.organisations[memoryId(orgId)]
+	if !ok {
+		return nil, fmt.Errorf("Error fetching organisation: record not found\n")
+	}
+	return &org, nil
+}
+
+func (m *MemoryStore) GetOrganisationByName(name string) (*Organisation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, org := range m.organisations {
+		if org.Name == name {
+			return &org, nil
+		}
+	}
+	return nil, nil
+}
+
+func (m *MemoryStore) GetOrganisation(tenantId any) (*Organisation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, org := range m.organisations {
+		if org.ExternalId == fmt.Sprintf("%v", tenantId) {
+			return &org, nil
+		}
+	}
+	return nil, nil
+}
+
+func (m *MemoryStore) CreateOrganisation(name string, externalSource string, tenantId string) (*Organisation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, org := range m.organisations {
+		if org.Name == name {
+			return nil, fmt.Errorf("organisation %v already exists", name)
+		}
+	}
+	org := Organisation{Name: name, ExternalSource: externalSource, ExternalId: tenantId}
+	org.ID, org.CreatedAt = m.id()
+	org.UpdatedAt = org.CreatedAt
+	m.organisations[org.ID] = org
+	return &org, nil
+}
+
+func (m *MemoryStore) CreateToken(orgId uint, value string, tokenType string) (*Token, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	token := Token{Value: value, OrganisationID: orgId, Type: tokenType}
+	token.ID, token.CreatedAt = m.id()
+	token.UpdatedAt = token.CreatedAt
+	m.tokens[token.ID] = token
+	return &token, nil
+}
+
+func (m *MemoryStore) GetToken(value any) (*Token, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, token := range m.tokens {
+		if token.Value == fmt.Sprintf("%v", value) {
+			return &token, nil
+		}
+	}
+	return nil, nil
+}
+
+// repoWithRelations fills the relation like Preload("Organisation"), callers hold the lock
+func (m *MemoryStore) repoWithRelations(repo Repo) Repo {
+	if org, ok := m.organisations[repo.OrganisationID]; ok {
+		repo.Organisation = &org
+	}
+	return repo
+}
+
+func (m *MemoryStore) GetRepo(orgId any, repoName string) (*Repo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, repo := range m.repos {
+		if repo.OrganisationID == memoryId(orgId) && repo.Name == repoName {
+			repo = m.repoWithRelations(repo)
+			return &repo, nil
+		}
+	}
+	return nil, nil
+}
+
+func (m *MemoryStore) GetRepoById(orgId any, repoId any) (*Repo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	repo, ok := m.repos[memoryId(repoId)]
+	if !ok || repo.OrganisationID != memoryId(orgId) {
+		return nil, nil
+	}
+	repo = m.repoWithRelations(repo)
+	return &repo, nil
+}
+
+func (m *MemoryStore) GetReposForOrg(orgId any) ([]Repo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	repos := make([]Repo, 0)
+	for _, repo := range m.repos {
+		if repo.OrganisationID == memoryId(orgId) {
+			repos = append(repos, m.repoWithRelations(repo))
+		}
+	}
+	sort.Slice(repos, func(i, j int) bool { return repos[i].ID < repos[j].ID })
+	return repos, nil
+}
+
+func (m *MemoryStore) CreateRepo(name string, org *Organisation, diggerConfig string) (*Repo, error) {
+	existing, err := m.GetRepo(org.ID, name)
+	if err != nil || existing != nil {
+		return existing, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	repo := Repo{Name: name, OrganisationID: org.ID, DiggerConfig: diggerConfig}
+	repo.ID, repo.CreatedAt = m.id()
+	repo.UpdatedAt = repo.CreatedAt
+	m.repos[repo.ID] = repo
+	repo = m.repoWithRelations(repo)
+	return &repo, nil
+}
+
+func (m *MemoryStore) saveRepo(repo *Repo) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	repo.UpdatedAt = time.Now()
+	stored := *repo
+	stored.Organisation = nil
+	m.repos[repo.ID] = stored
+}
+
+func (m *MemoryStore) UpdateRepoDiggerConfig(orgId any, diggerConfigYaml string, repo *Repo) ([]string, error) {
+	if diggerConfigYaml == "" {
+		return nil, fmt.Errorf("digger config can't be empty")
+	}
+	org, err := m.GetOrganisationById(orgId)
+	if err != nil {
+		return nil, err
+	}
+	diggerConfig, err := validateDiggerConfigYaml(diggerConfigYaml)
+	if err != nil {
+		return nil, err
+	}
+	repo.DiggerConfig = diggerConfigYaml
+	m.saveRepo(repo)
+
+	messages := make([]string, 0)
+	inConfig := make(map[string]bool)
+	for _, dc := range diggerConfig.Projects {
+		inConfig[dc.Name] = true
+		p, err := m.GetProjectByName(orgId, repo, dc.Name)
+		if err != nil {
+			return nil, err
+		}
+		if p != nil {
+			messages = append(messages, fmt.Sprintf("Project %s already exist\n", dc.Name))
+			continue
+		}
+		err = m.SaveProject(&Project{Name: dc.Name, Organisation: org, Repo: repo, Status: ProjectActive})
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, fmt.Sprintf("Project %s has been created\n", dc.Name))
+	}
+	for _, rp := range m.findProjects(func(p Project) bool { return p.RepoID == repo.ID }) {
+		if !inConfig[rp.Name] {
+			rp.Status = ProjectInactive
+			err = m.SaveProject(&rp)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return messages, nil
+}
+
+func (m *MemoryStore) projectWithRelations(project Project) Project {
+	if org, ok := m.organisations[project.OrganisationID]; ok {
+		project.Organisation = &org
+	}
+	if repo, ok := m.repos[project.RepoID]; ok {
+		project.Repo = &repo
+	}
+	return project
+}
+
+func (m *MemoryStore) findProjects(match func(p Project) bool) []Project {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	projects := make([]Project, 0)
+	for _, project := range m.projects {
+		if match(project) {
+			projects = append(projects, m.projectWithRelations(project))
+		}
+	}
+	sort.Slice(projects, func(i, j int) bool { return projects[i].ID < projects[j].ID })
+	return projects
+}
+
+func (m *MemoryStore) GetProjectsForOrg(orgId any) ([]Project, error) {
+	return m.findProjects(func(p Project) bool {
+		return p.OrganisationID == memoryId(orgId)
+	}), nil
+}
+
+func (m *MemoryStore) GetProjectsForRepoName(orgId any, repoName string) ([]Project, error) {
+	repo, err := m.GetRepo(orgId, repoName)
+	if err != nil || repo == nil {
+		return []Project{}, err
+	}
+	return m.findProjects(func(p Project) bool {
+		return p.OrganisationID == memoryId(orgId) && p.RepoID == repo.ID
+	}), nil
+}
+
+func (m *MemoryStore) GetProjectById(orgId any, projectId any) (*Project, error) {
+	projects := m.findProjects(func(p Project) bool {
+		return p.OrganisationID == memoryId(orgId) && p.ID == memoryId(projectId)
+	})
+	if len(projects) == 0 {
+		return nil, nil
+	}
+	return &projects[0], nil
+}
+
+func (m *MemoryStore) GetProjectByName(orgId any, repo *Repo, name string) (*Project, error) {
+	projects := m.findProjects(func(p Project) bool {
+		return p.OrganisationID == memoryId(orgId) && p.RepoID == repo.ID && p.Name == name
+	})
+	if len(projects) == 0 {
+		return nil, nil
+	}
+	return &projects[0], nil
+}
+
+func (m *MemoryStore) SaveProject(project *Project) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if project.Organisation != nil {
+		project.OrganisationID = project.Organisation.ID
+	}
+	if project.Repo != nil {
+		project.RepoID = project.Repo.ID
+	}
+	for _, existing := range m.projects {
+		if existing.ID != project.ID && existing.OrganisationID == project.OrganisationID &&
+			existing.RepoID == project.RepoID && existing.Name == project.Name {
+			return fmt.Errorf("project %v already exists", project.Name)
+		}
+	}
+	if project.ID == 0 {
+		project.ID, project.CreatedAt = m.id()
+	}
+	project.UpdatedAt = time.Now()
+	stored := *project
+	stored.Organisation, stored.Repo = nil, nil
+	m.projects[project.ID] = stored
+	return nil
+}
+
+func (m *MemoryStore) findPolicy(match func(p Policy) bool) *Policy {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, policy := range m.policies {
+		if match(policy) {
+			return &policy
+		}
+	}
+	return nil
+}
+
+func (m *MemoryStore) GetOrgPolicy(orgId any, policyType string) (*Policy, error) {
+	return m.findPolicy(func(p Policy) bool {
+		return p.OrganisationID == memoryId(orgId) && p.RepoID == nil && p.ProjectID == nil && p.Type == policyType
+	}), nil
+}
+
+func (m *MemoryStore) GetProjectPolicy(orgId any, repoId uint, projectId uint, policyType string) (*Policy, error) {
+	return m.findPolicy(func(p Policy) bool {
+		return p.OrganisationID == memoryId(orgId) && memoryId(p.RepoID) == repoId &&
+			memoryId(p.ProjectID) == projectId && p.Type == policyType
+	}), nil
+}
+
+// policyWithRelations fills the relations the policy pages show, callers hold the lock
+func (m *MemoryStore) policyWithRelations(policy Policy) Policy {
+	if org, ok := m.organisations[policy.OrganisationID]; ok {
+		policy.Organisation = &org
+	}
+	if repo, ok := m.repos[memoryId(policy.RepoID)]; ok {
+		policy.Repo = &repo
+	}
+	if project, ok := m.projects[memoryId(policy.ProjectID)]; ok {
+		project = m.projectWithRelations(project)
+		policy.Project = &project
+	}
+	return policy
+}
+
+func (m *MemoryStore) GetPoliciesForOrg(orgId any) ([]Policy, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	policies := make([]Policy, 0)
+	for _, policy := range m.policies {
+		project, ok := m.projects[memoryId(policy.ProjectID)]
+		if ok && project.OrganisationID == memoryId(orgId) {
+			policies = append(policies, m.policyWithRelations(policy))
+		}
+	}
+	sort.Slice(policies, func(i, j int) bool { return policies[i].ID < policies[j].ID })
+	return policies, nil
+}
+
+func (m *MemoryStore) GetPolicyById(orgId any, policyId any) (*Policy, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	policy, ok := m.policies[memoryId(policyId)]
+	if !ok {
+		return nil, nil
+	}
+	project, ok := m.projects[memoryId(policy.ProjectID)]
+	if !ok || project.OrganisationID != memoryId(orgId) {
+		return nil, nil
+	}
+	policy = m.policyWithRelations(policy)
+	return &policy, nil
+}
+
+func (m *MemoryStore) SavePolicy(policy *Policy) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if policy.Organisation != nil {
+		policy.OrganisationID = policy.Organisation.ID
+	}
+	if policy.Repo != nil {
+		repoId := policy.Repo.ID
+		policy.RepoID = &repoId
+	}
+	if policy.Project != nil {
+		projectId := policy.Project.ID
+		policy.ProjectID = &projectId
+	}
+	if policy.ID == 0 {
+		policy.ID, policy.CreatedAt = m.id()
+	}
+	policy.UpdatedAt = time.Now()
+	stored := *policy
+	stored.Organisation, stored.Repo, stored.Project, stored.CreatedBy = nil, nil, nil, nil
+	m.policies[policy.ID] = stored
+	return nil
+}
+
+func (m *MemoryStore) CreateDiggerJob(batch uuid.UUID, serializedJob []byte, branchName string, commitSha string) (*DiggerJob, error) {
+	if len(serializedJob) == 0 {
+		return nil, fmt.Errorf("serializedJob can't be empty")
+	}
+	job := &DiggerJob{DiggerJobId: uniuri.New(), Status: DiggerJobCreated,
+		BatchId: batch, SerializedJob: serializedJob, BranchName: branchName, CommitSha: commitSha}
+	return job, m.UpdateDiggerJob(job)
+}
+
+func (m *MemoryStore) GetDiggerJob(jobId string) (*DiggerJob, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// like the GORM store an unknown job is an empty one
+	job := m.jobs[jobId]
+	return &job, nil
+}
+
+func (m *MemoryStore) GetPendingParentDiggerJobs(batchId *uuid.UUID) ([]DiggerJob, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	children := make(map[string]bool)
+	for _, link := range m.parentLinks {
+		children[link.DiggerJobId] = true
+	}
+	jobs := make([]DiggerJob, 0)
+	for _, job := range m.jobs {
+		if job.Status == DiggerJobCreated && !children[job.DiggerJobId] && (batchId == nil || job.BatchId == *batchId) {
+			jobs = append(jobs, job)
+		}
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].ID < jobs[j].ID })
+	return jobs, nil
+}
+
+func (m *MemoryStore) CreateDiggerJobParentLink(parentJobId string, jobId string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	link := DiggerJobParentLink{ParentDiggerJobId: parentJobId, DiggerJobId: jobId}
+	link.ID, link.CreatedAt = m.id()
+	link.UpdatedAt = link.CreatedAt
+	m.parentLinks = append(m.parentLinks, link)
+	return nil
+}
+
+func (m *MemoryStore) GetDiggerJobParentLinksByParentId(parentId *string) ([]DiggerJobParentLink, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	links := make([]DiggerJobParentLink, 0)
+	for _, link := range m.parentLinks {
+		if link.ParentDiggerJobId == *parentId {
+			links = append(links, link)
+		}
+	}
+	return links, nil
+}
+
+func (m *MemoryStore) GetDiggerJobParentLinksChildId(childId *string) ([]DiggerJobParentLink, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	links := make([]DiggerJobParentLink, 0)
+	for _, link := range m.parentLinks {
+		if link.DiggerJobId == *childId {
+			links = append(links, link)
+		}
+	}
+	return links, nil
+}
+
+func (m *MemoryStore) UpdateDiggerJob(job *DiggerJob) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if job.ID == 0 {
+		job.ID, job.CreatedAt = m.id()
+	}
+	job.UpdatedAt = time.Now()
+	m.jobs[job.DiggerJobId] = *job
+	return nil
+}
+
+func (m *MemoryStore) setDiggerJobStatus(jobId string, from DiggerJobStatus, to DiggerJobStatus) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	job, ok := m.jobs[jobId]
+	if !ok || job.Status != from {
+		return false
+	}
+	job.Status = to
+	job.StatusUpdatedAt = time.Now()
+	m.jobs[jobId] = job
+	return true
+}
+
+func (m *MemoryStore) ClaimDiggerJob(jobId string) (bool, error) {
+	return m.setDiggerJobStatus(jobId, DiggerJobCreated, DiggerJobTriggered), nil
+}
+
+func (m *MemoryStore) ReleaseDiggerJob(jobId string) error {
+	m.setDiggerJobStatus(jobId, DiggerJobTriggered, DiggerJobCreated)
+	return nil
+}
+
+func (m *MemoryStore) CreateDiggerJobLink(diggerJobId string, repoFullName string) (*GithubDiggerJobLink, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	link := GithubDiggerJobLink{Status: DiggerJobLinkCreated, DiggerJobId: diggerJobId, RepoFullName: repoFullName}
+	link.ID, link.CreatedAt = m.id()
+	link.UpdatedAt = link.CreatedAt
+	m.jobLinks[diggerJobId] = link
+	return &link, nil
+}
+
+func (m *MemoryStore) GetDiggerJobLink(diggerJobId string) (*GithubDiggerJobLink, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	link, ok := m.jobLinks[diggerJobId]
+	if !ok {
+		return nil, nil
+	}
+	return &link, nil
+}
+
+func (m *MemoryStore) SetDiggerJobLinkWorkflowRun(diggerJobId string, workflowRunId int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if link, ok := m.jobLinks[diggerJobId]; ok {
+		link.GithubWorkflowRunId = workflowRunId
+		link.UpdatedAt = time.Now()
+		m.jobLinks[diggerJobId] = link
+	}
+	return nil
+}
+
+func (m *MemoryStore) GetProjectRuns(projectId uint) ([]ProjectRun, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	runs := make([]ProjectRun, 0)
+	for _, run := range m.runs {
+		if run.ProjectID == projectId {
+			if project, ok := m.projects[run.ProjectID]; ok {
+				run.Project = &project
+			}
+			runs = append(runs, run)
+		}
+	}
+	sort.Slice(runs, func(i, j int) bool { return runs[i].ID < runs[j].ID })
+	return runs, nil
+}
+
+func (m *MemoryStore) FindProjectRuns(filter RunFilter) (*RunPage, error) {
+	cursor, err := decodeRunCursor(filter.Cursor)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// before reports whether a comes first in the order of the filter
+	before := func(a *ProjectRun, b *ProjectRun) bool {
+		aValue, bValue := filter.sortValue(a), filter.sortValue(b)
+		if aValue == bValue {
+			aValue, bValue = int64(a.ID), int64(b.ID)
+		}
+		if filter.Ascending {
+			return aValue < bValue
+		}
+		return aValue > bValue
+	}
+
+	runs := make([]ProjectRun, 0)
+	for _, run := range m.runs {
+		project, ok := m.projects[run.ProjectID]
+		if !ok {
+			continue
+		}
+		project = m.projectWithRelations(project)
+		if (filter.OrganisationID != 0 && project.OrganisationID != filter.OrganisationID) ||
+			(filter.ProjectID != 0 && run.ProjectID != filter.ProjectID) ||
+			(filter.RepoName != "" && (project.Repo == nil || project.Repo.Name != filter.RepoName)) ||
+			(filter.ProjectName != "" && project.Name != filter.ProjectName) ||
+			(filter.Status != "" && run.Status != filter.Status) ||
+			(filter.Command != "" && run.Command != filter.Command) ||
+			(filter.PullRequestNumber != 0 && run.PullRequestNumber != filter.PullRequestNumber) ||
+			(filter.DiggerJobId != "" && run.DiggerJobId != filter.DiggerJobId) ||
+			(filter.BatchId != "" && run.BatchId != filter.BatchId) ||
+			(filter.CommitSha != "" && !strings.HasPrefix(run.CommitSha, filter.CommitSha)) ||
+			(filter.Actor != "" && run.Actor != filter.Actor) ||
+			(!filter.StartedAfter.IsZero() && run.StartedAt < filter.StartedAfter.UnixMilli()) ||
+			(!filter.StartedBefore.IsZero() && run.StartedAt >= filter.StartedBefore.UnixMilli()) {
+			continue
+		}
+		run.Project = &project
+		runs = append(runs, run)
+	}
+	total := int64(len(runs))
+	sort.Slice(runs, func(i, j int) bool { return before(&runs[i], &runs[j]) })
+
+	if cursor != nil {
+		after := ProjectRun{StartedAt: cursor.value, EndedAt: cursor.value}
+		after.ID = cursor.id
+		start := sort.Search(len(runs), func(i int) bool { return before(&after, &runs[i]) })
+		runs = runs[start:]
+	}
+	if len(runs) > filter.PageSize()+1 {
+		runs = runs[:filter.PageSize()+1]
+	}
+	return newRunPage(filter, runs, total), nil
+}
+
+func (m *MemoryStore) GetProjectRun(runId uint) (*ProjectRun, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	run, ok := m.runs[runId]
+	if !ok {
+		return nil, nil
+	}
+	if project, ok := m.projects[run.ProjectID]; ok {
+		project = m.projectWithRelations(project)
+		run.Project = &project
+	}
+	return &run, nil
+}
+
+func (m *MemoryStore) CreateProjectRun(run *ProjectRun) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if run.Project != nil {
+		run.ProjectID = run.Project.ID
+	}
+	run.ID, run.CreatedAt = m.id()
+	run.UpdatedAt = run.CreatedAt
+	for i := range run.ResourceChanges {
+		run.ResourceChanges[i].ProjectRunID = run.ID
+	}
+	stored := *run
+	stored.Project = nil
+	m.runs[run.ID] = stored
+	return nil
+}
+
+func (m *MemoryStore) UpdateProjectRunStatus(runId uint, status string, endedAt int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if run, ok := m.runs[runId]; ok {
+		run.Status = status
+		run.EndedAt = endedAt
+		run.UpdatedAt = time.Now()
+		m.runs[runId] = run
+	}
+	return nil
+}
+
+func (m *MemoryStore) CreateAuditEvent(event *AuditEvent) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	event.ID, event.CreatedAt = m.id()
+	m.auditEvents = append(m.auditEvents, *event)
+	return nil
+}
+
+func (m *MemoryStore) GetAuditEvents(orgId any, filter AuditEventFilter) ([]AuditEvent, int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	matching := make([]AuditEvent, 0)
+	// newest first, like the GORM store
+	for i := len(m.auditEvents) - 1; i >= 0; i-- {
+		e := m.auditEvents[i]
+		if e.OrganisationID != memoryId(orgId) ||
+			(filter.Actor != "" && e.Actor != filter.Actor) ||
+			(filter.Action != "" && e.Action != filter.Action) ||
+			(filter.TargetType != "" && e.TargetType != filter.TargetType) ||
+			(filter.TargetId != "" && e.TargetId != filter.TargetId) ||
+			(filter.From != nil && e.CreatedAt.Before(*filter.From)) ||
+			(filter.To != nil && !e.CreatedAt.Before(*filter.To)) {
+			continue
+		}
+		matching = append(matching, e)
+	}
+	total := int64(len(matching))
+	if filter.Offset >= len(matching) {
+		return []AuditEvent{}, total, nil
+	}
+	matching = matching[filter.Offset:]
+	if filter.Limit > 0 && filter.Limit < len(matching) {
+		matching = matching[:filter.Limit]
+	}
+	return matching, total, nil
+}
+
+func (m *MemoryStore) SetProjectVariable(projectId uint, name string, value string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.variables[projectId] == nil {
+		m.variables[projectId] = make(map[string]string)
+	}
+	m.variables[projectId][name] = value
+	return nil
+}
+
+func (m *MemoryStore) GetProjectVariables(projectId uint) (map[string]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	values := make(map[string]string)
+	for name, value := range m.variables[projectId] {
+		values[name] = value
+	}
+	return values, nil
+}
+
+func (m *MemoryStore) GetProjectVariableNames(projectId uint) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	names := make([]string, 0)
+	for name := range m.variables[projectId] {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (m *MemoryStore) DeleteProjectVariable(projectId uint, name string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.variables[projectId][name]; !ok {
+		return false, nil
+	}
+	delete(m.variables[projectId], name)
+	return true, nil
+}
+
+func (m *MemoryStore) CreatePlanArtifact(artifact *PlanArtifact) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	artifact.ID, artifact.CreatedAt = m.id()
+	artifact.UpdatedAt = artifact.CreatedAt
+	m.plans = append(m.plans, *artifact)
+	return nil
+}
+
+func (m *MemoryStore) GetLatestPlanArtifact(projectId uint, pullRequestNumber int) (*PlanArtifact, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := len(m.plans) - 1; i >= 0; i-- {
+		if m.plans[i].ProjectID == projectId && m.plans[i].PullRequestNumber == pullRequestNumber {
+			artifact := m.plans[i]
+			return &artifact, nil
+		}
+	}
+	return nil, nil
+}
+
+func (m *MemoryStore) AppendRunLogChunk(chunk *RunLogChunk) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	run, ok := m.runs[chunk.ProjectRunID]
+	if !ok {
+		return 0, fmt.Errorf("run %v not found", chunk.ProjectRunID)
+	}
+	if run.LogExpired || run.LogSize != chunk.StartOffset {
+		return run.LogSize, ErrRunLogOffsetMismatch
+	}
+	chunk.ID, chunk.CreatedAt = m.id()
+	chunk.UpdatedAt = chunk.CreatedAt
+	m.logChunks[run.ID] = append(m.logChunks[run.ID], *chunk)
+	run.LogSize += chunk.Size
+	m.runs[run.ID] = run
+	return run.LogSize, nil
+}
+
+func (m *MemoryStore) GetRunLogChunks(runId uint) ([]RunLogChunk, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]RunLogChunk{}, m.logChunks[runId]...), nil
+}
+
+func (m *MemoryStore) GetRunsWithLogsBefore(before time.Time, limit int) ([]ProjectRun, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	runs := make([]ProjectRun, 0)
+	for _, run := range m.runs {
+		if run.CreatedAt.Before(before) && !run.LogExpired {
+			runs = append(runs, run)
+		}
+	}
+	sort.Slice(runs, func(i, j int) bool { return runs[i].CreatedAt.Before(runs[j].CreatedAt) })
+	if len(runs) > limit {
+		runs = runs[:limit]
+	}
+	return runs, nil
+}
+
+func (m *MemoryStore) ExpireRunLog(runId uint) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.logChunks, runId)
+	if document, ok := m.searchDocs[runId]; ok {
+		document.Content = ""
+		m.searchDocs[runId] = document
+	}
+	if run, ok := m.runs[runId]; ok {
+		run.LogExpired = true
+		run.Output = ""
+		m.runs[runId] = run
+	}
+	return nil
+}
+
+func (m *MemoryStore) SaveRunSearchDocument(document *RunSearchDocument) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if existing, ok := m.searchDocs[document.ProjectRunID]; ok {
+		document.ID, document.CreatedAt = existing.ID, existing.CreatedAt
+	} else {
+		document.ID, document.CreatedAt = m.id()
+	}
+	document.UpdatedAt = time.Now()
+	m.searchDocs[document.ProjectRunID] = *document
+	return nil
+}
+
+func (m *MemoryStore) SearchRuns(orgId uint, query string, limit int) ([]RunSearchResult, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	terms := searchTerms(query)
+	results := make([]RunSearchResult, 0)
+	for _, document := range m.searchDocs {
+		run, ok := m.runs[document.ProjectRunID]
+		if document.OrganisationID != orgId || !ok || !matchesSearchTerms(&document, terms) {
+			continue
+		}
+		if project, ok := m.projects[run.ProjectID]; ok {
+			project = m.projectWithRelations(project)
+			run.Project = &project
+		}
+		results = append(results, RunSearchResult{
+			Run:             run,
+			Snippet:         searchSnippet(document.Content, terms),
+			ResourceChanges: matchingResourceChanges(run.ResourceChanges, terms),
+		})
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].Run.ID > results[j].Run.ID })
+	if len(results) > limit {
+		results = results[:limit]
+	}
+	return results, nil
+}
+
+func (m *MemoryStore) GetDriftSchedule(projectId uint) (*DriftSchedule, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	schedule, ok := m.driftSchedules[projectId]
+	if !ok {
+		return nil, nil
+	}
+	return &schedule, nil
+}
+
+func (m *MemoryStore) SaveDriftSchedule(schedule *DriftSchedule) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if schedule.Project != nil {
+		schedule.ProjectID = schedule.Project.ID
+	}
+	if schedule.ID == 0 {
+		schedule.ID, schedule.CreatedAt = m.id()
+	}
+	schedule.UpdatedAt = time.Now()
+	stored := *schedule
+	stored.Project = nil
+	m.driftSchedules[schedule.ProjectID] = stored
+	return nil
+}
+
+func (m *MemoryStore) GetDueDriftSchedules(now time.Time, limit int) ([]DriftSchedule, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	schedules := make([]DriftSchedule, 0)
+	for _, schedule := range m.driftSchedules {
+		if !schedule.Enabled || schedule.NextRunAt.After(now) {
+			continue
+		}
+		if project, ok := m.projects[schedule.ProjectID]; ok {
+			project = m.projectWithRelations(project)
+			schedule.Project = &project
+		}
+		schedules = append(schedules, schedule)
+	}
+	sort.Slice(schedules, func(i, j int) bool { return schedules[i].NextRunAt.Before(schedules[j].NextRunAt) })
+	if len(schedules) > limit {
+		schedules = schedules[:limit]
+	}
+	return schedules, nil
+}
+
+func (m *MemoryStore) SaveDriftReport(report *DriftReport) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if report.Project != nil {
+		report.ProjectID = report.Project.ID
+	}
+	if report.ID == 0 {
+		report.ID, report.CreatedAt = m.id()
+	}
+	report.UpdatedAt = time.Now()
+	stored := *report
+	stored.Project = nil
+	m.driftReports[report.ID] = stored
+	return nil
+}
+
+func (m *MemoryStore) GetDriftReportForJob(diggerJobId string) (*DriftReport, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, report := range m.driftReports {
+		if report.DiggerJobId == diggerJobId {
+			return &report, nil
+		}
+	}
+	return nil, nil
+}
+
+func (m *MemoryStore) GetDriftForOrg(orgId uint) ([]ProjectDrift, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	reports := make([]DriftReport, 0)
+	for _, report := range m.driftReports {
+		reports = append(reports, report)
+	}
+	sort.Slice(reports, func(i, j int) bool { return reports[i].ID < reports[j].ID })
+
+	byProject := make(map[uint]*ProjectDrift)
+	driftFor := func(projectId uint) *ProjectDrift {
+		project, ok := m.projects[projectId]
+		if !ok || project.OrganisationID != orgId {
+			return nil
+		}
+		if byProject[projectId] == nil {
+			byProject[projectId] = &ProjectDrift{Project: m.projectWithRelations(project)}
+		}
+		return byProject[projectId]
+	}
+	for _, schedule := range m.driftSchedules {
+		if drift := driftFor(schedule.ProjectID); drift != nil {
+			schedule := schedule
+			drift.Schedule = &schedule
+		}
+	}
+	for _, report := range reports {
+		drift := driftFor(report.ProjectID)
+		if drift == nil || report.Status == DriftReportPending {
+			continue
+		}
+		report := report
+		drift.LastReport = &report
+		switch report.Status {
+		case DriftReportNoDrift:
+			drift.DriftingSince = nil
+		case DriftReportDrifted:
+			if drift.DriftingSince == nil {
+				drift.DriftingSince = &report.CreatedAt
+			}
+		}
+	}
+
+	drift := make([]ProjectDrift, 0, len(byProject))
+	for _, projectDrift := range byProject {
+		if last := projectDrift.LastReport; last != nil && last.Status == DriftReportDrifted && last.ProjectRunID != nil {
+			if run, ok := m.runs[*last.ProjectRunID]; ok {
+				projectDrift.ResourceChanges = driftedChanges(run.ResourceChanges)
+			}
+		}
+		drift = append(drift, *projectDrift)
+	}
+	sortProjectDrift(drift)
+	return drift, nil
+}
+
+func (m *MemoryStore) GetDriftReportsForProject(projectId uint, limit int) ([]DriftReport, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	reports := make([]DriftReport, 0)
+	for _, report := range m.driftReports {
+		if report.ProjectID == projectId {
+			reports = append(reports, report)
+		}
+	}
+	sort.Slice(reports, func(i, j int) bool { return reports[i].ID > reports[j].ID })
+	if len(reports) > limit {
+		reports = reports[:limit]
+	}
+	return reports, nil
+}
+
+func (m *MemoryStore) AcquireLease(name string, holder string, ttl time.Duration) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	if lease, ok := m.leases[name]; ok && lease.Holder != holder && lease.ExpiresAt.After(now) {
+		return false, nil
+	}
+	m.leases[name] = SchedulerLease{Name: name, Holder: holder, ExpiresAt: now.Add(ttl)}
+	return true, nil
+}
+
+func (m *MemoryStore) SavePullRequestReview(review *PullRequestReview) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := fmt.Sprintf("%v#%v@%v", review.RepoFullName, review.PullRequestNumber, review.Reviewer)
+	if stored, ok := m.reviews[key]; ok {
+		if stored.SubmittedAt.After(review.SubmittedAt) {
+			return nil
+		}
+		review.ID, review.CreatedAt = stored.ID, stored.CreatedAt
+	} else {
+		review.ID, review.CreatedAt = m.id()
+	}
+	review.UpdatedAt = time.Now()
+	m.reviews[key] = *review
+	return nil
+}
+
+func (m *MemoryStore) GetPullRequestReviews(repoFullName string, prNumber int) ([]PullRequestReview, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	reviews := make([]PullRequestReview, 0)
+	for _, review := range m.reviews {
+		if review.RepoFullName == repoFullName && review.PullRequestNumber == prNumber {
+			reviews = append(reviews, review)
+		}
+	}
+	sort.Slice(reviews, func(i, j int) bool { return reviews[i].ID < reviews[j].ID })
+	return reviews, nil
+}
+
+func (m *MemoryStore) HoldDiggerJobForApproval(request *ApplyApprovalRequest) error {
+	if !m.setDiggerJobStatus(request.DiggerJobId, DiggerJobCreated, DiggerJobPendingApproval) {
+		return fmt.Errorf("digger job %v isn't waiting to be triggered", request.DiggerJobId)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	request.ID, request.CreatedAt = m.id()
+	request.UpdatedAt = request.CreatedAt
+	m.approvalRequests[request.DiggerJobId] = *request
+	return nil
+}
+
+func (m *MemoryStore) GetApplyApprovalRequests(repoFullName string, prNumber int) ([]ApplyApprovalRequest, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	requests := make([]ApplyApprovalRequest, 0)
+	for _, request := range m.approvalRequests {
+		if request.RepoFullName == repoFullName && request.PullRequestNumber == prNumber {
+			requests = append(requests, request)
+		}
+	}
+	sort.Slice(requests, func(i, j int) bool { return requests[i].ID < requests[j].ID })
+	return requests, nil
+}
+
+func (m *MemoryStore) ReleaseApprovedDiggerJob(diggerJobId string) (bool, error) {
+	return m.finishHeldDiggerJob(diggerJobId, DiggerJobCreated)
+}
+
+func (m *MemoryStore) CancelHeldDiggerJob(diggerJobId string) (bool, error) {
+	return m.finishHeldDiggerJob(diggerJobId, DiggerJobFailed)
+}
+
+func (m *MemoryStore) finishHeldDiggerJob(diggerJobId string, status DiggerJobStatus) (bool, error) {
+	if !m.setDiggerJobStatus(diggerJobId, DiggerJobPendingApproval, status) {
+		return false, nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.approvalRequests, diggerJobId)
+	return true, nil
+}
+
+func (m *MemoryStore) SetSecret(name string, value string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.secrets[name] = value
+	return nil
+}
+
+func (m *MemoryStore) GetSecretOrEnv(name string, envName string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if value, ok := m.secrets[name]; ok {
+		return value, nil
+	}
+	return os.Getenv(envName), nil
+}
+
+func (m *MemoryStore) GetGithubApp(gitHubAppId any) (*GithubApp, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, app := range m.githubApps {
+		if fmt.Sprint(app.GithubId) == fmt.Sprint(gitHubAppId) {
+			return &app, nil
+		}
+	}
+	return envGithubApp(gitHubAppId)
+}
+
+func (m *MemoryStore) GetDefaultGithubApp() (*GithubApp, error) {
+	if githubAppId := os.Getenv("GITHUB_APP_ID"); githubAppId != "" {
+		return m.GetGithubApp(githubAppId)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var latest *GithubApp
+	for _, app := range m.githubApps {
+		if latest == nil || app.ID > latest.ID {
+			app := app
+			latest = &app
+		}
+	}
+	if latest == nil {
+		return nil, ErrGithubAppNotFound
+	}
+	return latest, nil
+}
+
+func (m *MemoryStore) GetGithubAppCredentials(app *GithubApp) (*GithubAppCredentials, error) {
+	return githubAppCredentials(m, app)
+}
+
+func (m *MemoryStore) CreateGithubAppWithCredentials(app *GithubApp, creds GithubAppCredentials) (*GithubApp, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	app.ClientId = creds.ClientId
+	app.ID, app.CreatedAt = m.id()
+	app.UpdatedAt = app.CreatedAt
+	m.githubApps[app.ID] = *app
+	m.secrets[GithubAppSecretName(app.GithubId, GithubAppClientSecret)] = creds.ClientSecret
+	m.secrets[GithubAppSecretName(app.GithubId, GithubAppPrivateKey)] = creds.PrivateKey
+	m.secrets[GithubAppSecretName(app.GithubId, GithubAppWebhookSecret)] = creds.WebhookSecret
+	return app, nil
+}
+
+// findInstallations returns matching installations, most recently updated first
+func (m *MemoryStore) findInstallations(match func(i GithubAppInstallation) bool) []GithubAppInstallation {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	installations := make([]GithubAppInstallation, 0)
+	for _, installation := range m.installations {
+		if match(installation) {
+			installations = append(installations, installation)
+		}
+	}
+	sort.Slice(installations, func(i, j int) bool {
+		if installations[i].UpdatedAt.Equal(installations[j].UpdatedAt) {
+			return installations[i].ID > installations[j].ID
+		}
+		return installations[i].UpdatedAt.After(installations[j].UpdatedAt)
+	})
+	return installations
+}
+
+func (m *MemoryStore) saveInstallation(installation *GithubAppInstallation) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if installation.ID == 0 {
+		installation.ID, installation.CreatedAt = m.id()
+	}
+	installation.UpdatedAt = time.Now()
+	m.installations[installation.ID] = *installation
+}
+
+func (m *MemoryStore) GithubRepoAdded(installationId int64, appId int64, login string, accountId int64, repoFullName string) (*GithubAppInstallation, error) {
+	installations := m.findInstallations(func(i GithubAppInstallation) bool {
+		return i.GithubInstallationId == installationId && i.Repo == repoFullName && i.GithubAppId == appId
+	})
+	installation := &GithubAppInstallation{GithubInstallationId: installationId, GithubAppId: appId, Login: login,
+		AccountId: int(accountId), Repo: repoFullName}
+	if len(installations) > 0 {
+		installation = &installations[0]
+	}
+	installation.Status = GithubAppInstallActive
+	m.saveInstallation(installation)
+	return installation, nil
+}
+
+func (m *MemoryStore) GithubRepoRemoved(installationId int64, appId int64, repoFullName string) (*GithubAppInstallation, error) {
+	installations := m.findInstallations(func(i GithubAppInstallation) bool {
+		return i.GithubInstallationId == installationId && i.Status == GithubAppInstallActive && i.GithubAppId == appId && i.Repo == repoFullName
+	})
+	if len(installations) == 0 {
+		return nil, nil
+	}
+	installation := &installations[0]
+	installation.Status = GithubAppInstallDeleted
+	m.saveInstallation(installation)
+	return installation, nil
+}
+
+func (m *MemoryStore) GetGithubAppInstallations(installationId int64) ([]GithubAppInstallation, error) {
+	installations := m.findInstallations(func(i GithubAppInstallation) bool {
+		return i.GithubInstallationId == installationId && i.Status == GithubAppInstallActive
+	})
+	sort.Slice(installations, func(i, j int) bool { return installations[i].ID < installations[j].ID })
+	return installations, nil
+}
+
+func (m *MemoryStore) GetGithubAppInstallationsForRepo(repoFullName string) ([]GithubAppInstallation, error) {
+	return m.findInstallations(func(i GithubAppInstallation) bool {
+		return i.Status == GithubAppInstallActive && i.Repo == repoFullName
+	}), nil
+}
+
+func (m *MemoryStore) GetGithubAppInstallationByIdAndRepo(installationId int64, repoFullName string) (*GithubAppInstallation, error) {
+	installations := m.findInstallations(func(i GithubAppInstallation) bool {
+		return i.GithubInstallationId == installationId && i.Status == GithubAppInstallActive && i.Repo == repoFullName
+	})
+	if len(installations) == 0 {
+		return nil, fmt.Errorf("GithubAppInstallation with id=%v doesn't exist", installationId)
+	}
+	return &installations[0], nil
+}
+
+func (m *MemoryStore) GetGithubAppInstallationByOrgAndRepo(orgId any, repo string, status GithubAppInstallStatus) (*GithubAppInstallation, error) {
+	links, err := m.GetGithubInstallationLinksForOrg(orgId)
+	if err != nil {
+		return nil, err
+	}
+	if len(links) == 0 {
+		return nil, fmt.Errorf("GithubAppInstallationLink not found for orgId: %v", orgId)
+	}
+	linked := make(map[int64]bool)
+	for _, link := range links {
+		linked[link.GithubInstallationId] = true
+	}
+	installations := m.findInstallations(func(i GithubAppInstallation) bool {
+		return linked[i.GithubInstallationId] && i.Status == status && i.Repo == repo
+	})
+	if len(installations) == 0 {
+		return nil, nil
+	}
+	return &installations[0], nil
+}
+
+func (m *MemoryStore) findInstallationLinks(match func(l GithubAppInstallationLink) bool) []GithubAppInstallationLink {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	links := make([]GithubAppInstallationLink, 0)
+	for _, link := range m.installLinks {
+		if match(link) {
+			if org, ok := m.organisations[link.OrganisationId]; ok {
+				link.Organisation = &org
+			}
+			links = append(links, link)
+		}
+	}
+	sort.Slice(links, func(i, j int) bool { return links[i].ID < links[j].ID })
+	return links
+}
+
+func (m *MemoryStore) saveInstallationLink(link *GithubAppInstallationLink) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if link.Organisation != nil {
+		link.OrganisationId = link.Organisation.ID
+	}
+	if link.ID == 0 {
+		link.ID, link.CreatedAt = m.id()
+	}
+	link.UpdatedAt = time.Now()
+	stored := *link
+	stored.Organisation = nil
+	m.installLinks[link.ID] = stored
+}
+
+func (m *MemoryStore) CreateGithubInstallationLink(org *Organisation, installationId int64) (*GithubAppInstallationLink, error) {
+	existing, err := m.GetGithubAppInstallationLink(installationId)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		if existing.OrganisationId != org.ID {
+			return nil, fmt.Errorf("GitHub app installation %v already linked to another org ", installationId)
+		}
+		return existing, nil
+	}
+	link := &GithubAppInstallationLink{Organisation: org, GithubInstallationId: installationId, Status: GithubAppInstallationLinkActive}
+	m.saveInstallationLink(link)
+	return link, nil
+}
+
+func (m *MemoryStore) GetGithubAppInstallationLink(installationId int64) (*GithubAppInstallationLink, error) {
+	links := m.findInstallationLinks(func(l GithubAppInstallationLink) bool {
+		return l.GithubInstallationId == installationId && l.Status == GithubAppInstallationLinkActive
+	})
+	if len(links) == 0 {
+		return nil, nil
+	}
+	return &links[0], nil
+}
+
+func (m *MemoryStore) GetGithubInstallationLinksForOrg(orgId any) ([]GithubAppInstallationLink, error) {
+	return m.findInstallationLinks(func(l GithubAppInstallationLink) bool {
+		return l.OrganisationId == memoryId(orgId) && l.Status == GithubAppInstallationLinkActive
+	}), nil
+}
+
+func (m *MemoryStore) MakeGithubAppInstallationLinkInactive(link *GithubAppInstallationLink) (*GithubAppInstallationLink, error) {
+	link.Status = GithubAppInstallationLinkInactive
+	m.saveInstallationLink(link)
+	return link, nil
+}
+
+// uniqueRepoName works like the GORM one, callers hold the lock
+func (m *MemoryStore) uniqueRepoName(orgId uint, fullName string, githubRepoId int64) string {
+	name := DiggerRepoName(fullName)
+	for _, repo := range m.repos {
+		if repo.OrganisationID == orgId && repo.Name == name && repo.GithubRepoId != githubRepoId {
+			return fmt.Sprintf("%v-%v", name, githubRepoId)
+		}
+	}
+	return name
+}
+
+func (m *MemoryStore) GetRepoByGithubId(orgId any, githubRepoId int64) (*Repo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, repo := range m.repos {
+		if repo.OrganisationID == memoryId(orgId) && repo.VcsProvider == VcsProviderGithub && repo.GithubRepoId == githubRepoId {
+			repo = m.repoWithRelations(repo)
+			return &repo, nil
+		}
+	}
+	return nil, nil
+}
+
+func (m *MemoryStore) FindGithubRepo(orgId uint, installationId int64, githubRepoId int64, owner string, name string) (*Repo, error) {
+	fullName := owner + "/" + name
+	if githubRepoId == 0 {
+		return nil, fmt.Errorf("id of GitHub repository %v is missing", fullName)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var found *Repo
+	for _, repo := range m.repos {
+		if repo.OrganisationID == orgId && repo.GithubRepoId == githubRepoId {
+			found = &repo
+			break
+		}
+	}
+	if found != nil {
+		if found.RepoOwner != owner || found.RepoName != name {
+			oldFullName := found.RepoFullName
+			// only the repository of the installation the event came from follows the rename
+			var appId int64
+			for id, installation := range m.installations {
+				if installation.GithubInstallationId == installationId && installation.Repo == oldFullName {
+					if appId == 0 {
+						appId = installation.GithubAppId
+					}
+					if installation.GithubAppId == appId {
+						installation.Repo = fullName
+						installation.UpdatedAt = time.Now()
+						m.installations[id] = installation
+					}
+				}
+			}
+			found.Name = m.uniqueRepoName(orgId, fullName, githubRepoId)
+			found.RepoOwner, found.RepoName, found.RepoFullName = owner, name, fullName
+			found.UpdatedAt = time.Now()
+			m.repos[found.ID] = *found
+		}
+		repo := m.repoWithRelations(*found)
+		return &repo, nil
+	}
+
+	for _, repo := range m.repos {
+		if repo.OrganisationID != orgId || repo.GithubRepoId != 0 {
+			continue
+		}
+		if repo.RepoFullName == fullName || (repo.RepoFullName == "" && repo.Name == DiggerRepoName(fullName)) {
+			repo.VcsProvider = VcsProviderGithub
+			repo.GithubRepoId = githubRepoId
+			repo.RepoOwner, repo.RepoName, repo.RepoFullName = owner, name, fullName
+			repo.UpdatedAt = time.Now()
+			m.repos[repo.ID] = repo
+			repo = m.repoWithRelations(repo)
+			return &repo, nil
+		}
+	}
+	return nil, nil
+}
+
+func (m *MemoryStore) GetRepoByGithubFullName(orgId any, repoFullName string) (*Repo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, repo := range m.repos {
+		if repo.OrganisationID == memoryId(orgId) && repo.VcsProvider == VcsProviderGithub && repo.RepoFullName == repoFullName {
+			repo = m.repoWithRelations(repo)
+			return &repo, nil
+		}
+	}
+	return nil, nil
+}
+
+func (m *MemoryStore) GetOrCreateGithubRepo(org *Organisation, installationId int64, githubRepoId int64, owner string, name string, diggerConfig string) (*Repo, error) {
+	repo, err := m.FindGithubRepo(org.ID, installationId, githubRepoId, owner, name)
+	if err != nil || repo != nil {
+		return repo, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fullName := owner + "/" + name
+	created := Repo{Name: m.uniqueRepoName(org.ID, fullName, githubRepoId), OrganisationID: org.ID, DiggerConfig: diggerConfig,
+		VcsProvider: VcsProviderGithub, RepoOwner: owner, RepoName: name, RepoFullName: fullName, GithubRepoId: githubRepoId}
+	created.ID, created.CreatedAt = m.id()
+	created.UpdatedAt = created.CreatedAt
+	m.repos[created.ID] = created
+	created = m.repoWithRelations(created)
+	return &created, nil
+}
+
+func (m *MemoryStore) GetUserByEmail(email string) (*User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, user := range m.users {
+		if user.Email == email {
+			return &user, nil
+		}
+	}
+	return nil, nil
+}
+
+func (m *MemoryStore) GetUserByExternalId(externalId string) (*User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, user := range m.users {
+		if user.ExternalId == externalId {
+			return &user, nil
+		}
+	}
+	return nil, nil
+}
+
+func (m *MemoryStore) UpdateUser(user *User) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	user.UpdatedAt = time.Now()
+	m.users[user.ID] = *user
+	return nil
+}
+
+func (m *MemoryStore) CreateUser(username string, email string, externalId string) (*User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, user := range m.users {
+		if user.Username == username {
+			return nil, fmt.Errorf("user %v already exists", username)
+		}
+	}
+	user := User{Username: username, Email: email, ExternalId: externalId}
+	user.ID, user.CreatedAt = m.id()
+	user.UpdatedAt = user.CreatedAt
+	m.users[user.ID] = user
+	return &user, nil
+}
+
+// membershipWithUser fills the relation like Preload("User"), callers hold the lock
+func (m *MemoryStore) membershipWithUser(membership OrgMembership) OrgMembership {
+	if user, ok := m.users[membership.UserID]; ok {
+		membership.User = &user
+	}
+	return membership
+}
+
+func (m *MemoryStore) GetOrgMembership(orgId uint, userId uint) (*OrgMembership, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, membership := range m.memberships {
+		if membership.OrganisationID == orgId && membership.UserID == userId {
+			membership = m.membershipWithUser(membership)
+			return &membership, nil
+		}
+	}
+	return nil, nil
+}
+
+func (m *MemoryStore) GetOrgMemberships(orgId uint) ([]OrgMembership, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	memberships := make([]OrgMembership, 0)
+	for _, membership := range m.memberships {
+		if membership.OrganisationID == orgId {
+			memberships = append(memberships, m.membershipWithUser(membership))
+		}
+	}
+	sort.Slice(memberships, func(i, j int) bool { return memberships[i].ID < memberships[j].ID })
+	return memberships, nil
+}
+
+func (m *MemoryStore) UpsertOrgMembership(orgId uint, user *User, role Role, status MembershipStatus) (*OrgMembership, error) {
+	membership, err := m.GetOrgMembership(orgId, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if membership == nil {
+		membership = &OrgMembership{OrganisationID: orgId, UserID: user.ID}
+		membership.ID, membership.CreatedAt = m.id()
+	}
+	membership.Role = role
+	membership.Status = status
+	membership.UpdatedAt = time.Now()
+	stored := *membership
+	stored.User = nil
+	m.memberships[membership.ID] = stored
+	membership.User = user
+	return membership, nil
+}
+
+func (m *MemoryStore) RemoveOrgMembership(orgId uint, userId uint) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for id, membership := range m.memberships {
+		if membership.OrganisationID == orgId && membership.UserID == userId {
+			delete(m.memberships, id)
+			for grantId, grant := range m.roleGrants {
+				if grant.OrganisationID == orgId && grant.UserID == userId {
+					delete(m.roleGrants, grantId)
+				}
+			}
+			return nil
+		}
+	}
+	return gorm.ErrRecordNotFound
+}
+
+func (m *MemoryStore) CreateRoleGrant(orgId uint, userId uint, repoId *uint, projectId *uint, role Role) (*RoleGrant, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	grant := RoleGrant{OrganisationID: orgId, UserID: userId, RepoID: repoId, ProjectID: projectId, Role: role}
+	grant.ID, grant.CreatedAt = m.id()
+	grant.UpdatedAt = grant.CreatedAt
+	m.roleGrants[grant.ID] = grant
+	return &grant, nil
+}
+
+func (m *MemoryStore) GetRoleGrants(orgId uint, userId uint) ([]RoleGrant, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	grants := make([]RoleGrant, 0)
+	for _, grant := range m.roleGrants {
+		if grant.OrganisationID == orgId && grant.UserID == userId {
+			grants = append(grants, grant)
+		}
+	}
+	sort.Slice(grants, func(i, j int) bool { return grants[i].ID < grants[j].ID })
+	return grants, nil
+}
+
+func (m *MemoryStore) DeleteRoleGrant(orgId uint, userId uint, grantId uint) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	grant, ok := m.roleGrants[grantId]
+	if !ok || grant.OrganisationID != orgId || grant.UserID != userId {
+		return gorm.ErrRecordNotFound
+	}
+	delete(m.roleGrants, grantId)
+	return nil
+}
@@ -0,0 +1,182 @@
+package models
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Migration is a numbered schema or data change. Up and Down run in a transaction together with
+// the bookkeeping in schema_migrations, so a failed migration leaves no trace.
+type Migration struct {
+	Version int
+	Name    string
+	Up      func(tx *gorm.DB) error
+	Down    func(tx *gorm.DB) error
+}
+
+type SchemaMigration struct {
+	Version   int `gorm:"primaryKey;autoIncrement:false"`
+	Name      string
+	AppliedAt time.Time
+}
+
+func (SchemaMigration) TableName() string {
+	return "schema_migrations"
+}
+
+type MigrationStatus struct {
+	Migration Migration
+	AppliedAt *time.Time
+}
+
+// arbitrary key of postgres advisory lock held while migrations run, so replicas starting together don't race
+const migrationsAdvisoryLockKey = 20230825
+
+func sortedMigrations() []Migration {
+	migrations := make([]Migration, len(Migrations))
+	copy(migrations, Migrations)
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations
+}
+
+// withMigrationsLock runs the action on a single connection holding the migrations lock
+func withMigrationsLock(db *gorm.DB, action func(conn *gorm.DB) error) error {
+	return db.Connection(func(tx *gorm.DB) error {
+		// new session so statements run on the connection don't leak into each other
+		conn := tx.Session(&gorm.Session{})
+		if conn.Dialector.Name() == "postgres" {
+			err := conn.Exec("SELECT pg_advisory_lock(?)", migrationsAdvisoryLockKey).Error
+			if err != nil {
+				return fmt.Errorf("failed to acquire migrations lock: %v", err)
+			}
+			defer func() {
+				err := conn.Exec("SELECT pg_advisory_unlock(?)", migrationsAdvisoryLockKey).Error
+				if err != nil {
+					log.Printf("failed to release migrations lock: %v", err)
+				}
+			}()
+		}
+
+		err := conn.AutoMigrate(&SchemaMigration{})
+		if err != nil {
+			return fmt.Errorf("failed to create schema_migrations table: %v", err)
+		}
+		return action(conn)
+	})
+}
+
+func appliedMigrations(conn *gorm.DB) (map[int]SchemaMigration, error) {
+	var rows []SchemaMigration
+	err := conn.Order("version").Find(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+	applied := make(map[int]SchemaMigration)
+	for _, row := range rows {
+		applied[row.Version] = row
+	}
+	return applied, nil
+}
+
+// GetMigrationsStatus returns all known migrations with the time they have been applied, nil if they are pending
+func GetMigrationsStatus(db *gorm.DB) ([]MigrationStatus, error) {
+	result := make([]MigrationStatus, 0)
+	err := withMigrationsLock(db, func(conn *gorm.DB) error {
+		applied, err := appliedMigrations(conn)
+		if err != nil {
+			return err
+		}
+		for _, m := range sortedMigrations() {
+			status := MigrationStatus{Migration: m}
+			if row, ok := applied[m.Version]; ok {
+				appliedAt := row.AppliedAt
+				status.AppliedAt = &appliedAt
+			}
+			result = append(result, status)
+		}
+		return nil
+	})
+	return result, err
+}
+
+func GetPendingMigrations(db *gorm.DB) ([]Migration, error) {
+	statuses, err := GetMigrationsStatus(db)
+	if err != nil {
+		return nil, err
+	}
+	pending := make([]Migration, 0)
+	for _, s := range statuses {
+		if s.AppliedAt == nil {
+			pending = append(pending, s.Migration)
+		}
+	}
+	return pending, nil
+}
+
+// MigrateUp applies all pending migrations in order and returns the applied ones
+func MigrateUp(db *gorm.DB) ([]Migration, error) {
+	applied := make([]Migration, 0)
+	err := withMigrationsLock(db, func(conn *gorm.DB) error {
+		done, err := appliedMigrations(conn)
+		if err != nil {
+			return err
+		}
+		for _, m := range sortedMigrations() {
+			if _, ok := done[m.Version]; ok {
+				continue
+			}
+			log.Printf("applying migration %v %v", m.Version, m.Name)
+			err := conn.Transaction(func(tx *gorm.DB) error {
+				err := m.Up(tx)
+				if err != nil {
+					return err
+				}
+				return tx.Create(&SchemaMigration{Version: m.Version, Name: m.Name, AppliedAt: time.Now()}).Error
+			})
+			if err != nil {
+				return fmt.Errorf("migration %v %v failed: %v", m.Version, m.Name, err)
+			}
+			applied = append(applied, m)
+		}
+		return nil
+	})
+	return applied, err
+}
+
+// MigrateDown reverts the last steps applied migrations, newest first, and returns the reverted ones
+func MigrateDown(db *gorm.DB, steps int) ([]Migration, error) {
+	reverted := make([]Migration, 0)
+	err := withMigrationsLock(db, func(conn *gorm.DB) error {
+		done, err := appliedMigrations(conn)
+		if err != nil {
+			return err
+		}
+		migrations := sortedMigrations()
+		for i := len(migrations) - 1; i >= 0 && len(reverted) < steps; i-- {
+			m := migrations[i]
+			if _, ok := done[m.Version]; !ok {
+				continue
+			}
+			log.Printf("reverting migration %v %v", m.Version, m.Name)
+			err := conn.Transaction(func(tx *gorm.DB) error {
+				err := m.Down(tx)
+				if err != nil {
+					return err
+				}
+				return tx.Delete(&SchemaMigration{}, "version = ?", m.Version).Error
+			})
+			if err != nil {
+				return fmt.Errorf("reverting migration %v %v failed: %v", m.Version, m.Name, err)
+			}
+			reverted = append(reverted, m)
+		}
+		return nil
+	})
+	return reverted, err
+}
@@ -0,0 +1,900 @@
+package models
+
+import (
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Migrations is the ordered list of schema changes. Tables are described with types frozen at the time
+// the migration was written, so later changes of the models don't change what old migrations do.
+// New migrations are appended with the next version number, applied migrations must never be edited.
+var Migrations = []Migration{
+	{
+		Version: 1,
+		Name:    "initial schema",
+		Up: func(tx *gorm.DB) error {
+			// tables might already exist in deployments created before migrations were versioned,
+			// AutoMigrate only adds what is missing
+			return tx.AutoMigrate(&v1Policy{}, &v1Organisation{}, &v1Repo{}, &v1Project{}, &v1Token{}, &v1User{},
+				&v1ProjectRun{}, &v1GithubAppInstallation{}, &v1GithubApp{}, &v1GithubAppInstallationLink{},
+				&v1GithubDiggerJobLink{}, &v1DiggerJob{}, &v1DiggerJobParentLink{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(&v1DiggerJobParentLink{}, &v1DiggerJob{}, &v1GithubDiggerJobLink{},
+				&v1GithubAppInstallationLink{}, &v1GithubApp{}, &v1GithubAppInstallation{}, &v1ProjectRun{},
+				&v1Policy{}, &v1Token{}, &v1User{}, &v1Project{}, &v1Repo{}, &v1Organisation{})
+		},
+	},
+	{
+		Version: 2,
+		Name:    "move namespaces to repos",
+		Up: func(tx *gorm.DB) error {
+			// namespaces were renamed to repos in August 2023, only old deployments still have the table
+			if tx.Dialector.Name() != "postgres" || !tx.Migrator().HasTable("namespaces") {
+				return nil
+			}
+			err := tx.Exec(`INSERT INTO repos (id, created_at, updated_at, deleted_at, name, organisation_id)
+				SELECT id, created_at, updated_at, deleted_at, name, organisation_id FROM namespaces
+				WHERE NOT EXISTS (SELECT 1 FROM repos WHERE repos.id = namespaces.id)`).Error
+			if err != nil {
+				return err
+			}
+			if tx.Migrator().HasColumn("projects", "namespace_id") {
+				err = tx.Exec("UPDATE projects SET repo_id = namespace_id WHERE repo_id IS NULL OR repo_id = 0").Error
+				if err != nil {
+					return err
+				}
+			}
+			if tx.Migrator().HasColumn("policies", "namespace_id") {
+				err = tx.Exec("UPDATE policies SET repo_id = namespace_id WHERE repo_id IS NULL").Error
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		Down: func(tx *gorm.DB) error {
+			return nil
+		},
+	},
+	{
+		Version: 3,
+		Name:    "users, org memberships and role grants",
+		Up: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(&v3User{}, &v3OrgMembership{}, &v3RoleGrant{})
+		},
+		Down: func(tx *gorm.DB) error {
+			err := tx.Migrator().DropTable(&v3RoleGrant{}, &v3OrgMembership{})
+			if err != nil {
+				return err
+			}
+			err = tx.Migrator().DropColumn(&v3User{}, "ExternalId")
+			if err != nil {
+				return err
+			}
+			return tx.Migrator().DropColumn(&v3User{}, "Email")
+		},
+	},
+	{
+		Version: 4,
+		Name:    "audit events",
+		Up: func(tx *gorm.DB) error {
+			err := tx.AutoMigrate(&v4AuditEvent{})
+			if err != nil {
+				return err
+			}
+			if tx.Dialector.Name() != "postgres" {
+				return nil
+			}
+			// append-only is enforced by the database as well, not only by the model hooks
+			err = tx.Exec(`CREATE OR REPLACE FUNCTION audit_events_append_only() RETURNS trigger AS $$
+				BEGIN
+					RAISE EXCEPTION 'audit_events is append-only';
+				END;
+				$$ LANGUAGE plpgsql`).Error
+			if err != nil {
+				return err
+			}
+			return tx.Exec(`CREATE TRIGGER audit_events_append_only BEFORE UPDATE OR DELETE ON audit_events
+				FOR EACH ROW EXECUTE FUNCTION audit_events_append_only()`).Error
+		},
+		Down: func(tx *gorm.DB) error {
+			if tx.Dialector.Name() == "postgres" {
+				err := tx.Exec("DROP TRIGGER IF EXISTS audit_events_append_only ON audit_events").Error
+				if err != nil {
+					return err
+				}
+				err = tx.Exec("DROP FUNCTION IF EXISTS audit_events_append_only()").Error
+				if err != nil {
+					return err
+				}
+			}
+			return tx.Migrator().DropTable(&v4AuditEvent{})
+		},
+	},
+	{
+		Version: 5,
+		Name:    "repo identity by vcs provider and external id",
+		Up: func(tx *gorm.DB) error {
+			err := tx.AutoMigrate(&v5Repo{})
+			if err != nil {
+				return err
+			}
+			// GitHub was the only provider so far
+			err = tx.Model(&v5Repo{}).Where("vcs_provider IS NULL OR vcs_provider = ''").Update("vcs_provider", VcsProviderGithub).Error
+			if err != nil {
+				return err
+			}
+			return backfillRepoFullNames(tx)
+		},
+		Down: func(tx *gorm.DB) error {
+			err := tx.Migrator().DropIndex(&v5Repo{}, "idx_repo_github_id")
+			if err != nil {
+				return err
+			}
+			for _, column := range []string{"GithubRepoId", "RepoFullName", "RepoName", "RepoOwner", "VcsProvider"} {
+				err = tx.Migrator().DropColumn(&v5Repo{}, column)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		Version: 6,
+		Name:    "github enterprise server urls on github apps",
+		Up: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(&v6GithubApp{})
+		},
+		Down: func(tx *gorm.DB) error {
+			for _, column := range []string{"GithubOauthUrl", "GithubUploadUrl", "GithubApiUrl"} {
+				err := tx.Migrator().DropColumn(&v6GithubApp{}, column)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		Version: 7,
+		Name:    "github app client ids, envelope encrypted secrets and project variables",
+		Up: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(&v7GithubApp{}, &v7Secret{}, &v7ProjectVariable{})
+		},
+		Down: func(tx *gorm.DB) error {
+			err := tx.Migrator().DropTable(&v7ProjectVariable{}, &v7Secret{})
+			if err != nil {
+				return err
+			}
+			return tx.Migrator().DropColumn(&v7GithubApp{}, "ClientId")
+		},
+	},
+	{
+		Version: 8,
+		Name:    "structured plan results on project runs",
+		Up: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(&v8ProjectRun{}, &v8ProjectRunResourceChange{})
+		},
+		Down: func(tx *gorm.DB) error {
+			err := tx.Migrator().DropTable(&v8ProjectRunResourceChange{})
+			if err != nil {
+				return err
+			}
+			for _, column := range []string{"PlanReplaceCount", "PlanDeleteCount", "PlanUpdateCount", "PlanCreateCount", "HasStructuredPlan"} {
+				err := tx.Migrator().DropColumn(&v8ProjectRun{}, column)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		Version: 9,
+		Name:    "plan artifacts",
+		Up: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(&v9PlanArtifact{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(&v9PlanArtifact{})
+		},
+	},
+	{
+		Version: 10,
+		Name:    "run logs in the blob store",
+		Up: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(&v10ProjectRun{}, &v10RunLogChunk{})
+		},
+		Down: func(tx *gorm.DB) error {
+			err := tx.Migrator().DropTable(&v10RunLogChunk{})
+			if err != nil {
+				return err
+			}
+			for _, column := range []string{"LogExpired", "LogSize"} {
+				err := tx.Migrator().DropColumn(&v10ProjectRun{}, column)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		Version: 11,
+		Name:    "run history filters",
+		Up: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(&v11ProjectRun{})
+		},
+		Down: func(tx *gorm.DB) error {
+			// sqlite recreates tables when columns are dropped, which can lose the indexes
+			for _, index := range []string{"StartedAt", "ProjectID"} {
+				if !tx.Migrator().HasIndex(&v11ProjectRun{}, index) {
+					continue
+				}
+				err := tx.Migrator().DropIndex(&v11ProjectRun{}, index)
+				if err != nil {
+					return err
+				}
+			}
+			return tx.Migrator().DropColumn(&v11ProjectRun{}, "PullRequestNumber")
+		},
+	},
+	{
+		Version: 12,
+		Name:    "link runs to jobs",
+		Up: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(&v12ProjectRun{}, &v12DiggerJob{})
+		},
+		Down: func(tx *gorm.DB) error {
+			err := tx.Migrator().DropColumn(&v12DiggerJob{}, "CommitSha")
+			if err != nil {
+				return err
+			}
+			for _, column := range []string{"WorkflowRunUrl", "Actor", "CommitSha", "BatchId", "DiggerJobId"} {
+				err := tx.Migrator().DropColumn(&v12ProjectRun{}, column)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		Version: 13,
+		Name:    "run search",
+		Up: func(tx *gorm.DB) error {
+			err := tx.AutoMigrate(&v13RunSearchDocument{})
+			if err != nil {
+				return err
+			}
+			if tx.Dialector.Name() == "postgres" {
+				// resource addresses rank above words of the log
+				err = tx.Exec(`ALTER TABLE run_search_documents ADD COLUMN search_vector tsvector GENERATED ALWAYS AS (
+					setweight(to_tsvector('simple', coalesce(resource_addresses, '')), 'A') ||
+					setweight(to_tsvector('simple', coalesce(content, '')), 'B')) STORED`).Error
+				if err != nil {
+					return err
+				}
+				err = tx.Exec("CREATE INDEX idx_run_search_documents_vector ON run_search_documents USING GIN (search_vector)").Error
+				if err != nil {
+					return err
+				}
+			}
+			return v13IndexExistingRuns(tx)
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(&v13RunSearchDocument{})
+		},
+	},
+	{
+		Version: 14,
+		Name:    "drift detection schedules and reports",
+		Up: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(&v14DriftSchedule{}, &v14DriftReport{}, &v14SchedulerLease{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(&v14SchedulerLease{}, &v14DriftReport{}, &v14DriftSchedule{})
+		},
+	},
+	{
+		Version: 15,
+		Name:    "pull request reviews and apply approval requests",
+		Up: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(&v15PullRequestReview{}, &v15ApplyApprovalRequest{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(&v15ApplyApprovalRequest{}, &v15PullRequestReview{})
+		},
+	},
+	{
+		Version: 16,
+		Name:    "append-only audit events on sqlite",
+		Up: func(tx *gorm.DB) error {
+			// postgres has had its trigger since the audit events table was created
+			if tx.Dialector.Name() == "postgres" {
+				return nil
+			}
+			err := tx.Exec(`CREATE TRIGGER IF NOT EXISTS audit_events_no_update BEFORE UPDATE ON audit_events
+				BEGIN SELECT RAISE(ABORT, 'audit_events is append-only'); END`).Error
+			if err != nil {
+				return err
+			}
+			return tx.Exec(`CREATE TRIGGER IF NOT EXISTS audit_events_no_delete BEFORE DELETE ON audit_events
+				BEGIN SELECT RAISE(ABORT, 'audit_events is append-only'); END`).Error
+		},
+		Down: func(tx *gorm.DB) error {
+			if tx.Dialector.Name() == "postgres" {
+				return nil
+			}
+			err := tx.Exec("DROP TRIGGER IF EXISTS audit_events_no_update").Error
+			if err != nil {
+				return err
+			}
+			return tx.Exec("DROP TRIGGER IF EXISTS audit_events_no_delete").Error
+		},
+	},
+}
+
+// v13IndexExistingRuns makes runs reported before search searchable, logs kept in the blob store can't be read
+// here so only the legacy output of runs and the addresses of their plans are indexed
+func v13IndexExistingRuns(tx *gorm.DB) error {
+	var runs []v13RunToIndex
+	return tx.Table("project_runs").
+		Select("project_runs.id, projects.organisation_id, project_runs.output").
+		Joins("INNER JOIN projects ON projects.id = project_runs.project_id").
+		Where("project_runs.deleted_at IS NULL").
+		FindInBatches(&runs, 100, func(batch *gorm.DB, _ int) error {
+			runIds := make([]uint, 0, len(runs))
+			for _, run := range runs {
+				runIds = append(runIds, run.ID)
+			}
+			var changes []v8ProjectRunResourceChange
+			err := batch.Session(&gorm.Session{NewDB: true}).Where("project_run_id IN ?", runIds).Find(&changes).Error
+			if err != nil {
+				return err
+			}
+			addresses := make(map[uint][]string)
+			for _, change := range changes {
+				addresses[change.ProjectRunID] = append(addresses[change.ProjectRunID], change.Address)
+			}
+
+			documents := make([]v13RunSearchDocument, 0, len(runs))
+			for _, run := range runs {
+				documents = append(documents, v13RunSearchDocument{
+					ProjectRunID:      run.ID,
+					OrganisationID:    run.OrganisationID,
+					Content:           SearchableText(run.Output),
+					ResourceAddresses: strings.Join(addresses[run.ID], "\n"),
+				})
+			}
+			if len(documents) == 0 {
+				return nil
+			}
+			return batch.Session(&gorm.Session{NewDB: true}).Create(&documents).Error
+		}).Error
+}
+
+// backfillRepoFullNames finds the GitHub repository of existing repos among the repositories the app is installed on.
+// Repos whose name matches several repositories are left alone, GitHub ids are filled in by the next webhook.
+func backfillRepoFullNames(tx *gorm.DB) error {
+	var links []v1GithubAppInstallationLink
+	err := tx.Where("status = ?", GithubAppInstallationLinkActive).Find(&links).Error
+	if err != nil {
+		return err
+	}
+	var installations []v1GithubAppInstallation
+	err = tx.Where("status = ?", GithubAppInstallActive).Find(&installations).Error
+	if err != nil {
+		return err
+	}
+	fullNamesByInstallation := make(map[int64][]string)
+	for _, installation := range installations {
+		fullNamesByInstallation[installation.GithubInstallationId] = append(fullNamesByInstallation[installation.GithubInstallationId], installation.Repo)
+	}
+	// digger name -> full names for every org
+	candidates := make(map[uint]map[string]map[string]bool)
+	for _, link := range links {
+		if candidates[link.OrganisationId] == nil {
+			candidates[link.OrganisationId] = make(map[string]map[string]bool)
+		}
+		for _, fullName := range fullNamesByInstallation[link.GithubInstallationId] {
+			name := DiggerRepoName(fullName)
+			if candidates[link.OrganisationId][name] == nil {
+				candidates[link.OrganisationId][name] = make(map[string]bool)
+			}
+			candidates[link.OrganisationId][name][fullName] = true
+		}
+	}
+
+	var repos []v5Repo
+	err = tx.Where("repo_full_name IS NULL OR repo_full_name = ''").Find(&repos).Error
+	if err != nil {
+		return err
+	}
+	for _, repo := range repos {
+		fullNames := candidates[repo.OrganisationID][repo.Name]
+		if len(fullNames) != 1 {
+			continue
+		}
+		for fullName := range fullNames {
+			parts := strings.SplitN(fullName, "/", 2)
+			if len(parts) != 2 {
+				continue
+			}
+			err = tx.Model(&v5Repo{}).Where("id = ?", repo.ID).Updates(map[string]interface{}{
+				"repo_owner":     parts[0],
+				"repo_name":      parts[1],
+				"repo_full_name": fullName,
+			}).Error
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+type v1Organisation struct {
+	gorm.Model
+	Name           string `gorm:"uniqueIndex:idx_organisation"`
+	ExternalSource string `gorm:"uniqueIndex:idx_external_source"`
+	ExternalId     string `gorm:"uniqueIndex:idx_external_source"`
+}
+
+func (v1Organisation) TableName() string { return "organisations" }
+
+type v1Repo struct {
+	gorm.Model
+	Name           string `gorm:"uniqueIndex:idx_org_repo"`
+	OrganisationID uint   `gorm:"uniqueIndex:idx_org_repo"`
+	Organisation   *v1Organisation
+	DiggerConfig   string
+}
+
+func (v1Repo) TableName() string { return "repos" }
+
+type v1Project struct {
+	gorm.Model
+	Name              string `gorm:"uniqueIndex:idx_project"`
+	OrganisationID    uint   `gorm:"uniqueIndex:idx_project"`
+	Organisation      *v1Organisation
+	RepoID            uint `gorm:"uniqueIndex:idx_project"`
+	Repo              *v1Repo
+	ConfigurationYaml string
+	Status            int64
+}
+
+func (v1Project) TableName() string { return "projects" }
+
+type v1ProjectRun struct {
+	gorm.Model
+	ProjectID uint
+	Project   *v1Project
+	StartedAt int64
+	EndedAt   int64
+	Status    string
+	Command   string
+	Output    string
+}
+
+func (v1ProjectRun) TableName() string { return "project_runs" }
+
+type v1User struct {
+	gorm.Model
+	Username string `gorm:"uniqueIndex:idx_user"`
+}
+
+func (v1User) TableName() string { return "users" }
+
+type v1Policy struct {
+	gorm.Model
+	ProjectID      *uint
+	Policy         string
+	Type           string
+	CreatedBy      *v1User
+	CreatedByID    *uint
+	Organisation   *v1Organisation
+	OrganisationID uint
+	Repo           *v1Repo
+	RepoID         *uint
+}
+
+func (v1Policy) TableName() string { return "policies" }
+
+type v1Token struct {
+	gorm.Model
+	Value          string `gorm:"uniqueIndex:idx_token"`
+	OrganisationID uint
+	Organisation   *v1Organisation
+	Type           string
+}
+
+func (v1Token) TableName() string { return "tokens" }
+
+type v1GithubApp struct {
+	gorm.Model
+	GithubId     int64
+	Name         string
+	GithubAppUrl string
+}
+
+func (v1GithubApp) TableName() string { return "github_apps" }
+
+type v1GithubAppInstallation struct {
+	gorm.Model
+	GithubInstallationId int64
+	GithubAppId          int64
+	AccountId            int
+	Login                string
+	Repo                 string
+	Status               int64
+}
+
+func (v1GithubAppInstallation) TableName() string { return "github_app_installations" }
+
+type v1GithubAppInstallationLink struct {
+	gorm.Model
+	GithubInstallationId int64 `gorm:"index:idx_github_installation_org"`
+	OrganisationId       uint  `gorm:"index:idx_github_installation_org"`
+	Organisation         *v1Organisation
+	Status               int8
+}
+
+func (v1GithubAppInstallationLink) TableName() string { return "github_app_installation_links" }
+
+type v1DiggerJobParentLink struct {
+	gorm.Model
+	DiggerJobId       string `gorm:"size:50,index:idx_digger_job_id"`
+	ParentDiggerJobId string `gorm:"size:50,index:idx_parent_digger_job_id"`
+}
+
+func (v1DiggerJobParentLink) TableName() string { return "digger_job_parent_links" }
+
+type v1DiggerJob struct {
+	gorm.Model
+	DiggerJobId     string `gorm:"size:50,index:idx_digger_job_id"`
+	Status          int8
+	BatchId         uuid.UUID `gorm:"index:idx_batch_id"`
+	SerializedJob   []byte
+	BranchName      string
+	StatusUpdatedAt time.Time
+}
+
+func (v1DiggerJob) TableName() string { return "digger_jobs" }
+
+type v1GithubDiggerJobLink struct {
+	gorm.Model
+	DiggerJobId         string `gorm:"size:50,index:idx_digger_job_id"`
+	RepoFullName        string
+	GithubJobId         int64 `gorm:"index:idx_github_job_id"`
+	GithubWorkflowRunId int64
+	Status              int8
+}
+
+func (v1GithubDiggerJobLink) TableName() string { return "github_digger_job_links" }
+
+type v3User struct {
+	gorm.Model
+	Username   string `gorm:"uniqueIndex:idx_user"`
+	Email      string `gorm:"index"`
+	ExternalId string `gorm:"index"`
+}
+
+func (v3User) TableName() string { return "users" }
+
+type v3OrgMembership struct {
+	gorm.Model
+	OrganisationID uint `gorm:"uniqueIndex:idx_org_membership"`
+	Organisation   *v1Organisation
+	UserID         uint `gorm:"uniqueIndex:idx_org_membership"`
+	User           *v3User
+	Role           string
+	Status         string
+}
+
+func (v3OrgMembership) TableName() string { return "org_memberships" }
+
+type v3RoleGrant struct {
+	gorm.Model
+	OrganisationID uint
+	Organisation   *v1Organisation
+	UserID         uint `gorm:"index"`
+	User           *v3User
+	RepoID         *uint
+	Repo           *v1Repo
+	ProjectID      *uint
+	Role           string
+}
+
+func (v3RoleGrant) TableName() string { return "role_grants" }
+
+type v4AuditEvent struct {
+	ID             uint      `gorm:"primarykey"`
+	CreatedAt      time.Time `gorm:"index"`
+	OrganisationID uint      `gorm:"index"`
+	Actor          string    `gorm:"index"`
+	Action         string    `gorm:"index"`
+	TargetType     string
+	TargetId       string
+	Before         string
+	After          string
+	RequestId      string
+	SourceIp       string
+}
+
+func (v4AuditEvent) TableName() string { return "audit_events" }
+
+type v5Repo struct {
+	gorm.Model
+	Name           string `gorm:"uniqueIndex:idx_org_repo"`
+	OrganisationID uint   `gorm:"uniqueIndex:idx_org_repo"`
+	Organisation   *v1Organisation
+	DiggerConfig   string
+	VcsProvider    string
+	RepoOwner      string
+	RepoName       string
+	RepoFullName   string
+	GithubRepoId   int64 `gorm:"index:idx_repo_github_id"`
+}
+
+func (v5Repo) TableName() string { return "repos" }
+
+type v6GithubApp struct {
+	gorm.Model
+	GithubId        int64
+	Name            string
+	GithubAppUrl    string
+	GithubApiUrl    string
+	GithubUploadUrl string
+	GithubOauthUrl  string
+}
+
+func (v6GithubApp) TableName() string { return "github_apps" }
+
+type v7GithubApp struct {
+	gorm.Model
+	GithubId        int64
+	Name            string
+	GithubAppUrl    string
+	GithubApiUrl    string
+	GithubUploadUrl string
+	GithubOauthUrl  string
+	ClientId        string
+}
+
+func (v7GithubApp) TableName() string { return "github_apps" }
+
+type v7EncryptedValue struct {
+	KeyId            string
+	EncryptedDataKey string
+	Ciphertext       string
+}
+
+type v7Secret struct {
+	gorm.Model
+	Name           string           `gorm:"uniqueIndex"`
+	EncryptedValue v7EncryptedValue `gorm:"embedded"`
+}
+
+func (v7Secret) TableName() string { return "secrets" }
+
+type v7ProjectVariable struct {
+	gorm.Model
+	ProjectID      uint             `gorm:"uniqueIndex:idx_project_variable"`
+	Name           string           `gorm:"uniqueIndex:idx_project_variable"`
+	EncryptedValue v7EncryptedValue `gorm:"embedded"`
+}
+
+func (v7ProjectVariable) TableName() string { return "project_variables" }
+
+type v8ProjectRun struct {
+	gorm.Model
+	ProjectID         uint
+	StartedAt         int64
+	EndedAt           int64
+	Status            string
+	Command           string
+	Output            string
+	HasStructuredPlan bool
+	PlanCreateCount   int
+	PlanUpdateCount   int
+	PlanDeleteCount   int
+	PlanReplaceCount  int
+}
+
+func (v8ProjectRun) TableName() string { return "project_runs" }
+
+type v8ProjectRunResourceChange struct {
+	gorm.Model
+	ProjectRunID  uint `gorm:"index"`
+	Address       string
+	ModuleAddress string
+	Mode          string
+	Type          string
+	Name          string
+	Action        string
+	Actions       string
+}
+
+func (v8ProjectRunResourceChange) TableName() string { return "project_run_resource_changes" }
+
+type v9PlanArtifact struct {
+	gorm.Model
+	ProjectID         uint   `gorm:"index:idx_plan_artifact_project_pr"`
+	PullRequestNumber int    `gorm:"index:idx_plan_artifact_project_pr"`
+	DiggerJobId       string `gorm:"size:50;index:idx_plan_artifact_job"`
+	CommitSha         string
+	BlobKey           string
+	Size              int64
+	Sha256            string
+}
+
+func (v9PlanArtifact) TableName() string { return "plan_artifacts" }
+
+type v10ProjectRun struct {
+	gorm.Model
+	ProjectID         uint
+	StartedAt         int64
+	EndedAt           int64
+	Status            string
+	Command           string
+	Output            string
+	LogSize           int64
+	LogExpired        bool
+	HasStructuredPlan bool
+	PlanCreateCount   int
+	PlanUpdateCount   int
+	PlanDeleteCount   int
+	PlanReplaceCount  int
+}
+
+func (v10ProjectRun) TableName() string { return "project_runs" }
+
+type v10RunLogChunk struct {
+	gorm.Model
+	ProjectRunID uint  `gorm:"uniqueIndex:idx_run_log_chunk"`
+	StartOffset  int64 `gorm:"uniqueIndex:idx_run_log_chunk"`
+	Size         int64
+	BlobKey      string
+}
+
+func (v10RunLogChunk) TableName() string { return "run_log_chunks" }
+
+type v11ProjectRun struct {
+	gorm.Model
+	ProjectID         uint  `gorm:"index"`
+	PullRequestNumber int   `gorm:"index"`
+	StartedAt         int64 `gorm:"index"`
+	EndedAt           int64
+	Status            string
+	Command           string
+	Output            string
+	LogSize           int64
+	LogExpired        bool
+	HasStructuredPlan bool
+	PlanCreateCount   int
+	PlanUpdateCount   int
+	PlanDeleteCount   int
+	PlanReplaceCount  int
+}
+
+func (v11ProjectRun) TableName() string { return "project_runs" }
+
+type v12ProjectRun struct {
+	gorm.Model
+	ProjectID         uint   `gorm:"index"`
+	PullRequestNumber int    `gorm:"index"`
+	DiggerJobId       string `gorm:"size:50;index"`
+	BatchId           string `gorm:"size:36;index"`
+	CommitSha         string `gorm:"size:40;index"`
+	Actor             string
+	WorkflowRunUrl    string
+	StartedAt         int64 `gorm:"index"`
+	EndedAt           int64
+	Status            string
+	Command           string
+	Output            string
+	LogSize           int64
+	LogExpired        bool
+	HasStructuredPlan bool
+	PlanCreateCount   int
+	PlanUpdateCount   int
+	PlanDeleteCount   int
+	PlanReplaceCount  int
+}
+
+func (v12ProjectRun) TableName() string { return "project_runs" }
+
+type v12DiggerJob struct {
+	gorm.Model
+	DiggerJobId     string `gorm:"size:50,index:idx_digger_job_id"`
+	Status          int8
+	BatchId         uuid.UUID `gorm:"index:idx_batch_id"`
+	SerializedJob   []byte
+	BranchName      string
+	CommitSha       string
+	StatusUpdatedAt time.Time
+}
+
+func (v12DiggerJob) TableName() string { return "digger_jobs" }
+
+type v13RunSearchDocument struct {
+	gorm.Model
+	ProjectRunID      uint `gorm:"uniqueIndex"`
+	OrganisationID    uint `gorm:"index"`
+	Content           string
+	ResourceAddresses string
+}
+
+func (v13RunSearchDocument) TableName() string { return "run_search_documents" }
+
+type v13RunToIndex struct {
+	ID             uint
+	OrganisationID uint
+	Output         string
+}
+
+type v14DriftSchedule struct {
+	gorm.Model
+	ProjectID uint `gorm:"uniqueIndex"`
+	Cron      string
+	Enabled   bool
+	NextRunAt time.Time `gorm:"index"`
+	LastRunAt *time.Time
+}
+
+func (v14DriftSchedule) TableName() string { return "drift_schedules" }
+
+type v14DriftReport struct {
+	gorm.Model
+	ProjectID    uint   `gorm:"index"`
+	DiggerJobId  string `gorm:"size:50;index"`
+	CommitSha    string
+	ProjectRunID *uint
+	Status       string
+	ChangeCount  int
+	Alert        bool
+	Reason       string
+	CompletedAt  *time.Time
+}
+
+func (v14DriftReport) TableName() string { return "drift_reports" }
+
+type v14SchedulerLease struct {
+	Name      string `gorm:"primaryKey"`
+	Holder    string
+	ExpiresAt time.Time
+}
+
+func (v14SchedulerLease) TableName() string { return "scheduler_leases" }
+
+type v15PullRequestReview struct {
+	gorm.Model
+	RepoFullName      string `gorm:"uniqueIndex:idx_pull_request_review"`
+	PullRequestNumber int    `gorm:"uniqueIndex:idx_pull_request_review"`
+	Reviewer          string `gorm:"uniqueIndex:idx_pull_request_review"`
+	State             string
+	CommitSha         string
+	SubmittedAt       time.Time
+}
+
+func (v15PullRequestReview) TableName() string { return "pull_request_reviews" }
+
+type v15ApplyApprovalRequest struct {
+	gorm.Model
+	DiggerJobId       string `gorm:"size:50;uniqueIndex"`
+	RepoFullName      string `gorm:"index:idx_apply_approval_pull_request"`
+	PullRequestNumber int    `gorm:"index:idx_apply_approval_pull_request"`
+	OrganisationID    uint
+	ProjectName       string
+	ProjectDir        string
+	RequestedBy       string
+	Reason            string
+}
+
+func (v15ApplyApprovalRequest) TableName() string { return "apply_approval_requests" }
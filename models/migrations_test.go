@@ -0,0 +1,105 @@
+package models
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func TestMigrateUpAndDown(t *testing.T) {
+	dbName := "database_migrations_test.db"
+	os.Remove(dbName)
+	defer os.Remove(dbName)
+
+	gdb, err := gorm.Open(sqlite.Open(dbName), &gorm.Config{})
+	assert.NoError(t, err)
+
+	pending, err := GetPendingMigrations(gdb)
+	assert.NoError(t, err)
+	assert.Equal(t, len(Migrations), len(pending))
+
+	applied, err := MigrateUp(gdb)
+	assert.NoError(t, err)
+	assert.Equal(t, len(Migrations), len(applied))
+	assert.True(t, gdb.Migrator().HasTable("audit_events"))
+	assert.True(t, gdb.Migrator().HasColumn(&User{}, "ExternalId"))
+
+	// current models work on the migrated schema
+	database := &Database{GormDB: gdb}
+	org, err := database.CreateOrganisation("migrated", "test", "migrated")
+	assert.NoError(t, err)
+	_, err = database.CreateRepo("repo", org, "")
+	assert.NoError(t, err)
+
+	applied, err = MigrateUp(gdb)
+	assert.NoError(t, err)
+	assert.Empty(t, applied)
+
+	reverted, err := MigrateDown(gdb, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(reverted))
+	assert.Equal(t, Migrations[len(Migrations)-1].Version, reverted[0].Version)
+
+	statuses, err := GetMigrationsStatus(gdb)
+	assert.NoError(t, err)
+	assert.Nil(t, statuses[len(statuses)-1].AppliedAt)
+	assert.NotNil(t, statuses[0].AppliedAt)
+
+	applied, err = MigrateUp(gdb)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(applied))
+
+	pending, err = GetPendingMigrations(gdb)
+	assert.NoError(t, err)
+	assert.Empty(t, pending)
+}
+
+func TestMigrateDownToEmptyDatabaseOnSqlite(t *testing.T) {
+	dbName := "database_migrations_down_test.db"
+	os.Remove(dbName)
+	defer os.Remove(dbName)
+	defer os.Remove(dbName + "-wal")
+	defer os.Remove(dbName + "-shm")
+
+	dialector, err := Dialector("sqlite://" + dbName)
+	assert.NoError(t, err)
+	gdb, err := gorm.Open(dialector, &gorm.Config{})
+	assert.NoError(t, err)
+
+	_, err = MigrateUp(gdb)
+	assert.NoError(t, err)
+
+	reverted, err := MigrateDown(gdb, len(Migrations))
+	assert.NoError(t, err)
+	assert.Equal(t, len(Migrations), len(reverted))
+	assert.False(t, gdb.Migrator().HasTable("organisations"))
+}
+
+func TestMigrationIndexesExistingRunsForSearch(t *testing.T) {
+	dbName := "database_migrations_search_test.db"
+	os.Remove(dbName)
+	defer os.Remove(dbName)
+
+	gdb, err := gorm.Open(sqlite.Open(dbName), &gorm.Config{})
+	assert.NoError(t, err)
+	_, err = MigrateUp(gdb)
+	assert.NoError(t, err)
+	// back to version 12 which had no search documents
+	_, err = MigrateDown(gdb, len(Migrations)-12)
+	assert.NoError(t, err)
+
+	assert.NoError(t, gdb.Exec("INSERT INTO projects (id, name, organisation_id) VALUES (3, 'prod', 5)").Error)
+	assert.NoError(t, gdb.Create(&v12ProjectRun{Model: gorm.Model{ID: 9}, ProjectID: 3, Output: "\x1b[1mPlan:\x1b[0m 1 to add"}).Error)
+	assert.NoError(t, gdb.Create(&v8ProjectRunResourceChange{ProjectRunID: 9, Address: "aws_iam_role.deployer"}).Error)
+
+	_, err = MigrateUp(gdb)
+	assert.NoError(t, err)
+	var document RunSearchDocument
+	assert.NoError(t, gdb.Where("project_run_id = ?", 9).First(&document).Error)
+	assert.Equal(t, uint(5), document.OrganisationID)
+	assert.Equal(t, "Plan: 1 to add", document.Content)
+	assert.Equal(t, "aws_iam_role.deployer", document.ResourceAddresses)
+}
@@ -2,6 +2,7 @@ package models
 
 import (
 	"gorm.io/gorm"
+	"strings"
 	"time"
 )
 
@@ -12,44 +13,194 @@ type Organisation struct {
 	ExternalId     string `gorm:"uniqueIndex:idx_external_source"`
 }
 
+const VcsProviderGithub = "github"
+
+// Repo is identified by its VCS provider and the id the provider assigned, Name is the digger name used in API paths
+// and follows renames and transfers of the repository
 type Repo struct {
 	gorm.Model
 	Name           string `gorm:"uniqueIndex:idx_org_repo"`
 	OrganisationID uint   `gorm:"uniqueIndex:idx_org_repo"`
 	Organisation   *Organisation
 	DiggerConfig   string
+	VcsProvider    string
+	RepoOwner      string
+	RepoName       string
+	RepoFullName   string
+	GithubRepoId   int64 `gorm:"index:idx_repo_github_id"`
+}
+
+// DiggerRepoName is the name digger uses for a repository full name, e.g. diggerhq-digger for diggerhq/digger.
+// Different repositories can map to the same name, so it is only used for API paths and never for lookups of webhooks.
+func DiggerRepoName(repoFullName string) string {
+	return strings.ReplaceAll(repoFullName, "/", "-")
 }
 
 type ProjectRun struct {
 	gorm.Model
-	ProjectID uint
-	Project   *Project
-	StartedAt int64
-	EndedAt   int64
-	Status    string
-	Command   string
-	Output    string
+	ProjectID         uint `gorm:"index"`
+	Project           *Project
+	PullRequestNumber int `gorm:"index"`
+	// the job the run was reported for and what it was triggered by, empty for runs reported without a job
+	DiggerJobId    string `gorm:"size:50;index"`
+	BatchId        string `gorm:"size:36;index"`
+	CommitSha      string `gorm:"size:40;index"`
+	Actor          string
+	WorkflowRunUrl string
+	StartedAt      int64 `gorm:"index"`
+	EndedAt        int64
+	Status         string
+	Command        string
+	// Output is only set on runs reported before logs were kept in the blob store
+	Output string
+	// LogSize is the number of bytes appended to the log in RunLogChunks, LogExpired is set once retention removed them
+	LogSize    int64
+	LogExpired bool
+	// set from the `terraform show -json` plan uploaded by the runner
+	HasStructuredPlan bool
+	PlanCreateCount   int
+	PlanUpdateCount   int
+	PlanDeleteCount   int
+	PlanReplaceCount  int
+	ResourceChanges   []ProjectRunResourceChange
+}
+
+const (
+	ResourceActionCreate  = "create"
+	ResourceActionUpdate  = "update"
+	ResourceActionDelete  = "delete"
+	ResourceActionReplace = "replace"
+	ResourceActionRead    = "read"
+)
+
+const (
+	RunStatusRunning = "running"
+	RunStatusStarted = "started"
+)
+
+// IsRunning is true until the runner reports the final status of the run
+func (p *ProjectRun) IsRunning() bool {
+	return p.Status == RunStatusRunning || p.Status == RunStatusStarted
+}
+
+// RunLogChunk is a piece of the log of a run, its content is kept in the blob store under BlobKey
+type RunLogChunk struct {
+	gorm.Model
+	ProjectRunID uint  `gorm:"uniqueIndex:idx_run_log_chunk"`
+	StartOffset  int64 `gorm:"uniqueIndex:idx_run_log_chunk"`
+	Size         int64
+	BlobKey      string
+}
+
+// ProjectRunResourceChange is a resource the plan of a run changes, Actions are the terraform actions
+// joined with commas, e.g. "delete,create" for a replacement, Action is what they amount to
+type ProjectRunResourceChange struct {
+	gorm.Model
+	ProjectRunID  uint `gorm:"index"`
+	Address       string
+	ModuleAddress string
+	Mode          string
+	Type          string
+	Name          string
+	Action        string
+	Actions       string
+}
+
+// SetResourceChanges replaces the changes of the run and counts them by action
+func (p *ProjectRun) SetResourceChanges(changes []ProjectRunResourceChange) {
+	p.HasStructuredPlan = true
+	p.ResourceChanges = changes
+	p.PlanCreateCount, p.PlanUpdateCount, p.PlanDeleteCount, p.PlanReplaceCount = 0, 0, 0, 0
+	for _, change := range changes {
+		switch change.Action {
+		case ResourceActionCreate:
+			p.PlanCreateCount++
+		case ResourceActionUpdate:
+			p.PlanUpdateCount++
+		case ResourceActionDelete:
+			p.PlanDeleteCount++
+		case ResourceActionReplace:
+			p.PlanReplaceCount++
+		}
+	}
+}
+
+type planSummaryJson struct {
+	Create  int
+	Update  int
+	Delete  int
+	Replace int
+}
+
+type resourceChangeJson struct {
+	Address       string
+	ModuleAddress string `json:",omitempty"`
+	Type          string
+	Name          string
+	Action        string
+	Actions       []string
 }
 
 func (p *ProjectRun) MapToJsonStruct() interface{} {
+	var planSummary *planSummaryJson
+	if p.HasStructuredPlan {
+		planSummary = &planSummaryJson{
+			Create:  p.PlanCreateCount,
+			Update:  p.PlanUpdateCount,
+			Delete:  p.PlanDeleteCount,
+			Replace: p.PlanReplaceCount,
+		}
+	}
+	var resourceChanges []resourceChangeJson
+	for _, change := range p.ResourceChanges {
+		resourceChanges = append(resourceChanges, resourceChangeJson{
+			Address:       change.Address,
+			ModuleAddress: change.ModuleAddress,
+			Type:          change.Type,
+			Name:          change.Name,
+			Action:        change.Action,
+			Actions:       strings.Split(change.Actions, ","),
+		})
+	}
+
 	return struct {
-		Id          uint
-		ProjectID   uint
-		ProjectName string
-		StartedAt   time.Time
-		EndedAt     time.Time
-		Status      string
-		Command     string
-		Output      string
+		Id                uint
+		ProjectID         uint
+		ProjectName       string
+		PullRequestNumber int    `json:",omitempty"`
+		DiggerJobId       string `json:",omitempty"`
+		BatchId           string `json:",omitempty"`
+		CommitSha         string `json:",omitempty"`
+		Actor             string `json:",omitempty"`
+		WorkflowRunUrl    string `json:",omitempty"`
+		StartedAt         time.Time
+		EndedAt           time.Time
+		Status            string
+		Command           string
+		Output            string
+		LogSize           int64
+		LogExpired        bool
+		PlanSummary       *planSummaryJson     `json:",omitempty"`
+		ResourceChanges   []resourceChangeJson `json:",omitempty"`
 	}{
-		Id:          p.ID,
-		ProjectID:   p.ProjectID,
-		ProjectName: p.Project.Name,
-		StartedAt:   time.UnixMilli(p.StartedAt),
-		EndedAt:     time.UnixMilli(p.EndedAt),
-		Status:      p.Status,
-		Command:     p.Command,
-		Output:      p.Output,
+		Id:                p.ID,
+		ProjectID:         p.ProjectID,
+		ProjectName:       p.Project.Name,
+		PullRequestNumber: p.PullRequestNumber,
+		DiggerJobId:       p.DiggerJobId,
+		BatchId:           p.BatchId,
+		CommitSha:         p.CommitSha,
+		Actor:             p.Actor,
+		WorkflowRunUrl:    p.WorkflowRunUrl,
+		StartedAt:         time.UnixMilli(p.StartedAt),
+		EndedAt:           time.UnixMilli(p.EndedAt),
+		Status:            p.Status,
+		Command:           p.Command,
+		Output:            p.Output,
+		LogSize:           p.LogSize,
+		LogExpired:        p.LogExpired,
+		PlanSummary:       planSummary,
+		ResourceChanges:   resourceChanges,
 	}
 }
 
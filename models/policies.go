@@ -6,6 +6,11 @@ const (
 	POLICY_TYPE_ACCESS = "access"
 	POLICY_TYPE_PLAN   = "plan"
 	POLICY_TYPE_DRIFT  = "drift"
+	// POLICY_TYPE_DRIFT_ALERT decides which drift alerts, it is evaluated by the backend. Drift policies are
+	// evaluated by the runner like access and plan policies.
+	POLICY_TYPE_DRIFT_ALERT = "drift-alert"
+	// POLICY_TYPE_APPROVAL decides which pull requests may be applied, it is evaluated by the backend
+	POLICY_TYPE_APPROVAL = "approval"
 )
 
 type Policy struct {
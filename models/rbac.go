@@ -0,0 +1,148 @@
+package models
+
+import "gorm.io/gorm"
+
+type Role string
+
+const (
+	RoleViewer      Role = "viewer"
+	RoleOperator    Role = "operator"
+	RolePolicyAdmin Role = "policy-admin"
+	RoleOrgAdmin    Role = "org-admin"
+)
+
+// roles are ordered, every role has all the permissions of the roles before it
+var roleOrder = []Role{RoleViewer, RoleOperator, RolePolicyAdmin, RoleOrgAdmin}
+
+type Permission string
+
+const (
+	// PermissionRead allows to see projects, runs, repos and policies
+	PermissionRead Permission = "read"
+	// PermissionRunJobs allows to start runs, report projects and update job statuses
+	PermissionRunJobs Permission = "run-jobs"
+	// PermissionManagePolicies allows to create and update policies
+	PermissionManagePolicies Permission = "manage-policies"
+	// PermissionManageOrg allows to change repo settings, issue tokens and manage members
+	PermissionManageOrg Permission = "manage-org"
+)
+
+var rolePermissions = map[Role][]Permission{
+	RoleViewer:      {PermissionRead},
+	RoleOperator:    {PermissionRead, PermissionRunJobs},
+	RolePolicyAdmin: {PermissionRead, PermissionRunJobs, PermissionManagePolicies},
+	RoleOrgAdmin:    {PermissionRead, PermissionRunJobs, PermissionManagePolicies, PermissionManageOrg},
+}
+
+func IsValidRole(role string) bool {
+	_, ok := rolePermissions[Role(role)]
+	return ok
+}
+
+func (r Role) HasPermission(permission Permission) bool {
+	for _, p := range rolePermissions[r] {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
+func roleRank(role Role) int {
+	for i, r := range roleOrder {
+		if r == role {
+			return i
+		}
+	}
+	return -1
+}
+
+// HighestRole returns the most privileged of the roles, empty string if none of them is valid
+func HighestRole(roles ...Role) Role {
+	var result Role
+	for _, role := range roles {
+		if roleRank(role) > roleRank(result) {
+			result = role
+		}
+	}
+	return result
+}
+
+// TokenRole maps type of the digger issued token to a role, tokens issued before roles existed have access or admin type
+func TokenRole(tokenType string) Role {
+	switch tokenType {
+	case AccessPolicyType:
+		return RoleOperator
+	case AdminPolicyType:
+		return RoleOrgAdmin
+	}
+	if IsValidRole(tokenType) {
+		return Role(tokenType)
+	}
+	return ""
+}
+
+type MembershipStatus string
+
+const (
+	MembershipInvited MembershipStatus = "invited"
+	MembershipActive  MembershipStatus = "active"
+)
+
+type OrgMembership struct {
+	gorm.Model
+	OrganisationID uint `gorm:"uniqueIndex:idx_org_membership"`
+	Organisation   *Organisation
+	UserID         uint `gorm:"uniqueIndex:idx_org_membership"`
+	User           *User
+	Role           Role
+	Status         MembershipStatus
+}
+
+func (m *OrgMembership) MapToJsonStruct() interface{} {
+	return struct {
+		Id       uint             `json:"id"`
+		UserId   uint             `json:"userId"`
+		Username string           `json:"username"`
+		Email    string           `json:"email"`
+		Role     Role             `json:"role"`
+		Status   MembershipStatus `json:"status"`
+	}{
+		Id:       m.ID,
+		UserId:   m.UserID,
+		Username: m.User.Username,
+		Email:    m.User.Email,
+		Role:     m.Role,
+		Status:   m.Status,
+	}
+}
+
+// RoleGrant gives a member additional role on a single repo or project on top of the organisation role
+type RoleGrant struct {
+	gorm.Model
+	OrganisationID uint
+	Organisation   *Organisation
+	UserID         uint `gorm:"index"`
+	User           *User
+	RepoID         *uint
+	Repo           *Repo
+	ProjectID      *uint
+	Project        *Project
+	Role           Role
+}
+
+func (g *RoleGrant) MapToJsonStruct() interface{} {
+	return struct {
+		Id        uint  `json:"id"`
+		UserId    uint  `json:"userId"`
+		RepoId    *uint `json:"repoId,omitempty"`
+		ProjectId *uint `json:"projectId,omitempty"`
+		Role      Role  `json:"role"`
+	}{
+		Id:        g.ID,
+		UserId:    g.UserID,
+		RepoId:    g.RepoID,
+		ProjectId: g.ProjectID,
+		Role:      g.Role,
+	}
+}
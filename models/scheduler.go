@@ -14,6 +14,8 @@ const (
 	DiggerJobFailed    DiggerJobStatus = 3
 	DiggerJobStarted   DiggerJobStatus = 4
 	DiggerJobSucceeded DiggerJobStatus = 5
+	// DiggerJobPendingApproval holds an apply job until its pull request has the approvals its approval policy requires
+	DiggerJobPendingApproval DiggerJobStatus = 6
 )
 
 type DiggerJobParentLink struct {
@@ -24,11 +26,13 @@ type DiggerJobParentLink struct {
 
 type DiggerJob struct {
 	gorm.Model
-	DiggerJobId     string `gorm:"size:50,index:idx_digger_job_id"`
-	Status          DiggerJobStatus
-	BatchId         uuid.UUID `gorm:"index:idx_batch_id"`
-	SerializedJob   []byte
-	BranchName      string
+	DiggerJobId   string `gorm:"size:50,index:idx_digger_job_id"`
+	Status        DiggerJobStatus
+	BatchId       uuid.UUID `gorm:"index:idx_batch_id"`
+	SerializedJob []byte
+	BranchName    string
+	// CommitSha is the head of the pull request when the job was created
+	CommitSha       string
 	StatusUpdatedAt time.Time
 }
 
@@ -48,3 +52,15 @@ type GithubDiggerJobLink struct {
 	GithubWorkflowRunId int64
 	Status              DiggerJobLinkStatus
 }
+
+// PlanArtifact is the plan file a plan job uploaded for a commit, its content is kept in the blob store under BlobKey
+type PlanArtifact struct {
+	gorm.Model
+	ProjectID         uint   `gorm:"index:idx_plan_artifact_project_pr"`
+	PullRequestNumber int    `gorm:"index:idx_plan_artifact_project_pr"`
+	DiggerJobId       string `gorm:"size:50;index:idx_plan_artifact_job"`
+	CommitSha         string
+	BlobKey           string
+	Size              int64
+	Sha256            string
+}
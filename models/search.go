@@ -0,0 +1,165 @@
+package models
+
+import (
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"gorm.io/gorm"
+)
+
+// RunSearchDocument is the searchable text of a run, the start of its log and the addresses of the resources
+// its plan changes. On postgres the search_vector column added by migration 13 indexes it for full-text search.
+type RunSearchDocument struct {
+	gorm.Model
+	ProjectRunID      uint `gorm:"uniqueIndex"`
+	OrganisationID    uint `gorm:"index"`
+	Content           string
+	ResourceAddresses string
+}
+
+// the matches in snippets are marked with these, they are replaced after the snippet is escaped for HTML
+const (
+	SearchMatchStart = "⟪"
+	SearchMatchEnd   = "⟫"
+)
+
+type RunSearchResult struct {
+	Run ProjectRun
+	// Snippet is the part of the log around the first matches, empty if only resource addresses matched
+	Snippet string
+	// ResourceChanges are the changes of the plan whose address contains one of the search terms
+	ResourceChanges []ProjectRunResourceChange
+}
+
+var ansiEscapeRegex = regexp.MustCompile("\x1b\\[[0-9;?]*[A-Za-z]")
+
+// SearchableText removes the terminal escape sequences terraform colors its output with
+func SearchableText(log string) string {
+	return ansiEscapeRegex.ReplaceAllString(log, "")
+}
+
+// searchTerms splits a query into the words every match has to contain, quotes and excluded words are dropped
+func searchTerms(query string) []string {
+	terms := make([]string, 0)
+	for _, term := range strings.Fields(query) {
+		term = strings.Trim(term, `"`)
+		if term == "" || strings.HasPrefix(term, "-") || strings.EqualFold(term, "or") {
+			continue
+		}
+		terms = append(terms, term)
+	}
+	return terms
+}
+
+// splitAddressTerms separates terms shaped like resource addresses, e.g. aws_iam_role.deployer or
+// aws_instance.web[0], from the other terms of a query
+func splitAddressTerms(terms []string) ([]string, []string) {
+	addressTerms, otherTerms := make([]string, 0), make([]string, 0)
+	for _, term := range terms {
+		if strings.ContainsAny(term, ".[") {
+			addressTerms = append(addressTerms, term)
+		} else {
+			otherTerms = append(otherTerms, term)
+		}
+	}
+	return addressTerms, otherTerms
+}
+
+// matchesSearchTerms is the fallback match used without postgres, every term has to appear in the content or the addresses
+func matchesSearchTerms(document *RunSearchDocument, terms []string) bool {
+	content, addresses := strings.ToLower(document.Content), strings.ToLower(document.ResourceAddresses)
+	for _, term := range terms {
+		term = strings.ToLower(term)
+		if !strings.Contains(content, term) && !strings.Contains(addresses, term) {
+			return false
+		}
+	}
+	return len(terms) > 0
+}
+
+// searchSnippet cuts the content around the first match of a term and marks the matches in it
+func searchSnippet(content string, terms []string) string {
+	const context = 80
+	start := -1
+	for _, term := range terms {
+		index := indexFold(content, term)
+		if index != -1 && (start == -1 || index < start) {
+			start = index
+		}
+	}
+	if start == -1 {
+		return ""
+	}
+
+	from, to := start-context, start+context*2
+	if from < 0 {
+		from = 0
+	}
+	if to > len(content) {
+		to = len(content)
+	}
+	// don't cut characters in half
+	for from > 0 && !utf8.RuneStart(content[from]) {
+		from--
+	}
+	for to < len(content) && !utf8.RuneStart(content[to]) {
+		to++
+	}
+	snippet := content[from:to]
+
+	var marked strings.Builder
+	for i := 0; i < len(snippet); {
+		matched := ""
+		for _, term := range terms {
+			if hasPrefixFold(snippet[i:], term) && len(term) > len(matched) {
+				matched = snippet[i : i+len(term)]
+			}
+		}
+		if matched == "" {
+			marked.WriteByte(snippet[i])
+			i++
+			continue
+		}
+		marked.WriteString(SearchMatchStart + matched + SearchMatchEnd)
+		i += len(matched)
+	}
+
+	result := strings.TrimSpace(marked.String())
+	if from > 0 {
+		result = "…" + result
+	}
+	if to < len(content) {
+		result = result + "…"
+	}
+	return result
+}
+
+func hasPrefixFold(s string, prefix string) bool {
+	return len(s) >= len(prefix) && strings.EqualFold(s[:len(prefix)], prefix)
+}
+
+// indexFold is strings.Index ignoring case, the index is one in s unlike with an index into strings.ToLower(s)
+func indexFold(s string, substr string) int {
+	for i := 0; i+len(substr) <= len(s); i++ {
+		if hasPrefixFold(s[i:], substr) {
+			return i
+		}
+	}
+	return -1
+}
+
+// matchingResourceChanges returns the changes whose address contains one of the terms
+func matchingResourceChanges(changes []ProjectRunResourceChange, terms []string) []ProjectRunResourceChange {
+	matching := make([]ProjectRunResourceChange, 0)
+	for _, change := range changes {
+		address := strings.ToLower(change.Address)
+		for _, term := range terms {
+			if strings.Contains(address, strings.ToLower(term)) {
+				matching = append(matching, change)
+				break
+			}
+		}
+	}
+	return matching
+}
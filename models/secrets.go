@@ -0,0 +1,32 @@
+package models
+
+import (
+	"fmt"
+
+	"gorm.io/gorm"
+)
+
+// Secret is an envelope encrypted value looked up by name, e.g. github_app/123/private_key or stripe_key
+type Secret struct {
+	gorm.Model
+	Name           string         `gorm:"uniqueIndex"`
+	EncryptedValue EncryptedValue `gorm:"embedded"`
+}
+
+// ProjectVariable is added to the environment of the commands of every job dispatched for the project
+type ProjectVariable struct {
+	gorm.Model
+	ProjectID      uint           `gorm:"uniqueIndex:idx_project_variable"`
+	Name           string         `gorm:"uniqueIndex:idx_project_variable"`
+	EncryptedValue EncryptedValue `gorm:"embedded"`
+}
+
+func GithubAppSecretName(githubAppId int64, field string) string {
+	return fmt.Sprintf("github_app/%d/%v", githubAppId, field)
+}
+
+const (
+	GithubAppClientSecret  = "client_secret"
+	GithubAppPrivateKey    = "private_key"
+	GithubAppWebhookSecret = "webhook_secret"
+)
@@ -1,12 +1,14 @@
 package models
 
 import (
+	"fmt"
 	"gorm.io/driver/postgres"
-	_ "gorm.io/driver/postgres"
+	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 	"gorm.io/gorm/logger"
 	"log"
 	"os"
+	"strings"
 )
 
 type Database struct {
@@ -18,90 +20,102 @@ var DEFAULT_ORG_NAME = "digger"
 // var DB *gorm.DB
 var DB *Database
 
-func ConnectDatabase() {
-
-	database, err := gorm.Open(postgres.Open(os.Getenv("DATABASE_URL")), &gorm.Config{
-		Logger: logger.Default.LogMode(logger.Info),
-	})
-
-	if err != nil {
-		panic("Failed to connect to database!")
-	}
-
-	err = database.AutoMigrate(&Policy{})
-	if err != nil {
-		panic("Failed to perform migration for `Policies`!")
-	}
-
-	err = database.AutoMigrate(&Organisation{})
-	if err != nil {
-		panic("Failed to perform migration for `Organisations`!")
-	}
-
-	err = database.AutoMigrate(&Repo{})
-
-	if err != nil {
-		panic("Failed to perform migration for `Repos`!")
-	}
-
-	err = database.AutoMigrate(&Project{})
-
-	if err != nil {
-		panic("Failed to perform migration for `Projects`!")
-	}
-
-	err = database.AutoMigrate(&Token{})
-
-	if err != nil {
-		panic("Failed to perform migration for `Tokens`!")
+// sqliteBusyTimeoutMs is how long a write waits for the database lock before failing with SQLITE_BUSY
+const sqliteBusyTimeoutMs = 5000
+
+// Dialector picks the driver from the scheme of the database url. postgres:// and postgresql:// urls
+// (and plain key=value DSNs) use Postgres, sqlite:// and file: urls an embedded SQLite file,
+// e.g. sqlite:///var/lib/digger/digger.db
+func Dialector(databaseUrl string) (gorm.Dialector, error) {
+	switch {
+	case strings.HasPrefix(databaseUrl, "sqlite://"):
+		return sqlite.Open(sqliteDsn(strings.TrimPrefix(databaseUrl, "sqlite://"))), nil
+	case strings.HasPrefix(databaseUrl, "sqlite:"):
+		return sqlite.Open(sqliteDsn(strings.TrimPrefix(databaseUrl, "sqlite:"))), nil
+	case strings.HasPrefix(databaseUrl, "file:"):
+		return sqlite.Open(sqliteDsn(databaseUrl)), nil
+	case strings.HasPrefix(databaseUrl, "postgres://"), strings.HasPrefix(databaseUrl, "postgresql://"):
+		return postgres.Open(databaseUrl), nil
+	case strings.Contains(databaseUrl, "://"):
+		return nil, fmt.Errorf("unsupported database url scheme in %v", strings.SplitN(databaseUrl, "://", 2)[0])
+	case databaseUrl == "":
+		return nil, fmt.Errorf("DATABASE_URL is not set")
+	default:
+		return postgres.Open(databaseUrl), nil
 	}
+}
 
-	err = database.AutoMigrate(&User{})
-
-	if err != nil {
-		panic("Failed to perform migration for `Users`!")
+// sqliteDsn turns on WAL, so readers don't block the writer, waits on a locked database instead of failing
+// and enforces foreign keys. Options already present in the url win.
+func sqliteDsn(path string) string {
+	options := []string{"_journal_mode=WAL", fmt.Sprintf("_busy_timeout=%d", sqliteBusyTimeoutMs), "_foreign_keys=on", "_txlock=immediate"}
+	dsn := path
+	for _, option := range options {
+		key := strings.SplitN(option, "=", 2)[0]
+		if strings.Contains(dsn, key+"=") {
+			continue
+		}
+		if strings.Contains(dsn, "?") {
+			dsn += "&" + option
+		} else {
+			dsn += "?" + option
+		}
 	}
+	return dsn
+}
 
-	err = database.AutoMigrate(&ProjectRun{})
-
+// OpenDatabase connects to DATABASE_URL without touching the schema
+func OpenDatabase() (*gorm.DB, error) {
+	dialector, err := Dialector(os.Getenv("DATABASE_URL"))
 	if err != nil {
-		panic("Failed to perform migration for `ProjectRun`!")
+		return nil, err
 	}
-
-	err = database.AutoMigrate(&GithubAppInstallation{})
-
+	database, err := gorm.Open(dialector, &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Info),
+	})
 	if err != nil {
-		panic("Failed to perform migration for `GithubAppInstallation`!")
+		return nil, err
 	}
-
-	err = database.AutoMigrate(&GithubApp{})
-
-	if err != nil {
-		panic("Failed to perform migration for `GithubApp`!")
+	if database.Dialector.Name() == "sqlite" {
+		// SQLite has a single writer, one connection serialises writes in the process instead of
+		// making them wait for the file lock
+		sqlDB, err := database.DB()
+		if err != nil {
+			return nil, err
+		}
+		sqlDB.SetMaxOpenConns(1)
 	}
+	return database, nil
+}
 
-	err = database.AutoMigrate(&GithubAppInstallationLink{})
-
-	if err != nil {
-		panic("Failed to perform migration for `GithubAppInstallationLink`!")
-	}
+// ConnectDatabase refuses to start on a schema with pending migrations, unless DIGGER_AUTO_MIGRATE is set.
+// Otherwise migrations are applied with `migrate up` before the new version is rolled out.
+func ConnectDatabase() {
 
-	err = database.AutoMigrate(&GithubDiggerJobLink{})
+	database, err := OpenDatabase()
 
 	if err != nil {
-		panic("Failed to perform migration for `GithubDiggerJobLink`!")
+		log.Fatalf("Failed to connect to database: %v", err)
 	}
 
-	err = database.AutoMigrate(&DiggerJob{})
-
+	pending, err := GetPendingMigrations(database)
 	if err != nil {
-		panic("Failed to perform migration for `DiggerJob`!")
+		log.Fatalf("Failed to check database migrations: %v", err)
 	}
 
-	err = database.AutoMigrate(&DiggerJobParentLink{})
-
-	if err != nil {
-		panic("Failed to perform migration for `DiggerJobParentLink`!")
+	if len(pending) > 0 {
+		if os.Getenv("DIGGER_AUTO_MIGRATE") == "true" {
+			_, err = MigrateUp(database)
+			if err != nil {
+				log.Fatalf("Failed to migrate database: %v", err)
+			}
+		} else {
+			names := make([]string, 0)
+			for _, m := range pending {
+				names = append(names, fmt.Sprintf("%v %v", m.Version, m.Name))
+			}
+			log.Fatalf("Database has pending migrations (%v), run `migrate up` or set DIGGER_AUTO_MIGRATE=true", strings.Join(names, ", "))
+		}
 	}
 
 	DB = &Database{GormDB: database}
@@ -8,163 +8,25 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 	"log"
-	"net/http"
+	"os"
+	"strconv"
+	"strings"
 	"time"
 )
 
-func (db *Database) GetProjectsFromContext(c *gin.Context, orgIdKey string) ([]Project, bool) {
-	loggedInOrganisationId, exists := c.Get(orgIdKey)
-
-	log.Printf("getProjectsFromContext, org id: %v\n", loggedInOrganisationId)
-
-	if !exists {
-		c.String(http.StatusForbidden, "Not allowed to access this resource")
-		return nil, false
-	}
-
-	var projects []Project
-
-	err := db.GormDB.Preload("Organisation").Preload("Repo").
-		Joins("INNER JOIN repos ON projects.repo_id = repos.id").
-		Joins("INNER JOIN organisations ON projects.organisation_id = organisations.id").
-		Where("projects.organisation_id = ?", loggedInOrganisationId).Find(&projects).Error
-
-	if err != nil {
-		log.Printf("Unknown error occurred while fetching database, %v\n", err)
-		return nil, false
-	}
-
-	log.Printf("getProjectsFromContext, number of projects:%d\n", len(projects))
-	return projects, true
-}
-
-func (db *Database) GetReposFromContext(c *gin.Context, orgIdKey string) ([]Repo, bool) {
-	loggedInOrganisationId, exists := c.Get(orgIdKey)
-
-	log.Printf("GetReposFromContext, org id: %v\n", loggedInOrganisationId)
-
-	if !exists {
-		c.String(http.StatusForbidden, "Not allowed to access this resource")
-		return nil, false
-	}
-
-	var repos []Repo
-
-	err := db.GormDB.Preload("Organisation").
-		Joins("INNER JOIN organisations ON repos.organisation_id = organisations.id").
-		Where("repos.organisation_id = ?", loggedInOrganisationId).Find(&repos).Error
-
-	if err != nil {
-		log.Printf("Unknown error occurred while fetching database, %v\n", err)
-		return nil, false
-	}
-
-	log.Printf("GetReposFromContext, number of repos:%d\n", len(repos))
-	return repos, true
-}
-
-func (db *Database) GetPoliciesFromContext(c *gin.Context, orgIdKey string) ([]Policy, bool) {
-	loggedInOrganisationId, exists := c.Get(orgIdKey)
-
-	log.Printf("getPoliciesFromContext, org id: %v\n", loggedInOrganisationId)
-
-	if !exists {
-		c.String(http.StatusForbidden, "Not allowed to access this resource")
-		return nil, false
-	}
-
-	var policies []Policy
-
-	err := db.GormDB.Preload("Organisation").Preload("Repo").Preload("Project").
-		Joins("LEFT JOIN projects ON projects.id = policies.project_id").
-		Joins("LEFT JOIN repos ON projects.repo_id = repos.id").
-		Joins("LEFT JOIN organisations ON projects.organisation_id = organisations.id").
-		Where("projects.organisation_id = ?", loggedInOrganisationId).Find(&policies).Error
-
-	if err != nil {
-		log.Printf("Unknown error occurred while fetching database, %v\n", err)
-		return nil, false
-	}
-
-	log.Printf("getPoliciesFromContext, number of policies:%d\n", len(policies))
-	return policies, true
-}
-
-func (db *Database) GetProjectRunsFromContext(c *gin.Context, orgIdKey string) ([]ProjectRun, bool) {
-	loggedInOrganisationId, exists := c.Get(orgIdKey)
-
-	log.Printf("getProjectRunsFromContext, org id: %v\n", loggedInOrganisationId)
-
-	if !exists {
-		c.String(http.StatusForbidden, "Not allowed to access this resource")
-		return nil, false
-	}
-
-	var runs []ProjectRun
-
-	err := db.GormDB.Preload("Project").Preload("Project.Organisation").Preload("Project.Repo").
-		Joins("INNER JOIN projects ON projects.id = project_runs.project_id").
-		Joins("INNER JOIN repos ON projects.repo_id = repos.id").
-		Joins("INNER JOIN organisations ON projects.organisation_id = organisations.id").
-		Where("projects.organisation_id = ?", loggedInOrganisationId).Order("created_at desc").Find(&runs).Error
-
-	if err != nil {
-		log.Printf("Unknown error occurred while fetching database, %v\n", err)
-		return nil, false
-	}
-
-	log.Printf("getProjectRunsFromContext, number of runs:%d\n", len(runs))
-	return runs, true
-}
-
-func (db *Database) GetProjectByRunId(c *gin.Context, runId uint, orgIdKey string) (*ProjectRun, bool) {
-	loggedInOrganisationId, exists := c.Get(orgIdKey)
-	if !exists {
-		c.String(http.StatusForbidden, "Not allowed to access this resource")
-		return nil, false
-	}
-
-	log.Printf("GetProjectByRunId, org id: %v\n", loggedInOrganisationId)
-	var projectRun ProjectRun
-
-	err := db.GormDB.Preload("Project").Preload("Project.Organisation").Preload("Project.Repo").
-		Joins("INNER JOIN projects ON projects.id = project_runs.project_id").
-		Joins("INNER JOIN repos ON projects.repo_id = repos.id").
-		Joins("INNER JOIN organisations ON projects.organisation_id = organisations.id").
-		Where("projects.organisation_id = ?", loggedInOrganisationId).
-		Where("project_runs.id = ?", runId).First(&projectRun).Error
-
-	if err != nil {
-		log.Printf("Unknown error occurred while fetching database, %v\n", err)
-		return nil, false
-	}
-
-	return &projectRun, true
-}
-
-func (db *Database) GetProjectByProjectId(c *gin.Context, projectId uint, orgIdKey string) (*Project, bool) {
-	loggedInOrganisationId, exists := c.Get(orgIdKey)
-	if !exists {
-		c.String(http.StatusForbidden, "Not allowed to access this resource")
-		return nil, false
-	}
-
-	log.Printf("GetProjectByProjectId, org id: %v\n", loggedInOrganisationId)
-	var project Project
-
-	err := db.GormDB.Preload("Organisation").Preload("Repo").
-		Joins("INNER JOIN repos ON projects.repo_id = repos.id").
-		Joins("INNER JOIN organisations ON projects.organisation_id = organisations.id").
-		Where("projects.organisation_id = ?", loggedInOrganisationId).
-		Where("projects.id = ?", projectId).First(&project).Error
-
-	if err != nil {
-		log.Printf("Unknown error occurred while fetching database, %v\n", err)
-		return nil, false
+// GetProjectById returns project of the organisation, nil if it doesn't exist
+func (db *Database) GetProjectById(orgId any, projectId any) (*Project, error) {
+	project := &Project{}
+	result := db.GormDB.Preload("Organisation").Preload("Repo").Take(project, "organisation_id = ? AND id = ?", orgId, projectId)
+	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, result.Error
 	}
-
-	return &project, true
+	return project, nil
 }
 
 // GetProjectByName return project for specified org and repo
@@ -213,31 +75,6 @@ func (db *Database) GetProjectByRepo(orgId any, repo *Repo) ([]Project, error) {
 	return projects, nil
 }
 
-func (db *Database) GetPolicyByPolicyId(c *gin.Context, policyId uint, orgIdKey string) (*Policy, bool) {
-	loggedInOrganisationId, exists := c.Get(orgIdKey)
-	if !exists {
-		c.String(http.StatusForbidden, "Not allowed to access this resource")
-		return nil, false
-	}
-
-	log.Printf("getPolicyByPolicyId, org id: %v\n", loggedInOrganisationId)
-	var policy Policy
-
-	err := db.GormDB.Preload("Project").Preload("Project.Organisation").Preload("Project.Repo").
-		Joins("INNER JOIN projects ON projects.id = policies.project_id").
-		Joins("INNER JOIN repos ON projects.repo_id = repos.id").
-		Joins("INNER JOIN organisations ON projects.organisation_id = organisations.id").
-		Where("projects.organisation_id = ?", loggedInOrganisationId).
-		Where("policies.id = ?", policyId).First(&policy).Error
-
-	if err != nil {
-		log.Printf("Unknown error occurred while fetching database, %v\n", err)
-		return nil, false
-	}
-
-	return &policy, true
-}
-
 func (db *Database) GetDefaultRepo(c *gin.Context, orgIdKey string) (*Repo, bool) {
 	loggedInOrganisationId, exists := c.Get(orgIdKey)
 	if !exists {
@@ -279,7 +116,7 @@ func (db *Database) GetRepo(orgIdKey any, repoName string) (*Repo, error) {
 	return &repo, nil
 }
 
-// GetRepoById returns digger repo by organisationId and repo name (diggerhq-digger)
+// GetRepoById returns digger repo by organisationId and repo id, nil if it doesn't exist
 func (db *Database) GetRepoById(orgIdKey any, repoId any) (*Repo, error) {
 	var repo Repo
 
@@ -288,12 +125,25 @@ func (db *Database) GetRepoById(orgIdKey any, repoId any) (*Repo, error) {
 		Where("organisations.id = ? AND repos.ID=?", orgIdKey, repoId).First(&repo).Error
 
 	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
 		log.Printf("Failed to find digger repo for orgId: %v, and repoId: %v, error: %v\n", orgIdKey, repoId, err)
 		return nil, err
 	}
 	return &repo, nil
 }
 
+func (db *Database) GetReposForOrg(orgId any) ([]Repo, error) {
+	repos := make([]Repo, 0)
+	err := db.GormDB.Preload("Organisation").Where("organisation_id = ?", orgId).Order("id").Find(&repos).Error
+	if err != nil {
+		log.Printf("Failed to fetch repos for org %v, error: %v\n", orgId, err)
+		return nil, err
+	}
+	return repos, nil
+}
+
 // GithubRepoAdded handles github notification that github repo has been added to the app installation
 func (db *Database) GithubRepoAdded(installationId int64, appId int64, login string, accountId int64, repoFullName string) (*GithubAppInstallation, error) {
 
@@ -343,14 +193,22 @@ func (db *Database) GithubRepoRemoved(installationId int64, appId int64, repoFul
 	return item, nil
 }
 
+// GetGithubAppInstallationByOrgAndRepo looks up the repo across all installations linked to the org
 func (db *Database) GetGithubAppInstallationByOrgAndRepo(orgId any, repo string, status GithubAppInstallStatus) (*GithubAppInstallation, error) {
-	link, err := db.GetGithubInstallationLinkForOrg(orgId)
+	links, err := db.GetGithubInstallationLinksForOrg(orgId)
 	if err != nil {
 		return nil, err
 	}
+	if len(links) == 0 {
+		return nil, fmt.Errorf("GithubAppInstallationLink not found for orgId: %v", orgId)
+	}
+	installationIds := make([]int64, 0, len(links))
+	for _, link := range links {
+		installationIds = append(installationIds, link.GithubInstallationId)
+	}
 
 	installation := GithubAppInstallation{}
-	result := db.GormDB.Where("github_installation_id = ? AND status=? AND repo=?", link.GithubInstallationId, status, repo).Find(&installation)
+	result := db.GormDB.Where("github_installation_id IN ? AND status=? AND repo=?", installationIds, status, repo).Order("updated_at desc").Find(&installation)
 	if result.Error != nil {
 		if !errors.Is(result.Error, gorm.ErrRecordNotFound) {
 			return nil, result.Error
@@ -381,6 +239,17 @@ func (db *Database) GetGithubAppInstallationByIdAndRepo(installationId int64, re
 	return &installation, nil
 }
 
+// GetGithubAppInstallationsForRepo returns the active installations of all apps covering repoFullName,
+// most recently updated first
+func (db *Database) GetGithubAppInstallationsForRepo(repoFullName string) ([]GithubAppInstallation, error) {
+	var installations []GithubAppInstallation
+	result := db.GormDB.Where("status=? AND repo=?", GithubAppInstallActive, repoFullName).Order("updated_at desc").Find(&installations)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return installations, nil
+}
+
 func (db *Database) GetGithubAppInstallations(installationId int64) ([]GithubAppInstallation, error) {
 	var installations []GithubAppInstallation
 	result := db.GormDB.Where("github_installation_id = ? AND status=?", installationId, GithubAppInstallActive).Find(&installations)
@@ -419,17 +288,114 @@ func (db *Database) CreateGithubApp(name string, githubId int64, url string) (*G
 	return &app, nil
 }
 
-// GetGithubApp return GithubApp by Id
+// CreateGithubAppWithCredentials saves an app created through the manifest flow, its secrets go to the secrets table
+func (db *Database) CreateGithubAppWithCredentials(app *GithubApp, creds GithubAppCredentials) (*GithubApp, error) {
+	app.ClientId = creds.ClientId
+	err := db.GormDB.Transaction(func(tx *gorm.DB) error {
+		txDb := &Database{GormDB: tx}
+		err := tx.Save(app).Error
+		if err != nil {
+			return err
+		}
+		secrets := map[string]string{
+			GithubAppClientSecret:  creds.ClientSecret,
+			GithubAppPrivateKey:    creds.PrivateKey,
+			GithubAppWebhookSecret: creds.WebhookSecret,
+		}
+		for field, value := range secrets {
+			err = txDb.SetSecret(GithubAppSecretName(app.GithubId, field), value)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("GithubApp (name: %v, id: %v) has been created successfully\n", app.Name, app.GithubId)
+	return app, nil
+}
+
+// GetGithubAppCredentials returns the credentials of the app from the secrets table. Apps created by hand keep
+// their credentials in GITHUB_APP_CLIENT_ID, GITHUB_APP_CLIENT_SECRET, GITHUB_APP_PRIVATE_KEY and GITHUB_WEBHOOK_SECRET instead
+func (db *Database) GetGithubAppCredentials(app *GithubApp) (*GithubAppCredentials, error) {
+	return githubAppCredentials(db, app)
+}
+
+func githubAppCredentials(secrets SecretStore, app *GithubApp) (*GithubAppCredentials, error) {
+	creds := &GithubAppCredentials{ClientId: os.Getenv("GITHUB_APP_CLIENT_ID")}
+	if app.ClientId != "" {
+		creds.ClientId = app.ClientId
+	}
+	fields := []struct {
+		field   string
+		envName string
+		target  *string
+	}{
+		{GithubAppClientSecret, "GITHUB_APP_CLIENT_SECRET", &creds.ClientSecret},
+		{GithubAppPrivateKey, "GITHUB_APP_PRIVATE_KEY", &creds.PrivateKey},
+		{GithubAppWebhookSecret, "GITHUB_WEBHOOK_SECRET", &creds.WebhookSecret},
+	}
+	for _, secret := range fields {
+		value, err := secrets.GetSecretOrEnv(GithubAppSecretName(app.GithubId, secret.field), secret.envName)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read credentials of github app %v: %v", app.GithubId, err)
+		}
+		*secret.target = value
+	}
+	return creds, nil
+}
+
+// ErrGithubAppNotFound is returned when no GitHub app matches
+var ErrGithubAppNotFound = errors.New("github app not found")
+
+// GetDefaultGithubApp returns the app with GITHUB_APP_ID, or the latest app created through the manifest flow
+// when it isn't set. It returns ErrGithubAppNotFound if there is none yet.
+func (db *Database) GetDefaultGithubApp() (*GithubApp, error) {
+	if githubAppId := os.Getenv("GITHUB_APP_ID"); githubAppId != "" {
+		return db.GetGithubApp(githubAppId)
+	}
+	app := GithubApp{}
+	result := db.GormDB.Order("id desc").Limit(1).Find(&app)
+	if result.Error != nil {
+		log.Printf("Failed to find default GitHub App, error: %v\n", result.Error)
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, ErrGithubAppNotFound
+	}
+	return &app, nil
+}
+
+// GetGithubApp return GithubApp by Id, or ErrGithubAppNotFound if there is no such app. The app with
+// GITHUB_APP_ID doesn't need to be stored, it is configured by environment variables.
 func (db *Database) GetGithubApp(gitHubAppId any) (*GithubApp, error) {
 	app := GithubApp{}
-	result := db.GormDB.Where("github_id = ?", gitHubAppId).Find(&app)
+	result := db.GormDB.Where("github_id = ?", gitHubAppId).Limit(1).Find(&app)
 	if result.Error != nil {
 		log.Printf("Failed to find GitHub App for id: %v, error: %v\n", gitHubAppId, result.Error)
 		return nil, result.Error
 	}
+	if result.RowsAffected == 0 {
+		return envGithubApp(gitHubAppId)
+	}
 	return &app, nil
 }
 
+// envGithubApp returns the app configured by environment variables if it has the id
+func envGithubApp(gitHubAppId any) (*GithubApp, error) {
+	envAppId := os.Getenv("GITHUB_APP_ID")
+	if envAppId == "" || envAppId != fmt.Sprint(gitHubAppId) {
+		return nil, ErrGithubAppNotFound
+	}
+	githubId, err := strconv.ParseInt(envAppId, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("GITHUB_APP_ID %v isn't a number: %v", envAppId, err)
+	}
+	return &GithubApp{GithubId: githubId}, nil
+}
+
 func (db *Database) CreateGithubInstallationLink(org *Organisation, installationId int64) (*GithubAppInstallationLink, error) {
 	l := GithubAppInstallationLink{}
 	// check if there is already a link to another org, and throw an error in this case
@@ -448,19 +414,7 @@ func (db *Database) CreateGithubInstallationLink(org *Organisation, installation
 		return &l, nil
 	}
 
-	var list []GithubAppInstallationLink
-	// if there are other installation for this org, we need to make them inactive
-	result = db.GormDB.Preload("Organisation").Where("github_installation_id <> ? AND organisation_id = ? AND status=?", installationId, org.ID, GithubAppInstallationLinkActive).Find(&list)
-	if result.Error != nil {
-		if !errors.Is(result.Error, gorm.ErrRecordNotFound) {
-			return nil, result.Error
-		}
-	}
-	for _, item := range list {
-		item.Status = GithubAppInstallationLinkInactive
-		db.GormDB.Save(&item)
-	}
-
+	// an org can have several installations active at once, e.g. one per GitHub organisation or user account
 	link := GithubAppInstallationLink{Organisation: org, GithubInstallationId: installationId, Status: GithubAppInstallationLinkActive}
 	result = db.GormDB.Save(&link)
 	if result.Error != nil {
@@ -470,25 +424,14 @@ func (db *Database) CreateGithubInstallationLink(org *Organisation, installation
 	return &link, nil
 }
 
-func (db *Database) GetGithubInstallationLinkForOrg(orgId any) (*GithubAppInstallationLink, error) {
-	l := GithubAppInstallationLink{}
-	result := db.GormDB.Where("organisation_id = ? AND status=?", orgId, GithubAppInstallationLinkActive).Find(&l)
-	if result.Error != nil {
-		return nil, result.Error
-	}
-	if l.ID == 0 {
-		return nil, fmt.Errorf("GithubAppInstallationLink not found for orgId: %v\n", orgId)
-	}
-	return &l, nil
-}
-
-func (db *Database) GetGithubInstallationLinkForInstallationId(installationId any) (*GithubAppInstallationLink, error) {
-	l := GithubAppInstallationLink{}
-	result := db.GormDB.Where("github_installation_id = ? AND status=?", installationId, GithubAppInstallationLinkActive).Find(&l)
+// GetGithubInstallationLinksForOrg returns all active installation links of the org
+func (db *Database) GetGithubInstallationLinksForOrg(orgId any) ([]GithubAppInstallationLink, error) {
+	var links []GithubAppInstallationLink
+	result := db.GormDB.Where("organisation_id = ? AND status=?", orgId, GithubAppInstallationLinkActive).Order("id").Find(&links)
 	if result.Error != nil {
 		return nil, result.Error
 	}
-	return &l, nil
+	return links, nil
 }
 
 func (db *Database) MakeGithubAppInstallationLinkInactive(link *GithubAppInstallationLink) (*GithubAppInstallationLink, error) {
@@ -514,9 +457,9 @@ func (db *Database) CreateDiggerJobLink(diggerJobId string, repoFullName string)
 
 func (db *Database) GetDiggerJobLink(diggerJobId string) (*GithubDiggerJobLink, error) {
 	link := GithubDiggerJobLink{}
-	result := db.GormDB.Where("digger_job_id = ?", diggerJobId).Find(&link)
+	result := db.GormDB.Where("digger_job_id = ?", diggerJobId).First(&link)
 	if result.Error != nil {
-		if !errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
 			return nil, nil
 		}
 		log.Printf("Failed to get DiggerJobLink, %v", diggerJobId)
@@ -525,6 +468,16 @@ func (db *Database) GetDiggerJobLink(diggerJobId string) (*GithubDiggerJobLink,
 	return &link, nil
 }
 
+func (db *Database) SetDiggerJobLinkWorkflowRun(diggerJobId string, workflowRunId int64) error {
+	result := db.GormDB.Model(&GithubDiggerJobLink{}).Where("digger_job_id = ?", diggerJobId).
+		Update("github_workflow_run_id", workflowRunId)
+	if result.Error != nil {
+		log.Printf("Failed to set the workflow run of GithubDiggerJobLink %v, error: %v\n", diggerJobId, result.Error)
+		return result.Error
+	}
+	return nil
+}
+
 func (db *Database) UpdateDiggerJobLink(diggerJobId string, repoFullName string, githubJobId int64) (*GithubDiggerJobLink, error) {
 	jobLink := GithubDiggerJobLink{}
 	// check if there is already a link to another org, and throw an error in this case
@@ -557,13 +510,13 @@ func (db *Database) GetOrganisationById(orgId any) (*Organisation, error) {
 	return &org, nil
 }
 
-func (db *Database) CreateDiggerJob(batch uuid.UUID, serializedJob []byte, branchName string) (*DiggerJob, error) {
+func (db *Database) CreateDiggerJob(batch uuid.UUID, serializedJob []byte, branchName string, commitSha string) (*DiggerJob, error) {
 	if serializedJob == nil || len(serializedJob) == 0 {
 		return nil, fmt.Errorf("serializedJob can't be empty")
 	}
 	jobId := uniuri.New()
 	job := &DiggerJob{DiggerJobId: jobId, Status: DiggerJobCreated,
-		BatchId: batch, SerializedJob: serializedJob, BranchName: branchName}
+		BatchId: batch, SerializedJob: serializedJob, BranchName: branchName, CommitSha: commitSha}
 	result := db.GormDB.Save(job)
 	if result.Error != nil {
 		return nil, result.Error
@@ -582,6 +535,25 @@ func (db *Database) UpdateDiggerJob(job *DiggerJob) error {
 	return nil
 }
 
+// ClaimDiggerJob moves a created job to triggered, only one of concurrent callers gets true.
+// It is a conditional update rather than a row lock, so it works the same on Postgres and SQLite.
+func (db *Database) ClaimDiggerJob(jobId string) (bool, error) {
+	result := db.GormDB.Model(&DiggerJob{}).
+		Where("digger_job_id = ? AND status = ?", jobId, DiggerJobCreated).
+		Updates(map[string]interface{}{"status": DiggerJobTriggered, "status_updated_at": time.Now()})
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected == 1, nil
+}
+
+// ReleaseDiggerJob puts a claimed job back to created when it couldn't be triggered
+func (db *Database) ReleaseDiggerJob(jobId string) error {
+	return db.GormDB.Model(&DiggerJob{}).
+		Where("digger_job_id = ? AND status = ?", jobId, DiggerJobTriggered).
+		Updates(map[string]interface{}{"status": DiggerJobCreated, "status_updated_at": time.Now()}).Error
+}
+
 func (db *Database) GetPendingParentDiggerJobs(batchId *uuid.UUID) ([]DiggerJob, error) {
 	jobs := make([]DiggerJob, 0)
 
@@ -808,3 +780,1248 @@ func (db *Database) UpdateRepoDiggerConfig(orgId any, diggerConfigYaml string, r
 	}
 	return messages, nil
 }
+
+func (db *Database) GetUserByEmail(email string) (*User, error) {
+	user := &User{}
+	result := db.GormDB.Take(user, "email = ?", email)
+	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, result.Error
+	}
+	return user, nil
+}
+
+func (db *Database) GetUserByExternalId(externalId string) (*User, error) {
+	user := &User{}
+	result := db.GormDB.Take(user, "external_id = ?", externalId)
+	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, result.Error
+	}
+	return user, nil
+}
+
+func (db *Database) CreateUser(username string, email string, externalId string) (*User, error) {
+	user := &User{Username: username, Email: email, ExternalId: externalId}
+	result := db.GormDB.Save(user)
+	if result.Error != nil {
+		log.Printf("Failed to create user: %v, error: %v\n", username, result.Error)
+		return nil, result.Error
+	}
+	log.Printf("User %s, (id: %v) has been created successfully\n", username, user.ID)
+	return user, nil
+}
+
+func (db *Database) UpdateUser(user *User) error {
+	result := db.GormDB.Save(user)
+	if result.Error != nil {
+		log.Printf("Failed to update user: %v, error: %v\n", user.ID, result.Error)
+		return result.Error
+	}
+	return nil
+}
+
+func (db *Database) GetOrgMembership(orgId uint, userId uint) (*OrgMembership, error) {
+	membership := &OrgMembership{}
+	result := db.GormDB.Preload("User").Take(membership, "organisation_id = ? AND user_id = ?", orgId, userId)
+	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, result.Error
+	}
+	return membership, nil
+}
+
+func (db *Database) GetOrgMemberships(orgId uint) ([]OrgMembership, error) {
+	var memberships []OrgMembership
+	result := db.GormDB.Preload("User").Where("organisation_id = ?", orgId).Order("id").Find(&memberships)
+	if result.Error != nil {
+		log.Printf("Failed to fetch memberships for org: %v, error: %v\n", orgId, result.Error)
+		return nil, result.Error
+	}
+	return memberships, nil
+}
+
+// UpsertOrgMembership creates membership of the user in organisation or updates role and status of the existing one
+func (db *Database) UpsertOrgMembership(orgId uint, user *User, role Role, status MembershipStatus) (*OrgMembership, error) {
+	membership, err := db.GetOrgMembership(orgId, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	if membership == nil {
+		membership = &OrgMembership{OrganisationID: orgId, UserID: user.ID}
+	}
+	membership.User = user
+	membership.Role = role
+	membership.Status = status
+	result := db.GormDB.Save(membership)
+	if result.Error != nil {
+		log.Printf("Failed to save membership of user %v in org %v, error: %v\n", user.ID, orgId, result.Error)
+		return nil, result.Error
+	}
+	log.Printf("User %v is %v member of org %v with role %v\n", user.ID, status, orgId, role)
+	return membership, nil
+}
+
+// RemoveOrgMembership removes the user from organisation together with all role grants of the user in it
+func (db *Database) RemoveOrgMembership(orgId uint, userId uint) error {
+	return db.GormDB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Unscoped().Where("organisation_id = ? AND user_id = ?", orgId, userId).Delete(&RoleGrant{}).Error
+		if err != nil {
+			return err
+		}
+		// hard delete, the unique index of org and user would keep the user from being invited again
+		result := tx.Unscoped().Where("organisation_id = ? AND user_id = ?", orgId, userId).Delete(&OrgMembership{})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+		log.Printf("User %v has been removed from org %v\n", userId, orgId)
+		return nil
+	})
+}
+
+func (db *Database) GetRoleGrants(orgId uint, userId uint) ([]RoleGrant, error) {
+	var grants []RoleGrant
+	result := db.GormDB.Where("organisation_id = ? AND user_id = ?", orgId, userId).Find(&grants)
+	if result.Error != nil {
+		log.Printf("Failed to fetch role grants of user %v in org %v, error: %v\n", userId, orgId, result.Error)
+		return nil, result.Error
+	}
+	return grants, nil
+}
+
+func (db *Database) CreateRoleGrant(orgId uint, userId uint, repoId *uint, projectId *uint, role Role) (*RoleGrant, error) {
+	grant := &RoleGrant{OrganisationID: orgId, UserID: userId, RepoID: repoId, ProjectID: projectId, Role: role}
+	result := db.GormDB.Save(grant)
+	if result.Error != nil {
+		log.Printf("Failed to create role grant for user %v in org %v, error: %v\n", userId, orgId, result.Error)
+		return nil, result.Error
+	}
+	return grant, nil
+}
+
+func (db *Database) DeleteRoleGrant(orgId uint, userId uint, grantId uint) error {
+	result := db.GormDB.Where("organisation_id = ? AND user_id = ? AND id = ?", orgId, userId, grantId).Delete(&RoleGrant{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+func (db *Database) CreateAuditEvent(event *AuditEvent) error {
+	result := db.GormDB.Create(event)
+	if result.Error != nil {
+		log.Printf("Failed to create audit event %v for org %v, error: %v\n", event.Action, event.OrganisationID, result.Error)
+		return result.Error
+	}
+	return nil
+}
+
+// GetAuditEvents returns audit events of the organisation matching the filter, newest first, and the total count of them
+func (db *Database) GetAuditEvents(orgId any, filter AuditEventFilter) ([]AuditEvent, int64, error) {
+	query := db.GormDB.Model(&AuditEvent{}).Where("organisation_id = ?", orgId)
+	if filter.Actor != "" {
+		query = query.Where("actor = ?", filter.Actor)
+	}
+	if filter.Action != "" {
+		query = query.Where("action = ?", filter.Action)
+	}
+	if filter.TargetType != "" {
+		query = query.Where("target_type = ?", filter.TargetType)
+	}
+	if filter.TargetId != "" {
+		query = query.Where("target_id = ?", filter.TargetId)
+	}
+	if filter.From != nil {
+		query = query.Where("created_at >= ?", *filter.From)
+	}
+	if filter.To != nil {
+		query = query.Where("created_at < ?", *filter.To)
+	}
+
+	var total int64
+	err := query.Count(&total).Error
+	if err != nil {
+		log.Printf("Failed to count audit events for org %v, error: %v\n", orgId, err)
+		return nil, 0, err
+	}
+
+	var events []AuditEvent
+	if filter.Limit > 0 {
+		query = query.Limit(filter.Limit)
+	}
+	err = query.Order("created_at desc, id desc").Offset(filter.Offset).Find(&events).Error
+	if err != nil {
+		log.Printf("Failed to fetch audit events for org %v, error: %v\n", orgId, err)
+		return nil, 0, err
+	}
+	return events, total, nil
+}
+
+func (db *Database) GetOrganisationByName(name string) (*Organisation, error) {
+	org := &Organisation{}
+	result := db.GormDB.Take(org, "name = ?", name)
+	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, result.Error
+	}
+	return org, nil
+}
+
+func (db *Database) CreateToken(orgId uint, value string, tokenType string) (*Token, error) {
+	token := &Token{Value: value, OrganisationID: orgId, Type: tokenType}
+	result := db.GormDB.Create(token)
+	if result.Error != nil {
+		log.Printf("Failed to create token for org %v, error: %v\n", orgId, result.Error)
+		return nil, result.Error
+	}
+	return token, nil
+}
+
+func (db *Database) GetProjectsForOrg(orgId any) ([]Project, error) {
+	projects := make([]Project, 0)
+	err := db.GormDB.Preload("Organisation").Preload("Repo").
+		Joins("LEFT JOIN repos ON projects.repo_id = repos.id").
+		Joins("LEFT JOIN organisations ON projects.organisation_id = organisations.id").
+		Where("projects.organisation_id = ?", orgId).Find(&projects).Error
+	if err != nil {
+		log.Printf("Failed to fetch projects for org %v, error: %v\n", orgId, err)
+		return nil, err
+	}
+	return projects, nil
+}
+
+func (db *Database) GetProjectsForRepoName(orgId any, repoName string) ([]Project, error) {
+	projects := make([]Project, 0)
+	err := db.GormDB.Preload("Organisation").Preload("Repo").
+		Joins("LEFT JOIN repos ON projects.repo_id = repos.id").
+		Joins("LEFT JOIN organisations ON projects.organisation_id = organisations.id").
+		Where("repos.name = ? AND projects.organisation_id = ?", repoName, orgId).Find(&projects).Error
+	if err != nil {
+		log.Printf("Failed to fetch projects for repo %v, error: %v\n", repoName, err)
+		return nil, err
+	}
+	return projects, nil
+}
+
+func (db *Database) SaveProject(project *Project) error {
+	result := db.GormDB.Save(project)
+	if result.Error != nil {
+		log.Printf("Failed to save project: %v, error: %v\n", project.Name, result.Error)
+		return result.Error
+	}
+	return nil
+}
+
+func (db *Database) GetOrgPolicy(orgId any, policyType string) (*Policy, error) {
+	policy := &Policy{}
+	result := db.GormDB.Take(policy, "organisation_id = ? AND (repo_id IS NULL AND project_id IS NULL) AND type = ?", orgId, policyType)
+	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, result.Error
+	}
+	return policy, nil
+}
+
+func (db *Database) GetProjectPolicy(orgId any, repoId uint, projectId uint, policyType string) (*Policy, error) {
+	policy := &Policy{}
+	result := db.GormDB.Take(policy, "organisation_id = ? AND repo_id = ? AND project_id = ? AND type = ?", orgId, repoId, projectId, policyType)
+	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, result.Error
+	}
+	return policy, nil
+}
+
+// GetPoliciesForOrg returns the policies of the projects of the org
+func (db *Database) GetPoliciesForOrg(orgId any) ([]Policy, error) {
+	policies := make([]Policy, 0)
+	err := db.GormDB.Preload("Organisation").Preload("Repo").Preload("Project").
+		Joins("INNER JOIN projects ON projects.id = policies.project_id").
+		Where("projects.organisation_id = ?", orgId).Order("policies.id").Find(&policies).Error
+	if err != nil {
+		log.Printf("Failed to fetch policies for org %v, error: %v\n", orgId, err)
+		return nil, err
+	}
+	return policies, nil
+}
+
+// GetPolicyById returns the policy of a project of the org, nil if it doesn't exist
+func (db *Database) GetPolicyById(orgId any, policyId any) (*Policy, error) {
+	policy := &Policy{}
+	err := db.GormDB.Preload("Project").Preload("Project.Organisation").Preload("Project.Repo").
+		Joins("INNER JOIN projects ON projects.id = policies.project_id").
+		Where("projects.organisation_id = ? AND policies.id = ?", orgId, policyId).First(policy).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return policy, nil
+}
+
+func (db *Database) SavePolicy(policy *Policy) error {
+	result := db.GormDB.Save(policy)
+	if result.Error != nil {
+		log.Printf("Failed to save policy: %v, error: %v\n", policy.ID, result.Error)
+		return result.Error
+	}
+	return nil
+}
+
+func (db *Database) GetProjectRuns(projectId uint) ([]ProjectRun, error) {
+	runs := make([]ProjectRun, 0)
+	err := db.GormDB.Preload("Project").Where("project_id = ?", projectId).Find(&runs).Error
+	if err != nil {
+		log.Printf("Failed to fetch runs for project %v, error: %v\n", projectId, err)
+		return nil, err
+	}
+	return runs, nil
+}
+
+func (db *Database) FindProjectRuns(filter RunFilter) (*RunPage, error) {
+	cursor, err := decodeRunCursor(filter.Cursor)
+	if err != nil {
+		return nil, err
+	}
+
+	query := db.GormDB.Model(&ProjectRun{}).
+		Joins("INNER JOIN projects ON projects.id = project_runs.project_id").
+		Joins("INNER JOIN repos ON projects.repo_id = repos.id")
+	if filter.OrganisationID != 0 {
+		query = query.Where("projects.organisation_id = ?", filter.OrganisationID)
+	}
+	if filter.ProjectID != 0 {
+		query = query.Where("project_runs.project_id = ?", filter.ProjectID)
+	}
+	if filter.RepoName != "" {
+		query = query.Where("repos.name = ?", filter.RepoName)
+	}
+	if filter.ProjectName != "" {
+		query = query.Where("projects.name = ?", filter.ProjectName)
+	}
+	if filter.Status != "" {
+		query = query.Where("project_runs.status = ?", filter.Status)
+	}
+	if filter.Command != "" {
+		query = query.Where("project_runs.command = ?", filter.Command)
+	}
+	if filter.PullRequestNumber != 0 {
+		query = query.Where("project_runs.pull_request_number = ?", filter.PullRequestNumber)
+	}
+	if filter.DiggerJobId != "" {
+		query = query.Where("project_runs.digger_job_id = ?", filter.DiggerJobId)
+	}
+	if filter.BatchId != "" {
+		query = query.Where("project_runs.batch_id = ?", filter.BatchId)
+	}
+	if filter.CommitSha != "" {
+		query = query.Where("project_runs.commit_sha LIKE ?", filter.CommitSha+"%")
+	}
+	if filter.Actor != "" {
+		query = query.Where("project_runs.actor = ?", filter.Actor)
+	}
+	if !filter.StartedAfter.IsZero() {
+		query = query.Where("project_runs.started_at >= ?", filter.StartedAfter.UnixMilli())
+	}
+	if !filter.StartedBefore.IsZero() {
+		query = query.Where("project_runs.started_at < ?", filter.StartedBefore.UnixMilli())
+	}
+	query = query.Session(&gorm.Session{})
+
+	var total int64
+	err = query.Count(&total).Error
+	if err != nil {
+		log.Printf("Failed to count runs, error: %v\n", err)
+		return nil, err
+	}
+
+	column := "project_runs.id"
+	switch filter.SortBy {
+	case RunSortStartedAt, RunSortEndedAt:
+		column = "project_runs." + filter.SortBy
+	}
+	direction, comparison := "DESC", "<"
+	if filter.Ascending {
+		direction, comparison = "ASC", ">"
+	}
+	if cursor != nil {
+		if column == "project_runs.id" {
+			query = query.Where("project_runs.id "+comparison+" ?", cursor.id)
+		} else {
+			query = query.Where("("+column+" "+comparison+" ?) OR ("+column+" = ? AND project_runs.id "+comparison+" ?)", cursor.value, cursor.value, cursor.id)
+		}
+	}
+
+	pageSize := filter.PageSize()
+	runs := make([]ProjectRun, 0)
+	err = query.Preload("Project").Preload("Project.Repo").
+		Order(column + " " + direction).Order("project_runs.id " + direction).
+		Limit(pageSize + 1).Find(&runs).Error
+	if err != nil {
+		log.Printf("Failed to fetch runs, error: %v\n", err)
+		return nil, err
+	}
+	return newRunPage(filter, runs, total), nil
+}
+
+// newRunPage cuts runs, which has one more run than the page if there is a next page
+func newRunPage(filter RunFilter, runs []ProjectRun, total int64) *RunPage {
+	page := RunPage{Runs: runs, Total: total}
+	if len(runs) > filter.PageSize() {
+		page.Runs = runs[:filter.PageSize()]
+		last := &page.Runs[len(page.Runs)-1]
+		page.NextCursor = runCursor{value: filter.sortValue(last), id: last.ID}.encode()
+	}
+	return &page
+}
+
+// GetProjectRun returns the run with the resource changes of its plan
+func (db *Database) GetProjectRun(runId uint) (*ProjectRun, error) {
+	var run ProjectRun
+	err := db.GormDB.Preload("Project").Preload("Project.Organisation").Preload("Project.Repo").Preload("ResourceChanges").
+		Where("id = ?", runId).First(&run).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		log.Printf("Failed to fetch run %v, error: %v\n", runId, err)
+		return nil, err
+	}
+	return &run, nil
+}
+
+func (db *Database) CreateProjectRun(run *ProjectRun) error {
+	result := db.GormDB.Create(run)
+	if result.Error != nil {
+		log.Printf("Failed to create run for project %v, error: %v\n", run.ProjectID, result.Error)
+		return result.Error
+	}
+	return nil
+}
+
+func (db *Database) UpdateProjectRunStatus(runId uint, status string, endedAt int64) error {
+	result := db.GormDB.Model(&ProjectRun{}).Where("id = ?", runId).
+		Updates(map[string]interface{}{"status": status, "ended_at": endedAt})
+	if result.Error != nil {
+		log.Printf("Failed to update status of run %v, error: %v\n", runId, result.Error)
+		return result.Error
+	}
+	return nil
+}
+
+func (db *Database) GetRepoByGithubId(orgId any, githubRepoId int64) (*Repo, error) {
+	repo := &Repo{}
+	result := db.GormDB.Preload("Organisation").
+		Take(repo, "organisation_id = ? AND vcs_provider = ? AND github_repo_id = ?", orgId, VcsProviderGithub, githubRepoId)
+	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, result.Error
+	}
+	return repo, nil
+}
+
+// GetRepoByGithubFullName returns the repo of a GitHub repository by its full name, e.g. diggerhq/digger
+func (db *Database) GetRepoByGithubFullName(orgId any, repoFullName string) (*Repo, error) {
+	repo := &Repo{}
+	result := db.GormDB.Preload("Organisation").
+		Take(repo, "organisation_id = ? AND vcs_provider = ? AND repo_full_name = ?", orgId, VcsProviderGithub, repoFullName)
+	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, result.Error
+	}
+	return repo, nil
+}
+
+// FindGithubRepo returns the digger repo of a GitHub repository by its id. Repos created before the id was stored
+// are matched once by full name or digger name, they get the id assigned. Renames are applied to the found repo and
+// to the repository of the installation the event came from.
+// If record doesn't exist return nil
+func (db *Database) FindGithubRepo(orgId uint, installationId int64, githubRepoId int64, owner string, name string) (*Repo, error) {
+	fullName := owner + "/" + name
+	if githubRepoId == 0 {
+		// without the id any repo which hasn't been linked yet would match
+		return nil, fmt.Errorf("id of GitHub repository %v is missing", fullName)
+	}
+	repo, err := db.GetRepoByGithubId(orgId, githubRepoId)
+	if err != nil {
+		return nil, err
+	}
+	if repo != nil {
+		if repo.RepoOwner != owner || repo.RepoName != name {
+			err = db.UpdateGithubRepoIdentity(repo, installationId, owner, name)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return repo, nil
+	}
+
+	var legacy Repo
+	result := db.GormDB.Preload("Organisation").
+		Where("organisation_id = ? AND github_repo_id = 0", orgId).
+		Where("repo_full_name = ? OR (repo_full_name = '' AND name = ?)", fullName, DiggerRepoName(fullName)).
+		Limit(1).Find(&legacy)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, nil
+	}
+	legacy.VcsProvider = VcsProviderGithub
+	legacy.GithubRepoId = githubRepoId
+	legacy.RepoOwner = owner
+	legacy.RepoName = name
+	legacy.RepoFullName = fullName
+	err = db.GormDB.Save(&legacy).Error
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Repo %v has been linked to GitHub repository %v (id: %v)\n", legacy.Name, fullName, githubRepoId)
+	return &legacy, nil
+}
+
+// uniqueRepoName returns the digger name for the full name, with the GitHub id appended
+// if the name is already used by another repository in the org
+func (db *Database) uniqueRepoName(orgId uint, fullName string, githubRepoId int64) (string, error) {
+	name := DiggerRepoName(fullName)
+	var count int64
+	err := db.GormDB.Model(&Repo{}).Where("organisation_id = ? AND name = ? AND github_repo_id <> ?", orgId, name, githubRepoId).Count(&count).Error
+	if err != nil {
+		return "", err
+	}
+	if count > 0 {
+		return fmt.Sprintf("%v-%v", name, githubRepoId), nil
+	}
+	return name, nil
+}
+
+func (db *Database) GetOrCreateGithubRepo(org *Organisation, installationId int64, githubRepoId int64, owner string, name string, diggerConfig string) (*Repo, error) {
+	repo, err := db.FindGithubRepo(org.ID, installationId, githubRepoId, owner, name)
+	if err != nil || repo != nil {
+		return repo, err
+	}
+
+	fullName := owner + "/" + name
+	diggerRepoName, err := db.uniqueRepoName(org.ID, fullName, githubRepoId)
+	if err != nil {
+		return nil, err
+	}
+	repo = &Repo{
+		Name:           diggerRepoName,
+		Organisation:   org,
+		DiggerConfig:   diggerConfig,
+		VcsProvider:    VcsProviderGithub,
+		RepoOwner:      owner,
+		RepoName:       name,
+		RepoFullName:   fullName,
+		GithubRepoId:   githubRepoId,
+		OrganisationID: org.ID,
+	}
+	result := db.GormDB.Save(repo)
+	if result.Error != nil {
+		log.Printf("Failed to create repo: %v, error: %v\n", diggerRepoName, result.Error)
+		return nil, result.Error
+	}
+	log.Printf("Repo %s, (id: %v) has been created successfully\n", diggerRepoName, repo.ID)
+	return repo, nil
+}
+
+// UpdateGithubRepoIdentity follows a rename or transfer of the GitHub repository, the repository recorded for the
+// installation under the old full name is moved as well. Other installations of the name are left alone.
+func (db *Database) UpdateGithubRepoIdentity(repo *Repo, installationId int64, owner string, name string) error {
+	oldFullName := repo.RepoFullName
+	fullName := owner + "/" + name
+	diggerRepoName, err := db.uniqueRepoName(repo.OrganisationID, fullName, repo.GithubRepoId)
+	if err != nil {
+		return err
+	}
+	installation := GithubAppInstallation{}
+	if oldFullName != "" && oldFullName != fullName {
+		err = db.GormDB.Where("github_installation_id = ? AND repo = ?", installationId, oldFullName).Limit(1).Find(&installation).Error
+		if err != nil {
+			return err
+		}
+	}
+	err = db.GormDB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(repo).Updates(map[string]interface{}{
+			"name":           diggerRepoName,
+			"repo_owner":     owner,
+			"repo_name":      name,
+			"repo_full_name": fullName,
+		}).Error
+		if err != nil {
+			return err
+		}
+		if installation.ID != 0 {
+			err = tx.Model(&GithubAppInstallation{}).
+				Where("github_installation_id = ? AND github_app_id = ? AND repo = ?", installation.GithubInstallationId, installation.GithubAppId, oldFullName).
+				Update("repo", fullName).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	repo.Name = diggerRepoName
+	repo.RepoOwner = owner
+	repo.RepoName = name
+	repo.RepoFullName = fullName
+	log.Printf("Repo %v has been renamed from %v to %v\n", repo.ID, oldFullName, fullName)
+	return nil
+}
+
+// SetSecret creates or replaces the secret, the value is sealed with a new data key
+func (db *Database) SetSecret(name string, value string) error {
+	keyring, err := LoadKeyring()
+	if err != nil {
+		return err
+	}
+	encrypted, err := keyring.Seal(value)
+	if err != nil {
+		return err
+	}
+	secret := Secret{}
+	result := db.GormDB.Where("name = ?", name).Find(&secret)
+	if result.Error != nil {
+		return result.Error
+	}
+	secret.Name = name
+	secret.EncryptedValue = encrypted
+	return db.GormDB.Save(&secret).Error
+}
+
+// GetSecret returns nil if there is no secret with the name
+func (db *Database) GetSecret(name string) (*string, error) {
+	secret := Secret{}
+	result := db.GormDB.Where("name = ?", name).Find(&secret)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if secret.ID == 0 {
+		return nil, nil
+	}
+	keyring, err := LoadKeyring()
+	if err != nil {
+		return nil, err
+	}
+	value, err := keyring.Open(secret.EncryptedValue)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt secret %v: %v", name, err)
+	}
+	return &value, nil
+}
+
+// GetSecretOrEnv returns the secret, or the environment variable envName for deployments configured before secrets were stored
+func (db *Database) GetSecretOrEnv(name string, envName string) (string, error) {
+	value, err := db.GetSecret(name)
+	if err != nil {
+		return "", err
+	}
+	if value == nil {
+		return os.Getenv(envName), nil
+	}
+	return *value, nil
+}
+
+func (db *Database) DeleteSecret(name string) error {
+	// hard delete, so the name can be used again
+	return db.GormDB.Unscoped().Where("name = ?", name).Delete(&Secret{}).Error
+}
+
+func (db *Database) SetProjectVariable(projectId uint, name string, value string) error {
+	keyring, err := LoadKeyring()
+	if err != nil {
+		return err
+	}
+	encrypted, err := keyring.Seal(value)
+	if err != nil {
+		return err
+	}
+	variable := ProjectVariable{}
+	result := db.GormDB.Where("project_id = ? AND name = ?", projectId, name).Find(&variable)
+	if result.Error != nil {
+		return result.Error
+	}
+	variable.ProjectID = projectId
+	variable.Name = name
+	variable.EncryptedValue = encrypted
+	return db.GormDB.Save(&variable).Error
+}
+
+// GetProjectVariables returns the decrypted variables of the project by name
+func (db *Database) GetProjectVariables(projectId uint) (map[string]string, error) {
+	var variables []ProjectVariable
+	result := db.GormDB.Where("project_id = ?", projectId).Find(&variables)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	values := make(map[string]string)
+	if len(variables) == 0 {
+		return values, nil
+	}
+	keyring, err := LoadKeyring()
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range variables {
+		value, err := keyring.Open(v.EncryptedValue)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt variable %v of project %v: %v", v.Name, projectId, err)
+		}
+		values[v.Name] = value
+	}
+	return values, nil
+}
+
+func (db *Database) GetProjectVariableNames(projectId uint) ([]string, error) {
+	names := make([]string, 0)
+	result := db.GormDB.Model(&ProjectVariable{}).Where("project_id = ?", projectId).Order("name").Pluck("name", &names)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return names, nil
+}
+
+// DeleteProjectVariable returns false if the project has no variable with the name
+func (db *Database) DeleteProjectVariable(projectId uint, name string) (bool, error) {
+	result := db.GormDB.Unscoped().Where("project_id = ? AND name = ?", projectId, name).Delete(&ProjectVariable{})
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected > 0, nil
+}
+
+// RotateEncryptionKeys wraps the data keys of all secrets and variables with the current master key,
+// afterwards previous keys can be removed from DIGGER_ENCRYPTION_PREVIOUS_KEYS. Returns the number of rewrapped values.
+func (db *Database) RotateEncryptionKeys() (int, error) {
+	keyring, err := LoadKeyring()
+	if err != nil {
+		return 0, err
+	}
+	rotated := 0
+	err = db.GormDB.Transaction(func(tx *gorm.DB) error {
+		var secrets []Secret
+		err := tx.Where("key_id <> ?", keyring.CurrentKeyId()).Find(&secrets).Error
+		if err != nil {
+			return err
+		}
+		for _, secret := range secrets {
+			value, changed, err := keyring.Rewrap(secret.EncryptedValue)
+			if err != nil {
+				return fmt.Errorf("failed to rotate secret %v: %v", secret.Name, err)
+			}
+			if !changed {
+				continue
+			}
+			err = tx.Model(&secret).Updates(map[string]interface{}{"key_id": value.KeyId, "encrypted_data_key": value.EncryptedDataKey}).Error
+			if err != nil {
+				return err
+			}
+			rotated++
+		}
+
+		var variables []ProjectVariable
+		err = tx.Where("key_id <> ?", keyring.CurrentKeyId()).Find(&variables).Error
+		if err != nil {
+			return err
+		}
+		for _, variable := range variables {
+			value, changed, err := keyring.Rewrap(variable.EncryptedValue)
+			if err != nil {
+				return fmt.Errorf("failed to rotate variable %v of project %v: %v", variable.Name, variable.ProjectID, err)
+			}
+			if !changed {
+				continue
+			}
+			err = tx.Model(&variable).Updates(map[string]interface{}{"key_id": value.KeyId, "encrypted_data_key": value.EncryptedDataKey}).Error
+			if err != nil {
+				return err
+			}
+			rotated++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return rotated, nil
+}
+
+func (db *Database) CreatePlanArtifact(artifact *PlanArtifact) error {
+	result := db.GormDB.Create(artifact)
+	if result.Error != nil {
+		log.Printf("Failed to create plan artifact for job %v, error: %v\n", artifact.DiggerJobId, result.Error)
+		return result.Error
+	}
+	return nil
+}
+
+func (db *Database) GetLatestPlanArtifact(projectId uint, pullRequestNumber int) (*PlanArtifact, error) {
+	var artifact PlanArtifact
+	err := db.GormDB.Where("project_id = ? AND pull_request_number = ?", projectId, pullRequestNumber).
+		Order("created_at desc, id desc").First(&artifact).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		log.Printf("Failed to fetch plan artifact for project %v, error: %v\n", projectId, err)
+		return nil, err
+	}
+	return &artifact, nil
+}
+
+func (db *Database) AppendRunLogChunk(chunk *RunLogChunk) (int64, error) {
+	var size int64
+	err := db.GormDB.Transaction(func(tx *gorm.DB) error {
+		// only one of concurrent appends at the same offset moves the size
+		result := tx.Model(&ProjectRun{}).
+			Where("id = ? AND log_size = ? AND log_expired = ?", chunk.ProjectRunID, chunk.StartOffset, false).
+			Update("log_size", gorm.Expr("log_size + ?", chunk.Size))
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected != 1 {
+			var run ProjectRun
+			err := tx.Select("log_size").Where("id = ?", chunk.ProjectRunID).First(&run).Error
+			if err != nil {
+				return err
+			}
+			size = run.LogSize
+			return ErrRunLogOffsetMismatch
+		}
+		size = chunk.StartOffset + chunk.Size
+		return tx.Create(chunk).Error
+	})
+	if err != nil && !errors.Is(err, ErrRunLogOffsetMismatch) {
+		log.Printf("Failed to append to the log of run %v, error: %v\n", chunk.ProjectRunID, err)
+	}
+	return size, err
+}
+
+func (db *Database) GetRunLogChunks(runId uint) ([]RunLogChunk, error) {
+	chunks := make([]RunLogChunk, 0)
+	err := db.GormDB.Where("project_run_id = ?", runId).Order("start_offset").Find(&chunks).Error
+	if err != nil {
+		log.Printf("Failed to fetch the log of run %v, error: %v\n", runId, err)
+		return nil, err
+	}
+	return chunks, nil
+}
+
+func (db *Database) GetRunsWithLogsBefore(before time.Time, limit int) ([]ProjectRun, error) {
+	runs := make([]ProjectRun, 0)
+	err := db.GormDB.Where("created_at < ? AND log_expired = ?", before, false).
+		Order("created_at").Limit(limit).Find(&runs).Error
+	if err != nil {
+		log.Printf("Failed to fetch runs with expired logs, error: %v\n", err)
+		return nil, err
+	}
+	return runs, nil
+}
+
+func (db *Database) ExpireRunLog(runId uint) error {
+	return db.GormDB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Unscoped().Where("project_run_id = ?", runId).Delete(&RunLogChunk{}).Error
+		if err != nil {
+			return err
+		}
+		err = tx.Model(&RunSearchDocument{}).Where("project_run_id = ?", runId).Update("content", "").Error
+		if err != nil {
+			return err
+		}
+		return tx.Model(&ProjectRun{}).Where("id = ?", runId).
+			Updates(map[string]interface{}{"log_expired": true, "output": ""}).Error
+	})
+}
+
+func (db *Database) SaveRunSearchDocument(document *RunSearchDocument) error {
+	var existing RunSearchDocument
+	err := db.GormDB.Where("project_run_id = ?", document.ProjectRunID).First(&existing).Error
+	if err == nil {
+		document.ID, document.CreatedAt = existing.ID, existing.CreatedAt
+	} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+		log.Printf("Failed to fetch search document of run %v, error: %v\n", document.ProjectRunID, err)
+		return err
+	}
+	err = db.GormDB.Save(document).Error
+	if err != nil {
+		log.Printf("Failed to save search document of run %v, error: %v\n", document.ProjectRunID, err)
+		return err
+	}
+	return nil
+}
+
+// runSearchHeadlineOptions make postgres mark matches like searchSnippet does
+const runSearchHeadlineOptions = "StartSel=" + SearchMatchStart + ", StopSel=" + SearchMatchEnd + ", MaxWords=30, MinWords=10, MaxFragments=2, FragmentDelimiter=\" … \""
+
+// SearchRuns uses full-text search on postgres and falls back to matching every term with LIKE on other databases
+func (db *Database) SearchRuns(orgId uint, query string, limit int) ([]RunSearchResult, error) {
+	terms := searchTerms(query)
+	if len(terms) == 0 {
+		return []RunSearchResult{}, nil
+	}
+
+	var matches []struct {
+		ProjectRunID uint
+		Snippet      string
+	}
+	if db.GormDB.Dialector.Name() == "postgres" {
+		params := map[string]interface{}{"query": query, "options": runSearchHeadlineOptions, "org": orgId, "limit": limit}
+		match := "search_vector @@ websearch_to_tsquery('simple', @query)"
+		// the parser splits addresses at dots and underscores differently for the document and the query,
+		// addresses are also matched as substrings like without postgres, e.g. aws_iam_role.deployer finds
+		// module.iam.aws_iam_role.deployer
+		addressTerms, otherTerms := splitAddressTerms(terms)
+		if len(addressTerms) > 0 {
+			conditions := make([]string, 0)
+			for i, term := range addressTerms {
+				name := fmt.Sprintf("address%d", i)
+				conditions = append(conditions, fmt.Sprintf(`resource_addresses ILIKE @%v ESCAPE '\'`, name))
+				params[name] = "%" + likeEscaper.Replace(term) + "%"
+			}
+			if len(otherTerms) > 0 {
+				conditions = append(conditions, "search_vector @@ plainto_tsquery('simple', @otherTerms)")
+				params["otherTerms"] = strings.Join(otherTerms, " ")
+			}
+			match = "(" + match + " OR (" + strings.Join(conditions, " AND ") + "))"
+		}
+		err := db.GormDB.Raw(`SELECT project_run_id, ts_headline('simple', content, websearch_to_tsquery('simple', @query), @options) AS snippet
+			FROM run_search_documents
+			WHERE organisation_id = @org AND deleted_at IS NULL AND `+match+`
+			ORDER BY ts_rank(search_vector, websearch_to_tsquery('simple', @query)) DESC, project_run_id DESC
+			LIMIT @limit`, params).
+			Scan(&matches).Error
+		if err != nil {
+			log.Printf("Failed to search runs, error: %v\n", err)
+			return nil, err
+		}
+		for i := range matches {
+			// a headline without a match is the start of the log, only the addresses matched then
+			if !strings.Contains(matches[i].Snippet, SearchMatchStart) {
+				matches[i].Snippet = ""
+			}
+		}
+	} else {
+		documents := make([]RunSearchDocument, 0)
+		search := db.GormDB.Where("organisation_id = ?", orgId)
+		for _, term := range terms {
+			pattern := "%" + likeEscaper.Replace(term) + "%"
+			search = search.Where(`(content LIKE ? ESCAPE '\' OR resource_addresses LIKE ? ESCAPE '\')`, pattern, pattern)
+		}
+		err := search.Order("project_run_id DESC").Limit(limit).Find(&documents).Error
+		if err != nil {
+			log.Printf("Failed to search runs, error: %v\n", err)
+			return nil, err
+		}
+		for _, document := range documents {
+			matches = append(matches, struct {
+				ProjectRunID uint
+				Snippet      string
+			}{document.ProjectRunID, searchSnippet(document.Content, terms)})
+		}
+	}
+
+	runIds := make([]uint, 0, len(matches))
+	for _, match := range matches {
+		runIds = append(runIds, match.ProjectRunID)
+	}
+	runs := make([]ProjectRun, 0)
+	err := db.GormDB.Preload("Project").Preload("Project.Repo").Preload("ResourceChanges").Where("id IN ?", runIds).Find(&runs).Error
+	if err != nil {
+		log.Printf("Failed to fetch runs of search results, error: %v\n", err)
+		return nil, err
+	}
+	runsById := make(map[uint]ProjectRun)
+	for _, run := range runs {
+		runsById[run.ID] = run
+	}
+
+	results := make([]RunSearchResult, 0, len(matches))
+	for _, match := range matches {
+		run, ok := runsById[match.ProjectRunID]
+		if !ok {
+			continue
+		}
+		results = append(results, RunSearchResult{
+			Run:             run,
+			Snippet:         match.Snippet,
+			ResourceChanges: matchingResourceChanges(run.ResourceChanges, terms),
+		})
+	}
+	return results, nil
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+func (db *Database) GetDriftSchedule(projectId uint) (*DriftSchedule, error) {
+	var schedule DriftSchedule
+	err := db.GormDB.Where("project_id = ?", projectId).First(&schedule).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		log.Printf("Failed to fetch drift schedule of project %v, error: %v\n", projectId, err)
+		return nil, err
+	}
+	return &schedule, nil
+}
+
+func (db *Database) SaveDriftSchedule(schedule *DriftSchedule) error {
+	err := db.GormDB.Omit("Project").Save(schedule).Error
+	if err != nil {
+		log.Printf("Failed to save drift schedule of project %v, error: %v\n", schedule.ProjectID, err)
+		return err
+	}
+	return nil
+}
+
+func (db *Database) GetDueDriftSchedules(now time.Time, limit int) ([]DriftSchedule, error) {
+	var schedules []DriftSchedule
+	err := db.GormDB.Preload("Project").Preload("Project.Repo").
+		Where("enabled = ? AND next_run_at <= ?", true, now.UTC()).
+		Order("next_run_at").Limit(limit).Find(&schedules).Error
+	if err != nil {
+		log.Printf("Failed to fetch due drift schedules, error: %v\n", err)
+		return nil, err
+	}
+	return schedules, nil
+}
+
+func (db *Database) SaveDriftReport(report *DriftReport) error {
+	err := db.GormDB.Omit("Project").Save(report).Error
+	if err != nil {
+		log.Printf("Failed to save drift report of project %v, error: %v\n", report.ProjectID, err)
+		return err
+	}
+	return nil
+}
+
+func (db *Database) GetDriftReportForJob(diggerJobId string) (*DriftReport, error) {
+	var report DriftReport
+	err := db.GormDB.Where("digger_job_id = ?", diggerJobId).First(&report).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		log.Printf("Failed to fetch drift report of job %v, error: %v\n", diggerJobId, err)
+		return nil, err
+	}
+	return &report, nil
+}
+
+func (db *Database) GetDriftForOrg(orgId uint) ([]ProjectDrift, error) {
+	orgProjects := db.GormDB.Model(&Project{}).Select("id").Where("organisation_id = ?", orgId)
+
+	var schedules []DriftSchedule
+	err := db.GormDB.Where("project_id IN (?)", orgProjects).Find(&schedules).Error
+	if err != nil {
+		log.Printf("Failed to fetch drift schedules of org %v, error: %v\n", orgId, err)
+		return nil, err
+	}
+	var lastReports []DriftReport
+	lastReportIds := db.GormDB.Model(&DriftReport{}).Select("MAX(id)").
+		Where("project_id IN (?) AND status <> ?", orgProjects, DriftReportPending).Group("project_id")
+	err = db.GormDB.Where("id IN (?)", lastReportIds).Find(&lastReports).Error
+	if err != nil {
+		log.Printf("Failed to fetch drift reports of org %v, error: %v\n", orgId, err)
+		return nil, err
+	}
+	// a project drifts since its first drifted report after the last report without drift
+	var driftStartReports []DriftReport
+	driftStartIds := db.GormDB.Model(&DriftReport{}).Select("MIN(id)").
+		Where("project_id IN (?) AND status = ?", orgProjects, DriftReportDrifted).
+		Where("id > COALESCE((SELECT MAX(n.id) FROM drift_reports n WHERE n.project_id = drift_reports.project_id AND n.status = ? AND n.deleted_at IS NULL), 0)", DriftReportNoDrift).
+		Group("project_id")
+	err = db.GormDB.Where("id IN (?)", driftStartIds).Find(&driftStartReports).Error
+	if err != nil {
+		log.Printf("Failed to fetch drift start of org %v, error: %v\n", orgId, err)
+		return nil, err
+	}
+
+	projectIds := make([]uint, 0)
+	byProject := make(map[uint]*ProjectDrift)
+	driftFor := func(projectId uint) *ProjectDrift {
+		if byProject[projectId] == nil {
+			byProject[projectId] = &ProjectDrift{}
+			projectIds = append(projectIds, projectId)
+		}
+		return byProject[projectId]
+	}
+	for i := range schedules {
+		driftFor(schedules[i].ProjectID).Schedule = &schedules[i]
+	}
+	runIds := make([]uint, 0)
+	for i := range lastReports {
+		driftFor(lastReports[i].ProjectID).LastReport = &lastReports[i]
+		if lastReports[i].Status == DriftReportDrifted && lastReports[i].ProjectRunID != nil {
+			runIds = append(runIds, *lastReports[i].ProjectRunID)
+		}
+	}
+	for i := range driftStartReports {
+		driftFor(driftStartReports[i].ProjectID).DriftingSince = &driftStartReports[i].CreatedAt
+	}
+
+	var projects []Project
+	err = db.GormDB.Preload("Organisation").Preload("Repo").Where("id IN ?", projectIds).Find(&projects).Error
+	if err != nil {
+		log.Printf("Failed to fetch drift projects of org %v, error: %v\n", orgId, err)
+		return nil, err
+	}
+	var changes []ProjectRunResourceChange
+	err = db.GormDB.Where("project_run_id IN ? AND action <> ?", runIds, ResourceActionRead).Order("id").Find(&changes).Error
+	if err != nil {
+		log.Printf("Failed to fetch drifted resources of org %v, error: %v\n", orgId, err)
+		return nil, err
+	}
+	changesByRun := make(map[uint][]ProjectRunResourceChange)
+	for _, change := range changes {
+		changesByRun[change.ProjectRunID] = append(changesByRun[change.ProjectRunID], change)
+	}
+
+	drift := make([]ProjectDrift, 0, len(projects))
+	for _, project := range projects {
+		projectDrift := byProject[project.ID]
+		projectDrift.Project = project
+		if last := projectDrift.LastReport; last != nil && last.Status == DriftReportDrifted && last.ProjectRunID != nil {
+			projectDrift.ResourceChanges = changesByRun[*last.ProjectRunID]
+		}
+		drift = append(drift, *projectDrift)
+	}
+	sortProjectDrift(drift)
+	return drift, nil
+}
+
+func (db *Database) GetDriftReportsForProject(projectId uint, limit int) ([]DriftReport, error) {
+	var reports []DriftReport
+	err := db.GormDB.Where("project_id = ?", projectId).Order("id DESC").Limit(limit).Find(&reports).Error
+	if err != nil {
+		log.Printf("Failed to fetch drift reports of project %v, error: %v\n", projectId, err)
+		return nil, err
+	}
+	return reports, nil
+}
+
+func (db *Database) AcquireLease(name string, holder string, ttl time.Duration) (bool, error) {
+	now := time.Now().UTC()
+	// renewing or taking over an expired lease is a single conditional update, so only one replica wins
+	result := db.GormDB.Model(&SchedulerLease{}).
+		Where("name = ? AND (holder = ? OR expires_at < ?)", name, holder, now).
+		Updates(map[string]interface{}{"holder": holder, "expires_at": now.Add(ttl)})
+	if result.Error != nil {
+		log.Printf("Failed to renew lease %v, error: %v\n", name, result.Error)
+		return false, result.Error
+	}
+	if result.RowsAffected > 0 {
+		return true, nil
+	}
+	result = db.GormDB.Clauses(clause.OnConflict{DoNothing: true}).
+		Create(&SchedulerLease{Name: name, Holder: holder, ExpiresAt: now.Add(ttl)})
+	if result.Error != nil {
+		log.Printf("Failed to create lease %v, error: %v\n", name, result.Error)
+		return false, result.Error
+	}
+	return result.RowsAffected > 0, nil
+}
+
+func (db *Database) SavePullRequestReview(review *PullRequestReview) error {
+	// an older review delivered late doesn't replace the newer one
+	err := db.GormDB.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "repo_full_name"}, {Name: "pull_request_number"}, {Name: "reviewer"}},
+		DoUpdates: clause.AssignmentColumns([]string{"state", "commit_sha", "submitted_at", "updated_at"}),
+		Where:     clause.Where{Exprs: []clause.Expression{clause.Expr{SQL: "pull_request_reviews.submitted_at <= excluded.submitted_at"}}},
+	}).Create(review).Error
+	if err != nil {
+		log.Printf("Failed to save review of %v#%v by %v, error: %v\n", review.RepoFullName, review.PullRequestNumber, review.Reviewer, err)
+		return err
+	}
+	return nil
+}
+
+func (db *Database) GetPullRequestReviews(repoFullName string, prNumber int) ([]PullRequestReview, error) {
+	var reviews []PullRequestReview
+	err := db.GormDB.Where("repo_full_name = ? AND pull_request_number = ?", repoFullName, prNumber).Order("id").Find(&reviews).Error
+	if err != nil {
+		log.Printf("Failed to fetch reviews of %v#%v, error: %v\n", repoFullName, prNumber, err)
+		return nil, err
+	}
+	return reviews, nil
+}
+
+func (db *Database) HoldDiggerJobForApproval(request *ApplyApprovalRequest) error {
+	return db.GormDB.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&DiggerJob{}).
+			Where("digger_job_id = ? AND status = ?", request.DiggerJobId, DiggerJobCreated).
+			Updates(map[string]interface{}{"status": DiggerJobPendingApproval, "status_updated_at": time.Now()})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return fmt.Errorf("digger job %v isn't waiting to be triggered", request.DiggerJobId)
+		}
+		return tx.Create(request).Error
+	})
+}
+
+func (db *Database) GetApplyApprovalRequests(repoFullName string, prNumber int) ([]ApplyApprovalRequest, error) {
+	var requests []ApplyApprovalRequest
+	err := db.GormDB.Where("repo_full_name = ? AND pull_request_number = ?", repoFullName, prNumber).Order("id").Find(&requests).Error
+	if err != nil {
+		log.Printf("Failed to fetch apply approval requests of %v#%v, error: %v\n", repoFullName, prNumber, err)
+		return nil, err
+	}
+	return requests, nil
+}
+
+func (db *Database) ReleaseApprovedDiggerJob(diggerJobId string) (bool, error) {
+	return db.finishHeldDiggerJob(diggerJobId, DiggerJobCreated)
+}
+
+func (db *Database) CancelHeldDiggerJob(diggerJobId string) (bool, error) {
+	return db.finishHeldDiggerJob(diggerJobId, DiggerJobFailed)
+}
+
+// finishHeldDiggerJob moves a held job to status and removes its request
+func (db *Database) finishHeldDiggerJob(diggerJobId string, status DiggerJobStatus) (bool, error) {
+	finished := false
+	err := db.GormDB.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&DiggerJob{}).
+			Where("digger_job_id = ? AND status = ?", diggerJobId, DiggerJobPendingApproval).
+			Updates(map[string]interface{}{"status": status, "status_updated_at": time.Now()})
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+		finished = true
+		return tx.Unscoped().Where("digger_job_id = ?", diggerJobId).Delete(&ApplyApprovalRequest{}).Error
+	})
+	if err != nil {
+		log.Printf("Failed to finish held digger job %v, error: %v\n", diggerJobId, err)
+		return false, err
+	}
+	return finished, nil
+}
@@ -0,0 +1,77 @@
+//go:build postgres
+
+package models
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+// setupPostgres migrates a new schema in the database of the DATABASE_URL url, the schema is dropped after the test.
+// Run with DATABASE_URL=postgres://... go test -tags postgres ./models
+func setupPostgres(t *testing.T) *Database {
+	databaseUrl := os.Getenv("DATABASE_URL")
+	if databaseUrl == "" {
+		t.Skip("DATABASE_URL is not set")
+	}
+	gdb, err := gorm.Open(postgres.Open(databaseUrl), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema := fmt.Sprintf("digger_test_%d", time.Now().UnixNano())
+	assert.NoError(t, gdb.Exec("CREATE SCHEMA "+schema).Error)
+	t.Cleanup(func() {
+		gdb.Exec("DROP SCHEMA " + schema + " CASCADE")
+	})
+
+	parsed, err := url.Parse(databaseUrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := parsed.Query()
+	query.Set("search_path", schema)
+	parsed.RawQuery = query.Encode()
+	schemaDb, err := gorm.Open(postgres.Open(parsed.String()), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = MigrateUp(schemaDb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Database{GormDB: schemaDb}
+}
+
+func TestPostgresSearchMatchesAddressesLikeSqlite(t *testing.T) {
+	database := setupPostgres(t)
+	org, err := database.CreateOrganisation("searchOrg", "test", "searchOrg")
+	assert.NoError(t, err)
+	repo, err := database.CreateRepo("infra", org, "")
+	assert.NoError(t, err)
+	project := &Project{Name: "prod", OrganisationID: org.ID, RepoID: repo.ID}
+	assert.NoError(t, database.SaveProject(project))
+
+	run := &ProjectRun{ProjectID: project.ID, Status: "succeeded", Command: "digger plan",
+		ResourceChanges: []ProjectRunResourceChange{{Address: "module.x.aws_iam_role.deployer", Action: ResourceActionCreate}}}
+	assert.NoError(t, database.CreateProjectRun(run))
+	assert.NoError(t, database.SaveRunSearchDocument(&RunSearchDocument{ProjectRunID: run.ID, OrganisationID: org.ID,
+		Content: "Plan: 1 to add, 0 to change, 0 to destroy.\n", ResourceAddresses: "module.x.aws_iam_role.deployer"}))
+
+	for _, query := range []string{"aws_iam_role.deployer", "module.x.aws_iam_role.deployer", "AWS_IAM_ROLE.deployer add"} {
+		results, err := database.SearchRuns(org.ID, query, 10)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, len(results), query)
+	}
+	for _, query := range []string{"aws_iam_role.other", "aws_iam_role.deployer kubernetes"} {
+		results, err := database.SearchRuns(org.ID, query, 10)
+		assert.NoError(t, err)
+		assert.Equal(t, 0, len(results), query)
+	}
+}
@@ -1,13 +1,12 @@
 package models
 
 import (
+	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
-	"gorm.io/driver/sqlite"
-	"gorm.io/gorm"
 	"log"
 	"os"
-	"strings"
 	"testing"
+	"time"
 )
 
 func setupSuite(tb testing.TB) (func(tb testing.TB), *Database, *Organisation) {
@@ -16,29 +15,11 @@ func setupSuite(tb testing.TB) (func(tb testing.TB), *Database, *Organisation) {
 	// database file name
 	dbName := "database_storage_test.db"
 
-	// remove old database
-	e := os.Remove(dbName)
-	if e != nil {
-		if !strings.Contains(e.Error(), "no such file or directory") {
-			log.Fatal(e)
-		}
-	}
-
-	// open and create a new database
-	gdb, err := gorm.Open(sqlite.Open(dbName), &gorm.Config{})
+	// create a new database with the migrated schema
+	database, err := NewTestDatabase(dbName)
 	if err != nil {
 		log.Fatal(err)
 	}
-
-	// migrate tables
-	err = gdb.AutoMigrate(&Policy{}, &Organisation{}, &Repo{}, &Project{}, &Token{},
-		&User{}, &ProjectRun{}, &GithubAppInstallation{}, &GithubApp{}, &GithubAppInstallationLink{},
-		&GithubDiggerJobLink{}, &DiggerJob{}, &DiggerJobParentLink{})
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	database := &Database{GormDB: gdb}
 	DB = database
 
 	// create an org
@@ -82,6 +63,41 @@ func TestCreateGithubInstallationLink(t *testing.T) {
 	assert.Equal(t, link.ID, link2.ID)
 }
 
+func TestOrgCanHaveMultipleGithubInstallations(t *testing.T) {
+	teardownSuite, _, org := setupSuite(t)
+	defer teardownSuite(t)
+
+	_, err := DB.CreateGithubInstallationLink(org, 1)
+	assert.NoError(t, err)
+	_, err = DB.CreateGithubInstallationLink(org, 2)
+	assert.NoError(t, err)
+
+	links, err := DB.GetGithubInstallationLinksForOrg(org.ID)
+	assert.NoError(t, err)
+	assert.Len(t, links, 2)
+
+	_, err = DB.GithubRepoAdded(1, 1, "first", 1, "first/repo")
+	assert.NoError(t, err)
+	_, err = DB.GithubRepoAdded(2, 1, "second", 2, "second/repo")
+	assert.NoError(t, err)
+
+	installation, err := DB.GetGithubAppInstallationByOrgAndRepo(org.ID, "second/repo", GithubAppInstallActive)
+	assert.NoError(t, err)
+	assert.NotNil(t, installation)
+	assert.Equal(t, int64(2), installation.GithubInstallationId)
+
+	installation, err = DB.GetGithubAppInstallationByOrgAndRepo(org.ID, "first/repo", GithubAppInstallActive)
+	assert.NoError(t, err)
+	assert.NotNil(t, installation)
+	assert.Equal(t, int64(1), installation.GithubInstallationId)
+
+	// a second org can't take over an installation that's already linked
+	other, err := DB.CreateOrganisation("otherOrg", "test", "22222222-2222-2222-2222-222222222222")
+	assert.NoError(t, err)
+	_, err = DB.CreateGithubInstallationLink(other, 2)
+	assert.Error(t, err)
+}
+
 func TestGithubRepoAdded(t *testing.T) {
 	teardownSuite, _, _ := setupSuite(t)
 	defer teardownSuite(t)
@@ -128,3 +144,237 @@ func TestGithubRepoRemoved(t *testing.T) {
 	assert.Equal(t, i.ID, i2.ID)
 	assert.Equal(t, GithubAppInstallDeleted, i.Status)
 }
+
+func TestAuditEventsAreAppendOnly(t *testing.T) {
+	teardownSuite, _, org := setupSuite(t)
+	defer teardownSuite(t)
+
+	err := DB.CreateAuditEvent(&AuditEvent{OrganisationID: org.ID, Actor: "user:1", Action: AuditActionPolicyUpdated, TargetType: "policy", TargetId: "1"})
+	assert.NoError(t, err)
+	event := &AuditEvent{OrganisationID: org.ID, Actor: "token:2", Action: AuditActionTokenIssued, TargetType: "token", TargetId: "2"}
+	err = DB.CreateAuditEvent(event)
+	assert.NoError(t, err)
+
+	events, total, err := DB.GetAuditEvents(org.ID, AuditEventFilter{Actor: "token:2"})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), total)
+	assert.Equal(t, AuditActionTokenIssued, events[0].Action)
+
+	event.Actor = "someone else"
+	assert.Error(t, DB.GormDB.Save(event).Error)
+	assert.Error(t, DB.GormDB.Delete(event).Error)
+
+	_, total, err = DB.GetAuditEvents(org.ID, AuditEventFilter{})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), total)
+}
+
+func TestAuditEventsCannotBeChangedWithSql(t *testing.T) {
+	teardownSuite, _, org := setupSuite(t)
+	defer teardownSuite(t)
+
+	event := &AuditEvent{OrganisationID: org.ID, Actor: "user:1", Action: AuditActionPolicyUpdated, TargetType: "policy", TargetId: "1"}
+	err := DB.CreateAuditEvent(event)
+	assert.NoError(t, err)
+
+	// raw statements skip the model hooks, the triggers of the migration reject them
+	err = DB.GormDB.Exec("UPDATE audit_events SET actor = ? WHERE id = ?", "someone else", event.ID).Error
+	assert.ErrorContains(t, err, "audit_events is append-only")
+	err = DB.GormDB.Exec("DELETE FROM audit_events WHERE id = ?", event.ID).Error
+	assert.ErrorContains(t, err, "audit_events is append-only")
+
+	events, _, err := DB.GetAuditEvents(org.ID, AuditEventFilter{})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(events))
+	assert.Equal(t, "user:1", events[0].Actor)
+}
+
+func TestClaimDiggerJobOnlyOnce(t *testing.T) {
+	teardownSuite, _, _ := setupSuite(t)
+	defer teardownSuite(t)
+
+	job, err := DB.CreateDiggerJob(uuid.New(), []byte("{}"), "main", "")
+	assert.NoError(t, err)
+
+	claimed, err := DB.ClaimDiggerJob(job.DiggerJobId)
+	assert.NoError(t, err)
+	assert.True(t, claimed)
+
+	claimed, err = DB.ClaimDiggerJob(job.DiggerJobId)
+	assert.NoError(t, err)
+	assert.False(t, claimed)
+
+	err = DB.ReleaseDiggerJob(job.DiggerJobId)
+	assert.NoError(t, err)
+	claimed, err = DB.ClaimDiggerJob(job.DiggerJobId)
+	assert.NoError(t, err)
+	assert.True(t, claimed)
+}
+
+func TestGithubReposAreIdentifiedById(t *testing.T) {
+	teardownSuite, _, org := setupSuite(t)
+	defer teardownSuite(t)
+
+	// both map to the digger name a-b-c
+	first, err := DB.GetOrCreateGithubRepo(org, 1, 100, "a-b", "c", "")
+	assert.NoError(t, err)
+	assert.Equal(t, "a-b-c", first.Name)
+	second, err := DB.GetOrCreateGithubRepo(org, 1, 200, "a", "b-c", "")
+	assert.NoError(t, err)
+	assert.NotEqual(t, first.ID, second.ID)
+	assert.Equal(t, "a-b-c-200", second.Name)
+
+	_, err = DB.GithubRepoAdded(1, 1, "a-b", 1, "a-b/c")
+	assert.NoError(t, err)
+	// another app installed on a GitHub Enterprise Server may have a repository of the same name
+	_, err = DB.GithubRepoAdded(2, 2, "a-b", 1, "a-b/c")
+	assert.NoError(t, err)
+
+	renamed, err := DB.FindGithubRepo(org.ID, 1, 100, "a-b", "renamed")
+	assert.NoError(t, err)
+	assert.Equal(t, first.ID, renamed.ID)
+	assert.Equal(t, "a-b-renamed", renamed.Name)
+	assert.Equal(t, "a-b/renamed", renamed.RepoFullName)
+	installation, err := DB.GetGithubAppInstallationByIdAndRepo(1, "a-b/renamed")
+	assert.NoError(t, err)
+	assert.NotNil(t, installation)
+	installation, err = DB.GetGithubAppInstallationByIdAndRepo(2, "a-b/c")
+	assert.NoError(t, err)
+	assert.NotNil(t, installation)
+
+	_, err = DB.FindGithubRepo(org.ID, 1, 0, "a-b", "renamed")
+	assert.Error(t, err)
+
+	// repos created before ids were stored are matched by name once
+	legacy, err := DB.CreateRepo("diggerhq-digger", org, "")
+	assert.NoError(t, err)
+	found, err := DB.FindGithubRepo(org.ID, 1, 300, "diggerhq", "digger")
+	assert.NoError(t, err)
+	assert.Equal(t, legacy.ID, found.ID)
+	byId, err := DB.GetRepoByGithubId(org.ID, 300)
+	assert.NoError(t, err)
+	assert.Equal(t, legacy.ID, byId.ID)
+}
+
+func TestGithubAppCredentialsAreEncrypted(t *testing.T) {
+	teardownSuite, _, _ := setupSuite(t)
+	defer teardownSuite(t)
+
+	t.Setenv("DIGGER_ENCRYPTION_KEY", "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=")
+	t.Setenv("GITHUB_APP_PRIVATE_KEY", "from env")
+
+	app, err := DB.CreateGithubAppWithCredentials(&GithubApp{GithubId: 42, Name: "digger"}, GithubAppCredentials{
+		ClientId:      "client",
+		ClientSecret:  "client secret",
+		PrivateKey:    "private key",
+		WebhookSecret: "webhook secret",
+	})
+	assert.NoError(t, err)
+
+	stored := Secret{}
+	assert.NoError(t, DB.GormDB.Where("name = ?", GithubAppSecretName(42, GithubAppPrivateKey)).First(&stored).Error)
+	assert.NotContains(t, stored.EncryptedValue.Ciphertext, "private key")
+
+	saved, err := DB.GetGithubApp(42)
+	assert.NoError(t, err)
+	assert.Equal(t, app.ID, saved.ID)
+	creds, err := DB.GetGithubAppCredentials(saved)
+	assert.NoError(t, err)
+	assert.Equal(t, GithubAppCredentials{ClientId: "client", ClientSecret: "client secret", PrivateKey: "private key", WebhookSecret: "webhook secret"}, *creds)
+
+	defaultApp, err := DB.GetDefaultGithubApp()
+	assert.NoError(t, err)
+	assert.Equal(t, saved.ID, defaultApp.ID)
+
+	_, err = DB.GetGithubApp(43)
+	assert.ErrorIs(t, err, ErrGithubAppNotFound)
+	t.Setenv("GITHUB_APP_ID", "43")
+	envApp, err := DB.GetGithubApp(43)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(43), envApp.GithubId)
+
+	// apps created by hand fall back to environment variables
+	creds, err = DB.GetGithubAppCredentials(&GithubApp{GithubId: 43})
+	assert.NoError(t, err)
+	assert.Equal(t, "from env", creds.PrivateKey)
+
+	t.Setenv("DIGGER_ENCRYPTION_KEY", "ZmVkY2JhOTg3NjU0MzIxMGZlZGNiYTk4NzY1NDMyMTA=")
+	_, err = DB.GetGithubAppCredentials(saved)
+	assert.Error(t, err)
+}
+
+func TestEncryptionKeysCanBeRotated(t *testing.T) {
+	teardownSuite, _, org := setupSuite(t)
+	defer teardownSuite(t)
+
+	oldKey := "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="
+	newKey := "ZmVkY2JhOTg3NjU0MzIxMGZlZGNiYTk4NzY1NDMyMTA="
+	t.Setenv("DIGGER_ENCRYPTION_KEY", oldKey)
+
+	repo, err := DB.CreateRepo("repo", org, "")
+	assert.NoError(t, err)
+	project, err := DB.CreateProject("project", org, repo)
+	assert.NoError(t, err)
+	assert.NoError(t, DB.SetSecret("stripe_key", "sk_test"))
+	assert.NoError(t, DB.SetProjectVariable(project.ID, "TF_VAR_region", "eu-west-1"))
+
+	t.Setenv("DIGGER_ENCRYPTION_KEY", newKey)
+	_, err = DB.GetSecret("stripe_key")
+	assert.Error(t, err)
+
+	t.Setenv("DIGGER_ENCRYPTION_PREVIOUS_KEYS", oldKey)
+	rotated, err := DB.RotateEncryptionKeys()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, rotated)
+
+	// the old key isn't needed anymore
+	t.Setenv("DIGGER_ENCRYPTION_PREVIOUS_KEYS", "")
+	value, err := DB.GetSecret("stripe_key")
+	assert.NoError(t, err)
+	assert.Equal(t, "sk_test", *value)
+	variables, err := DB.GetProjectVariables(project.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"TF_VAR_region": "eu-west-1"}, variables)
+
+	assert.NoError(t, DB.DeleteSecret("stripe_key"))
+	value, err = DB.GetSecret("stripe_key")
+	assert.NoError(t, err)
+	assert.Nil(t, value)
+	assert.NoError(t, DB.SetSecret("stripe_key", "sk_live"))
+}
+
+func TestRunLogChunksAreAppendedAtTheEnd(t *testing.T) {
+	teardownSuite, _, _ := setupSuite(t)
+	defer teardownSuite(t)
+
+	run := ProjectRun{ProjectID: 1}
+	assert.NoError(t, DB.CreateProjectRun(&run))
+
+	size, err := DB.AppendRunLogChunk(&RunLogChunk{ProjectRunID: run.ID, StartOffset: 0, Size: 10, BlobKey: "a"})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(10), size)
+
+	size, err = DB.AppendRunLogChunk(&RunLogChunk{ProjectRunID: run.ID, StartOffset: 0, Size: 10, BlobKey: "b"})
+	assert.ErrorIs(t, err, ErrRunLogOffsetMismatch)
+	assert.Equal(t, int64(10), size)
+
+	size, err = DB.AppendRunLogChunk(&RunLogChunk{ProjectRunID: run.ID, StartOffset: 10, Size: 5, BlobKey: "c"})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(15), size)
+
+	chunks, err := DB.GetRunLogChunks(run.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(chunks))
+	assert.Equal(t, "c", chunks[1].BlobKey)
+
+	runs, err := DB.GetRunsWithLogsBefore(time.Now().Add(time.Minute), 10)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(runs))
+	assert.NoError(t, DB.ExpireRunLog(run.ID))
+	runs, err = DB.GetRunsWithLogsBefore(time.Now().Add(time.Minute), 10)
+	assert.NoError(t, err)
+	assert.Empty(t, runs)
+	chunks, err = DB.GetRunLogChunks(run.ID)
+	assert.NoError(t, err)
+	assert.Empty(t, chunks)
+}
@@ -0,0 +1,323 @@
+package models
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var ErrRunLogOffsetMismatch = errors.New("offset doesn't match the size of the log")
+
+// Stores are the narrow interfaces controllers use to read and write data. Database implements all of them
+// on top of GORM, MemoryStore keeps everything in memory for unit tests.
+// Lookups return nil, nil when the record doesn't exist, except GetOrganisationById which returns an error.
+
+type OrgStore interface {
+	GetOrganisationById(orgId any) (*Organisation, error)
+	GetOrganisationByName(name string) (*Organisation, error)
+	// GetOrganisation returns the org of the tenant, nil if there is none
+	GetOrganisation(tenantId any) (*Organisation, error)
+	CreateOrganisation(name string, externalSource string, tenantId string) (*Organisation, error)
+	CreateToken(orgId uint, value string, tokenType string) (*Token, error)
+	// GetToken returns the token with the value, nil if there is none
+	GetToken(value any) (*Token, error)
+}
+
+type RepoStore interface {
+	GetRepo(orgId any, repoName string) (*Repo, error)
+	GetRepoById(orgId any, repoId any) (*Repo, error)
+	GetReposForOrg(orgId any) ([]Repo, error)
+	// CreateRepo returns the existing repo if there is one with the same name in the org
+	CreateRepo(name string, org *Organisation, diggerConfig string) (*Repo, error)
+	// UpdateRepoDiggerConfig saves the config and creates its new projects, projects removed from it become inactive
+	UpdateRepoDiggerConfig(orgId any, diggerConfigYaml string, repo *Repo) ([]string, error)
+}
+
+type ProjectStore interface {
+	GetProjectsForOrg(orgId any) ([]Project, error)
+	GetProjectsForRepoName(orgId any, repoName string) ([]Project, error)
+	GetProjectById(orgId any, projectId any) (*Project, error)
+	GetProjectByName(orgId any, repo *Repo, name string) (*Project, error)
+	SaveProject(project *Project) error
+}
+
+type PolicyStore interface {
+	// GetOrgPolicy returns the policy of the org which isn't specific to a repo or project
+	GetOrgPolicy(orgId any, policyType string) (*Policy, error)
+	GetProjectPolicy(orgId any, repoId uint, projectId uint, policyType string) (*Policy, error)
+	// GetPoliciesForOrg returns the policies of the projects of the org
+	GetPoliciesForOrg(orgId any) ([]Policy, error)
+	GetPolicyById(orgId any, policyId any) (*Policy, error)
+	SavePolicy(policy *Policy) error
+}
+
+type JobStore interface {
+	CreateDiggerJob(batch uuid.UUID, serializedJob []byte, branchName string, commitSha string) (*DiggerJob, error)
+	GetDiggerJob(jobId string) (*DiggerJob, error)
+	// GetPendingParentDiggerJobs returns the created jobs of the batch which don't wait for other jobs, of all batches if it is nil
+	GetPendingParentDiggerJobs(batchId *uuid.UUID) ([]DiggerJob, error)
+	UpdateDiggerJob(job *DiggerJob) error
+	ClaimDiggerJob(jobId string) (bool, error)
+	ReleaseDiggerJob(jobId string) error
+	// CreateDiggerJobParentLink makes the job wait for the parent job to succeed
+	CreateDiggerJobParentLink(parentJobId string, jobId string) error
+	GetDiggerJobParentLinksByParentId(parentId *string) ([]DiggerJobParentLink, error)
+	GetDiggerJobParentLinksChildId(childId *string) ([]DiggerJobParentLink, error)
+	CreateDiggerJobLink(diggerJobId string, repoFullName string) (*GithubDiggerJobLink, error)
+	GetDiggerJobLink(diggerJobId string) (*GithubDiggerJobLink, error)
+	// SetDiggerJobLinkWorkflowRun records the GitHub Actions run the job is running in
+	SetDiggerJobLinkWorkflowRun(diggerJobId string, workflowRunId int64) error
+}
+
+// GithubStore keeps the GitHub apps, the repositories of their installations and which org each installation is linked to
+type GithubStore interface {
+	// GetGithubApp and GetDefaultGithubApp return ErrGithubAppNotFound if there is no such app
+	GetGithubApp(gitHubAppId any) (*GithubApp, error)
+	GetDefaultGithubApp() (*GithubApp, error)
+	GetGithubAppCredentials(app *GithubApp) (*GithubAppCredentials, error)
+	CreateGithubAppWithCredentials(app *GithubApp, creds GithubAppCredentials) (*GithubApp, error)
+	GithubRepoAdded(installationId int64, appId int64, login string, accountId int64, repoFullName string) (*GithubAppInstallation, error)
+	GithubRepoRemoved(installationId int64, appId int64, repoFullName string) (*GithubAppInstallation, error)
+	// GetGithubAppInstallations returns the active repositories of the installation
+	GetGithubAppInstallations(installationId int64) ([]GithubAppInstallation, error)
+	// GetGithubAppInstallationsForRepo returns the active installations of all apps covering repoFullName,
+	// most recently updated first
+	GetGithubAppInstallationsForRepo(repoFullName string) ([]GithubAppInstallation, error)
+	// GetGithubAppInstallationByIdAndRepo returns an error if the repository isn't active in the installation
+	GetGithubAppInstallationByIdAndRepo(installationId int64, repoFullName string) (*GithubAppInstallation, error)
+	GetGithubAppInstallationByOrgAndRepo(orgId any, repo string, status GithubAppInstallStatus) (*GithubAppInstallation, error)
+	CreateGithubInstallationLink(org *Organisation, installationId int64) (*GithubAppInstallationLink, error)
+	// GetGithubAppInstallationLink returns the active link of the installation
+	GetGithubAppInstallationLink(installationId int64) (*GithubAppInstallationLink, error)
+	GetGithubInstallationLinksForOrg(orgId any) ([]GithubAppInstallationLink, error)
+	MakeGithubAppInstallationLinkInactive(link *GithubAppInstallationLink) (*GithubAppInstallationLink, error)
+	// GetRepoByGithubFullName returns the repo of a GitHub repository by its full name, e.g. diggerhq/digger
+	GetRepoByGithubFullName(orgId any, repoFullName string) (*Repo, error)
+	GetRepoByGithubId(orgId any, githubRepoId int64) (*Repo, error)
+	FindGithubRepo(orgId uint, installationId int64, githubRepoId int64, owner string, name string) (*Repo, error)
+	GetOrCreateGithubRepo(org *Organisation, installationId int64, githubRepoId int64, owner string, name string, diggerConfig string) (*Repo, error)
+}
+
+// MemberStore keeps the users and their memberships and role grants in orgs.
+// RemoveOrgMembership and DeleteRoleGrant return gorm.ErrRecordNotFound if there is nothing to remove.
+type MemberStore interface {
+	GetUserByEmail(email string) (*User, error)
+	GetUserByExternalId(externalId string) (*User, error)
+	CreateUser(username string, email string, externalId string) (*User, error)
+	UpdateUser(user *User) error
+	GetOrgMembership(orgId uint, userId uint) (*OrgMembership, error)
+	GetOrgMemberships(orgId uint) ([]OrgMembership, error)
+	UpsertOrgMembership(orgId uint, user *User, role Role, status MembershipStatus) (*OrgMembership, error)
+	RemoveOrgMembership(orgId uint, userId uint) error
+	CreateRoleGrant(orgId uint, userId uint, repoId *uint, projectId *uint, role Role) (*RoleGrant, error)
+	DeleteRoleGrant(orgId uint, userId uint, grantId uint) error
+	GetRoleGrants(orgId uint, userId uint) ([]RoleGrant, error)
+}
+
+type SecretStore interface {
+	// GetSecretOrEnv returns the secret, or the environment variable envName if it isn't stored
+	GetSecretOrEnv(name string, envName string) (string, error)
+}
+
+type RunStore interface {
+	GetProjectRuns(projectId uint) ([]ProjectRun, error)
+	// FindProjectRuns returns a page of the runs matching the filter, newest first unless sorted otherwise
+	FindProjectRuns(filter RunFilter) (*RunPage, error)
+	GetProjectRun(runId uint) (*ProjectRun, error)
+	CreateProjectRun(run *ProjectRun) error
+	UpdateProjectRunStatus(runId uint, status string, endedAt int64) error
+}
+
+const (
+	RunSortCreatedAt = "created_at"
+	RunSortStartedAt = "started_at"
+	RunSortEndedAt   = "ended_at"
+)
+
+const (
+	DefaultRunPageSize = 50
+	MaxRunPageSize     = 200
+)
+
+var ErrInvalidRunCursor = errors.New("invalid cursor")
+
+// RunFilter selects runs, zero values match everything
+type RunFilter struct {
+	OrganisationID    uint
+	ProjectID         uint
+	RepoName          string
+	ProjectName       string
+	Status            string
+	Command           string
+	PullRequestNumber int
+	DiggerJobId       string
+	BatchId           string
+	// CommitSha matches runs of commits starting with it, so short shas work
+	CommitSha string
+	Actor     string
+	// StartedAfter and StartedBefore limit when the runs started, the range includes its start only
+	StartedAfter  time.Time
+	StartedBefore time.Time
+	// SortBy is one of the RunSort constants, RunSortCreatedAt by default
+	SortBy    string
+	Ascending bool
+	// Cursor is the NextCursor of the previous page
+	Cursor string
+	Limit  int
+}
+
+type RunPage struct {
+	Runs []ProjectRun
+	// Total counts all runs matching the filter, not only the ones on the page
+	Total int64
+	// NextCursor is empty on the last page
+	NextCursor string
+}
+
+// PageSize returns the limit of the filter capped to MaxRunPageSize
+func (f RunFilter) PageSize() int {
+	if f.Limit <= 0 {
+		return DefaultRunPageSize
+	}
+	if f.Limit > MaxRunPageSize {
+		return MaxRunPageSize
+	}
+	return f.Limit
+}
+
+// sortValue is the value of the run the filter sorts by, runs are created in the order of their ids
+func (f RunFilter) sortValue(run *ProjectRun) int64 {
+	switch f.SortBy {
+	case RunSortStartedAt:
+		return run.StartedAt
+	case RunSortEndedAt:
+		return run.EndedAt
+	default:
+		return int64(run.ID)
+	}
+}
+
+// runCursor points after the last run of a page, runs with the same sort value are ordered by id
+type runCursor struct {
+	value int64
+	id    uint
+}
+
+func (c runCursor) encode() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d:%d", c.value, c.id)))
+}
+
+func decodeRunCursor(cursor string) (*runCursor, error) {
+	if cursor == "" {
+		return nil, nil
+	}
+	decoded, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, ErrInvalidRunCursor
+	}
+	var c runCursor
+	_, err = fmt.Sscanf(string(decoded), "%d:%d", &c.value, &c.id)
+	if err != nil {
+		return nil, ErrInvalidRunCursor
+	}
+	return &c, nil
+}
+
+// RunLogStore keeps the metadata of run logs, their content is in the blob store
+type RunLogStore interface {
+	// AppendRunLogChunk adds the chunk if its offset is the current size of the log and returns the new size,
+	// otherwise ErrRunLogOffsetMismatch and the current size
+	AppendRunLogChunk(chunk *RunLogChunk) (int64, error)
+	GetRunLogChunks(runId uint) ([]RunLogChunk, error)
+	// GetRunsWithLogsBefore returns runs created before the time whose logs haven't expired yet
+	GetRunsWithLogsBefore(before time.Time, limit int) ([]ProjectRun, error)
+	// ExpireRunLog removes the chunks and the legacy output of the run
+	ExpireRunLog(runId uint) error
+}
+
+type RunSearchStore interface {
+	// SaveRunSearchDocument replaces the document of the run
+	SaveRunSearchDocument(document *RunSearchDocument) error
+	// SearchRuns returns the runs of the org matching the query, best matches first
+	SearchRuns(orgId uint, query string, limit int) ([]RunSearchResult, error)
+}
+
+type PlanArtifactStore interface {
+	CreatePlanArtifact(artifact *PlanArtifact) error
+	// GetLatestPlanArtifact returns the artifact uploaded last for the project and pull request
+	GetLatestPlanArtifact(projectId uint, pullRequestNumber int) (*PlanArtifact, error)
+}
+
+type DriftStore interface {
+	GetDriftSchedule(projectId uint) (*DriftSchedule, error)
+	SaveDriftSchedule(schedule *DriftSchedule) error
+	// GetDueDriftSchedules returns enabled schedules whose next run is due, with their project and its repo
+	GetDueDriftSchedules(now time.Time, limit int) ([]DriftSchedule, error)
+	SaveDriftReport(report *DriftReport) error
+	// GetDriftReportForJob returns the report of the drift check the job was created for
+	GetDriftReportForJob(diggerJobId string) (*DriftReport, error)
+	// GetDriftForOrg returns the drift state of the projects of the org with a schedule or a report, drifting ones first
+	GetDriftForOrg(orgId uint) ([]ProjectDrift, error)
+	// GetDriftReportsForProject returns the last reports of the project, newest first
+	GetDriftReportsForProject(projectId uint, limit int) ([]DriftReport, error)
+}
+
+type ApprovalStore interface {
+	// SavePullRequestReview replaces the review of the reviewer unless the stored one was submitted later
+	SavePullRequestReview(review *PullRequestReview) error
+	GetPullRequestReviews(repoFullName string, prNumber int) ([]PullRequestReview, error)
+	// HoldDiggerJobForApproval moves the created job of the request to DiggerJobPendingApproval and saves the request
+	HoldDiggerJobForApproval(request *ApplyApprovalRequest) error
+	GetApplyApprovalRequests(repoFullName string, prNumber int) ([]ApplyApprovalRequest, error)
+	// ReleaseApprovedDiggerJob moves a held job back to created and removes its request, false if it wasn't held
+	ReleaseApprovedDiggerJob(diggerJobId string) (bool, error)
+	// CancelHeldDiggerJob fails a held job and removes its request, false if it wasn't held
+	CancelHeldDiggerJob(diggerJobId string) (bool, error)
+}
+
+type LeaseStore interface {
+	// AcquireLease takes or renews the lease for holder until now+ttl, false if another holder's lease hasn't expired
+	AcquireLease(name string, holder string, ttl time.Duration) (bool, error)
+}
+
+type AuditStore interface {
+	CreateAuditEvent(event *AuditEvent) error
+	GetAuditEvents(orgId any, filter AuditEventFilter) ([]AuditEvent, int64, error)
+}
+
+// VariableStore keeps project variables, values are only returned by GetProjectVariables
+type VariableStore interface {
+	SetProjectVariable(projectId uint, name string, value string) error
+	GetProjectVariables(projectId uint) (map[string]string, error)
+	GetProjectVariableNames(projectId uint) ([]string, error)
+	DeleteProjectVariable(projectId uint, name string) (bool, error)
+}
+
+type Stores struct {
+	Orgs      OrgStore
+	Repos     RepoStore
+	Projects  ProjectStore
+	Policies  PolicyStore
+	Jobs      JobStore
+	Runs      RunStore
+	Audit     AuditStore
+	Variables VariableStore
+	Plans     PlanArtifactStore
+	RunLogs   RunLogStore
+	Search    RunSearchStore
+	Drift     DriftStore
+	Leases    LeaseStore
+	Approvals ApprovalStore
+	Github    GithubStore
+	Members   MemberStore
+	Secrets   SecretStore
+}
+
+// Stores returns the GORM backed stores
+func (db *Database) Stores() Stores {
+	return Stores{Orgs: db, Repos: db, Projects: db, Policies: db, Jobs: db, Runs: db, Audit: db, Variables: db, Plans: db, RunLogs: db, Search: db, Drift: db, Leases: db, Approvals: db,
+		Github: db, Members: db, Secrets: db}
+}
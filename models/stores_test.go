@@ -0,0 +1,382 @@
+package models
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testStores checks the behaviour both store implementations have to share
+func testStores(t *testing.T, stores Stores) {
+	org, err := stores.Orgs.CreateOrganisation("storesOrg", "test", "storesOrg")
+	assert.NoError(t, err)
+
+	found, err := stores.Orgs.GetOrganisationByName("storesOrg")
+	assert.NoError(t, err)
+	assert.Equal(t, org.ID, found.ID)
+	missing, err := stores.Orgs.GetOrganisationByName("missing")
+	assert.NoError(t, err)
+	assert.Nil(t, missing)
+
+	repo, err := stores.Repos.CreateRepo("infra", org, "")
+	assert.NoError(t, err)
+	sameRepo, err := stores.Repos.CreateRepo("infra", org, "")
+	assert.NoError(t, err)
+	assert.Equal(t, repo.ID, sameRepo.ID)
+
+	project := &Project{Name: "prod", OrganisationID: org.ID, RepoID: repo.ID}
+	assert.NoError(t, stores.Projects.SaveProject(project))
+	projects, err := stores.Projects.GetProjectsForRepoName(org.ID, "infra")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(projects))
+	assert.Equal(t, "infra", projects[0].Repo.Name)
+	assert.Equal(t, "storesOrg", projects[0].Organisation.Name)
+	byName, err := stores.Projects.GetProjectByName(org.ID, repo, "prod")
+	assert.NoError(t, err)
+	assert.Equal(t, project.ID, byName.ID)
+
+	orgPolicy := &Policy{OrganisationID: org.ID, Type: POLICY_TYPE_PLAN, Policy: "org"}
+	assert.NoError(t, stores.Policies.SavePolicy(orgPolicy))
+	projectPolicy := &Policy{OrganisationID: org.ID, RepoID: &repo.ID, ProjectID: &project.ID, Type: POLICY_TYPE_PLAN, Policy: "project"}
+	assert.NoError(t, stores.Policies.SavePolicy(projectPolicy))
+	policy, err := stores.Policies.GetOrgPolicy(org.ID, POLICY_TYPE_PLAN)
+	assert.NoError(t, err)
+	assert.Equal(t, "org", policy.Policy)
+	policy, err = stores.Policies.GetProjectPolicy(org.ID, repo.ID, project.ID, POLICY_TYPE_PLAN)
+	assert.NoError(t, err)
+	assert.Equal(t, "project", policy.Policy)
+	policy, err = stores.Policies.GetProjectPolicy(org.ID, repo.ID, project.ID, POLICY_TYPE_ACCESS)
+	assert.NoError(t, err)
+	assert.Nil(t, policy)
+
+	assert.NoError(t, stores.Runs.CreateProjectRun(&ProjectRun{ProjectID: project.ID, Status: "succeeded"}))
+	runs, err := stores.Runs.GetProjectRuns(project.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(runs))
+	assert.Equal(t, "prod", runs[0].Project.Name)
+
+	testFindProjectRuns(t, stores, org, repo, project)
+	testSearchRuns(t, stores, org, project)
+	testDrift(t, stores, project)
+	testApprovals(t, stores, org)
+	testMembers(t, stores, org)
+
+	job := &DiggerJob{DiggerJobId: "job-1", Status: DiggerJobCreated}
+	assert.NoError(t, stores.Jobs.UpdateDiggerJob(job))
+	claimed, err := stores.Jobs.ClaimDiggerJob("job-1")
+	assert.NoError(t, err)
+	assert.True(t, claimed)
+	claimed, err = stores.Jobs.ClaimDiggerJob("job-1")
+	assert.NoError(t, err)
+	assert.False(t, claimed)
+	stored, err := stores.Jobs.GetDiggerJob("job-1")
+	assert.NoError(t, err)
+	assert.Equal(t, DiggerJobTriggered, stored.Status)
+
+	link, err := stores.Jobs.GetDiggerJobLink("job-1")
+	assert.NoError(t, err)
+	assert.Nil(t, link)
+	_, err = stores.Jobs.CreateDiggerJobLink("job-1", "acme/infra")
+	assert.NoError(t, err)
+	assert.NoError(t, stores.Jobs.SetDiggerJobLinkWorkflowRun("job-1", 4242))
+	link, err = stores.Jobs.GetDiggerJobLink("job-1")
+	assert.NoError(t, err)
+	assert.Equal(t, "acme/infra", link.RepoFullName)
+	assert.Equal(t, int64(4242), link.GithubWorkflowRunId)
+}
+
+func testFindProjectRuns(t *testing.T, stores Stores, org *Organisation, repo *Repo, project *Project) {
+	staging := &Project{Name: "staging", OrganisationID: org.ID, RepoID: repo.ID}
+	assert.NoError(t, stores.Projects.SaveProject(staging))
+	day := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 5; i++ {
+		run := &ProjectRun{ProjectID: staging.ID, Status: "succeeded", Command: "digger plan", PullRequestNumber: 7,
+			StartedAt: day.Add(time.Duration(i%3) * time.Hour).UnixMilli()}
+		if i == 4 {
+			run.Status, run.Command, run.PullRequestNumber = "failed", "digger apply", 8
+		}
+		assert.NoError(t, stores.Runs.CreateProjectRun(run))
+	}
+
+	// pages follow each other without gaps, also when runs have the same sort value
+	for _, filter := range []RunFilter{
+		{OrganisationID: org.ID, ProjectName: "staging", Limit: 2},
+		{OrganisationID: org.ID, ProjectName: "staging", Limit: 2, SortBy: RunSortStartedAt},
+		{OrganisationID: org.ID, ProjectName: "staging", Limit: 2, SortBy: RunSortStartedAt, Ascending: true},
+	} {
+		seen := map[uint]bool{}
+		var previous *ProjectRun
+		for pages := 0; pages < 3; pages++ {
+			page, err := stores.Runs.FindProjectRuns(filter)
+			assert.NoError(t, err)
+			assert.Equal(t, int64(5), page.Total)
+			for i := range page.Runs {
+				run := page.Runs[i]
+				assert.False(t, seen[run.ID])
+				seen[run.ID] = true
+				assert.Equal(t, "infra", run.Project.Repo.Name)
+				if previous != nil {
+					value, previousValue := filter.sortValue(&run), filter.sortValue(previous)
+					if filter.Ascending {
+						assert.True(t, value >= previousValue)
+					} else {
+						assert.True(t, value <= previousValue)
+					}
+				}
+				previous = &run
+			}
+			assert.Equal(t, pages == 2, page.NextCursor == "")
+			filter.Cursor = page.NextCursor
+		}
+		assert.Equal(t, 5, len(seen))
+	}
+
+	page, err := stores.Runs.FindProjectRuns(RunFilter{OrganisationID: org.ID, RepoName: "infra", Status: "succeeded", Command: "digger plan", PullRequestNumber: 7,
+		StartedAfter: day.Add(time.Hour), StartedBefore: day.Add(3 * time.Hour)})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), page.Total)
+	assert.Equal(t, 2, len(page.Runs))
+	assert.Equal(t, "", page.NextCursor)
+
+	page, err = stores.Runs.FindProjectRuns(RunFilter{ProjectID: staging.ID, PullRequestNumber: 8})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(page.Runs))
+	assert.Equal(t, "digger apply", page.Runs[0].Command)
+
+	page, err = stores.Runs.FindProjectRuns(RunFilter{OrganisationID: org.ID + 100})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), page.Total)
+
+	_, err = stores.Runs.FindProjectRuns(RunFilter{Cursor: "not a cursor"})
+	assert.ErrorIs(t, err, ErrInvalidRunCursor)
+}
+
+func testSearchRuns(t *testing.T, stores Stores, org *Organisation, project *Project) {
+	run := &ProjectRun{ProjectID: project.ID, Status: "succeeded", Command: "digger plan",
+		ResourceChanges: []ProjectRunResourceChange{{Address: "aws_iam_role.deployer", Action: ResourceActionCreate}, {Address: "aws_s3_bucket.logs", Action: ResourceActionCreate}}}
+	assert.NoError(t, stores.Runs.CreateProjectRun(run))
+	assert.NoError(t, stores.Search.SaveRunSearchDocument(&RunSearchDocument{ProjectRunID: run.ID, OrganisationID: org.ID,
+		Content: "Initializing...\nError: creating IAM Role (deployer): AccessDenied\n", ResourceAddresses: "aws_iam_role.deployer\naws_s3_bucket.logs"}))
+	other, err := stores.Orgs.CreateOrganisation("otherSearchOrg", "test", "otherSearchOrg")
+	assert.NoError(t, err)
+	otherRun := &ProjectRun{ProjectID: project.ID, Status: "failed"}
+	assert.NoError(t, stores.Runs.CreateProjectRun(otherRun))
+	assert.NoError(t, stores.Search.SaveRunSearchDocument(&RunSearchDocument{ProjectRunID: otherRun.ID, OrganisationID: other.ID, Content: "Error: AccessDenied"}))
+
+	results, err := stores.Search.SearchRuns(org.ID, "AccessDenied", 10)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(results))
+	assert.Equal(t, run.ID, results[0].Run.ID)
+	assert.Equal(t, "prod", results[0].Run.Project.Name)
+	assert.Contains(t, results[0].Snippet, SearchMatchStart+"AccessDenied"+SearchMatchEnd)
+	assert.Equal(t, 0, len(results[0].ResourceChanges))
+
+	results, err = stores.Search.SearchRuns(org.ID, "deployer", 10)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(results))
+	assert.Equal(t, 1, len(results[0].ResourceChanges))
+	assert.Equal(t, "aws_iam_role.deployer", results[0].ResourceChanges[0].Address)
+
+	results, err = stores.Search.SearchRuns(org.ID, "AccessDenied kubernetes", 10)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(results))
+
+	// documents are replaced when a run is indexed again
+	assert.NoError(t, stores.Search.SaveRunSearchDocument(&RunSearchDocument{ProjectRunID: run.ID, OrganisationID: org.ID, Content: "Apply complete!"}))
+	results, err = stores.Search.SearchRuns(org.ID, "AccessDenied", 10)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(results))
+
+	// addresses match inside of modules
+	moduleRun := &ProjectRun{ProjectID: project.ID, Status: "succeeded", Command: "digger plan",
+		ResourceChanges: []ProjectRunResourceChange{{Address: "module.iam.aws_iam_role.deployer", Action: ResourceActionUpdate}}}
+	assert.NoError(t, stores.Runs.CreateProjectRun(moduleRun))
+	assert.NoError(t, stores.Search.SaveRunSearchDocument(&RunSearchDocument{ProjectRunID: moduleRun.ID, OrganisationID: org.ID,
+		Content: "Plan: 0 to add, 1 to change, 0 to destroy.\n", ResourceAddresses: "module.iam.aws_iam_role.deployer"}))
+	for _, query := range []string{"aws_iam_role.deployer", "aws_iam_role.deployer change"} {
+		results, err = stores.Search.SearchRuns(org.ID, query, 10)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, len(results), query)
+		assert.Equal(t, moduleRun.ID, results[0].Run.ID, query)
+		assert.Equal(t, 1, len(results[0].ResourceChanges), query)
+	}
+	results, err = stores.Search.SearchRuns(org.ID, "aws_iam_role.deployer destroyed", 10)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(results))
+}
+
+func testDrift(t *testing.T, stores Stores, project *Project) {
+	now := time.Now()
+	missing, err := stores.Drift.GetDriftSchedule(project.ID)
+	assert.NoError(t, err)
+	assert.Nil(t, missing)
+	schedule := &DriftSchedule{ProjectID: project.ID, Cron: "0 6 * * *", Enabled: true, NextRunAt: now.Add(time.Hour)}
+	assert.NoError(t, stores.Drift.SaveDriftSchedule(schedule))
+	due, err := stores.Drift.GetDueDriftSchedules(now, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(due))
+	due, err = stores.Drift.GetDueDriftSchedules(now.Add(2*time.Hour), 10)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(due))
+	assert.Equal(t, "prod", due[0].Project.Name)
+	assert.Equal(t, "infra", due[0].Project.Repo.Name)
+	schedule.Enabled = false
+	assert.NoError(t, stores.Drift.SaveDriftSchedule(schedule))
+	due, err = stores.Drift.GetDueDriftSchedules(now.Add(2*time.Hour), 10)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(due))
+
+	report := &DriftReport{ProjectID: project.ID, DiggerJobId: "drift-job", Status: DriftReportPending}
+	assert.NoError(t, stores.Drift.SaveDriftReport(report))
+	report.Status = DriftReportNoDrift
+	assert.NoError(t, stores.Drift.SaveDriftReport(report))
+	found, err := stores.Drift.GetDriftReportForJob("drift-job")
+	assert.NoError(t, err)
+	assert.Equal(t, DriftReportNoDrift, found.Status)
+
+	run := &ProjectRun{ProjectID: project.ID, Status: "succeeded", DiggerJobId: "drift-job-2"}
+	run.SetResourceChanges([]ProjectRunResourceChange{
+		{Address: "aws_s3_bucket.logs", Type: "aws_s3_bucket", Name: "logs", Action: ResourceActionUpdate, Actions: "update"},
+		{Address: "data.aws_iam_policy.read", Mode: "data", Type: "aws_iam_policy", Name: "read", Action: ResourceActionRead, Actions: "read"},
+	})
+	assert.NoError(t, stores.Runs.CreateProjectRun(run))
+	firstDrift := &DriftReport{ProjectID: project.ID, Status: DriftReportDrifted, ChangeCount: 1, ProjectRunID: &run.ID}
+	assert.NoError(t, stores.Drift.SaveDriftReport(firstDrift))
+	// failed checks don't end drift, pending ones aren't the last check
+	assert.NoError(t, stores.Drift.SaveDriftReport(&DriftReport{ProjectID: project.ID, Status: DriftReportFailed}))
+	lastDrift := &DriftReport{ProjectID: project.ID, Status: DriftReportDrifted, ChangeCount: 1, ProjectRunID: &run.ID}
+	assert.NoError(t, stores.Drift.SaveDriftReport(lastDrift))
+	assert.NoError(t, stores.Drift.SaveDriftReport(&DriftReport{ProjectID: project.ID, Status: DriftReportPending}))
+
+	drift, err := stores.Drift.GetDriftForOrg(project.OrganisationID)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(drift))
+	assert.Equal(t, "infra", drift[0].Project.Repo.Name)
+	assert.Equal(t, "0 6 * * *", drift[0].Schedule.Cron)
+	assert.Equal(t, lastDrift.ID, drift[0].LastReport.ID)
+	assert.WithinDuration(t, firstDrift.CreatedAt, *drift[0].DriftingSince, time.Second)
+	assert.Equal(t, 1, len(drift[0].ResourceChanges))
+	assert.Equal(t, "aws_s3_bucket.logs", drift[0].ResourceChanges[0].Address)
+	drift, err = stores.Drift.GetDriftForOrg(project.OrganisationID + 1000)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(drift))
+
+	assert.NoError(t, stores.Drift.SaveDriftReport(&DriftReport{ProjectID: project.ID, Status: DriftReportNoDrift}))
+	drift, err = stores.Drift.GetDriftForOrg(project.OrganisationID)
+	assert.NoError(t, err)
+	assert.Nil(t, drift[0].DriftingSince)
+	assert.Equal(t, DriftReportNoDrift, drift[0].LastReport.Status)
+	assert.Equal(t, 0, len(drift[0].ResourceChanges))
+
+	reports, err := stores.Drift.GetDriftReportsForProject(project.ID, 3)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(reports))
+	assert.Equal(t, DriftReportNoDrift, reports[0].Status)
+	assert.Equal(t, DriftReportPending, reports[1].Status)
+
+	acquired, err := stores.Leases.AcquireLease("scheduler", "a", time.Minute)
+	assert.NoError(t, err)
+	assert.True(t, acquired)
+	acquired, err = stores.Leases.AcquireLease("scheduler", "b", time.Minute)
+	assert.NoError(t, err)
+	assert.False(t, acquired)
+	acquired, err = stores.Leases.AcquireLease("scheduler", "a", -time.Minute)
+	assert.NoError(t, err)
+	assert.True(t, acquired)
+	// the lease of a expired, b takes over
+	acquired, err = stores.Leases.AcquireLease("scheduler", "b", time.Minute)
+	assert.NoError(t, err)
+	assert.True(t, acquired)
+}
+
+func testApprovals(t *testing.T, stores Stores, org *Organisation) {
+	now := time.Now()
+	review := &PullRequestReview{RepoFullName: "acme/infra", PullRequestNumber: 3, Reviewer: "bob", State: ReviewStateApproved, CommitSha: "abc", SubmittedAt: now}
+	assert.NoError(t, stores.Approvals.SavePullRequestReview(review))
+	// a later review replaces the earlier one, a review delivered late doesn't
+	assert.NoError(t, stores.Approvals.SavePullRequestReview(&PullRequestReview{RepoFullName: "acme/infra", PullRequestNumber: 3, Reviewer: "bob", State: ReviewStateChangesRequested, CommitSha: "def", SubmittedAt: now.Add(time.Minute)}))
+	assert.NoError(t, stores.Approvals.SavePullRequestReview(&PullRequestReview{RepoFullName: "acme/infra", PullRequestNumber: 3, Reviewer: "bob", State: ReviewStateCommented, CommitSha: "abc", SubmittedAt: now.Add(-time.Minute)}))
+	assert.NoError(t, stores.Approvals.SavePullRequestReview(&PullRequestReview{RepoFullName: "acme/infra", PullRequestNumber: 4, Reviewer: "carol", State: ReviewStateApproved, SubmittedAt: now}))
+	reviews, err := stores.Approvals.GetPullRequestReviews("acme/infra", 3)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(reviews))
+	assert.Equal(t, ReviewStateChangesRequested, reviews[0].State)
+	assert.Equal(t, "def", reviews[0].CommitSha)
+
+	assert.NoError(t, stores.Jobs.UpdateDiggerJob(&DiggerJob{DiggerJobId: "apply-job", Status: DiggerJobCreated}))
+	request := &ApplyApprovalRequest{DiggerJobId: "apply-job", RepoFullName: "acme/infra", PullRequestNumber: 3, OrganisationID: org.ID, ProjectName: "prod", Reason: "needs 1 approval"}
+	assert.NoError(t, stores.Approvals.HoldDiggerJobForApproval(request))
+	assert.Error(t, stores.Approvals.HoldDiggerJobForApproval(&ApplyApprovalRequest{DiggerJobId: "apply-job", RepoFullName: "acme/infra", PullRequestNumber: 3}))
+	job, err := stores.Jobs.GetDiggerJob("apply-job")
+	assert.NoError(t, err)
+	assert.Equal(t, DiggerJobPendingApproval, job.Status)
+	// held jobs can't be triggered
+	claimed, err := stores.Jobs.ClaimDiggerJob("apply-job")
+	assert.NoError(t, err)
+	assert.False(t, claimed)
+	requests, err := stores.Approvals.GetApplyApprovalRequests("acme/infra", 3)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(requests))
+	assert.Equal(t, "prod", requests[0].ProjectName)
+
+	released, err := stores.Approvals.ReleaseApprovedDiggerJob("apply-job")
+	assert.NoError(t, err)
+	assert.True(t, released)
+	released, err = stores.Approvals.ReleaseApprovedDiggerJob("apply-job")
+	assert.NoError(t, err)
+	assert.False(t, released)
+	requests, err = stores.Approvals.GetApplyApprovalRequests("acme/infra", 3)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(requests))
+	job, err = stores.Jobs.GetDiggerJob("apply-job")
+	assert.NoError(t, err)
+	assert.Equal(t, DiggerJobCreated, job.Status)
+
+	// held jobs of closed pull requests never run
+	assert.NoError(t, stores.Approvals.HoldDiggerJobForApproval(&ApplyApprovalRequest{DiggerJobId: "apply-job", RepoFullName: "acme/infra", PullRequestNumber: 3}))
+	cancelled, err := stores.Approvals.CancelHeldDiggerJob("apply-job")
+	assert.NoError(t, err)
+	assert.True(t, cancelled)
+	released, err = stores.Approvals.ReleaseApprovedDiggerJob("apply-job")
+	assert.NoError(t, err)
+	assert.False(t, released)
+	requests, err = stores.Approvals.GetApplyApprovalRequests("acme/infra", 3)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(requests))
+	job, err = stores.Jobs.GetDiggerJob("apply-job")
+	assert.NoError(t, err)
+	assert.Equal(t, DiggerJobFailed, job.Status)
+}
+
+func testMembers(t *testing.T, stores Stores, org *Organisation) {
+	user, err := stores.Members.CreateUser("member@digger.dev", "member@digger.dev", "member")
+	assert.NoError(t, err)
+	_, err = stores.Members.UpsertOrgMembership(org.ID, user, RoleOperator, MembershipActive)
+	assert.NoError(t, err)
+	_, err = stores.Members.CreateRoleGrant(org.ID, user.ID, nil, nil, RoleOrgAdmin)
+	assert.NoError(t, err)
+
+	// a removed member can be invited again
+	assert.NoError(t, stores.Members.RemoveOrgMembership(org.ID, user.ID))
+	assert.Error(t, stores.Members.RemoveOrgMembership(org.ID, user.ID))
+	membership, err := stores.Members.UpsertOrgMembership(org.ID, user, RoleViewer, MembershipInvited)
+	assert.NoError(t, err)
+	assert.Equal(t, RoleViewer, membership.Role)
+	membership, err = stores.Members.GetOrgMembership(org.ID, user.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, MembershipInvited, membership.Status)
+	memberships, err := stores.Members.GetOrgMemberships(org.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(memberships))
+}
+
+func TestGormStores(t *testing.T) {
+	teardownSuite, database, _ := setupSuite(t)
+	defer teardownSuite(t)
+	testStores(t, database.Stores())
+}
+
+func TestMemoryStores(t *testing.T) {
+	testStores(t, NewMemoryStore().Stores())
+}
@@ -0,0 +1,31 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+// NewTestDatabase creates a fresh SQLite database in dbName and builds its schema with the versioned
+// migrations, so test suites run against the same schema as production
+func NewTestDatabase(dbName string) (*Database, error) {
+	err := os.Remove(dbName)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	gdb, err := gorm.Open(sqlite.Open(dbName), &gorm.Config{})
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = MigrateUp(gdb)
+	if err != nil {
+		return nil, fmt.Errorf("failed to migrate test database: %v", err)
+	}
+	return &Database{GormDB: gdb}, nil
+}
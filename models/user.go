@@ -5,4 +5,19 @@ import "gorm.io/gorm"
 type User struct {
 	gorm.Model
 	Username string `gorm:"uniqueIndex:idx_user"`
+	Email    string `gorm:"index"`
+	// ExternalId is the subject of the user in the identity provider, it is set on first login
+	ExternalId string `gorm:"index"`
+}
+
+func (u *User) MapToJsonStruct() interface{} {
+	return struct {
+		Id       uint   `json:"id"`
+		Username string `json:"username"`
+		Email    string `json:"email"`
+	}{
+		Id:       u.ID,
+		Username: u.Username,
+		Email:    u.Email,
+	}
 }
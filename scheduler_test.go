@@ -2,10 +2,11 @@ package main
 
 import (
 	"digger.dev/cloud/models"
+	"digger.dev/cloud/services"
+	"encoding/json"
+	"github.com/diggerhq/digger/libs/orchestrator"
 	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
-	"gorm.io/driver/sqlite"
-	"gorm.io/gorm"
 	"log"
 	"os"
 	"strings"
@@ -23,30 +24,12 @@ func setupSuite(tb testing.TB) (func(tb testing.TB), *models.Database) {
 	// database file name
 	dbName := "database_test.db"
 
-	// remove old database
-	e := os.Remove(dbName)
-	if e != nil {
-		if !strings.Contains(e.Error(), "no such file or directory") {
-			log.Fatal(e)
-		}
-	}
-
-	// open and create a new database
-	gdb, err := gorm.Open(sqlite.Open(dbName), &gorm.Config{})
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	// migrate tables
-	err = gdb.AutoMigrate(&models.Policy{}, &models.Organisation{}, &models.Repo{}, &models.Project{}, &models.Token{},
-		&models.User{}, &models.ProjectRun{}, &models.GithubAppInstallation{}, &models.GithubApp{}, &models.GithubAppInstallationLink{},
-		&models.GithubDiggerJobLink{}, &models.DiggerJob{}, &models.DiggerJobParentLink{})
+	// create a new database with the migrated schema
+	database, err := models.NewTestDatabase(dbName)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	database := &models.Database{GormDB: gdb}
-
 	orgTenantId := "11111111-1111-1111-1111-111111111111"
 	externalSource := "test"
 	orgName := "testOrg"
@@ -84,7 +67,7 @@ func TestCreateDiggerJob(t *testing.T) {
 	defer teardownSuite(t)
 
 	batchId, _ := uuid.NewUUID()
-	job, err := database.CreateDiggerJob(batchId, []byte{100}, "")
+	job, err := database.CreateDiggerJob(batchId, []byte{100}, "", "")
 
 	assert.NoError(t, err)
 	assert.NotNil(t, job)
@@ -96,7 +79,7 @@ func TestCreateSingleJob(t *testing.T) {
 	defer teardownSuite(t)
 
 	batchId, _ := uuid.NewUUID()
-	job, err := database.CreateDiggerJob(batchId, []byte{100}, "")
+	job, err := database.CreateDiggerJob(batchId, []byte{100}, "", "")
 
 	assert.NoError(t, err)
 	assert.NotNil(t, job)
@@ -108,20 +91,20 @@ func TestFindDiggerJobsByParentJobId(t *testing.T) {
 	defer teardownSuite(t)
 
 	batchId, _ := uuid.NewUUID()
-	job, err := database.CreateDiggerJob(batchId, []byte{100}, "")
+	job, err := database.CreateDiggerJob(batchId, []byte{100}, "", "")
 	parentJobId := job.DiggerJobId
 	assert.NoError(t, err)
 	assert.NotNil(t, job)
 	assert.NotZero(t, job.ID)
 
-	job, err = database.CreateDiggerJob(batchId, []byte{100}, "")
+	job, err = database.CreateDiggerJob(batchId, []byte{100}, "", "")
 	assert.NoError(t, err)
 	assert.NotNil(t, job)
 	assert.NotZero(t, job.ID)
 	err = database.CreateDiggerJobParentLink(parentJobId, job.DiggerJobId)
 	assert.Nil(t, err)
 
-	job, err = database.CreateDiggerJob(batchId, []byte{100}, "")
+	job, err = database.CreateDiggerJob(batchId, []byte{100}, "", "")
 	assert.NoError(t, err)
 	assert.NotNil(t, job)
 	err = database.CreateDiggerJobParentLink(parentJobId, job.DiggerJobId)
@@ -132,3 +115,43 @@ func TestFindDiggerJobsByParentJobId(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, 2, len(jobs))
 }
+
+func TestJobDispatchInputsIncludeProjectVariables(t *testing.T) {
+	teardownSuite, database := setupSuite(t)
+	defer teardownSuite(t)
+	t.Setenv("DIGGER_ENCRYPTION_KEY", "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=")
+
+	org, err := database.GetOrganisationByName("testOrg")
+	assert.NoError(t, err)
+	repo, err := database.GetOrCreateGithubRepo(org, 1, 1, "diggerhq", "infra", "")
+	assert.NoError(t, err)
+	project, err := database.CreateProject("prod", org, repo)
+	assert.NoError(t, err)
+	assert.NoError(t, database.SetProjectVariable(project.ID, "TF_VAR_region", "eu-west-1"))
+	_, err = database.GithubRepoAdded(10, 1, "diggerhq", 1, "diggerhq/infra")
+	assert.NoError(t, err)
+	_, err = database.CreateGithubInstallationLink(org, 10)
+	assert.NoError(t, err)
+
+	serialized, _ := json.Marshal(orchestrator.JobJson{ProjectName: "prod", CommandEnvVars: map[string]string{"EXISTING": "1"}})
+	batchId, _ := uuid.NewUUID()
+	job, err := database.CreateDiggerJob(batchId, serialized, "main", "")
+	assert.NoError(t, err)
+
+	inputs, err := services.JobDispatchInputs(database.Stores(), org.ID, job, "diggerhq", "infra")
+	assert.NoError(t, err)
+	assert.Equal(t, job.DiggerJobId, inputs["id"])
+	var dispatched orchestrator.JobJson
+	assert.NoError(t, json.Unmarshal([]byte(inputs["job"].(string)), &dispatched))
+	assert.Equal(t, map[string]string{"EXISTING": "1", "TF_VAR_region": "eu-west-1"}, dispatched.CommandEnvVars)
+
+	// values are only added to the dispatched inputs
+	stored, err := database.GetDiggerJob(job.DiggerJobId)
+	assert.NoError(t, err)
+	assert.NotContains(t, string(stored.SerializedJob), "eu-west-1")
+
+	// repos the org doesn't have get no variables
+	inputs, err = services.JobDispatchInputs(database.Stores(), org.ID, job, "diggerhq", "other")
+	assert.NoError(t, err)
+	assert.Equal(t, string(serialized), inputs["job"])
+}
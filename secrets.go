@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"digger.dev/cloud/models"
+)
+
+// runSecretsCommand handles `secrets set <name>` with the value read from stdin, `secrets delete <name>` and `secrets rotate`
+func runSecretsCommand(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: secrets set <name> | delete <name> | rotate")
+	}
+
+	gormDb, err := models.OpenDatabase()
+	if err != nil {
+		return fmt.Errorf("failed to connect to database: %v", err)
+	}
+	database := &models.Database{GormDB: gormDb}
+
+	switch args[0] {
+	case "set":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: secrets set <name>")
+		}
+		// read from stdin so values don't end up in the shell history
+		value, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return fmt.Errorf("failed to read secret value: %v", err)
+		}
+		err = database.SetSecret(args[1], strings.TrimRight(string(value), "\r\n"))
+		if err != nil {
+			return err
+		}
+		log.Printf("secret %v has been saved", args[1])
+	case "delete":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: secrets delete <name>")
+		}
+		err := database.DeleteSecret(args[1])
+		if err != nil {
+			return err
+		}
+		log.Printf("secret %v has been deleted", args[1])
+	case "rotate":
+		rotated, err := database.RotateEncryptionKeys()
+		if err != nil {
+			return err
+		}
+		log.Printf("%v values have been rotated to the current encryption key", rotated)
+	default:
+		return fmt.Errorf("unknown secrets command %v, expected set, delete or rotate", args[0])
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"digger.dev/cloud/models"
+)
+
+// ApprovalPolicy decides whether a pull request has the approvals to apply it. It is the JSON document stored as
+// the approval policy of the project, or of the org if the project has none. Without a policy applies aren't held.
+type ApprovalPolicy struct {
+	// MinApprovals is how many reviewers other than the author have to approve
+	MinApprovals int `json:"min_approvals"`
+	// RequiredTeams are slugs of teams of the repository owner, each needs an approval of one of its members
+	RequiredTeams []string `json:"required_teams"`
+	// RequireCodeowners needs an approval of an owner of the project directory, if CODEOWNERS names any
+	RequireCodeowners bool `json:"require_codeowners"`
+	// DismissStaleApprovals only counts approvals of the head of the pull request, a push voids earlier approvals
+	DismissStaleApprovals bool `json:"dismiss_stale_approvals"`
+}
+
+// ParseApprovalPolicy parses the text of an approval policy
+func ParseApprovalPolicy(text string) (*ApprovalPolicy, error) {
+	policy := &ApprovalPolicy{}
+	decoder := json.NewDecoder(strings.NewReader(text))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(policy)
+	if err != nil {
+		return nil, fmt.Errorf("approval policy isn't valid: %v", err)
+	}
+	if policy.MinApprovals < 0 {
+		return nil, fmt.Errorf("min_approvals can't be negative")
+	}
+	for _, team := range policy.RequiredTeams {
+		if team == "" || strings.Contains(team, "/") {
+			return nil, fmt.Errorf("required_teams has %q, expected the slug of a team of the repository owner", team)
+		}
+	}
+	return policy, nil
+}
+
+// ApprovalPolicyForProject returns the approval policy of the project, or of its org if the project has none.
+// It is nil if neither has one.
+func ApprovalPolicyForProject(policies models.PolicyStore, project *models.Project) (*ApprovalPolicy, error) {
+	policy, err := policies.GetProjectPolicy(project.OrganisationID, project.RepoID, project.ID, models.POLICY_TYPE_APPROVAL)
+	if err != nil {
+		return nil, err
+	}
+	if policy == nil {
+		policy, err = policies.GetOrgPolicy(project.OrganisationID, models.POLICY_TYPE_APPROVAL)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if policy == nil {
+		return nil, nil
+	}
+	return ParseApprovalPolicy(policy.Policy)
+}
+
+// PullRequestApprovals is what approval policies are evaluated against
+type PullRequestApprovals struct {
+	HeadSha string
+	Author  string
+	Reviews []models.PullRequestReview
+	// Codeowners are the owners of the project directory, "@user" or "@org/team"
+	Codeowners []string
+	// IsTeamMember tells whether the user is a member of the team of the repository owner
+	IsTeamMember func(team string, login string) (bool, error)
+}
+
+// Evaluate decides whether the pull request may be applied and explains why
+func (p *ApprovalPolicy) Evaluate(pr PullRequestApprovals) (bool, string, error) {
+	approvers := make([]string, 0)
+	for _, review := range pr.Reviews {
+		if review.State != models.ReviewStateApproved || strings.EqualFold(review.Reviewer, pr.Author) {
+			continue
+		}
+		if p.DismissStaleApprovals && review.CommitSha != pr.HeadSha {
+			continue
+		}
+		approvers = append(approvers, review.Reviewer)
+	}
+
+	reasons := make([]string, 0)
+	if len(approvers) < p.MinApprovals {
+		of := ""
+		if p.DismissStaleApprovals {
+			of = " of the latest commit"
+		}
+		reasons = append(reasons, fmt.Sprintf("it needs %v approvals%v, it has %v", p.MinApprovals, of, len(approvers)))
+	}
+	for _, team := range p.RequiredTeams {
+		approved, err := anyApproverInTeam(pr, approvers, team)
+		if err != nil {
+			return false, "", err
+		}
+		if !approved {
+			reasons = append(reasons, fmt.Sprintf("it needs an approval of a member of the %v team", team))
+		}
+	}
+	if p.RequireCodeowners && len(pr.Codeowners) > 0 {
+		approved, err := anyApproverOwns(pr, approvers)
+		if err != nil {
+			return false, "", err
+		}
+		if !approved {
+			reasons = append(reasons, fmt.Sprintf("it needs an approval of a code owner of the project (%v)", strings.Join(pr.Codeowners, ", ")))
+		}
+	}
+
+	if len(reasons) > 0 {
+		return false, strings.Join(reasons, "; "), nil
+	}
+	if len(approvers) == 0 {
+		return true, "the approval policy doesn't require approvals", nil
+	}
+	return true, "approved by " + strings.Join(approvers, ", "), nil
+}
+
+func anyApproverInTeam(pr PullRequestApprovals, approvers []string, team string) (bool, error) {
+	for _, approver := range approvers {
+		member, err := pr.IsTeamMember(team, approver)
+		if err != nil {
+			return false, fmt.Errorf("failed to check whether %v is a member of %v: %v", approver, team, err)
+		}
+		if member {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func anyApproverOwns(pr PullRequestApprovals, approvers []string) (bool, error) {
+	for _, owner := range pr.Codeowners {
+		name, isHandle := strings.CutPrefix(owner, "@")
+		if !isHandle {
+			// owners named by email can't be matched to reviewers
+			continue
+		}
+		if _, team, isTeam := strings.Cut(name, "/"); isTeam {
+			approved, err := anyApproverInTeam(pr, approvers, team)
+			if err != nil || approved {
+				return approved, err
+			}
+			continue
+		}
+		for _, approver := range approvers {
+			if strings.EqualFold(approver, name) {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
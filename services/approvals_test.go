@@ -0,0 +1,106 @@
+package services
+
+import (
+	"testing"
+
+	"digger.dev/cloud/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseApprovalPolicy(t *testing.T) {
+	policy, err := ParseApprovalPolicy(`{"min_approvals": 2, "required_teams": ["platform"], "require_codeowners": true}`)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, policy.MinApprovals)
+	assert.Equal(t, []string{"platform"}, policy.RequiredTeams)
+
+	_, err = ParseApprovalPolicy(`{"min_approval": 2}`)
+	assert.Error(t, err)
+	_, err = ParseApprovalPolicy(`{"min_approvals": -1}`)
+	assert.Error(t, err)
+	_, err = ParseApprovalPolicy(`{"required_teams": ["acme/platform"]}`)
+	assert.Error(t, err)
+	_, err = ParseApprovalPolicy(`package digger`)
+	assert.Error(t, err)
+}
+
+func approved(reviewer string, sha string) models.PullRequestReview {
+	return models.PullRequestReview{Reviewer: reviewer, State: models.ReviewStateApproved, CommitSha: sha}
+}
+
+func TestApprovalPolicyEvaluate(t *testing.T) {
+	teams := map[string][]string{"platform": {"carol"}, "infra-owners": {"dave"}}
+	isTeamMember := func(team string, login string) (bool, error) {
+		for _, member := range teams[team] {
+			if member == login {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+
+	policy := &ApprovalPolicy{MinApprovals: 2, DismissStaleApprovals: true}
+	pr := PullRequestApprovals{HeadSha: "head", Author: "alice", IsTeamMember: isTeamMember, Reviews: []models.PullRequestReview{
+		approved("alice", "head"),
+		approved("bob", "old"),
+		approved("carol", "head"),
+		{Reviewer: "erin", State: models.ReviewStateChangesRequested, CommitSha: "head"},
+	}}
+	ok, reason, err := policy.Evaluate(pr)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	assert.Equal(t, "it needs 2 approvals of the latest commit, it has 1", reason)
+
+	policy.DismissStaleApprovals = false
+	ok, reason, err = policy.Evaluate(pr)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "approved by bob, carol", reason)
+
+	policy = &ApprovalPolicy{RequiredTeams: []string{"platform", "security"}}
+	ok, reason, err = policy.Evaluate(pr)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	assert.Equal(t, "it needs an approval of a member of the security team", reason)
+
+	policy = &ApprovalPolicy{RequireCodeowners: true}
+	pr.Codeowners = []string{"@acme/infra-owners", "@Frank", "ops@example.com"}
+	ok, reason, err = policy.Evaluate(pr)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	assert.Equal(t, "it needs an approval of a code owner of the project (@acme/infra-owners, @Frank, ops@example.com)", reason)
+	pr.Reviews = append(pr.Reviews, approved("frank", "head"))
+	ok, _, err = policy.Evaluate(pr)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	pr.Reviews = []models.PullRequestReview{approved("dave", "old")}
+	ok, _, err = policy.Evaluate(pr)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	// without owners of the project directory there is nobody to approve
+	pr.Codeowners = nil
+	pr.Reviews = nil
+	ok, reason, err = policy.Evaluate(pr)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "the approval policy doesn't require approvals", reason)
+}
+
+func TestCodeownersOwnersOf(t *testing.T) {
+	codeowners := ParseCodeowners(`
+# everything else
+*                   @acme/platform
+/infra/             @acme/infra-owners # infrastructure
+/infra/prod/        @acme/sre @alice
+modules/            @bob
+docs/*.md           docs@example.com
+`)
+	assert.Equal(t, []string{"@acme/platform"}, codeowners.OwnersOf(""))
+	assert.Equal(t, []string{"@acme/platform"}, codeowners.OwnersOf("."))
+	assert.Equal(t, []string{"@acme/infra-owners"}, codeowners.OwnersOf("infra/staging"))
+	assert.Equal(t, []string{"@acme/sre", "@alice"}, codeowners.OwnersOf("infra/prod"))
+	assert.Equal(t, []string{"@acme/sre", "@alice"}, codeowners.OwnersOf("./infra/prod/eu"))
+	assert.Equal(t, []string{"@bob"}, codeowners.OwnersOf("stacks/modules/vpc"))
+	assert.Equal(t, []string{"@acme/platform"}, codeowners.OwnersOf("infrastructure"))
+	assert.Nil(t, ParseCodeowners("/infra/ @alice").OwnersOf("apps"))
+}
@@ -0,0 +1,137 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var ErrBlobNotFound = errors.New("blob not found")
+
+// BlobStore keeps binary artifacts like plan files, keys are slash separated paths
+type BlobStore interface {
+	Put(key string, content io.Reader) (int64, error)
+	// Get returns ErrBlobNotFound if there is no blob with the key
+	Get(key string) (io.ReadCloser, error)
+	// GetRange reads length bytes from offset on, or everything after offset if length is negative
+	GetRange(key string, offset int64, length int64) (io.ReadCloser, error)
+	Delete(key string) error
+}
+
+// LoadBlobStore returns the blob store configured with DIGGER_BLOB_STORE, "filesystem" (the default) keeps blobs
+// in DIGGER_BLOB_STORE_DIR and "s3" in an S3 compatible bucket
+func LoadBlobStore() (BlobStore, error) {
+	switch os.Getenv("DIGGER_BLOB_STORE") {
+	case "", "filesystem":
+	case "s3":
+		return NewS3BlobStore(os.Getenv("DIGGER_BLOB_S3_BUCKET"), os.Getenv("DIGGER_BLOB_S3_PREFIX"), os.Getenv("DIGGER_BLOB_S3_ENDPOINT"))
+	default:
+		return nil, fmt.Errorf("unknown DIGGER_BLOB_STORE %v", os.Getenv("DIGGER_BLOB_STORE"))
+	}
+	dir := os.Getenv("DIGGER_BLOB_STORE_DIR")
+	if dir == "" {
+		dir = filepath.Join(os.TempDir(), "digger-blobs")
+	}
+	return NewFilesystemBlobStore(dir)
+}
+
+type FilesystemBlobStore struct {
+	dir string
+}
+
+func NewFilesystemBlobStore(dir string) (*FilesystemBlobStore, error) {
+	err := os.MkdirAll(dir, 0o700)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create blob store directory %v: %v", dir, err)
+	}
+	return &FilesystemBlobStore{dir: dir}, nil
+}
+
+func (s *FilesystemBlobStore) path(key string) (string, error) {
+	for _, part := range strings.Split(key, "/") {
+		if part == "" || part == "." || part == ".." {
+			return "", fmt.Errorf("invalid blob key %v", key)
+		}
+	}
+	return filepath.Join(s.dir, filepath.FromSlash(key)), nil
+}
+
+// Put writes to a temporary file first, so readers never see a partial blob
+func (s *FilesystemBlobStore) Put(key string, content io.Reader) (int64, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return 0, err
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0o700)
+	if err != nil {
+		return 0, err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".upload-*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+
+	size, err := io.Copy(tmp, content)
+	if err != nil {
+		tmp.Close()
+		return 0, err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return 0, err
+	}
+	err = os.Rename(tmp.Name(), path)
+	if err != nil {
+		return 0, err
+	}
+	return size, nil
+}
+
+func (s *FilesystemBlobStore) Get(key string) (io.ReadCloser, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrBlobNotFound
+	}
+	return file, err
+}
+
+func (s *FilesystemBlobStore) GetRange(key string, offset int64, length int64) (io.ReadCloser, error) {
+	file, err := s.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	_, err = file.(*os.File).Seek(offset, io.SeekStart)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if length < 0 {
+		return file, nil
+	}
+	return limitedReadCloser{Reader: io.LimitReader(file, length), Closer: file}, nil
+}
+
+type limitedReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+func (s *FilesystemBlobStore) Delete(key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,120 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// S3BlobStore keeps blobs in an S3 bucket, endpoint is only set for S3 compatible stores like MinIO.
+// Credentials and region come from the usual AWS environment variables.
+type S3BlobStore struct {
+	bucket   string
+	prefix   string
+	client   *s3.S3
+	uploader *s3manager.Uploader
+}
+
+func NewS3BlobStore(bucket string, prefix string, endpoint string) (*S3BlobStore, error) {
+	if bucket == "" {
+		return nil, fmt.Errorf("DIGGER_BLOB_S3_BUCKET has to be set")
+	}
+	config := aws.NewConfig()
+	if endpoint != "" {
+		config = config.WithEndpoint(endpoint).WithS3ForcePathStyle(true)
+	}
+	sess, err := session.NewSession(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create AWS session: %v", err)
+	}
+	return &S3BlobStore{
+		bucket:   bucket,
+		prefix:   strings.Trim(prefix, "/"),
+		client:   s3.New(sess),
+		uploader: s3manager.NewUploader(sess),
+	}, nil
+}
+
+func (s *S3BlobStore) objectKey(key string) string {
+	if s.prefix == "" {
+		return key
+	}
+	return s.prefix + "/" + key
+}
+
+func (s *S3BlobStore) Put(key string, content io.Reader) (int64, error) {
+	counter := &countingReader{Reader: content}
+	_, err := s.uploader.Upload(&s3manager.UploadInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.objectKey(key)),
+		Body:   counter,
+	})
+	if err != nil {
+		// keeps errors of the content reader, e.g. a body over the size limit, recognisable
+		if counter.err != nil {
+			return 0, counter.err
+		}
+		return 0, err
+	}
+	return counter.n, nil
+}
+
+func (s *S3BlobStore) Get(key string) (io.ReadCloser, error) {
+	return s.GetRange(key, 0, -1)
+}
+
+func (s *S3BlobStore) GetRange(key string, offset int64, length int64) (io.ReadCloser, error) {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.objectKey(key)),
+	}
+	if length == 0 {
+		return io.NopCloser(strings.NewReader("")), nil
+	}
+	if offset > 0 || length > 0 {
+		if length < 0 {
+			input.Range = aws.String(fmt.Sprintf("bytes=%v-", offset))
+		} else {
+			input.Range = aws.String(fmt.Sprintf("bytes=%v-%v", offset, offset+length-1))
+		}
+	}
+	output, err := s.client.GetObject(input)
+	if err != nil {
+		var awsErr awserr.Error
+		if errors.As(err, &awsErr) && awsErr.Code() == s3.ErrCodeNoSuchKey {
+			return nil, ErrBlobNotFound
+		}
+		return nil, err
+	}
+	return output.Body, nil
+}
+
+func (s *S3BlobStore) Delete(key string) error {
+	_, err := s.client.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.objectKey(key)),
+	})
+	return err
+}
+
+type countingReader struct {
+	io.Reader
+	n   int64
+	err error
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.n += int64(n)
+	if err != nil && err != io.EOF {
+		r.err = err
+	}
+	return n, err
+}
@@ -0,0 +1,79 @@
+package services
+
+import (
+	"path"
+	"regexp"
+	"strings"
+)
+
+// CodeownersPaths are where GitHub looks for the CODEOWNERS file, in order
+var CodeownersPaths = []string{".github/CODEOWNERS", "CODEOWNERS", "docs/CODEOWNERS"}
+
+type codeownersRule struct {
+	pattern *regexp.Regexp
+	owners  []string
+}
+
+// Codeowners are the rules of a CODEOWNERS file, like on GitHub the last rule matching a path decides its owners
+type Codeowners struct {
+	rules []codeownersRule
+}
+
+// ParseCodeowners parses a CODEOWNERS file. Owners are kept as written, "@user", "@org/team" or an email.
+func ParseCodeowners(text string) *Codeowners {
+	codeowners := &Codeowners{}
+	for _, line := range strings.Split(text, "\n") {
+		line, _, _ = strings.Cut(line, "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		codeowners.rules = append(codeowners.rules, codeownersRule{
+			pattern: codeownersPattern(fields[0]),
+			owners:  fields[1:],
+		})
+	}
+	return codeowners
+}
+
+// codeownersPattern matches a path and everything below it. Patterns with a slash other than a trailing one are
+// relative to the root of the repository, others match at any depth.
+func codeownersPattern(pattern string) *regexp.Regexp {
+	trimmed := strings.TrimSuffix(pattern, "/")
+	anchored := strings.Contains(trimmed, "/")
+	trimmed = strings.TrimPrefix(trimmed, "/")
+
+	var expression strings.Builder
+	if anchored {
+		expression.WriteString("^")
+	} else {
+		expression.WriteString("^(.*/)?")
+	}
+	for i := 0; i < len(trimmed); i++ {
+		switch {
+		case strings.HasPrefix(trimmed[i:], "**"):
+			expression.WriteString(".*")
+			i++
+		case trimmed[i] == '*':
+			expression.WriteString("[^/]*")
+		case trimmed[i] == '?':
+			expression.WriteString("[^/]")
+		default:
+			expression.WriteString(regexp.QuoteMeta(trimmed[i : i+1]))
+		}
+	}
+	expression.WriteString("(/.*)?$")
+	return regexp.MustCompile(expression.String())
+}
+
+// OwnersOf returns the owners of a directory of the repository, none if no rule matches it
+func (c *Codeowners) OwnersOf(dir string) []string {
+	dir = strings.TrimPrefix(path.Clean("/"+dir), "/")
+	var owners []string
+	for _, rule := range c.rules {
+		if rule.pattern.MatchString(dir) {
+			owners = rule.owners
+		}
+	}
+	return owners
+}
@@ -0,0 +1,188 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"digger.dev/cloud/utils"
+	dg_configuration "github.com/diggerhq/digger/libs/digger_config"
+	"github.com/google/go-github/v55/github"
+)
+
+var ErrDiggerConfigNotFound = errors.New("digger.yml not found")
+
+// DiggerConfigLoader reads digger.yml and repository trees through the GitHub contents and trees APIs instead of
+// cloning. Commits never change, so results are cached by commit sha.
+type DiggerConfigLoader struct {
+	mu         sync.Mutex
+	maxEntries int
+	// insertion order for eviction
+	keys  []string
+	files map[string]string
+	trees map[string][]string
+}
+
+func NewDiggerConfigLoader(maxEntries int) *DiggerConfigLoader {
+	return &DiggerConfigLoader{
+		maxEntries: maxEntries,
+		files:      make(map[string]string),
+		trees:      make(map[string][]string),
+	}
+}
+
+// ConfigLoader is shared by the webhook handlers
+var ConfigLoader = NewDiggerConfigLoader(1000)
+
+func (l *DiggerConfigLoader) cached(key string) (string, []string, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if file, ok := l.files[key]; ok {
+		return file, nil, true
+	}
+	if tree, ok := l.trees[key]; ok {
+		return "", tree, true
+	}
+	return "", nil, false
+}
+
+func (l *DiggerConfigLoader) store(key string, file string, tree []string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, isFile := l.files[key]
+	_, isTree := l.trees[key]
+	if tree != nil {
+		l.trees[key] = tree
+	} else {
+		l.files[key] = file
+	}
+	// concurrent loads of the same commit store it twice, it is only counted once
+	if !isFile && !isTree {
+		l.keys = append(l.keys, key)
+	}
+	for len(l.keys) > l.maxEntries {
+		delete(l.files, l.keys[0])
+		delete(l.trees, l.keys[0])
+		l.keys = l.keys[1:]
+	}
+}
+
+// LoadDiggerYml returns the content of digger.yml, or digger.yaml, at the commit sha
+func (l *DiggerConfigLoader) LoadDiggerYml(client *github.Client, repoOwner string, repoName string, sha string) (string, error) {
+	key := fmt.Sprintf("%v/%v@%v:digger.yml", repoOwner, repoName, sha)
+	if content, _, ok := l.cached(key); ok {
+		return content, nil
+	}
+
+	var found []string
+	for _, fileName := range []string{"digger.yml", "digger.yaml"} {
+		file, _, resp, err := client.Repositories.GetContents(context.Background(), repoOwner, repoName, fileName, &github.RepositoryContentGetOptions{Ref: sha})
+		if err != nil {
+			if resp != nil && resp.StatusCode == http.StatusNotFound {
+				continue
+			}
+			return "", fmt.Errorf("failed to get %v of %v/%v at %v: %v", fileName, repoOwner, repoName, sha, err)
+		}
+		if file == nil {
+			return "", fmt.Errorf("%v of %v/%v is a directory", fileName, repoOwner, repoName)
+		}
+		content, err := file.GetContent()
+		if err != nil {
+			return "", fmt.Errorf("failed to decode %v of %v/%v: %v", fileName, repoOwner, repoName, err)
+		}
+		found = append(found, content)
+	}
+
+	if len(found) == 0 {
+		return "", ErrDiggerConfigNotFound
+	}
+	if len(found) > 1 {
+		return "", dg_configuration.ErrDiggerConfigConflict
+	}
+	l.store(key, found[0], nil)
+	return found[0], nil
+}
+
+// terraformFiles lists the paths of all .tf files at the commit sha, false if GitHub truncated the tree
+func (l *DiggerConfigLoader) terraformFiles(client *github.Client, repoOwner string, repoName string, sha string) ([]string, bool, error) {
+	key := fmt.Sprintf("%v/%v@%v:tree", repoOwner, repoName, sha)
+	if _, tree, ok := l.cached(key); ok {
+		return tree, true, nil
+	}
+
+	tree, _, err := client.Git.GetTree(context.Background(), repoOwner, repoName, sha, true)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to get tree of %v/%v at %v: %v", repoOwner, repoName, sha, err)
+	}
+	if tree.GetTruncated() {
+		return nil, false, nil
+	}
+	files := make([]string, 0)
+	for _, entry := range tree.Entries {
+		if entry.GetType() == "blob" && strings.HasSuffix(entry.GetPath(), ".tf") {
+			files = append(files, entry.GetPath())
+		}
+	}
+	l.store(key, "", files)
+	return files, true, nil
+}
+
+// GenerateProjects adds the projects of generate_projects to config. Plain include/exclude generation only needs
+// the paths of terraform files, which come from the trees API. Terragrunt parsing reads file contents, so does
+// a huge repo GitHub can't list in one response, those are checked out from the repo cache. The checkout is of the
+// whole commit, not a sparse or partial clone, terragrunt files can include files anywhere in the repo. The mirror
+// only fetches the commit, not its history.
+func (l *DiggerConfigLoader) GenerateProjects(client *github.Client, repoOwner string, repoName string, sha string, cloneUrl string, branch string, token string, config *dg_configuration.DiggerConfigYaml) error {
+	if config.GenerateProjectsConfig == nil {
+		return nil
+	}
+
+	needsClone := config.GenerateProjectsConfig.Terragrunt || config.GenerateProjectsConfig.TerragruntParsingConfig != nil
+	if !needsClone {
+		files, complete, err := l.terraformFiles(client, repoOwner, repoName, sha)
+		if err != nil {
+			return err
+		}
+		if complete {
+			return generateProjectsFromPaths(config, files)
+		}
+		log.Printf("tree of %v/%v is too large for the trees API, cloning", repoOwner, repoName)
+	}
+
+	return utils.DefaultRepoCache().DoAction(cloneUrl, branch, sha, token, func(dir string) error {
+		return dg_configuration.HandleYamlProjectGeneration(config, dir)
+	})
+}
+
+// generateProjectsFromPaths lays out empty terraform files in a temporary directory, which is all
+// the directory walker of project generation looks at
+func generateProjectsFromPaths(config *dg_configuration.DiggerConfigYaml, files []string) error {
+	dir, err := os.MkdirTemp("", "digger-tree")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	for _, file := range files {
+		path := filepath.Join(dir, filepath.FromSlash(file))
+		// paths come from GitHub, but still never write outside of the directory
+		if !strings.HasPrefix(path, dir+string(os.PathSeparator)) {
+			continue
+		}
+		err := os.MkdirAll(filepath.Dir(path), 0o755)
+		if err != nil {
+			return err
+		}
+		err = os.WriteFile(path, nil, 0o644)
+		if err != nil {
+			return err
+		}
+	}
+	return dg_configuration.HandleYamlProjectGeneration(config, dir)
+}
@@ -0,0 +1,103 @@
+package services
+
+import (
+	"net/http"
+	"testing"
+
+	dg_configuration "github.com/diggerhq/digger/libs/digger_config"
+	"github.com/google/go-github/v55/github"
+	"github.com/migueleliasweb/go-github-mock/src/mock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfigLoaderUsesContentsAndTreesApis(t *testing.T) {
+	contentsRequests := 0
+	treeRequests := 0
+	mockedHTTPClient := mock.NewMockedHTTPClient(
+		mock.WithRequestMatchHandler(
+			mock.GetReposContentsByOwnerByRepoByPath,
+			http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				contentsRequests++
+				assert.Equal(t, "abc123", r.URL.Query().Get("ref"))
+				if r.URL.Path != "/repos/diggerhq/infra/contents/digger.yml" {
+					mock.WriteError(w, http.StatusNotFound, "Not Found")
+					return
+				}
+				w.Write(mock.MustMarshal(github.RepositoryContent{
+					Type:    github.String("file"),
+					Content: github.String("generate_projects:\n  include: \"envs/**\"\n"),
+				}))
+			}),
+		),
+		mock.WithRequestMatchHandler(
+			mock.GetReposGitTreesByOwnerByRepoByTreeSha,
+			http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				treeRequests++
+				w.Write(mock.MustMarshal(github.Tree{
+					Truncated: github.Bool(false),
+					Entries: []*github.TreeEntry{
+						{Path: github.String("envs/dev/main.tf"), Type: github.String("blob")},
+						{Path: github.String("envs/prod/main.tf"), Type: github.String("blob")},
+						{Path: github.String("envs/prod/modules/vpc/main.tf"), Type: github.String("blob")},
+						{Path: github.String("README.md"), Type: github.String("blob")},
+					},
+				}))
+			}),
+		),
+	)
+	client := github.NewClient(mockedHTTPClient)
+	loader := NewDiggerConfigLoader(10)
+
+	for i := 0; i < 2; i++ {
+		diggerYml, err := loader.LoadDiggerYml(client, "diggerhq", "infra", "abc123")
+		assert.NoError(t, err)
+
+		configYaml, err := dg_configuration.LoadDiggerConfigYamlFromString(diggerYml)
+		assert.NoError(t, err)
+		// no clone url, generating from the tree must not need one
+		err = loader.GenerateProjects(client, "diggerhq", "infra", "abc123", "", "main", "", configYaml)
+		assert.NoError(t, err)
+
+		dirs := make([]string, 0)
+		for _, project := range configYaml.Projects {
+			dirs = append(dirs, project.Dir)
+		}
+		assert.ElementsMatch(t, []string{"envs/dev", "envs/prod"}, dirs)
+	}
+
+	// digger.yml and digger.yaml once, the second round is served from the cache
+	assert.Equal(t, 2, contentsRequests)
+	assert.Equal(t, 1, treeRequests)
+}
+
+func TestConfigLoaderMissingDiggerYml(t *testing.T) {
+	mockedHTTPClient := mock.NewMockedHTTPClient(
+		mock.WithRequestMatchHandler(
+			mock.GetReposContentsByOwnerByRepoByPath,
+			http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mock.WriteError(w, http.StatusNotFound, "Not Found")
+			}),
+		),
+	)
+	client := github.NewClient(mockedHTTPClient)
+
+	_, err := NewDiggerConfigLoader(10).LoadDiggerYml(client, "diggerhq", "infra", "abc123")
+	assert.ErrorIs(t, err, ErrDiggerConfigNotFound)
+}
+
+func TestConfigLoaderEvictsOldestCommits(t *testing.T) {
+	loader := NewDiggerConfigLoader(2)
+	loader.store("a", "first", nil)
+	loader.store("b", "second", nil)
+	// storing a commit again doesn't count it twice
+	loader.store("b", "second", nil)
+	loader.store("c", "third", nil)
+
+	_, _, ok := loader.cached("a")
+	assert.False(t, ok)
+	for _, key := range []string{"b", "c"} {
+		_, _, ok = loader.cached(key)
+		assert.True(t, ok, key)
+	}
+	assert.Equal(t, []string{"b", "c"}, loader.keys)
+}
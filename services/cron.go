@@ -0,0 +1,148 @@
+package services
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CronSchedule is a parsed five field cron expression: minute, hour, day of month, month and day of week.
+// Fields are bitsets of the values they match.
+type CronSchedule struct {
+	minutes, hours, days, months, weekdays uint64
+	// like cron, a day matches if either day field does when both are restricted
+	daysRestricted, weekdaysRestricted bool
+}
+
+var cronAliases = map[string]string{
+	"@hourly":   "0 * * * *",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@weekly":   "0 0 * * 0",
+	"@monthly":  "0 0 1 * *",
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+}
+
+// ParseCron parses expressions like "0 6 * * 1-5" or "*/30 * * * *" and the @daily style aliases.
+// Lists, ranges and steps are supported, names of months and days are not.
+func ParseCron(expression string) (*CronSchedule, error) {
+	expression = strings.TrimSpace(expression)
+	if alias, ok := cronAliases[expression]; ok {
+		expression = alias
+	}
+	fields := strings.Fields(expression)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron expression %q needs 5 fields, it has %v", expression, len(fields))
+	}
+
+	var schedule CronSchedule
+	var err error
+	bounds := []struct {
+		name     string
+		min, max int
+		field    *uint64
+	}{
+		{"minute", 0, 59, &schedule.minutes},
+		{"hour", 0, 23, &schedule.hours},
+		{"day of month", 1, 31, &schedule.days},
+		{"month", 1, 12, &schedule.months},
+		{"day of week", 0, 7, &schedule.weekdays},
+	}
+	for i, bound := range bounds {
+		*bound.field, err = parseCronField(fields[i], bound.min, bound.max)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %v %q: %v", bound.name, fields[i], err)
+		}
+	}
+	// 7 is another name for sunday
+	if schedule.weekdays&(1<<7) != 0 {
+		schedule.weekdays = schedule.weekdays&^(1<<7) | 1
+	}
+	schedule.daysRestricted = !strings.HasPrefix(fields[2], "*")
+	schedule.weekdaysRestricted = !strings.HasPrefix(fields[4], "*")
+
+	if schedule.Next(time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)).IsZero() {
+		return nil, fmt.Errorf("cron expression %q never matches", expression)
+	}
+	return &schedule, nil
+}
+
+func parseCronField(field string, min int, max int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rangePart, stepPart, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			step, err = strconv.Atoi(stepPart)
+			if err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step %q", stepPart)
+			}
+		}
+
+		start, end := min, max
+		if rangePart != "*" {
+			from, to, isRange := strings.Cut(rangePart, "-")
+			var err error
+			start, err = strconv.Atoi(from)
+			if err != nil {
+				return 0, fmt.Errorf("invalid value %q", from)
+			}
+			end = start
+			if isRange {
+				end, err = strconv.Atoi(to)
+				if err != nil {
+					return 0, fmt.Errorf("invalid value %q", to)
+				}
+			} else if hasStep {
+				// 5/15 means from 5 to the end in steps of 15
+				end = max
+			}
+		}
+		if start < min || end > max || start > end {
+			return 0, fmt.Errorf("%v-%v is outside of %v-%v", start, end, min, max)
+		}
+		for value := start; value <= end; value += step {
+			bits |= 1 << uint(value)
+		}
+	}
+	return bits, nil
+}
+
+// Next returns the first time after the given one the schedule matches, in UTC. It is zero if nothing
+// matches within five years, e.g. for the 30th of February.
+func (s *CronSchedule) Next(after time.Time) time.Time {
+	t := after.UTC().Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		if s.months&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+			continue
+		}
+		if !s.matchesDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, time.UTC)
+			continue
+		}
+		if s.hours&(1<<uint(t.Hour())) == 0 {
+			t = t.Truncate(time.Hour).Add(time.Hour)
+			continue
+		}
+		if s.minutes&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+func (s *CronSchedule) matchesDay(t time.Time) bool {
+	day := s.days&(1<<uint(t.Day())) != 0
+	weekday := s.weekdays&(1<<uint(t.Weekday())) != 0
+	if s.daysRestricted && s.weekdaysRestricted {
+		return day || weekday
+	}
+	return day && weekday
+}
@@ -0,0 +1,37 @@
+package services
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCronNext(t *testing.T) {
+	// a wednesday
+	now := time.Date(2024, 3, 6, 10, 17, 30, 0, time.UTC)
+	for expression, expected := range map[string]time.Time{
+		"*/15 * * * *":  time.Date(2024, 3, 6, 10, 30, 0, 0, time.UTC),
+		"0 6 * * *":     time.Date(2024, 3, 7, 6, 0, 0, 0, time.UTC),
+		"0 6 * * 1-5":   time.Date(2024, 3, 7, 6, 0, 0, 0, time.UTC),
+		"0 6 * * 0":     time.Date(2024, 3, 10, 6, 0, 0, 0, time.UTC),
+		"0 6 * * 7":     time.Date(2024, 3, 10, 6, 0, 0, 0, time.UTC),
+		"30 2 1,15 * *": time.Date(2024, 3, 15, 2, 30, 0, 0, time.UTC),
+		// either day field matches when both are restricted
+		"0 0 1 * 5":     time.Date(2024, 3, 8, 0, 0, 0, 0, time.UTC),
+		"0 0 29 2 *":    time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC),
+		"@monthly":      time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC),
+		"5/20 10 * * *": time.Date(2024, 3, 6, 10, 25, 0, 0, time.UTC),
+	} {
+		schedule, err := ParseCron(expression)
+		assert.NoError(t, err, expression)
+		assert.Equal(t, expected, schedule.Next(now), expression)
+	}
+}
+
+func TestParseCronRefusesInvalidExpressions(t *testing.T) {
+	for _, expression := range []string{"", "* * * *", "60 * * * *", "0 24 * * *", "0 0 0 * *", "*/0 * * * *", "a * * * *", "5-1 * * * *", "0 0 30 2 *"} {
+		_, err := ParseCron(expression)
+		assert.Error(t, err, expression)
+	}
+}
@@ -0,0 +1,316 @@
+package services
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"digger.dev/cloud/models"
+	"github.com/google/uuid"
+)
+
+const (
+	driftSchedulerLease = "drift-scheduler"
+	// the leader renews its lease every interval, replicas take over once it wasn't renewed for the ttl
+	driftSchedulerInterval = 30 * time.Second
+	driftSchedulerLeaseTtl = 2 * time.Minute
+	driftChecksPerInterval = 100
+	// drift alerts are only posted to slack, the policy must not make the server send requests to other hosts
+	slackWebhookHost = "hooks.slack.com"
+)
+
+// DriftAlertPolicy decides which drift is acceptable. It is the JSON document stored as the drift-alert policy of the
+// project, or of the org if the project has none. Without a policy any drift alerts.
+type DriftAlertPolicy struct {
+	// IgnoreAddresses are resource addresses whose drift is acceptable, * matches any characters,
+	// e.g. "aws_autoscaling_group.*" or "module.cache.*"
+	IgnoreAddresses []string `json:"ignore_addresses"`
+	// IgnoreActions are resource actions whose drift is acceptable, e.g. "update"
+	IgnoreActions []string `json:"ignore_actions"`
+	// MaxChanges is how many changes that aren't ignored are accepted without alerting
+	MaxChanges int `json:"max_changes"`
+	// SlackWebhookUrl is sent a message when drift isn't accepted, only https://hooks.slack.com/ urls are allowed
+	SlackWebhookUrl string `json:"slack_webhook_url"`
+
+	ignoreAddressRegexes []*regexp.Regexp
+}
+
+var resourceActions = []string{models.ResourceActionCreate, models.ResourceActionUpdate, models.ResourceActionDelete, models.ResourceActionReplace}
+
+// ParseDriftAlertPolicy parses the text of a drift alert policy, an empty text is the default policy
+func ParseDriftAlertPolicy(text string) (*DriftAlertPolicy, error) {
+	policy := &DriftAlertPolicy{}
+	if strings.TrimSpace(text) != "" {
+		decoder := json.NewDecoder(strings.NewReader(text))
+		decoder.DisallowUnknownFields()
+		err := decoder.Decode(policy)
+		if err != nil {
+			return nil, fmt.Errorf("drift alert policy isn't valid: %v", err)
+		}
+	}
+	if policy.MaxChanges < 0 {
+		return nil, fmt.Errorf("max_changes can't be negative")
+	}
+	for _, action := range policy.IgnoreActions {
+		known := false
+		for _, resourceAction := range resourceActions {
+			known = known || action == resourceAction
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown action %q in ignore_actions, expected one of %v", action, strings.Join(resourceActions, ", "))
+		}
+	}
+	if policy.SlackWebhookUrl != "" && !isSlackWebhookUrl(policy.SlackWebhookUrl) {
+		return nil, fmt.Errorf("slack_webhook_url has to be a https://%v/ url", slackWebhookHost)
+	}
+	for _, pattern := range policy.IgnoreAddresses {
+		quoted := strings.ReplaceAll(regexp.QuoteMeta(pattern), `\*`, ".*")
+		policy.ignoreAddressRegexes = append(policy.ignoreAddressRegexes, regexp.MustCompile("^"+quoted+"$"))
+	}
+	return policy, nil
+}
+
+func isSlackWebhookUrl(webhookUrl string) bool {
+	parsed, err := url.Parse(webhookUrl)
+	if err != nil {
+		return false
+	}
+	return parsed.Scheme == "https" && parsed.User == nil && parsed.Host == slackWebhookHost
+}
+
+func (p *DriftAlertPolicy) ignores(change models.ProjectRunResourceChange) bool {
+	for _, action := range p.IgnoreActions {
+		if change.Action == action {
+			return true
+		}
+	}
+	for _, regex := range p.ignoreAddressRegexes {
+		if regex.MatchString(change.Address) {
+			return true
+		}
+	}
+	return false
+}
+
+// Evaluate decides if the drift of the changes has to alert and explains why
+func (p *DriftAlertPolicy) Evaluate(changes []models.ProjectRunResourceChange) (bool, string) {
+	if len(changes) == 0 {
+		return false, "no drift"
+	}
+	unaccepted := make([]string, 0)
+	for _, change := range changes {
+		if !p.ignores(change) {
+			unaccepted = append(unaccepted, change.Address)
+		}
+	}
+	if len(unaccepted) == 0 {
+		return false, fmt.Sprintf("the drift alert policy ignores all %v changed resources", len(changes))
+	}
+	if len(unaccepted) <= p.MaxChanges {
+		return false, fmt.Sprintf("%v changed resources are within the %v the drift alert policy accepts", len(unaccepted), p.MaxChanges)
+	}
+	if len(unaccepted) > 5 {
+		unaccepted = append(unaccepted[:5], "…")
+	}
+	return true, fmt.Sprintf("the drift alert policy doesn't accept changes of %v", strings.Join(unaccepted, ", "))
+}
+
+// DriftAlertPolicyForProject returns the drift alert policy of the project, or of its org if the project has none
+func DriftAlertPolicyForProject(policies models.PolicyStore, project *models.Project) (*DriftAlertPolicy, error) {
+	policy, err := policies.GetProjectPolicy(project.OrganisationID, project.RepoID, project.ID, models.POLICY_TYPE_DRIFT_ALERT)
+	if err != nil {
+		return nil, err
+	}
+	if policy == nil {
+		policy, err = policies.GetOrgPolicy(project.OrganisationID, models.POLICY_TYPE_DRIFT_ALERT)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if policy == nil {
+		return ParseDriftAlertPolicy("")
+	}
+	return ParseDriftAlertPolicy(policy.Policy)
+}
+
+// DriftJobDispatcher creates and dispatches the plan jobs of drift checks, controllers implement it on top of the VCS
+type DriftJobDispatcher interface {
+	// CreateDriftJob creates a plan-only job for the head of the default branch of the repo of the project
+	CreateDriftJob(project *models.Project) (*models.DiggerJob, error)
+	DispatchDriftJob(project *models.Project, job *models.DiggerJob) error
+}
+
+// StartDriftScheduler starts the drift checks of due schedules in the background. Replicas compete for a lease,
+// only the one holding it starts checks.
+func StartDriftScheduler(stores models.Stores, dispatcher DriftJobDispatcher) {
+	hostname, _ := os.Hostname()
+	holder := hostname + "-" + uuid.NewString()
+	go func() {
+		for {
+			started, err := RunDueDriftChecks(stores, dispatcher, holder, time.Now())
+			if err != nil {
+				log.Printf("failed to run drift checks: %v", err)
+			}
+			if started > 0 {
+				log.Printf("started %v drift checks", started)
+			}
+			time.Sleep(driftSchedulerInterval)
+		}
+	}()
+}
+
+// RunDueDriftChecks starts the checks of the schedules due at now if holder is the leader and returns how many it started
+func RunDueDriftChecks(stores models.Stores, dispatcher DriftJobDispatcher, holder string, now time.Time) (int, error) {
+	leader, err := stores.Leases.AcquireLease(driftSchedulerLease, holder, driftSchedulerLeaseTtl)
+	if err != nil || !leader {
+		return 0, err
+	}
+	schedules, err := stores.Drift.GetDueDriftSchedules(now, driftChecksPerInterval)
+	if err != nil {
+		return 0, err
+	}
+	started := 0
+	for i := range schedules {
+		err := startDriftCheck(stores, dispatcher, &schedules[i], now)
+		if err != nil {
+			log.Printf("drift check of project %v failed to start: %v", schedules[i].ProjectID, err)
+			continue
+		}
+		started++
+	}
+	return started, nil
+}
+
+// startDriftCheck moves the schedule on before dispatching, a check that fails to start is reported and retried
+// at the next scheduled time
+func startDriftCheck(stores models.Stores, dispatcher DriftJobDispatcher, schedule *models.DriftSchedule, now time.Time) error {
+	project := schedule.Project
+	cron, err := ParseCron(schedule.Cron)
+	if err != nil {
+		schedule.Enabled = false
+	} else {
+		schedule.NextRunAt = cron.Next(now)
+	}
+	schedule.LastRunAt = &now
+	saveErr := stores.Drift.SaveDriftSchedule(schedule)
+	if saveErr != nil {
+		return saveErr
+	}
+	if err != nil {
+		return fmt.Errorf("the schedule was disabled: %v", err)
+	}
+	if project == nil {
+		return fmt.Errorf("project %v not found", schedule.ProjectID)
+	}
+
+	report := &models.DriftReport{ProjectID: project.ID, Status: models.DriftReportPending}
+	job, err := dispatcher.CreateDriftJob(project)
+	if err == nil {
+		report.DiggerJobId, report.CommitSha = job.DiggerJobId, job.CommitSha
+		err = stores.Drift.SaveDriftReport(report)
+		if err != nil {
+			return err
+		}
+		err = dispatcher.DispatchDriftJob(project, job)
+	}
+	if err != nil {
+		report.Status, report.Reason, report.CompletedAt = models.DriftReportFailed, err.Error(), &now
+		saveErr := stores.Drift.SaveDriftReport(report)
+		if saveErr != nil {
+			log.Printf("failed to save drift report of project %v: %v", project.ID, saveErr)
+		}
+		return err
+	}
+	return nil
+}
+
+// CompleteDriftReport records the result of a drift check once the run of its job finished. Runs of other
+// jobs are ignored. run needs its resource changes.
+func CompleteDriftReport(stores models.Stores, project *models.Project, run *models.ProjectRun) error {
+	if run.DiggerJobId == "" || run.IsRunning() {
+		return nil
+	}
+	report, err := stores.Drift.GetDriftReportForJob(run.DiggerJobId)
+	if err != nil || report == nil || report.Status != models.DriftReportPending {
+		return err
+	}
+
+	now := time.Now()
+	report.ProjectRunID, report.CompletedAt = &run.ID, &now
+	var policy *DriftAlertPolicy
+	var changes []models.ProjectRunResourceChange
+	status := strings.ToLower(run.Status)
+	switch {
+	case strings.Contains(status, "fail") || status == "error":
+		report.Status, report.Reason = models.DriftReportFailed, "the plan finished with status "+run.Status
+	case !run.HasStructuredPlan:
+		report.Status, report.Reason = models.DriftReportFailed, "the runner didn't report the plan as planJson"
+	default:
+		policy, err = DriftAlertPolicyForProject(stores.Policies, project)
+		if err != nil {
+			report.Status, report.Reason = models.DriftReportFailed, err.Error()
+			break
+		}
+		// data sources are read on every plan, that isn't drift
+		for _, change := range run.ResourceChanges {
+			if change.Action != models.ResourceActionRead {
+				changes = append(changes, change)
+			}
+		}
+		report.ChangeCount = len(changes)
+		report.Status = models.DriftReportNoDrift
+		if len(changes) > 0 {
+			report.Status = models.DriftReportDrifted
+		}
+		report.Alert, report.Reason = policy.Evaluate(changes)
+	}
+
+	err = stores.Drift.SaveDriftReport(report)
+	if err != nil {
+		return err
+	}
+	if report.Alert {
+		log.Printf("drift of project %v needs attention: %v", project.ID, report.Reason)
+		if policy.SlackWebhookUrl != "" {
+			go notifySlackAboutDrift(policy.SlackWebhookUrl, project, report)
+		}
+	}
+	return nil
+}
+
+func notifySlackAboutDrift(webhookUrl string, project *models.Project, report *models.DriftReport) {
+	// policies stored before the url was checked on upsert
+	if !isSlackWebhookUrl(webhookUrl) {
+		log.Printf("not sending drift alert of project %v, the slack webhook url isn't of %v", project.ID, slackWebhookHost)
+		return
+	}
+	name := project.Name
+	if project.Repo != nil {
+		name = project.Repo.Name + "/" + name
+	}
+	body, _ := json.Marshal(map[string]string{
+		"text": fmt.Sprintf(":warning: %v drifted, %v resources changed: %v", name, report.ChangeCount, report.Reason),
+	})
+	client := http.Client{
+		Timeout: 10 * time.Second,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	response, err := client.Post(webhookUrl, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Printf("failed to send drift alert to slack: %v", err)
+		return
+	}
+	response.Body.Close()
+	if response.StatusCode >= 300 {
+		log.Printf("slack refused drift alert with status %v", response.StatusCode)
+	}
+}
@@ -0,0 +1,159 @@
+package services
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"digger.dev/cloud/models"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeDriftDispatcher struct {
+	created    int
+	dispatched []string
+	createErr  error
+}
+
+func (f *fakeDriftDispatcher) CreateDriftJob(project *models.Project) (*models.DiggerJob, error) {
+	if f.createErr != nil {
+		return nil, f.createErr
+	}
+	f.created++
+	return &models.DiggerJob{DiggerJobId: fmt.Sprintf("drift-%v", f.created), CommitSha: "abc123"}, nil
+}
+
+func (f *fakeDriftDispatcher) DispatchDriftJob(project *models.Project, job *models.DiggerJob) error {
+	f.dispatched = append(f.dispatched, job.DiggerJobId)
+	return nil
+}
+
+func setupDriftProject(t *testing.T) (*models.MemoryStore, *models.Project) {
+	store := models.NewMemoryStore()
+	org, err := store.CreateOrganisation("driftOrg", "test", "driftOrg")
+	assert.NoError(t, err)
+	repo, err := store.CreateRepo("infra", org, "")
+	assert.NoError(t, err)
+	project := &models.Project{Name: "prod", OrganisationID: org.ID, RepoID: repo.ID}
+	assert.NoError(t, store.SaveProject(project))
+	return store, project
+}
+
+func TestDriftAlertPolicyDecidesWhenToAlert(t *testing.T) {
+	changes := []models.ProjectRunResourceChange{
+		{Address: "aws_autoscaling_group.web", Action: models.ResourceActionUpdate},
+		{Address: "module.cache.aws_elasticache_cluster.main", Action: models.ResourceActionReplace},
+		{Address: "aws_iam_role.deployer", Action: models.ResourceActionDelete},
+	}
+
+	policy, err := ParseDriftAlertPolicy("")
+	assert.NoError(t, err)
+	alert, reason := policy.Evaluate(changes)
+	assert.True(t, alert)
+	assert.Contains(t, reason, "aws_iam_role.deployer")
+	alert, _ = policy.Evaluate(nil)
+	assert.False(t, alert)
+
+	policy, err = ParseDriftAlertPolicy(`{"ignore_addresses": ["aws_autoscaling_group.*", "module.cache.*"], "ignore_actions": ["delete"]}`)
+	assert.NoError(t, err)
+	alert, reason = policy.Evaluate(changes)
+	assert.False(t, alert)
+	assert.Equal(t, "the drift alert policy ignores all 3 changed resources", reason)
+
+	policy, err = ParseDriftAlertPolicy(`{"max_changes": 2}`)
+	assert.NoError(t, err)
+	alert, _ = policy.Evaluate(changes)
+	assert.True(t, alert)
+	alert, _ = policy.Evaluate(changes[:2])
+	assert.False(t, alert)
+
+	_, err = ParseDriftAlertPolicy(`{"slack_webhook_url": "https://hooks.slack.com/services/T000/B000/XXXX"}`)
+	assert.NoError(t, err)
+
+	for _, invalid := range []string{"package digger", `{"ignore_actions": ["destroy"]}`, `{"max_changes": -1}`, `{"unknown": true}`,
+		`{"slack_webhook_url": "http://hooks.slack.com/services/T000"}`, `{"slack_webhook_url": "https://169.254.169.254/latest/meta-data"}`,
+		`{"slack_webhook_url": "https://hooks.slack.com.example.com/services"}`, `{"slack_webhook_url": "https://hooks.slack.com:8443/services"}`,
+		`{"slack_webhook_url": "https://user@hooks.slack.com/services"}`} {
+		_, err = ParseDriftAlertPolicy(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestDriftChecksRunOnScheduleOnlyOnTheLeader(t *testing.T) {
+	store, project := setupDriftProject(t)
+	stores := store.Stores()
+	now := time.Date(2024, 3, 6, 6, 0, 30, 0, time.UTC)
+	schedule := &models.DriftSchedule{ProjectID: project.ID, Cron: "0 6 * * *", Enabled: true, NextRunAt: now.Add(-30 * time.Second)}
+	assert.NoError(t, stores.Drift.SaveDriftSchedule(schedule))
+
+	dispatcher := &fakeDriftDispatcher{}
+	started, err := RunDueDriftChecks(stores, dispatcher, "replica-1", now)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, started)
+	assert.Equal(t, []string{"drift-1"}, dispatcher.dispatched)
+	stored, err := stores.Drift.GetDriftSchedule(project.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, time.Date(2024, 3, 7, 6, 0, 0, 0, time.UTC), stored.NextRunAt)
+	report, err := stores.Drift.GetDriftReportForJob("drift-1")
+	assert.NoError(t, err)
+	assert.Equal(t, models.DriftReportPending, report.Status)
+	assert.Equal(t, "abc123", report.CommitSha)
+
+	// the check isn't due again, and another replica doesn't get the lease while the leader holds it
+	started, err = RunDueDriftChecks(stores, dispatcher, "replica-1", now.Add(time.Minute))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, started)
+	started, err = RunDueDriftChecks(stores, dispatcher, "replica-2", now.Add(24*time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, started)
+	assert.Equal(t, 1, len(dispatcher.dispatched))
+
+	// a check that can't be created is reported as failed
+	dispatcher.createErr = fmt.Errorf("drift detection is disabled for project prod in digger.yml")
+	started, err = RunDueDriftChecks(stores, dispatcher, "replica-1", now.Add(24*time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, started)
+	report, err = stores.Drift.GetDriftReportForJob("")
+	assert.NoError(t, err)
+	assert.Equal(t, models.DriftReportFailed, report.Status)
+	assert.Contains(t, report.Reason, "disabled")
+}
+
+func TestDriftReportIsCompletedByTheRunOfItsJob(t *testing.T) {
+	store, project := setupDriftProject(t)
+	stores := store.Stores()
+	assert.NoError(t, stores.Drift.SaveDriftReport(&models.DriftReport{ProjectID: project.ID, DiggerJobId: "drift-1", Status: models.DriftReportPending}))
+	assert.NoError(t, stores.Policies.SavePolicy(&models.Policy{OrganisationID: project.OrganisationID, Type: models.POLICY_TYPE_DRIFT_ALERT,
+		Policy: `{"ignore_addresses": ["aws_autoscaling_group.*"]}`}))
+	// drift policies are evaluated by the runner, their text doesn't matter to the report
+	assert.NoError(t, stores.Policies.SavePolicy(&models.Policy{OrganisationID: project.OrganisationID, Type: models.POLICY_TYPE_DRIFT,
+		Policy: `package digger`}))
+
+	// runs of other jobs don't complete the report
+	other := &models.ProjectRun{ProjectID: project.ID, DiggerJobId: "plan-1", Status: "succeeded"}
+	assert.NoError(t, CompleteDriftReport(stores, project, other))
+
+	run := &models.ProjectRun{ProjectID: project.ID, DiggerJobId: "drift-1", Status: "succeeded"}
+	run.SetResourceChanges([]models.ProjectRunResourceChange{
+		{Address: "aws_autoscaling_group.web", Action: models.ResourceActionUpdate},
+		{Address: "data.aws_ami.ubuntu", Action: models.ResourceActionRead},
+		{Address: "aws_security_group.web", Action: models.ResourceActionUpdate},
+	})
+	assert.NoError(t, stores.Runs.CreateProjectRun(run))
+	assert.NoError(t, CompleteDriftReport(stores, project, run))
+
+	report, err := stores.Drift.GetDriftReportForJob("drift-1")
+	assert.NoError(t, err)
+	assert.Equal(t, models.DriftReportDrifted, report.Status)
+	assert.Equal(t, 2, report.ChangeCount)
+	assert.True(t, report.Alert)
+	assert.Contains(t, report.Reason, "aws_security_group.web")
+	assert.Equal(t, run.ID, *report.ProjectRunID)
+
+	// a completed report isn't changed by later runs of the job
+	failed := &models.ProjectRun{ProjectID: project.ID, DiggerJobId: "drift-1", Status: "failed"}
+	assert.NoError(t, CompleteDriftReport(stores, project, failed))
+	report, err = stores.Drift.GetDriftReportForJob("drift-1")
+	assert.NoError(t, err)
+	assert.Equal(t, models.DriftReportDrifted, report.Status)
+}
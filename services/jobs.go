@@ -0,0 +1,88 @@
+package services
+
+import (
+	"encoding/json"
+	"log"
+
+	"digger.dev/cloud/models"
+)
+
+// JobTransitions changes the status of the jobs of an org and records every change in its audit log.
+// Actor is who caused the changes, e.g. github:alice for the applies started by a comment of alice.
+type JobTransitions struct {
+	Stores models.Stores
+	OrgId  uint
+	Actor  string
+}
+
+// Claim moves a created job to triggered, false if it was claimed before
+func (t JobTransitions) Claim(jobId string) (bool, error) {
+	claimed, err := t.Stores.Jobs.ClaimDiggerJob(jobId)
+	if err != nil || !claimed {
+		return claimed, err
+	}
+	t.record(jobId, models.DiggerJobCreated, models.DiggerJobTriggered)
+	return true, nil
+}
+
+// Release puts a claimed job back to created when it couldn't be triggered
+func (t JobTransitions) Release(jobId string) error {
+	err := t.Stores.Jobs.ReleaseDiggerJob(jobId)
+	if err != nil {
+		return err
+	}
+	t.record(jobId, models.DiggerJobTriggered, models.DiggerJobCreated)
+	return nil
+}
+
+// HoldForApproval holds the created job of the request until the apply is approved
+func (t JobTransitions) HoldForApproval(request *models.ApplyApprovalRequest) error {
+	err := t.Stores.Approvals.HoldDiggerJobForApproval(request)
+	if err != nil {
+		return err
+	}
+	t.record(request.DiggerJobId, models.DiggerJobCreated, models.DiggerJobPendingApproval)
+	return nil
+}
+
+// ReleaseApproved moves a held job back to created, false if it wasn't held
+func (t JobTransitions) ReleaseApproved(jobId string) (bool, error) {
+	released, err := t.Stores.Approvals.ReleaseApprovedDiggerJob(jobId)
+	if err != nil || !released {
+		return released, err
+	}
+	t.record(jobId, models.DiggerJobPendingApproval, models.DiggerJobCreated)
+	return true, nil
+}
+
+// CancelHeld fails a held job, false if it wasn't held
+func (t JobTransitions) CancelHeld(jobId string) (bool, error) {
+	cancelled, err := t.Stores.Approvals.CancelHeldDiggerJob(jobId)
+	if err != nil || !cancelled {
+		return cancelled, err
+	}
+	t.record(jobId, models.DiggerJobPendingApproval, models.DiggerJobFailed)
+	return true, nil
+}
+
+// record doesn't fail the transition, the status has already changed
+func (t JobTransitions) record(jobId string, from models.DiggerJobStatus, to models.DiggerJobStatus) {
+	before, _ := json.Marshal(map[string]models.DiggerJobStatus{"status": from})
+	after, _ := json.Marshal(map[string]models.DiggerJobStatus{"status": to})
+	event := &models.AuditEvent{
+		OrganisationID: t.OrgId,
+		Actor:          t.Actor,
+		Action:         models.AuditActionJobStatusUpdated,
+		TargetType:     "job",
+		TargetId:       jobId,
+		Before:         string(before),
+		After:          string(after),
+	}
+	if event.Actor == "" {
+		event.Actor = "unknown"
+	}
+	err := t.Stores.Audit.CreateAuditEvent(event)
+	if err != nil {
+		log.Printf("failed to record status change of job %v: %v", jobId, err)
+	}
+}
@@ -0,0 +1,177 @@
+package services
+
+import (
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+const defaultJwksCacheTTL = 1 * time.Hour
+
+// keys are refetched at most this often when a token with unknown kid shows up, so we don't hammer the provider
+const defaultJwksMinRefreshInterval = 1 * time.Minute
+
+// KeySource returns a public key used to verify signature of the token with specified kid
+type KeySource interface {
+	GetKey(kid string) (*rsa.PublicKey, error)
+}
+
+// StaticKeySource always returns the same key regardless of kid, it is used with JWT_PUBLIC_KEY
+type StaticKeySource struct {
+	Key *rsa.PublicKey
+}
+
+func (s *StaticKeySource) GetKey(kid string) (*rsa.PublicKey, error) {
+	return s.Key, nil
+}
+
+// JwksKeySet fetches RSA signing keys from a JWKS endpoint and caches them in memory.
+// Keys are refreshed once the cache expires or when a key with unknown kid is requested, which handles key rotation.
+// Concurrent requests share a single fetch and the last fetched keys are kept while the endpoint fails.
+type JwksKeySet struct {
+	Url                string
+	HttpClient         *http.Client
+	CacheTTL           time.Duration
+	MinRefreshInterval time.Duration
+	mutex              sync.Mutex
+	keys               map[string]*rsa.PublicKey
+	fetchedAt          time.Time
+	attemptedAt        time.Time
+	fetches            singleflight.Group
+}
+
+type jsonWebKey struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+type jsonWebKeySet struct {
+	Keys []jsonWebKey `json:"keys"`
+}
+
+func NewJwksKeySet(url string) *JwksKeySet {
+	return &JwksKeySet{
+		Url:                url,
+		HttpClient:         &http.Client{Timeout: 10 * time.Second},
+		CacheTTL:           defaultJwksCacheTTL,
+		MinRefreshInterval: defaultJwksMinRefreshInterval,
+	}
+}
+
+// GetKey returns the public key with the specified kid, keys are fetched again once the cache is expired
+// or if kid isn't known yet (the provider might have rotated its keys). If fetching fails the cached keys are
+// still served, failed fetches are retried at most every MinRefreshInterval.
+func (k *JwksKeySet) GetKey(kid string) (*rsa.PublicKey, error) {
+	key, ok, refresh := k.cachedKey(kid)
+	if refresh {
+		if ok {
+			log.Printf("cached keys of %v expired, refreshing\n", k.Url)
+		} else {
+			log.Printf("kid %v not found in cached keys, refreshing %v\n", kid, k.Url)
+		}
+		_, err, _ := k.fetches.Do("", func() (interface{}, error) {
+			return nil, k.refresh()
+		})
+		if err != nil && !ok {
+			return nil, err
+		}
+		if err != nil {
+			log.Printf("serving cached key %v of %v after failed refresh: %v\n", kid, k.Url, err)
+		}
+		key, ok, _ = k.cachedKey(kid)
+	}
+	if !ok {
+		return nil, fmt.Errorf("no key found for kid %v in %v", kid, k.Url)
+	}
+	return key, nil
+}
+
+// cachedKey looks up the kid in the cached keys and tells whether they should be fetched again
+func (k *JwksKeySet) cachedKey(kid string) (*rsa.PublicKey, bool, bool) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	key, ok := k.keys[kid]
+	if k.keys == nil {
+		return nil, false, true
+	}
+	stale := !ok || time.Since(k.fetchedAt) > k.CacheTTL
+	return key, ok, stale && time.Since(k.attemptedAt) > k.MinRefreshInterval
+}
+
+// refresh fetches the keys, the cached keys are only replaced by a successful fetch
+func (k *JwksKeySet) refresh() error {
+	k.mutex.Lock()
+	k.attemptedAt = time.Now()
+	k.mutex.Unlock()
+
+	keys, err := k.fetchKeys()
+	if err != nil {
+		log.Printf("error while fetching jwks from %v: %v\n", k.Url, err)
+		return err
+	}
+
+	k.mutex.Lock()
+	k.keys = keys
+	k.fetchedAt = time.Now()
+	k.mutex.Unlock()
+	log.Printf("fetched %d keys from %v\n", len(keys), k.Url)
+	return nil
+}
+
+func (k *JwksKeySet) fetchKeys() (map[string]*rsa.PublicKey, error) {
+	resp, err := k.HttpClient.Get(k.Url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code %v while fetching jwks from %v", resp.StatusCode, k.Url)
+	}
+
+	var keySet jsonWebKeySet
+	if err := json.NewDecoder(resp.Body).Decode(&keySet); err != nil {
+		return nil, fmt.Errorf("error while decoding jwks: %v", err)
+	}
+
+	keys := make(map[string]*rsa.PublicKey)
+	for _, jwk := range keySet.Keys {
+		if jwk.Kty != "RSA" || (jwk.Use != "" && jwk.Use != "sig") {
+			continue
+		}
+		key, err := parseRSAJsonWebKey(jwk)
+		if err != nil {
+			log.Printf("skipping jwk with kid %v: %v\n", jwk.Kid, err)
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+	return keys, nil
+}
+
+func parseRSAJsonWebKey(jwk jsonWebKey) (*rsa.PublicKey, error) {
+	n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+	if err != nil {
+		return nil, fmt.Errorf("invalid modulus: %v", err)
+	}
+	e, err := base64.RawURLEncoding.DecodeString(jwk.E)
+	if err != nil {
+		return nil, fmt.Errorf("invalid exponent: %v", err)
+	}
+	return &rsa.PublicKey{
+		N: new(big.Int).SetBytes(n),
+		E: int(new(big.Int).SetBytes(e).Int64()),
+	}, nil
+}
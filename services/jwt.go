@@ -0,0 +1,116 @@
+package services
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// JwtVerifier verifies signature of RS* tokens and checks that issuer and audience are one of the allowed values.
+// Empty Issuers or Audiences means the corresponding claim isn't checked.
+type JwtVerifier struct {
+	KeySource KeySource
+	Issuers   []string
+	Audiences []string
+}
+
+// Verify parses the token, checks its signature and standard claims and returns token claims
+func (v *JwtVerifier) Verify(tokenString string) (jwt.MapClaims, error) {
+	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		kid, _ := token.Header["kid"].(string)
+		return v.KeySource.GetKey(kid)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid {
+		return nil, fmt.Errorf("token is invalid")
+	}
+
+	if len(v.Issuers) > 0 {
+		issuerMatch := false
+		for _, issuer := range v.Issuers {
+			if claims.VerifyIssuer(issuer, true) {
+				issuerMatch = true
+				break
+			}
+		}
+		if !issuerMatch {
+			return nil, fmt.Errorf("unexpected token issuer: %v", claims["iss"])
+		}
+	}
+
+	if len(v.Audiences) > 0 {
+		audienceMatch := false
+		for _, audience := range v.Audiences {
+			if claims.VerifyAudience(audience, true) {
+				audienceMatch = true
+				break
+			}
+		}
+		if !audienceMatch {
+			return nil, fmt.Errorf("unexpected token audience: %v", claims["aud"])
+		}
+	}
+
+	return claims, nil
+}
+
+var jwtVerifier *JwtVerifier
+var jwtVerifierErr error
+var jwtVerifierOnce sync.Once
+
+// GetJwtVerifier returns verifier shared by all the places where user tokens are checked.
+// It is configured with JWT_JWKS_URL, JWT_ISSUERS and JWT_AUDIENCES (comma separated),
+// JWT_PUBLIC_KEY is still supported for a single static key.
+func GetJwtVerifier() (*JwtVerifier, error) {
+	jwtVerifierOnce.Do(func() {
+		jwtVerifier, jwtVerifierErr = NewJwtVerifierFromEnv()
+		if jwtVerifierErr != nil {
+			log.Printf("Failed to configure JWT verifier: %v", jwtVerifierErr)
+		}
+	})
+	return jwtVerifier, jwtVerifierErr
+}
+
+func NewJwtVerifierFromEnv() (*JwtVerifier, error) {
+	var keySource KeySource
+	if jwksUrl := os.Getenv("JWT_JWKS_URL"); jwksUrl != "" {
+		log.Printf("Using JWKS from %v to verify tokens", jwksUrl)
+		keySource = NewJwksKeySet(jwksUrl)
+	} else if jwtPublicKey := os.Getenv("JWT_PUBLIC_KEY"); jwtPublicKey != "" {
+		publicKey, err := jwt.ParseRSAPublicKeyFromPEM([]byte(jwtPublicKey))
+		if err != nil {
+			return nil, fmt.Errorf("error while parsing public key: %v", err)
+		}
+		keySource = &StaticKeySource{Key: publicKey}
+	} else {
+		return nil, fmt.Errorf("neither JWT_JWKS_URL nor JWT_PUBLIC_KEY environment variable provided")
+	}
+
+	return &JwtVerifier{
+		KeySource: keySource,
+		Issuers:   splitEnvList(os.Getenv("JWT_ISSUERS")),
+		Audiences: splitEnvList(os.Getenv("JWT_AUDIENCES")),
+	}, nil
+}
+
+func splitEnvList(value string) []string {
+	result := make([]string, 0)
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			result = append(result, item)
+		}
+	}
+	return result
+}
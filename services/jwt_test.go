@@ -0,0 +1,145 @@
+package services
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/stretchr/testify/assert"
+)
+
+type rotatingJwks struct {
+	kid string
+	key *rsa.PrivateKey
+}
+
+func (j *rotatingJwks) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"keys": []map[string]string{{
+			"kid": j.kid,
+			"kty": "RSA",
+			"n":   base64.RawURLEncoding.EncodeToString(j.key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(j.key.E)).Bytes()),
+		}},
+	})
+}
+
+func signToken(t *testing.T, key *rsa.PrivateKey, kid string, claims jwt.MapClaims) string {
+	claims["exp"] = time.Now().Add(time.Minute).Unix()
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = kid
+	signed, err := token.SignedString(key)
+	assert.NoError(t, err)
+	return signed
+}
+
+func TestJwtVerifierRefreshesKeysOnUnknownKid(t *testing.T) {
+	key1, _ := rsa.GenerateKey(rand.Reader, 2048)
+	key2, _ := rsa.GenerateKey(rand.Reader, 2048)
+	jwks := &rotatingJwks{kid: "key-1", key: key1}
+	server := httptest.NewServer(jwks)
+	defer server.Close()
+
+	keySet := NewJwksKeySet(server.URL)
+	keySet.MinRefreshInterval = 0
+	verifier := JwtVerifier{KeySource: keySet}
+
+	_, err := verifier.Verify(signToken(t, key1, "key-1", jwt.MapClaims{}))
+	assert.NoError(t, err)
+
+	// provider rotates its keys, new kid should be picked up without restart
+	jwks.kid = "key-2"
+	jwks.key = key2
+	_, err = verifier.Verify(signToken(t, key2, "key-2", jwt.MapClaims{}))
+	assert.NoError(t, err)
+
+	_, err = verifier.Verify(signToken(t, key1, "key-1", jwt.MapClaims{}))
+	assert.Error(t, err)
+}
+
+func TestJwtVerifierChecksIssuersAndAudiences(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	verifier := JwtVerifier{
+		KeySource: &StaticKeySource{Key: &key.PublicKey},
+		Issuers:   []string{"https://issuer-a", "https://issuer-b"},
+		Audiences: []string{"digger"},
+	}
+
+	_, err := verifier.Verify(signToken(t, key, "", jwt.MapClaims{"iss": "https://issuer-b", "aud": []string{"other", "digger"}}))
+	assert.NoError(t, err)
+
+	_, err = verifier.Verify(signToken(t, key, "", jwt.MapClaims{"iss": "https://issuer-c", "aud": "digger"}))
+	assert.Error(t, err)
+
+	_, err = verifier.Verify(signToken(t, key, "", jwt.MapClaims{"iss": "https://issuer-a", "aud": "other"}))
+	assert.Error(t, err)
+}
+
+type flakyJwks struct {
+	rotatingJwks
+	mutex    sync.Mutex
+	requests int
+	failing  bool
+	release  chan struct{}
+}
+
+func (j *flakyJwks) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if j.release != nil {
+		<-j.release
+	}
+	j.mutex.Lock()
+	j.requests++
+	failing := j.failing
+	j.mutex.Unlock()
+	if failing {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	j.rotatingJwks.ServeHTTP(w, r)
+}
+
+func TestJwksKeySetSharesFetchesAndKeepsKeysWhenRefreshFails(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	jwks := &flakyJwks{rotatingJwks: rotatingJwks{kid: "key-1", key: key}, release: make(chan struct{})}
+	server := httptest.NewServer(jwks)
+	defer server.Close()
+	keySet := NewJwksKeySet(server.URL)
+
+	// concurrent requests wait for the same fetch
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := keySet.GetKey("key-1")
+			assert.NoError(t, err)
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(jwks.release)
+	wg.Wait()
+	assert.Equal(t, 1, jwks.requests)
+
+	// expired keys are still served while the provider fails, the failed fetch isn't retried right away
+	keySet.CacheTTL = 0
+	keySet.MinRefreshInterval = 0
+	jwks.failing = true
+	publicKey, err := keySet.GetKey("key-1")
+	assert.NoError(t, err)
+	assert.Equal(t, &key.PublicKey, publicKey)
+	keySet.MinRefreshInterval = time.Hour
+	_, err = keySet.GetKey("key-1")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, jwks.requests)
+
+	_, err = keySet.GetKey("key-2")
+	assert.Error(t, err)
+}
@@ -0,0 +1,267 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"digger.dev/cloud/models"
+	"github.com/golang-jwt/jwt"
+	"golang.org/x/oauth2"
+)
+
+// OidcProvider holds configuration of a generic OpenID Connect provider (Okta, Keycloak, Dex, ...) used for web UI login.
+// Endpoints are taken from the provider's discovery document.
+type OidcProvider struct {
+	Issuer                string
+	ClientId              string
+	ClientSecret          string
+	RedirectUrl           string
+	Scopes                []string
+	AuthorizationEndpoint string
+	TokenEndpoint         string
+	JwksUri               string
+	// OrgClaim is the name of the claim which value is matched against Organisation.ExternalId
+	OrgClaim string
+	// RolesClaim is the name of the claim with the list of user's roles (or groups)
+	RolesClaim string
+	// AdminRoles are roles which make a new member org admin, all other new members get DefaultRole
+	AdminRoles  []string
+	DefaultRole models.Role
+	Verifier    *JwtVerifier
+}
+
+type oidcDiscoveryDocument struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JwksUri               string `json:"jwks_uri"`
+}
+
+// DiscoverOidcProvider fetches discovery document of the issuer and fills in provider endpoints
+func DiscoverOidcProvider(provider *OidcProvider, httpClient *http.Client) error {
+	discoveryUrl := strings.TrimSuffix(provider.Issuer, "/") + "/.well-known/openid-configuration"
+	resp, err := httpClient.Get(discoveryUrl)
+	if err != nil {
+		log.Printf("error while fetching oidc discovery document from %v: %v\n", discoveryUrl, err)
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code %v while fetching %v", resp.StatusCode, discoveryUrl)
+	}
+
+	var document oidcDiscoveryDocument
+	if err := json.NewDecoder(resp.Body).Decode(&document); err != nil {
+		return fmt.Errorf("error while decoding oidc discovery document: %v", err)
+	}
+	if document.Issuer != provider.Issuer {
+		return fmt.Errorf("issuer in discovery document %v doesn't match configured issuer %v", document.Issuer, provider.Issuer)
+	}
+	if document.AuthorizationEndpoint == "" || document.TokenEndpoint == "" || document.JwksUri == "" {
+		return fmt.Errorf("discovery document of %v is missing required endpoints", provider.Issuer)
+	}
+
+	provider.AuthorizationEndpoint = document.AuthorizationEndpoint
+	provider.TokenEndpoint = document.TokenEndpoint
+	provider.JwksUri = document.JwksUri
+	provider.Verifier = &JwtVerifier{
+		KeySource: NewJwksKeySet(document.JwksUri),
+		Issuers:   []string{provider.Issuer},
+		Audiences: []string{provider.ClientId},
+	}
+	return nil
+}
+
+func (p *OidcProvider) OAuth2Config() *oauth2.Config {
+	return &oauth2.Config{
+		ClientID:     p.ClientId,
+		ClientSecret: p.ClientSecret,
+		RedirectURL:  p.RedirectUrl,
+		Scopes:       p.Scopes,
+		Endpoint: oauth2.Endpoint{
+			AuthURL:  p.AuthorizationEndpoint,
+			TokenURL: p.TokenEndpoint,
+		},
+	}
+}
+
+// GetOrganisation maps the organisation claim of the id token to the digger organisation
+func (p *OidcProvider) GetOrganisation(orgs models.OrgStore, claims jwt.MapClaims) (*models.Organisation, error) {
+	orgValue, ok := claims[p.OrgClaim].(string)
+	if !ok || orgValue == "" {
+		// some providers send organisation as a list of groups, first one is used
+		if values := claimStrings(claims[p.OrgClaim]); len(values) > 0 {
+			orgValue = values[0]
+		}
+	}
+	if orgValue == "" {
+		return nil, fmt.Errorf("claim %v is missing in the id token", p.OrgClaim)
+	}
+
+	org, err := orgs.GetOrganisation(orgValue)
+	if err != nil {
+		return nil, err
+	}
+	if org == nil {
+		return nil, fmt.Errorf("no organisation found for %v", orgValue)
+	}
+	return org, nil
+}
+
+// GetRole maps roles claim of the id token to the role of the user in organisation
+func (p *OidcProvider) GetRole(claims jwt.MapClaims) models.Role {
+	for _, role := range claimStrings(claims[p.RolesClaim]) {
+		for _, adminRole := range p.AdminRoles {
+			if role == adminRole {
+				return models.RoleOrgAdmin
+			}
+		}
+	}
+	return p.DefaultRole
+}
+
+// GetMember finds the user of the id token and its membership in organisation. Users are matched by subject and then
+// by verified email so invited users are linked on first login, users linked to another subject are never relinked.
+// Users logging in for the first time become members with the role from the claims, role of existing members is
+// managed in digger.
+func (p *OidcProvider) GetMember(members models.MemberStore, org *models.Organisation, claims jwt.MapClaims) (*models.User, *models.OrgMembership, error) {
+	subject, _ := claims["sub"].(string)
+	if subject == "" {
+		return nil, nil, fmt.Errorf("sub claim is missing in the id token")
+	}
+	email, _ := claims["email"].(string)
+
+	user, err := members.GetUserByExternalId(subject)
+	if err != nil {
+		return nil, nil, err
+	}
+	if user == nil && email != "" {
+		user, err = members.GetUserByEmail(email)
+		if err != nil {
+			return nil, nil, err
+		}
+		if user != nil {
+			// anybody can claim an address the provider hasn't verified
+			if emailVerified, _ := claims["email_verified"].(bool); !emailVerified {
+				return nil, nil, fmt.Errorf("email %v isn't verified, it can't be linked to the existing user", email)
+			}
+			if user.ExternalId != "" {
+				return nil, nil, fmt.Errorf("user with email %v is linked to another identity", email)
+			}
+			user.ExternalId = subject
+			err = members.UpdateUser(user)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	if user == nil {
+		username := email
+		if username == "" {
+			username = subject
+		}
+		user, err = members.CreateUser(username, email, subject)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	membership, err := members.GetOrgMembership(org.ID, user.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if membership == nil {
+		membership, err = members.UpsertOrgMembership(org.ID, user, p.GetRole(claims), models.MembershipActive)
+	} else if membership.Status != models.MembershipActive {
+		membership, err = members.UpsertOrgMembership(org.ID, user, membership.Role, models.MembershipActive)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return user, membership, nil
+}
+
+func claimStrings(claim interface{}) []string {
+	result := make([]string, 0)
+	switch value := claim.(type) {
+	case string:
+		result = append(result, strings.Fields(value)...)
+	case []interface{}:
+		for _, item := range value {
+			if s, ok := item.(string); ok {
+				result = append(result, s)
+			}
+		}
+	}
+	return result
+}
+
+var oidcProvider *OidcProvider
+var oidcProviderLock sync.Mutex
+
+// GetOidcProvider returns provider configured with OIDC_* environment variables, discovery is done on first use and
+// retried on later calls until it succeeds
+func GetOidcProvider(secrets models.SecretStore) (*OidcProvider, error) {
+	oidcProviderLock.Lock()
+	defer oidcProviderLock.Unlock()
+	if oidcProvider != nil {
+		return oidcProvider, nil
+	}
+	provider, err := NewOidcProviderFromEnv(secrets)
+	if err != nil {
+		log.Printf("Failed to configure OIDC provider: %v", err)
+		return nil, err
+	}
+	oidcProvider = provider
+	return oidcProvider, nil
+}
+
+// NewOidcProviderFromEnv configures the provider with OIDC_* environment variables, the client secret is read from the
+// oidc_client_secret secret if it is stored
+func NewOidcProviderFromEnv(secrets models.SecretStore) (*OidcProvider, error) {
+	clientSecret, err := secrets.GetSecretOrEnv("oidc_client_secret", "OIDC_CLIENT_SECRET")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read OIDC client secret: %v", err)
+	}
+	provider := &OidcProvider{
+		Issuer:       os.Getenv("OIDC_ISSUER_URL"),
+		ClientId:     os.Getenv("OIDC_CLIENT_ID"),
+		ClientSecret: clientSecret,
+		RedirectUrl:  os.Getenv("OIDC_REDIRECT_URL"),
+		Scopes:       splitEnvList(os.Getenv("OIDC_SCOPES")),
+		OrgClaim:     os.Getenv("OIDC_ORG_CLAIM"),
+		RolesClaim:   os.Getenv("OIDC_ROLES_CLAIM"),
+		AdminRoles:   splitEnvList(os.Getenv("OIDC_ADMIN_ROLES")),
+		DefaultRole:  models.Role(os.Getenv("OIDC_DEFAULT_ROLE")),
+	}
+	if provider.Issuer == "" || provider.ClientId == "" || provider.RedirectUrl == "" {
+		return nil, fmt.Errorf("OIDC_ISSUER_URL, OIDC_CLIENT_ID and OIDC_REDIRECT_URL have to be provided")
+	}
+	if len(provider.Scopes) == 0 {
+		provider.Scopes = []string{"openid", "profile", "email"}
+	}
+	if provider.OrgClaim == "" {
+		provider.OrgClaim = "org"
+	}
+	if provider.RolesClaim == "" {
+		provider.RolesClaim = "roles"
+	}
+	if provider.DefaultRole == "" {
+		provider.DefaultRole = models.RoleViewer
+	} else if !models.IsValidRole(string(provider.DefaultRole)) {
+		return nil, fmt.Errorf("OIDC_DEFAULT_ROLE %v is not a valid role", provider.DefaultRole)
+	}
+
+	err = DiscoverOidcProvider(provider, &http.Client{Timeout: 10 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	return provider, nil
+}
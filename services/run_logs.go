@@ -0,0 +1,182 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"digger.dev/cloud/models"
+	"github.com/dchest/uniuri"
+)
+
+// MaxRunLogChunkBytes limits a single append, runners upload long logs in several chunks
+const MaxRunLogChunkBytes = 8 * 1024 * 1024
+
+// AppendRunLog stores content as the chunk of the run log starting at offset and returns the new size of the log.
+// If offset isn't the current size, e.g. because a retried upload already went through, it returns
+// models.ErrRunLogOffsetMismatch and the current size.
+func AppendRunLog(store models.RunLogStore, blobs BlobStore, runId uint, offset int64, content io.Reader) (int64, error) {
+	// every upload gets its own key, so one of two concurrent appends at the same offset can't overwrite the other
+	key := fmt.Sprintf("logs/%v/%016d-%v", runId, offset, uniuri.New())
+	size, err := blobs.Put(key, content)
+	if err != nil {
+		return 0, err
+	}
+
+	chunk := models.RunLogChunk{ProjectRunID: runId, StartOffset: offset, Size: size, BlobKey: key}
+	logSize, err := store.AppendRunLogChunk(&chunk)
+	if err != nil {
+		deleteErr := blobs.Delete(key)
+		if deleteErr != nil {
+			log.Printf("failed to delete log chunk %v which wasn't appended: %v", key, deleteErr)
+		}
+		return logSize, err
+	}
+	return logSize, nil
+}
+
+// OpenRunLog reads length bytes of the log of run from offset on, everything after offset if length is negative.
+// Runs reported before logs were chunked are read from their Output.
+func OpenRunLog(store models.RunLogStore, blobs BlobStore, run *models.ProjectRun, offset int64, length int64) (io.ReadCloser, error) {
+	if run.LogSize == 0 && run.Output != "" {
+		output := run.Output
+		if offset > int64(len(output)) {
+			offset = int64(len(output))
+		}
+		output = output[offset:]
+		if length >= 0 && length < int64(len(output)) {
+			output = output[:length]
+		}
+		return io.NopCloser(strings.NewReader(output)), nil
+	}
+
+	chunks, err := store.GetRunLogChunks(run.ID)
+	if err != nil {
+		return nil, err
+	}
+	return &runLogReader{blobs: blobs, chunks: chunks, offset: offset, remaining: length}, nil
+}
+
+// runLogReader opens the chunks one after another while they are read
+type runLogReader struct {
+	blobs     BlobStore
+	chunks    []models.RunLogChunk
+	offset    int64
+	remaining int64
+	current   io.ReadCloser
+}
+
+func (r *runLogReader) Read(p []byte) (int, error) {
+	for {
+		if r.remaining == 0 {
+			return 0, io.EOF
+		}
+		if r.current == nil {
+			err := r.openNext()
+			if err != nil {
+				return 0, err
+			}
+		}
+		if r.remaining > 0 && int64(len(p)) > r.remaining {
+			p = p[:r.remaining]
+		}
+		n, err := r.current.Read(p)
+		r.offset += int64(n)
+		if r.remaining > 0 {
+			r.remaining -= int64(n)
+		}
+		if err == io.EOF {
+			r.current.Close()
+			r.current = nil
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+func (r *runLogReader) openNext() error {
+	for len(r.chunks) > 0 {
+		chunk := r.chunks[0]
+		r.chunks = r.chunks[1:]
+		end := chunk.StartOffset + chunk.Size
+		if end <= r.offset {
+			continue
+		}
+		content, err := r.blobs.GetRange(chunk.BlobKey, r.offset-chunk.StartOffset, -1)
+		if err != nil {
+			return fmt.Errorf("failed to read log chunk %v: %v", chunk.BlobKey, err)
+		}
+		r.current = content
+		return nil
+	}
+	return io.EOF
+}
+
+func (r *runLogReader) Close() error {
+	if r.current != nil {
+		return r.current.Close()
+	}
+	return nil
+}
+
+// ExpireRunLogs removes the logs of runs created before the retention period and returns how many were removed
+func ExpireRunLogs(store models.RunLogStore, blobs BlobStore, retention time.Duration) (int, error) {
+	runs, err := store.GetRunsWithLogsBefore(time.Now().Add(-retention), 100)
+	if err != nil {
+		return 0, err
+	}
+	for i, run := range runs {
+		chunks, err := store.GetRunLogChunks(run.ID)
+		if err != nil {
+			return i, err
+		}
+		for _, chunk := range chunks {
+			err := blobs.Delete(chunk.BlobKey)
+			if err != nil && !errors.Is(err, ErrBlobNotFound) {
+				return i, fmt.Errorf("failed to delete log chunk %v: %v", chunk.BlobKey, err)
+			}
+		}
+		err = store.ExpireRunLog(run.ID)
+		if err != nil {
+			return i, err
+		}
+	}
+	return len(runs), nil
+}
+
+// StartRunLogRetention removes logs older than DIGGER_RUN_LOG_RETENTION_DAYS every hour, logs are kept forever
+// if it isn't set
+func StartRunLogRetention(store models.RunLogStore, blobs BlobStore) {
+	days, err := strconv.Atoi(os.Getenv("DIGGER_RUN_LOG_RETENTION_DAYS"))
+	if err != nil || days <= 0 {
+		return
+	}
+	retention := time.Duration(days) * 24 * time.Hour
+	go func() {
+		for {
+			for {
+				expired, err := ExpireRunLogs(store, blobs, retention)
+				if err != nil {
+					log.Printf("failed to expire run logs: %v", err)
+					break
+				}
+				if expired > 0 {
+					log.Printf("expired the logs of %v runs", expired)
+				}
+				// a full page means there might be more
+				if expired < 100 {
+					break
+				}
+			}
+			time.Sleep(time.Hour)
+		}
+	}()
+}
@@ -0,0 +1,79 @@
+package services
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"digger.dev/cloud/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func readRunLog(t *testing.T, store models.RunLogStore, blobs BlobStore, run *models.ProjectRun, offset int64, length int64) string {
+	content, err := OpenRunLog(store, blobs, run, offset, length)
+	assert.NoError(t, err)
+	defer content.Close()
+	data, err := io.ReadAll(content)
+	assert.NoError(t, err)
+	return string(data)
+}
+
+func TestRunLogIsAppendedInChunksAndReadInRanges(t *testing.T) {
+	store := models.NewMemoryStore()
+	blobs, err := NewFilesystemBlobStore(t.TempDir())
+	assert.NoError(t, err)
+	run := models.ProjectRun{ProjectID: 1}
+	assert.NoError(t, store.CreateProjectRun(&run))
+
+	size, err := AppendRunLog(store, blobs, run.ID, 0, strings.NewReader("Initializing...\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(16), size)
+
+	// a retried upload of the first chunk
+	size, err = AppendRunLog(store, blobs, run.ID, 0, strings.NewReader("Initializing...\n"))
+	assert.ErrorIs(t, err, models.ErrRunLogOffsetMismatch)
+	assert.Equal(t, int64(16), size)
+
+	size, err = AppendRunLog(store, blobs, run.ID, 16, strings.NewReader("Plan: 1 to add\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(31), size)
+
+	stored, err := store.GetProjectRun(run.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(31), stored.LogSize)
+	assert.Equal(t, "Initializing...\nPlan: 1 to add\n", readRunLog(t, store, blobs, stored, 0, -1))
+	// spans both chunks
+	assert.Equal(t, "...\nPlan", readRunLog(t, store, blobs, stored, 12, 8))
+	assert.Equal(t, "to add\n", readRunLog(t, store, blobs, stored, 24, -1))
+
+	legacy := models.ProjectRun{Output: "legacy output"}
+	assert.Equal(t, "output", readRunLog(t, store, blobs, &legacy, 7, -1))
+}
+
+func TestExpireRunLogs(t *testing.T) {
+	store := models.NewMemoryStore()
+	blobs, err := NewFilesystemBlobStore(t.TempDir())
+	assert.NoError(t, err)
+	run := models.ProjectRun{ProjectID: 1}
+	assert.NoError(t, store.CreateProjectRun(&run))
+	_, err = AppendRunLog(store, blobs, run.ID, 0, strings.NewReader("output"))
+	assert.NoError(t, err)
+	chunks, _ := store.GetRunLogChunks(run.ID)
+	blobKey := chunks[0].BlobKey
+
+	expired, err := ExpireRunLogs(store, blobs, time.Hour)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, expired)
+
+	expired, err = ExpireRunLogs(store, blobs, -time.Hour)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, expired)
+
+	stored, _ := store.GetProjectRun(run.ID)
+	assert.True(t, stored.LogExpired)
+	chunks, _ = store.GetRunLogChunks(run.ID)
+	assert.Empty(t, chunks)
+	_, err = blobs.Get(blobKey)
+	assert.ErrorIs(t, err, ErrBlobNotFound)
+}
@@ -0,0 +1,43 @@
+package services
+
+import (
+	"io"
+	"strings"
+
+	"digger.dev/cloud/models"
+)
+
+// MaxRunSearchContentBytes limits how much of a log is searchable, errors and plans are usually at its start
+const MaxRunSearchContentBytes = 1024 * 1024
+
+// IndexRunForSearch stores the searchable text of the run, the start of its log without colors and the
+// addresses of the resources its plan changes. run needs its project and resource changes.
+func IndexRunForSearch(search models.RunSearchStore, logs models.RunLogStore, blobs BlobStore, run *models.ProjectRun) error {
+	content := ""
+	if !run.LogExpired {
+		log, err := OpenRunLog(logs, blobs, run, 0, MaxRunSearchContentBytes)
+		if err != nil {
+			return err
+		}
+		defer log.Close()
+		data, err := io.ReadAll(log)
+		if err != nil {
+			return err
+		}
+		// postgres text can't hold NUL bytes, and the limit can cut a character in half
+		content = models.SearchableText(strings.ReplaceAll(strings.ToValidUTF8(string(data), ""), "\x00", ""))
+	}
+
+	addresses := make([]string, 0, len(run.ResourceChanges))
+	for _, change := range run.ResourceChanges {
+		addresses = append(addresses, change.Address)
+	}
+
+	document := models.RunSearchDocument{
+		ProjectRunID:      run.ID,
+		OrganisationID:    run.Project.OrganisationID,
+		Content:           content,
+		ResourceAddresses: strings.Join(addresses, "\n"),
+	}
+	return search.SaveRunSearchDocument(&document)
+}
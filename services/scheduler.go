@@ -7,60 +7,76 @@ import (
 	"log"
 )
 
-func DiggerJobCompleted(client *github.Client, parentJob *models.DiggerJob, repoOwner string, repoName string, workflowFileName string) error {
+func DiggerJobCompleted(jobs JobTransitions, client *github.Client, parentJob *models.DiggerJob, repoOwner string, repoName string, workflowFileName string) error {
 	log.Printf("DiggerJobCompleted parentJobId: %v", parentJob.DiggerJobId)
 
-	jobLinksForParent, err := models.DB.GetDiggerJobParentLinksByParentId(&parentJob.DiggerJobId)
+	jobLinksForParent, err := jobs.Stores.Jobs.GetDiggerJobParentLinksByParentId(&parentJob.DiggerJobId)
 	if err != nil {
 		return err
 	}
 
 	for _, jobLink := range jobLinksForParent {
-		jobLinksForChild, err := models.DB.GetDiggerJobParentLinksChildId(&jobLink.DiggerJobId)
+		allParentJobsAreComplete, err := ParentDiggerJobsSucceeded(jobs.Stores.Jobs, jobLink.DiggerJobId)
 		if err != nil {
 			return err
 		}
-		allParentJobsAreComplete := true
 
-		for _, jobLinkForChild := range jobLinksForChild {
-			parentJob, err := models.DB.GetDiggerJob(jobLinkForChild.ParentDiggerJobId)
+		if allParentJobsAreComplete {
+			// parents completing at the same time would both see all parents complete
+			claimed, err := jobs.Claim(jobLink.DiggerJobId)
 			if err != nil {
 				return err
 			}
-
-			if parentJob.Status != models.DiggerJobSucceeded {
-				allParentJobsAreComplete = false
-				break
+			if !claimed {
+				// held applies are started once they are approved
+				log.Printf("job %v has already been triggered or is held", jobLink.DiggerJobId)
+				continue
 			}
-
-		}
-
-		if allParentJobsAreComplete {
-			job, err := models.DB.GetDiggerJob(jobLink.DiggerJobId)
+			job, err := jobs.Stores.Jobs.GetDiggerJob(jobLink.DiggerJobId)
 			if err != nil {
 				return err
 			}
-			TriggerJob(client, repoOwner, repoName, job, workflowFileName)
+			TriggerJob(jobs, client, repoOwner, repoName, job, workflowFileName)
 		}
 
 	}
 	return nil
 }
 
-func TriggerJob(client *github.Client, repoOwner string, repoName string, job *models.DiggerJob, workflowFileName string) {
+// ParentDiggerJobsSucceeded tells if the job may start, jobs without parents may always start
+func ParentDiggerJobsSucceeded(store models.JobStore, jobId string) (bool, error) {
+	links, err := store.GetDiggerJobParentLinksChildId(&jobId)
+	if err != nil {
+		return false, err
+	}
+	for _, link := range links {
+		parentJob, err := store.GetDiggerJob(link.ParentDiggerJobId)
+		if err != nil {
+			return false, err
+		}
+		if parentJob.Status != models.DiggerJobSucceeded {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func TriggerJob(jobs JobTransitions, client *github.Client, repoOwner string, repoName string, job *models.DiggerJob, workflowFileName string) {
 	log.Printf("TriggerJob jobId: %v", job.DiggerJobId)
 	ctx := context.Background()
-	if job.SerializedJob == nil {
-		log.Printf("GitHub job can't be nil")
+	inputs, err := JobDispatchInputs(jobs.Stores, jobs.OrgId, job, repoOwner, repoName)
+	if err == nil {
+		_, err = client.Actions.CreateWorkflowDispatchEventByFileName(ctx, repoOwner, repoName, workflowFileName, github.CreateWorkflowDispatchEventRequest{
+			Ref:    job.BranchName,
+			Inputs: inputs,
+		})
 	}
-	jobString := string(job.SerializedJob)
-	log.Printf("jobString: %v \n", jobString)
-	_, err := client.Actions.CreateWorkflowDispatchEventByFileName(ctx, repoOwner, repoName, workflowFileName, github.CreateWorkflowDispatchEventRequest{
-		Ref:    job.BranchName,
-		Inputs: map[string]interface{}{"job": jobString, "id": job.DiggerJobId},
-	})
 	if err != nil {
 		log.Printf("TriggerJob err: %v\n", err)
+		err = jobs.Release(job.DiggerJobId)
+		if err != nil {
+			log.Printf("failed to release job %v: %v\n", job.DiggerJobId, err)
+		}
 		return
 	}
 }
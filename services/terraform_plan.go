@@ -0,0 +1,69 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"digger.dev/cloud/models"
+)
+
+// the parts of the `terraform show -json` output the resource changes are built from
+type terraformPlanJson struct {
+	FormatVersion   string `json:"format_version"`
+	ResourceChanges []struct {
+		Address       string `json:"address"`
+		ModuleAddress string `json:"module_address"`
+		Mode          string `json:"mode"`
+		Type          string `json:"type"`
+		Name          string `json:"name"`
+		Change        struct {
+			Actions []string `json:"actions"`
+		} `json:"change"`
+	} `json:"resource_changes"`
+}
+
+// ParseTerraformPlanJson reads the resource changes of a plan in the `terraform show -json` format,
+// resources the plan leaves alone are skipped
+func ParseTerraformPlanJson(planJson []byte) ([]models.ProjectRunResourceChange, error) {
+	var plan terraformPlanJson
+	err := json.Unmarshal(planJson, &plan)
+	if err != nil {
+		return nil, fmt.Errorf("plan is not valid json: %v", err)
+	}
+	if plan.FormatVersion == "" {
+		return nil, fmt.Errorf("plan has no format_version, expected the output of terraform show -json")
+	}
+
+	changes := make([]models.ProjectRunResourceChange, 0)
+	for _, resourceChange := range plan.ResourceChanges {
+		action := resourceAction(resourceChange.Change.Actions)
+		if action == "" {
+			continue
+		}
+		changes = append(changes, models.ProjectRunResourceChange{
+			Address:       resourceChange.Address,
+			ModuleAddress: resourceChange.ModuleAddress,
+			Mode:          resourceChange.Mode,
+			Type:          resourceChange.Type,
+			Name:          resourceChange.Name,
+			Action:        action,
+			Actions:       strings.Join(resourceChange.Change.Actions, ","),
+		})
+	}
+	return changes, nil
+}
+
+// resourceAction maps the terraform actions of a resource to a single action, empty for no-op. Actions of newer
+// terraform versions are kept as they are and not counted.
+func resourceAction(actions []string) string {
+	joined := strings.Join(actions, ",")
+	switch joined {
+	case "no-op":
+		return ""
+	case "delete,create", "create,delete":
+		return models.ResourceActionReplace
+	default:
+		return joined
+	}
+}
@@ -0,0 +1,67 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"digger.dev/cloud/models"
+	"github.com/diggerhq/digger/libs/orchestrator"
+)
+
+// JobDispatchInputs returns the workflow inputs of the job. Variables of the project are added to the environment
+// of its commands here rather than when the job is created, so their values are never stored in the job.
+func JobDispatchInputs(stores models.Stores, orgId uint, job *models.DiggerJob, repoOwner string, repoName string) (map[string]interface{}, error) {
+	if job.SerializedJob == nil {
+		return nil, fmt.Errorf("GitHub job can't be nil")
+	}
+	jobString := string(job.SerializedJob)
+	inputs := map[string]interface{}{"job": jobString, "id": job.DiggerJobId}
+
+	var jobJson orchestrator.JobJson
+	err := json.Unmarshal(job.SerializedJob, &jobJson)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse job %v: %v", job.DiggerJobId, err)
+	}
+
+	variables, err := projectVariablesForRepo(stores, orgId, repoOwner+"/"+repoName, jobJson.ProjectName)
+	if err != nil {
+		return nil, err
+	}
+	if len(variables) == 0 {
+		return inputs, nil
+	}
+
+	if jobJson.CommandEnvVars == nil {
+		jobJson.CommandEnvVars = make(map[string]string)
+	}
+	for name, value := range variables {
+		jobJson.CommandEnvVars[name] = value
+	}
+	marshalled, err := json.Marshal(jobJson)
+	if err != nil {
+		return nil, fmt.Errorf("failed to serialise job %v: %v", job.DiggerJobId, err)
+	}
+	inputs["job"] = string(marshalled)
+	return inputs, nil
+}
+
+// projectVariablesForRepo returns the variables of the project in the repo of the org the job is dispatched for
+func projectVariablesForRepo(stores models.Stores, orgId uint, repoFullName string, projectName string) (map[string]string, error) {
+	repo, err := stores.Github.GetRepoByGithubFullName(orgId, repoFullName)
+	if err != nil {
+		return nil, err
+	}
+	if repo == nil {
+		log.Printf("no repo %v in org %v, dispatching without project variables", repoFullName, orgId)
+		return nil, nil
+	}
+	project, err := stores.Projects.GetProjectByName(orgId, repo, projectName)
+	if err != nil {
+		return nil, err
+	}
+	if project == nil {
+		return nil, nil
+	}
+	return stores.Variables.GetProjectVariables(project.ID)
+}
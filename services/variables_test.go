@@ -0,0 +1,41 @@
+package services
+
+import (
+	"encoding/json"
+	"testing"
+
+	"digger.dev/cloud/models"
+	"github.com/diggerhq/digger/libs/orchestrator"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJobDispatchInputsUseVariablesOfTheOrgOfTheJob(t *testing.T) {
+	store := models.NewMemoryStore()
+	stores := store.Stores()
+
+	// the same repository name exists in two orgs, e.g. installed from github.com and from a GHES instance
+	orgIds := make(map[string]uint)
+	for i, name := range []string{"github", "ghes"} {
+		org, err := store.CreateOrganisation(name, "test", name)
+		assert.NoError(t, err)
+		orgIds[name] = org.ID
+		repo, err := store.GetOrCreateGithubRepo(org, int64(i+1), int64(i+100), "acme", "infra", "")
+		assert.NoError(t, err)
+		project := &models.Project{Name: "prod", OrganisationID: org.ID, RepoID: repo.ID}
+		assert.NoError(t, store.SaveProject(project))
+		assert.NoError(t, store.SetProjectVariable(project.ID, "TF_VAR_env", name))
+	}
+
+	serialized, _ := json.Marshal(orchestrator.JobJson{ProjectName: "prod"})
+	job, err := store.CreateDiggerJob(uuid.New(), serialized, "main", "")
+	assert.NoError(t, err)
+
+	for name, orgId := range orgIds {
+		inputs, err := JobDispatchInputs(stores, orgId, job, "acme", "infra")
+		assert.NoError(t, err)
+		var dispatched orchestrator.JobJson
+		assert.NoError(t, json.Unmarshal([]byte(inputs["job"].(string)), &dispatched))
+		assert.Equal(t, map[string]string{"TF_VAR_env": name}, dispatched.CommandEnvVars)
+	}
+}
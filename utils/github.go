@@ -2,58 +2,24 @@ package utils
 
 import (
 	"context"
+	"digger.dev/cloud/models"
 	"fmt"
 	"github.com/bradleyfalzon/ghinstallation/v2"
-	"github.com/go-git/go-git/v5"
-	"github.com/go-git/go-git/v5/plumbing"
-	"github.com/go-git/go-git/v5/plumbing/transport/http"
 	"github.com/google/go-github/v55/github"
-	"log"
 	net "net/http"
-	"os"
 )
 
-func createTempDir() string {
-	tempDir, err := os.MkdirTemp("", "repo")
-	if err != nil {
-		log.Fatal(err)
-	}
-	return tempDir
-}
-
-type action func(string)
+type action func(string) error
 
+// CloneGitRepoAndDoAction checks out the head of branch from the repo cache and runs action in the checkout
 func CloneGitRepoAndDoAction(repoUrl string, branch string, token string, action action) error {
-	dir := createTempDir()
-	cloneOptions := git.CloneOptions{
-		URL:           repoUrl,
-		ReferenceName: plumbing.NewBranchReferenceName(branch),
-		Depth:         1,
-		SingleBranch:  true,
-	}
-
-	if token != "" {
-		cloneOptions.Auth = &http.BasicAuth{
-			Username: "x-access-token", // anything except an empty string
-			Password: token,
-		}
-	}
-
-	_, err := git.PlainClone(dir, false, &cloneOptions)
-	if err != nil {
-		log.Printf("PlainClone error: %v\n", err)
-		return err
-	}
-
-	action(dir)
-
-	defer os.RemoveAll(dir)
-	return nil
-
+	return DefaultRepoCache().DoAction(repoUrl, branch, "", token, action)
 }
 
 // just a wrapper around github client to be able to use mocks
 type DiggerGithubRealClientProvider struct {
+	// Github keeps the apps and their credentials
+	Github models.GithubStore
 }
 
 type DiggerGithubClientMockProvider struct {
@@ -65,21 +31,47 @@ type GithubClientProvider interface {
 }
 
 func (gh *DiggerGithubRealClientProvider) Get(githubAppId int64, installationId int64) (*github.Client, *string, error) {
-	githubAppPrivateKey := os.Getenv("GITHUB_APP_PRIVATE_KEY")
+	app, err := gh.Github.GetGithubApp(githubAppId)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error getting github app: %v\n", err)
+	}
+
+	creds, err := gh.Github.GetGithubAppCredentials(app)
+	if err != nil {
+		return nil, nil, err
+	}
+
 	tr := net.DefaultTransport
-	itr, err := ghinstallation.New(tr, githubAppId, installationId, []byte(githubAppPrivateKey))
+	itr, err := ghinstallation.New(tr, githubAppId, installationId, []byte(creds.PrivateKey))
 	if err != nil {
 		return nil, nil, fmt.Errorf("error initialising github app installation: %v\n", err)
 	}
+	itr.BaseURL = app.ApiBaseUrl()
 
 	token, err := itr.Token(context.Background())
 	if err != nil {
 		return nil, nil, fmt.Errorf("error initialising git app token: %v\n", err)
 	}
-	ghClient := github.NewClient(&net.Client{Transport: itr})
+	ghClient, err := NewGithubClient(app, &net.Client{Transport: itr})
+	if err != nil {
+		return nil, nil, err
+	}
 	return ghClient, &token, nil
 }
 
+// NewGithubClient creates a client talking to github.com or to the enterprise server the app is registered on
+func NewGithubClient(app *models.GithubApp, httpClient *net.Client) (*github.Client, error) {
+	ghClient := github.NewClient(httpClient)
+	if !app.IsEnterprise() {
+		return ghClient, nil
+	}
+	ghClient, err := ghClient.WithEnterpriseURLs(app.ApiBaseUrl()+"/", app.UploadBaseUrl()+"/")
+	if err != nil {
+		return nil, fmt.Errorf("error initialising github enterprise client: %v\n", err)
+	}
+	return ghClient, nil
+}
+
 func (gh *DiggerGithubClientMockProvider) Get(githubAppId int64, installationId int64) (*github.Client, *string, error) {
 	ghClient := github.NewClient(gh.MockedHTTPClient)
 	token := "token"
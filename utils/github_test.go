@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"digger.dev/cloud/models"
 	"github.com/stretchr/testify/assert"
 	"log"
 	"os"
@@ -13,21 +14,44 @@ func init() {
 }
 
 func TestGithubCloneWithInvalidTokenThrowsErr(t *testing.T) {
-	f := func(d string) {}
+	f := func(d string) error { return nil }
 	err := CloneGitRepoAndDoAction("https://github.com/diggerhq/private-repo", "main", "invalid-token", f)
 	assert.NotNil(t, err)
 }
 
 func TestGithubCloneWithPublicRepoThrowsNoError(t *testing.T) {
 	token := os.Getenv("GITHUB_PAT_TOKEN")
-	f := func(d string) {}
+	f := func(d string) error { return nil }
 	err := CloneGitRepoAndDoAction("https://github.com/diggerhq/digger", "develop", token, f)
 	assert.Nil(t, err)
 }
 
 func TestGithubCloneWithInvalidBranchThrowsError(t *testing.T) {
 	token := os.Getenv("GITHUB_PAT_TOKEN")
-	f := func(d string) {}
+	f := func(d string) error { return nil }
 	err := CloneGitRepoAndDoAction("https://github.com/diggerhq/digger", "not-a-branch", token, f)
 	assert.NotNil(t, err)
 }
+
+func TestNewGithubClientUsesEnterpriseUrls(t *testing.T) {
+	app := &models.GithubApp{GithubApiUrl: "https://ghes.example.com", GithubOauthUrl: "https://ghes.example.com/login/oauth/"}
+	client, err := NewGithubClient(app, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "https://ghes.example.com/api/v3/", client.BaseURL.String())
+	assert.Equal(t, "https://ghes.example.com/api/uploads/", client.UploadURL.String())
+
+	tokenUrl, err := app.OauthAccessTokenUrl()
+	assert.NoError(t, err)
+	assert.Equal(t, "https://ghes.example.com/login/oauth/access_token", tokenUrl)
+
+	cloneUrl, err := app.CloneUrl("https://github.com/diggerhq/digger.git")
+	assert.NoError(t, err)
+	assert.Equal(t, "https://ghes.example.com/diggerhq/digger.git", cloneUrl)
+
+	client, err = NewGithubClient(&models.GithubApp{}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "https://api.github.com/", client.BaseURL.String())
+	tokenUrl, err = (&models.GithubApp{}).OauthAccessTokenUrl()
+	assert.NoError(t, err)
+	assert.Equal(t, "https://github.com/login/oauth/access_token", tokenUrl)
+}
@@ -12,8 +12,8 @@ import (
 	"log"
 )
 
-// ConvertJobsToDiggerJobs jobs is map with project name as a key and a Job as a value
-func ConvertJobsToDiggerJobs(jobsMap map[string]orchestrator.Job, projectMap map[string]configuration.Project, projectsGraph graph.Graph[string, configuration.Project], branch string, repoFullName string) (*uuid.UUID, map[string]*models.DiggerJob, error) {
+// ConvertJobsToDiggerJobs jobs is map with project name as a key and a Job as a value, commitSha is the commit the jobs run for
+func ConvertJobsToDiggerJobs(jobStore models.JobStore, jobsMap map[string]orchestrator.Job, projectMap map[string]configuration.Project, projectsGraph graph.Graph[string, configuration.Project], branch string, commitSha string, repoFullName string) (*uuid.UUID, map[string]*models.DiggerJob, error) {
 	result := make(map[string]*models.DiggerJob)
 
 	log.Printf("Number of Jobs: %v\n", len(jobsMap))
@@ -44,12 +44,12 @@ func ConvertJobsToDiggerJobs(jobsMap map[string]orchestrator.Job, projectMap map
 	visit := func(value string) bool {
 		if predecessorMap[value] == nil || len(predecessorMap[value]) == 0 {
 			fmt.Printf("no parent for %v\n", value)
-			parentJob, err := models.DB.CreateDiggerJob(batchId, marshalledJobsMap[value], branch)
+			parentJob, err := jobStore.CreateDiggerJob(batchId, marshalledJobsMap[value], branch, commitSha)
 			if err != nil {
 				log.Printf("failed to create a job")
 				return false
 			}
-			_, err = models.DB.CreateDiggerJobLink(parentJob.DiggerJobId, repoFullName)
+			_, err = jobStore.CreateDiggerJobLink(parentJob.DiggerJobId, repoFullName)
 			if err != nil {
 				log.Printf("failed to create a digger job link")
 				return false
@@ -62,17 +62,17 @@ func ConvertJobsToDiggerJobs(jobsMap map[string]orchestrator.Job, projectMap map
 				parent := edge.Source
 				fmt.Printf("parent: %v\n", parent)
 				parentDiggerJob := result[parent]
-				childJob, err := models.DB.CreateDiggerJob(batchId, marshalledJobsMap[value], branch)
+				childJob, err := jobStore.CreateDiggerJob(batchId, marshalledJobsMap[value], branch, commitSha)
 				if err != nil {
 					log.Printf("failed to create a job")
 					return false
 				}
-				_, err = models.DB.CreateDiggerJobLink(childJob.DiggerJobId, repoFullName)
+				_, err = jobStore.CreateDiggerJobLink(childJob.DiggerJobId, repoFullName)
 				if err != nil {
 					log.Printf("failed to create a digger job link")
 					return false
 				}
-				err = models.DB.CreateDiggerJobParentLink(parentDiggerJob.DiggerJobId, childJob.DiggerJobId)
+				err = jobStore.CreateDiggerJobParentLink(parentDiggerJob.DiggerJobId, childJob.DiggerJobId)
 				if err != nil {
 					log.Printf("failed to create a digger job parent link")
 					return false
@@ -0,0 +1,358 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport/http"
+)
+
+const defaultRepoCacheMaxBytes = 10 * 1024 * 1024 * 1024
+
+// RepoCache keeps a bare mirror per repository on disk. Mirrors are fetched on demand, only the requested commits
+// without their history, every action gets a checkout of the requested commit in its own directory, and the least
+// recently used mirrors are removed once the cache grows over its disk budget.
+type RepoCache struct {
+	dir      string
+	maxBytes int64
+
+	mu    sync.Mutex
+	locks map[string]*sync.Mutex
+	// sizes of the mirrors, read from disk on first use and updated after every fetch
+	mirrors map[string]*mirrorUsage
+}
+
+func NewRepoCache(dir string, maxBytes int64) *RepoCache {
+	return &RepoCache{
+		dir:      dir,
+		maxBytes: maxBytes,
+		locks:    make(map[string]*sync.Mutex),
+	}
+}
+
+var defaultRepoCache *RepoCache
+var defaultRepoCacheOnce sync.Once
+
+// DefaultRepoCache is configured with DIGGER_REPO_CACHE_DIR and DIGGER_REPO_CACHE_MAX_BYTES
+func DefaultRepoCache() *RepoCache {
+	defaultRepoCacheOnce.Do(func() {
+		dir := os.Getenv("DIGGER_REPO_CACHE_DIR")
+		if dir == "" {
+			dir = filepath.Join(os.TempDir(), "digger-repo-cache")
+		}
+		var maxBytes int64 = defaultRepoCacheMaxBytes
+		if value := os.Getenv("DIGGER_REPO_CACHE_MAX_BYTES"); value != "" {
+			parsed, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				log.Printf("invalid DIGGER_REPO_CACHE_MAX_BYTES %v, using the default: %v", value, err)
+			} else {
+				maxBytes = parsed
+			}
+		}
+		defaultRepoCache = NewRepoCache(dir, maxBytes)
+	})
+	return defaultRepoCache
+}
+
+func (c *RepoCache) lock(key string) *sync.Mutex {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	lock, ok := c.locks[key]
+	if !ok {
+		lock = &sync.Mutex{}
+		c.locks[key] = lock
+	}
+	return lock
+}
+
+// mirrorKey names the mirror after the repository url, the token is never part of it
+func mirrorKey(repoUrl string) string {
+	sum := sha256.Sum256([]byte(strings.TrimSuffix(repoUrl, ".git")))
+	return hex.EncodeToString(sum[:16])
+}
+
+// DoAction checks out sha, or the head of branch if sha is empty, into a temporary directory and runs action in it.
+// The error of the action is returned.
+func (c *RepoCache) DoAction(repoUrl string, branch string, sha string, token string, action action) error {
+	key := mirrorKey(repoUrl)
+	worktree, err := os.MkdirTemp("", "repo")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(worktree)
+
+	fetched, err := c.checkout(key, repoUrl, branch, sha, token, worktree)
+	if err != nil {
+		return err
+	}
+	c.used(key, fetched)
+	c.evict(key)
+
+	return action(worktree)
+}
+
+// checkout writes the files of the commit to worktree, true if the commit had to be fetched into the mirror
+func (c *RepoCache) checkout(key string, repoUrl string, branch string, sha string, token string, worktree string) (bool, error) {
+	lock := c.lock(key)
+	lock.Lock()
+	defer lock.Unlock()
+
+	mirrorDir := filepath.Join(c.dir, key)
+	repo, err := openMirror(mirrorDir, repoUrl)
+	if err != nil {
+		return false, err
+	}
+	// marks the mirror as recently used for eviction
+	now := time.Now()
+	os.Chtimes(mirrorDir, now, now)
+
+	var commit *object.Commit
+	if sha != "" {
+		commit, err = repo.CommitObject(plumbing.NewHash(sha))
+		if err == nil {
+			return false, writeCommitFiles(commit, worktree)
+		}
+	}
+
+	err = fetchCommit(repo, repoUrl, branch, sha, token)
+	if err != nil {
+		return true, err
+	}
+	hash := plumbing.NewHash(sha)
+	if sha == "" {
+		ref, err := repo.Reference(plumbing.NewBranchReferenceName(branch), true)
+		if err != nil {
+			return true, fmt.Errorf("failed to resolve branch %v: %v", branch, err)
+		}
+		hash = ref.Hash()
+	}
+	commit, err = repo.CommitObject(hash)
+	if err != nil {
+		return true, fmt.Errorf("commit %v not found on branch %v: %v", hash, branch, err)
+	}
+	return true, writeCommitFiles(commit, worktree)
+}
+
+func openMirror(mirrorDir string, repoUrl string) (*git.Repository, error) {
+	repo, err := git.PlainOpen(mirrorDir)
+	if err == nil {
+		return repo, nil
+	}
+	if !errors.Is(err, git.ErrRepositoryNotExists) {
+		log.Printf("mirror %v is broken, recreating it: %v", mirrorDir, err)
+	}
+	os.RemoveAll(mirrorDir)
+	repo, err = git.PlainInit(mirrorDir, true)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create mirror: %v", err)
+	}
+	_, err = repo.CreateRemote(&config.RemoteConfig{Name: git.DefaultRemoteName, URLs: []string{repoUrl}})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create mirror remote: %v", err)
+	}
+	return repo, nil
+}
+
+// fetchedCommitRef keeps the last commit fetched by sha, objects stay in the mirror when it moves on
+const fetchedCommitRef = "refs/digger/fetched"
+
+// fetchCommit fetches sha, or the head of branch if sha is empty, without its history. Servers that don't
+// allow fetching commits by sha get the head of branch fetched instead.
+func fetchCommit(repo *git.Repository, repoUrl string, branch string, sha string, token string) error {
+	refName := plumbing.NewBranchReferenceName(branch)
+	branchRefSpec := config.RefSpec(fmt.Sprintf("+%v:%v", refName, refName))
+	refSpec := branchRefSpec
+	if sha != "" {
+		refSpec = config.RefSpec(fmt.Sprintf("+%v:%v", sha, fetchedCommitRef))
+	}
+	fetchOptions := git.FetchOptions{
+		RemoteURL: repoUrl,
+		RefSpecs:  []config.RefSpec{refSpec},
+		Depth:     1,
+		Force:     true,
+	}
+	if token != "" {
+		fetchOptions.Auth = &http.BasicAuth{
+			Username: "x-access-token", // anything except an empty string
+			Password: token,
+		}
+	}
+	err := repo.Fetch(&fetchOptions)
+	if errors.Is(err, git.ErrExactSHA1NotSupported) {
+		fetchOptions.RefSpecs = []config.RefSpec{branchRefSpec}
+		err = repo.Fetch(&fetchOptions)
+	}
+	if err != nil && !errors.Is(err, git.NoErrAlreadyUpToDate) {
+		log.Printf("Fetch error: %v\n", err)
+		return err
+	}
+	return nil
+}
+
+// writeCommitFiles writes the files of commit to dir, leaving the mirror's HEAD and index alone
+func writeCommitFiles(commit *object.Commit, dir string) error {
+	files, err := commit.Files()
+	if err != nil {
+		return err
+	}
+	return files.ForEach(func(file *object.File) error {
+		path := filepath.Join(dir, filepath.FromSlash(file.Name))
+		if !strings.HasPrefix(path, dir+string(os.PathSeparator)) {
+			return fmt.Errorf("invalid path in repository: %v", file.Name)
+		}
+		err := os.MkdirAll(filepath.Dir(path), 0o755)
+		if err != nil {
+			return err
+		}
+
+		if file.Mode == filemode.Symlink {
+			target, err := file.Contents()
+			if err != nil {
+				return err
+			}
+			return os.Symlink(target, path)
+		}
+
+		perm := os.FileMode(0o644)
+		if file.Mode == filemode.Executable {
+			perm = 0o755
+		}
+		reader, err := file.Reader()
+		if err != nil {
+			return err
+		}
+		defer reader.Close()
+		out, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm)
+		if err != nil {
+			return err
+		}
+		defer out.Close()
+		_, err = io.Copy(out, reader)
+		return err
+	})
+}
+
+type mirrorUsage struct {
+	key      string
+	size     int64
+	lastUsed time.Time
+}
+
+// used updates the last use of the mirror, and its size if it was fetched into
+func (c *RepoCache) used(key string, fetched bool) {
+	var size int64 = -1
+	if fetched {
+		size = dirSize(filepath.Join(c.dir, key))
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.mirrors == nil {
+		c.mirrors = scanMirrors(c.dir)
+	}
+	mirror, ok := c.mirrors[key]
+	if !ok {
+		mirror = &mirrorUsage{key: key}
+		c.mirrors[key] = mirror
+		if size < 0 {
+			size = dirSize(filepath.Join(c.dir, key))
+		}
+	}
+	if size >= 0 {
+		mirror.size = size
+	}
+	mirror.lastUsed = time.Now()
+}
+
+// scanMirrors reads the mirrors left on disk by earlier runs
+func scanMirrors(dir string) map[string]*mirrorUsage {
+	mirrors := make(map[string]*mirrorUsage)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		log.Printf("failed to list repo cache: %v", err)
+		return mirrors
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		mirrors[entry.Name()] = &mirrorUsage{key: entry.Name(), size: dirSize(filepath.Join(dir, entry.Name())), lastUsed: info.ModTime()}
+	}
+	return mirrors
+}
+
+// evict removes the least recently used mirrors until the cache fits into its budget. Mirrors in use are
+// skipped, and the one just used is kept even if it doesn't fit on its own.
+func (c *RepoCache) evict(current string) {
+	c.mu.Lock()
+	var mirrors []mirrorUsage
+	var total int64
+	for _, mirror := range c.mirrors {
+		total += mirror.size
+		mirrors = append(mirrors, *mirror)
+	}
+	c.mu.Unlock()
+	if total <= c.maxBytes {
+		return
+	}
+
+	sort.Slice(mirrors, func(i, j int) bool {
+		return mirrors[i].lastUsed.Before(mirrors[j].lastUsed)
+	})
+	for _, mirror := range mirrors {
+		if total <= c.maxBytes {
+			return
+		}
+		if mirror.key == current {
+			continue
+		}
+		lock := c.lock(mirror.key)
+		if !lock.TryLock() {
+			continue
+		}
+		err := os.RemoveAll(filepath.Join(c.dir, mirror.key))
+		if err == nil {
+			c.mu.Lock()
+			delete(c.mirrors, mirror.key)
+			c.mu.Unlock()
+		}
+		lock.Unlock()
+		if err != nil {
+			log.Printf("failed to evict mirror %v: %v", mirror.key, err)
+			continue
+		}
+		log.Printf("evicted mirror %v from the repo cache, %v bytes", mirror.key, mirror.size)
+		total -= mirror.size
+	}
+}
+
+func dirSize(dir string) int64 {
+	var size int64
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
@@ -0,0 +1,126 @@
+package utils
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/stretchr/testify/assert"
+)
+
+func commitFile(t *testing.T, dir string, name string, content string) string {
+	repo, err := git.PlainOpen(dir)
+	assert.NoError(t, err)
+	worktree, err := repo.Worktree()
+	assert.NoError(t, err)
+	err = os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644)
+	assert.NoError(t, err)
+	_, err = worktree.Add(name)
+	assert.NoError(t, err)
+	hash, err := worktree.Commit("update "+name, &git.CommitOptions{
+		Author: &object.Signature{Name: "digger", Email: "digger@example.com", When: time.Now()},
+	})
+	assert.NoError(t, err)
+	return hash.String()
+}
+
+func newSourceRepo(t *testing.T) string {
+	dir := t.TempDir()
+	_, err := git.PlainInitWithOptions(dir, &git.PlainInitOptions{
+		InitOptions: git.InitOptions{DefaultBranch: "refs/heads/main"},
+	})
+	assert.NoError(t, err)
+	return dir
+}
+
+func TestRepoCacheChecksOutCommitsFromTheMirror(t *testing.T) {
+	source := newSourceRepo(t)
+	first := commitFile(t, source, "digger.yml", "projects: []\n")
+	second := commitFile(t, source, "digger.yml", "generate_projects: {}\n")
+	// like GitHub the source lets commits be fetched by sha
+	sourceRepo, err := git.PlainOpen(source)
+	assert.NoError(t, err)
+	sourceConfig, err := sourceRepo.Config()
+	assert.NoError(t, err)
+	sourceConfig.Raw.Section("uploadpack").SetOption("allowReachableSHA1InWant", "true")
+	assert.NoError(t, sourceRepo.SetConfig(sourceConfig))
+
+	cacheDir := t.TempDir()
+	cache := NewRepoCache(cacheDir, 1024*1024*1024)
+	readDiggerYml := func(sha string) (string, error) {
+		var content []byte
+		err := cache.DoAction(source, "main", sha, "", func(dir string) error {
+			var err error
+			content, err = os.ReadFile(filepath.Join(dir, "digger.yml"))
+			return err
+		})
+		return string(content), err
+	}
+
+	content, err := readDiggerYml("")
+	assert.NoError(t, err)
+	assert.Equal(t, "generate_projects: {}\n", content)
+	// only the head was fetched, not its history
+	mirror, err := git.PlainOpen(filepath.Join(cacheDir, mirrorKey(source)))
+	assert.NoError(t, err)
+	_, err = mirror.CommitObject(plumbing.NewHash(first))
+	assert.Error(t, err)
+
+	content, err = readDiggerYml(first)
+	assert.NoError(t, err)
+	assert.Equal(t, "projects: []\n", content)
+
+	// both commits are in the mirror now, they are checked out without fetching
+	os.RemoveAll(source)
+	content, err = readDiggerYml(first)
+	assert.NoError(t, err)
+	assert.Equal(t, "projects: []\n", content)
+
+	err = cache.DoAction(source, "main", second, "", func(dir string) error {
+		return errors.New("digger.yml is invalid")
+	})
+	assert.EqualError(t, err, "digger.yml is invalid")
+}
+
+func TestRepoCacheEvictsLeastRecentlyUsedMirrors(t *testing.T) {
+	first := newSourceRepo(t)
+	commitFile(t, first, "main.tf", "resource \"null_resource\" \"a\" {}\n")
+	second := newSourceRepo(t)
+	commitFile(t, second, "main.tf", "resource \"null_resource\" \"b\" {}\n")
+
+	cacheDir := t.TempDir()
+	// too small for two mirrors
+	cache := NewRepoCache(cacheDir, 1)
+	noop := func(dir string) error { return nil }
+
+	assert.NoError(t, cache.DoAction(first, "main", "", "", noop))
+	assert.DirExists(t, filepath.Join(cacheDir, mirrorKey(first)))
+
+	assert.NoError(t, cache.DoAction(second, "main", "", "", noop))
+	assert.NoDirExists(t, filepath.Join(cacheDir, mirrorKey(first)))
+	assert.DirExists(t, filepath.Join(cacheDir, mirrorKey(second)))
+
+	// mirrors of an earlier run count towards the budget too
+	third := newSourceRepo(t)
+	commitFile(t, third, "main.tf", "resource \"null_resource\" \"c\" {}\n")
+	assert.NoError(t, NewRepoCache(cacheDir, 1).DoAction(third, "main", "", "", noop))
+	assert.NoDirExists(t, filepath.Join(cacheDir, mirrorKey(second)))
+	assert.DirExists(t, filepath.Join(cacheDir, mirrorKey(third)))
+}
+
+func TestRepoCacheFetchesTheBranchIfCommitsCantBeFetchedBySha(t *testing.T) {
+	source := newSourceRepo(t)
+	head := commitFile(t, source, "main.tf", "resource \"null_resource\" \"a\" {}\n")
+
+	cache := NewRepoCache(t.TempDir(), 1024*1024*1024)
+	err := cache.DoAction(source, "main", head, "", func(dir string) error {
+		_, err := os.Stat(filepath.Join(dir, "main.tf"))
+		return err
+	})
+	assert.NoError(t, err)
+}